@@ -0,0 +1,443 @@
+// Package internal provides adoption of backups made without Migrate.
+//
+// Years of `rsync -aAX` trees and tarballs predate Migrate. Adopting one inspects
+// it, infers whether it holds a complete system or a home directory, and writes
+// BACKUP-INFO.txt and BACKUP-MANIFEST.json next to it. From then on restore and
+// verify treat it like any other backup: an rsync tree as a mirror backup, a
+// tarball as an archive backup that is read in place. A tarball comes from
+// anywhere, so its members get no more trust than any other archive: one whose
+// path leads through a symlink is not restored.
+package internal
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// maxAdoptDepth is how many wrapping directories (rsync without a trailing
+	// slash, tar -C / home/alice) are looked through to find the backed-up tree.
+	maxAdoptDepth = 3
+
+	// maxAdoptedAccountFile bounds the etc/passwd and etc/group read from a tarball.
+	maxAdoptedAccountFile = 1024 * 1024
+
+	// Origins recorded in the manifest of an adopted backup
+	adoptedRsyncTree  = "rsync tree"
+	adoptedTarArchive = "tar archive"
+)
+
+// homeMarkers are entries only found at the top of a home directory.
+var homeMarkers = []string{
+	".bashrc", ".bash_profile", ".profile", ".zshrc", ".config", ".local", ".ssh",
+	".gnupg", "Desktop", "Documents", "Downloads", "Music", "Pictures", "Videos",
+}
+
+// AdoptedBackup describes a backup that was adopted.
+type AdoptedBackup struct {
+	Path       string // Backup root to restore and verify from
+	BackupType string // "Complete System" or "Home Directory"
+	Origin     string // adoptedRsyncTree or adoptedTarArchive
+	Root       string // Tree inside the directory or tarball that was backed up
+	Hostname   string
+	Files      int64 // Tarballs only
+	Size       int64
+}
+
+// Describe summarizes an adopted backup for the user.
+func (a *AdoptedBackup) Describe() string {
+	var s strings.Builder
+	fmt.Fprintf(&s, "Backup:   %s\n", a.Path)
+	fmt.Fprintf(&s, "Type:     %s (%s)\n", a.BackupType, a.Origin)
+	if a.Root != "." {
+		fmt.Fprintf(&s, "Tree:     %s\n", a.Root)
+	}
+	if a.Hostname != "" {
+		fmt.Fprintf(&s, "Hostname: %s\n", a.Hostname)
+	}
+	if a.Origin == adoptedTarArchive {
+		fmt.Fprintf(&s, "Files:    %s (%s)\n", FormatNumber(a.Files), FormatBytes(a.Size))
+	}
+	return s.String()
+}
+
+// AdoptBackup inspects an rsync tree or tarball at path and writes the metadata
+// that makes it a Migrate backup.
+func AdoptBackup(path string) (*AdoptedBackup, error) {
+	path = filepath.Clean(path)
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot adopt %s: %v", path, err)
+	}
+	if info.IsDir() {
+		return adoptTree(path)
+	}
+	if info.Mode().IsRegular() {
+		return adoptTarball(path)
+	}
+	return nil, fmt.Errorf("cannot adopt %s: not a directory or tar archive", path)
+}
+
+// adoptTree adopts a directory tree copied with rsync or cp -a.
+func adoptTree(dir string) (*AdoptedBackup, error) {
+	root, backupType, err := inferBackupRoot(func(rel string) []string {
+		entries, err := os.ReadDir(filepath.Join(dir, rel))
+		if err != nil {
+			return nil
+		}
+		names := make([]string, 0, len(entries))
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		return names
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot adopt %s: %v", dir, err)
+	}
+
+	// The tree itself becomes the backup root, so it restores like a mirror backup
+	backupPath := filepath.Join(dir, root)
+	if err := checkNotMigrateBackup(backupPath); err != nil {
+		return nil, err
+	}
+
+	adopted := &AdoptedBackup{Path: backupPath, BackupType: backupType, Origin: adoptedRsyncTree, Root: root}
+	manifest := adoptedManifest(adopted)
+	if backupType == "Complete System" {
+		adopted.Hostname = readHostname(readFileLimited(filepath.Join(backupPath, "etc", "hostname")))
+		manifest.Users, _ = readAccountNames(filepath.Join(backupPath, "etc", "passwd"))
+		manifest.Groups, _ = readAccountNames(filepath.Join(backupPath, "etc", "group"))
+	} else if info, err := os.Lstat(backupPath); err == nil {
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+			manifest.Users, manifest.Groups = homeOwnerNames(stat.Uid, stat.Gid)
+		}
+	}
+	manifest.Hostname = adopted.Hostname
+	manifest.Format = BackupFormatMirror
+
+	if err := writeAdoptedBackup(backupPath, adopted, manifest); err != nil {
+		return nil, err
+	}
+	return adopted, nil
+}
+
+// tarPrefixStats collects what is known about one candidate root inside a tarball.
+type tarPrefixStats struct {
+	children map[string]bool
+	files    int64
+	size     int64
+	owner    *[2]int // uid, gid of the first entry at or below the prefix
+}
+
+// adoptTarball adopts a tar archive (plain, gzip, bzip2 or zstd). The archive
+// stays where it is; its directory becomes the backup root.
+func adoptTarball(file string) (*AdoptedBackup, error) {
+	codec, err := detectTarCodec(file)
+	if err != nil {
+		return nil, fmt.Errorf("cannot adopt %s: %v", file, err)
+	}
+	backupPath := filepath.Dir(file)
+	if err := checkNotMigrateBackup(backupPath); err != nil {
+		return nil, err
+	}
+
+	// One pass over the archive: directory listings, sizes and owners of every
+	// candidate root, plus the account files a system backup carries
+	prefixes := make(map[string]*tarPrefixStats)
+	stats := func(prefix string) *tarPrefixStats {
+		s := prefixes[prefix]
+		if s == nil {
+			s = &tarPrefixStats{children: make(map[string]bool)}
+			prefixes[prefix] = s
+		}
+		return s
+	}
+	accountFiles := make(map[string][]byte)
+
+	f, err := os.Open(file)
+	if err != nil {
+		return nil, fmt.Errorf("cannot adopt %s: %v", file, err)
+	}
+	archive, err := newArchiveReader(f, codec)
+	if err != nil {
+		return nil, fmt.Errorf("cannot adopt %s: %v", file, err)
+	}
+	defer archive.Close()
+
+	for {
+		hdr, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("cannot adopt %s: archive is damaged: %v", file, err)
+		}
+		name := path.Clean("/" + hdr.Name)[1:]
+		if name == "" {
+			name = "."
+		}
+
+		parts := strings.Split(name, "/")
+		if name == "." {
+			parts = nil
+		}
+		prefix := "."
+		for depth := 0; depth <= len(parts) && depth <= maxAdoptDepth+1; depth++ {
+			s := stats(prefix)
+			if s.owner == nil {
+				s.owner = &[2]int{hdr.Uid, hdr.Gid}
+			}
+			if hdr.Typeflag == tar.TypeReg {
+				s.files++
+				s.size += hdr.Size
+			}
+			if depth == len(parts) {
+				break
+			}
+			s.children[parts[depth]] = true
+			prefix = path.Join(prefix, parts[depth])
+		}
+
+		if hdr.Typeflag == tar.TypeReg && hdr.Size <= maxAdoptedAccountFile && len(parts) <= maxAdoptDepth+2 {
+			switch path.Base(name) {
+			case "passwd", "group", "hostname":
+				if path.Base(path.Dir(name)) == "etc" {
+					data, err := io.ReadAll(archive)
+					if err != nil {
+						return nil, fmt.Errorf("cannot adopt %s: archive is damaged: %v", file, err)
+					}
+					accountFiles[name] = data
+				}
+			}
+		}
+	}
+
+	root, backupType, err := inferBackupRoot(func(rel string) []string {
+		s := prefixes[rel]
+		if s == nil {
+			return nil
+		}
+		names := make([]string, 0, len(s.children))
+		for name := range s.children {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return names
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot adopt %s: %v", file, err)
+	}
+
+	rootStats := prefixes[root]
+	adopted := &AdoptedBackup{
+		Path:       backupPath,
+		BackupType: backupType,
+		Origin:     adoptedTarArchive,
+		Root:       root,
+		Files:      rootStats.files,
+		Size:       rootStats.size,
+	}
+	manifest := adoptedManifest(adopted)
+	if backupType == "Complete System" {
+		etc := path.Join(root, "etc")
+		adopted.Hostname = readHostname(accountFiles[path.Join(etc, "hostname")])
+		manifest.Users, _ = parseAccountNames(bytes.NewReader(accountFiles[path.Join(etc, "passwd")]))
+		manifest.Groups, _ = parseAccountNames(bytes.NewReader(accountFiles[path.Join(etc, "group")]))
+	} else if rootStats.owner != nil {
+		manifest.Users, manifest.Groups = homeOwnerNames(uint32(rootStats.owner[0]), uint32(rootStats.owner[1]))
+	}
+	manifest.Hostname = adopted.Hostname
+	manifest.Format = BackupFormatArchive
+	manifest.Archive = &ArchiveInfo{
+		Name:    filepath.Base(file),
+		Volumes: 1,
+		Files:   adopted.Files,
+		Size:    adopted.Size,
+		File:    filepath.Base(file),
+		Codec:   codec,
+		Root:    root,
+	}
+
+	if err := writeAdoptedBackup(backupPath, adopted, manifest); err != nil {
+		return nil, err
+	}
+	return adopted, nil
+}
+
+// inferBackupRoot finds the backed-up tree below "." and whether it is a system
+// or home backup. list returns the names directly below a relative path.
+func inferBackupRoot(list func(rel string) []string) (root, backupType string, err error) {
+	root = "."
+	for depth := 0; depth <= maxAdoptDepth; depth++ {
+		names := list(root)
+		if backupType := classifyBackupTree(names); backupType != "" {
+			return root, backupType, nil
+		}
+
+		// A copy of /home holds several home directories: the user has to pick one
+		var homes []string
+		for _, name := range names {
+			if classifyBackupTree(list(path.Join(root, name))) == "Home Directory" {
+				homes = append(homes, name)
+			}
+		}
+		if len(homes) > 1 {
+			return "", "", fmt.Errorf("%s holds several home directories (%s) - adopt one of them", root, strings.Join(homes, ", "))
+		}
+
+		// Look through a single wrapping directory
+		var candidates []string
+		for _, name := range names {
+			if name != "lost+found" {
+				candidates = append(candidates, name)
+			}
+		}
+		if len(candidates) != 1 {
+			break
+		}
+		root = path.Join(root, candidates[0])
+	}
+	return "", "", fmt.Errorf("it does not look like a system backup (etc/ and usr/) or a home directory (.config, Documents, ...)")
+}
+
+// classifyBackupTree tells a system tree from a home directory by its top-level
+// names, returning "" if it is neither.
+func classifyBackupTree(names []string) string {
+	present := make(map[string]bool, len(names))
+	for _, name := range names {
+		present[name] = true
+	}
+	if present["etc"] && (present["usr"] || present["var"] || present["boot"]) {
+		return "Complete System"
+	}
+	for _, marker := range homeMarkers {
+		if present[marker] {
+			return "Home Directory"
+		}
+	}
+	return ""
+}
+
+// detectTarCodec identifies a tar archive's compression from its magic bytes.
+func detectTarCodec(file string) (string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	header := make([]byte, 512)
+	n, _ := io.ReadFull(f, header)
+	header = header[:n]
+	switch {
+	case bytes.HasPrefix(header, []byte{0x1f, 0x8b}):
+		return "gzip", nil
+	case bytes.HasPrefix(header, []byte("BZh")):
+		return "bzip2", nil
+	case bytes.HasPrefix(header, []byte{0x28, 0xb5, 0x2f, 0xfd}):
+		return "zstd", nil
+	case n >= 262 && bytes.HasPrefix(header[257:], []byte("ustar")):
+		return "", nil
+	case bytes.HasPrefix(header, []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}):
+		return "", fmt.Errorf("xz archives are not supported - recompress with zstd or gzip")
+	}
+	return "", fmt.Errorf("not a tar archive")
+}
+
+// checkNotMigrateBackup refuses to adopt over an existing Migrate backup.
+func checkNotMigrateBackup(backupPath string) error {
+	if _, err := os.Stat(filepath.Join(backupPath, "BACKUP-INFO.txt")); err == nil {
+		return fmt.Errorf("%s already holds a Migrate backup", backupPath)
+	}
+	return nil
+}
+
+// homeOwnerNames records the owner of an adopted home directory as the user
+// adopting it, so restoring translates its uid and gid to this user's.
+func homeOwnerNames(uid, gid uint32) (map[uint32]string, map[uint32]string) {
+	current, err := user.Lookup(getCurrentUser())
+	if err != nil {
+		return nil, nil
+	}
+	users := map[uint32]string{uid: current.Username}
+	groups := map[uint32]string{}
+	if group, err := user.LookupGroupId(current.Gid); err == nil {
+		groups[gid] = group.Name
+	}
+	return users, groups
+}
+
+// adoptedManifest starts the manifest of an adopted backup.
+func adoptedManifest(adopted *AdoptedBackup) *BackupManifest {
+	sourcePath := "/"
+	if adopted.BackupType == "Home Directory" {
+		sourcePath = "/home/" + getCurrentUser()
+	}
+	return &BackupManifest{
+		Version:    backupManifestVersion,
+		AppVersion: AppVersion,
+		Created:    time.Now(),
+		BackupType: adopted.BackupType,
+		SourcePath: sourcePath,
+		Adopted:    adopted.Origin,
+	}
+}
+
+// writeAdoptedBackup writes BACKUP-MANIFEST.json and BACKUP-INFO.txt for an adopted backup.
+func writeAdoptedBackup(backupPath string, adopted *AdoptedBackup, manifest *BackupManifest) error {
+	if err := writeBackupManifest(backupPath, manifest); err != nil {
+		return fmt.Errorf("failed to write backup manifest: %v", err)
+	}
+
+	hostname := adopted.Hostname
+	if hostname == "" {
+		hostname = "unknown"
+	}
+	info := fmt.Sprintf(`%s BACKUP
+=========================
+Adopted: %s
+Hostname: %s
+Backup Type: %s
+Origin: %s (not created by Migrate)
+
+This backup was adopted by %s v%s. Restore and verify it with: migrate
+`, strings.ToUpper(adopted.BackupType), time.Now().Format(time.RFC3339), hostname, adopted.BackupType, adopted.Origin, AppName, AppVersion)
+
+	if err := os.WriteFile(filepath.Join(backupPath, "BACKUP-INFO.txt"), []byte(info), 0644); err != nil {
+		os.Remove(filepath.Join(backupPath, backupManifestFile))
+		return fmt.Errorf("failed to write backup info: %v", err)
+	}
+	return nil
+}
+
+// readFileLimited reads a small file, returning nil if it is missing or too large.
+func readFileLimited(path string) []byte {
+	info, err := os.Stat(path)
+	if err != nil || info.Size() > maxAdoptedAccountFile {
+		return nil
+	}
+	data, _ := os.ReadFile(path)
+	return data
+}
+
+// readHostname returns the first line of an /etc/hostname file.
+func readHostname(data []byte) string {
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" && !strings.HasPrefix(line, "#") {
+			return line
+		}
+	}
+	return ""
+}
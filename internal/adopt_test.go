@@ -0,0 +1,71 @@
+package internal
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// An adopted tarball is extracted with the same checks as a Migrate archive,
+// after the root it was adopted with is stripped from its member names.
+func TestAdoptedTarballCannotEscapeTarget(t *testing.T) {
+	backupPath := t.TempDir()
+	target := filepath.Join(t.TempDir(), "target")
+	outside := filepath.Join(t.TempDir(), "outside")
+	os.MkdirAll(target, 0755)
+	os.MkdirAll(outside, 0755)
+
+	file := filepath.Join(backupPath, "home.tar.gz")
+	f, err := os.Create(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gz := gzip.NewWriter(f)
+	tw := tar.NewWriter(gz)
+	for _, hdr := range []*tar.Header{
+		{Name: "home/alice/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "home/alice/.bashrc", Typeflag: tar.TypeReg, Mode: 0644, Size: 5},
+		{Name: "home/alice/Documents/", Typeflag: tar.TypeDir, Mode: 0755},
+		{Name: "home/alice/evil", Typeflag: tar.TypeSymlink, Linkname: outside, Mode: 0777},
+		{Name: "home/alice/evil/pwned", Typeflag: tar.TypeReg, Mode: 0644, Size: 5},
+	} {
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Size > 0 {
+			tw.Write([]byte("hello"))
+		}
+	}
+	tw.Close()
+	gz.Close()
+	f.Close()
+
+	adopted, err := AdoptBackup(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if adopted.Root != "home/alice" {
+		t.Fatalf("adopted root = %q, want home/alice", adopted.Root)
+	}
+	manifest, err := loadBackupManifest(backupPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	archive, err := openArchive(backupPath, manifest.Archive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer archive.Close()
+
+	if err := restoreArchiveStream(archive, manifest.Archive, target, nil, nil); err == nil {
+		t.Fatal("restore succeeded although a member wrote through a symlink")
+	}
+	if _, err := os.Lstat(filepath.Join(outside, "pwned")); !os.IsNotExist(err) {
+		t.Fatalf("member was written outside the target: %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(target, ".bashrc")); err != nil {
+		t.Fatalf("ordinary member was not restored: %v", err)
+	}
+}
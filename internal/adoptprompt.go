@@ -0,0 +1,130 @@
+// Package internal provides the path prompt for adopting an existing backup.
+package internal
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"migrate/internal/screens"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// BackupAdopted reports the result of adopting an rsync tree or tarball.
+type BackupAdopted struct {
+	backup *AdoptedBackup
+	err    error
+}
+
+// adoptBackupCmd inspects the backup in the background, since a tarball is read in full.
+func adoptBackupCmd(path string) tea.Cmd {
+	return func() tea.Msg {
+		backup, err := AdoptBackup(path)
+		return BackupAdopted{backup: backup, err: err}
+	}
+}
+
+// startAdoptPathEntry asks for the path of the backup on the mounted drive.
+func (m Model) startAdoptPathEntry(drive BackupDriveStatus) Model {
+	m.adoptDrive = drive
+	m.adoptPath = strings.TrimSuffix(drive.mountPoint, "/") + "/"
+	m.adoptChecking = false
+	m.adoptError = ""
+	m.selectedDrive = drive.mountPoint
+	m.message = ""
+	m.screen = screens.ScreenAdoptPath
+	return m
+}
+
+// handleAdoptPathKey edits the path field.
+func (m Model) handleAdoptPathKey(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	if m.adoptChecking {
+		return m, nil
+	}
+
+	switch msg.Type {
+	case tea.KeyEsc, tea.KeyCtrlC:
+		m.adoptPath = ""
+		m.adoptError = ""
+		m.operation = ""
+		m.screen = screens.ScreenRestore
+		m.choices = screens.RestoreMenuChoices
+		m.cursor = 0
+		return m, nil
+
+	case tea.KeyEnter:
+		if strings.TrimSpace(m.adoptPath) == "" {
+			m.adoptError = "Please enter a path"
+			return m, nil
+		}
+		m.adoptChecking = true
+		m.adoptError = ""
+		return m, adoptBackupCmd(strings.TrimSpace(m.adoptPath))
+
+	case tea.KeyBackspace:
+		if m.adoptPath != "" {
+			_, size := utf8.DecodeLastRuneInString(m.adoptPath)
+			m.adoptPath = m.adoptPath[:len(m.adoptPath)-size]
+		}
+		return m, nil
+
+	case tea.KeyCtrlU:
+		m.adoptPath = ""
+		return m, nil
+
+	case tea.KeySpace:
+		m.adoptPath += " "
+		return m, nil
+
+	case tea.KeyRunes:
+		m.adoptPath += string(msg.Runes)
+		return m, nil
+	}
+	return m, nil
+}
+
+// handleBackupAdopted offers to restore from the adopted backup, or asks again.
+func (m Model) handleBackupAdopted(msg BackupAdopted) (tea.Model, tea.Cmd) {
+	m.adoptChecking = false
+	if msg.err != nil {
+		m.adoptError = "❌ " + msg.err.Error()
+		return m, nil
+	}
+
+	// Restore and verify read the adopted backup like a drive holding a Migrate backup
+	m.adoptDrive.mountPoint = msg.backup.Path
+	m.selectedDrive = msg.backup.Path
+	m.operation = "adopt_done"
+	m.confirmation = fmt.Sprintf("📥 Existing backup adopted\n\n%s\nBACKUP-INFO.txt and BACKUP-MANIFEST.json were written next to it,\nso Restore and Verify now accept it like any Migrate backup.\n\nRestore from it now?",
+		msg.backup.Describe())
+	m.screen = screens.ScreenConfirm
+	m.cursor = 0
+	return m, nil
+}
+
+// renderAdoptPath renders the path prompt.
+func (m Model) renderAdoptPath() string {
+	var s strings.Builder
+
+	ascii := asciiStyle.Render(MigrateASCII)
+	s.WriteString(ascii + "\n")
+	s.WriteString(titleStyle.Render("📥 Adopt Existing Backup") + "\n\n")
+
+	prompt := fmt.Sprintf("Drive mounted at %s.\n\nEnter the path of a directory copied with rsync -aAX (or cp -a),\nor of a .tar, .tar.gz, .tar.bz2 or .tar.zst archive.\nMigrate works out whether it holds a system or a home directory.", m.adoptDrive.mountPoint)
+	s.WriteString(infoStyle.Render(prompt) + "\n\n")
+
+	s.WriteString(selectedMenuItemStyle.Render("📂 "+m.adoptPath+"▏") + "\n")
+
+	if m.adoptChecking {
+		s.WriteString("\n" + infoStyle.Render("Inspecting backup...") + "\n")
+	} else if m.adoptError != "" {
+		s.WriteString("\n" + warningStyle.Render(m.adoptError) + "\n")
+	}
+
+	help := helpStyle.Render("enter: adopt • ctrl+u: clear • esc: cancel")
+	s.WriteString("\n" + help)
+
+	content := borderStyle.Width(safeRenderWidth(m.width)).Render(s.String())
+	return safeCenterContent(m.width, m.height, content)
+}
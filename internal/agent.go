@@ -0,0 +1,404 @@
+// Package internal provides the background agent that backs up designated drives.
+//
+// The agent keeps a list of backup drives by UUID in agent.json. It waits for
+// drives to be attached, and when one of them appears it mounts it, runs the
+// backup configured for that drive with verification, unmounts it and tells the
+// desktop user how it went. Each drive is backed up once per attachment. A locked
+// LUKS drive waits until it is unlocked, for example from the desktop's prompt:
+// its unlocked mapper device appearing is a drive change like any other.
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/signal"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"migrate/internal/drives"
+)
+
+// agentBackupPoll is how often the agent checks whether its backup has finished.
+const agentBackupPoll = time.Second
+
+// agentConfig is the list of designated backup drives in agent.json.
+type agentConfig struct {
+	Drives map[string]string `json:"drives"` // UUID -> "system" or "home"
+}
+
+// agentOperations maps the backup kinds of agent.json to their operation types.
+var agentOperations = map[string]string{
+	"system": "system_backup",
+	"home":   "home_backup",
+}
+
+// SaveAgentDrive designates a backup drive for the agent, given as "uuid=system"
+// or "uuid=home" (--agent-add).
+func SaveAgentDrive(spec string) error {
+	uuid, kind, ok := strings.Cut(spec, "=")
+	uuid = strings.TrimSpace(uuid)
+	if !ok || uuid == "" {
+		return fmt.Errorf("expected uuid=system or uuid=home, got %q", spec)
+	}
+	if _, ok := agentOperations[kind]; !ok {
+		return fmt.Errorf("unknown backup %q (use system or home)", kind)
+	}
+
+	config, _ := loadAgentConfig()
+	config.Drives[uuid] = kind
+	return saveAgentConfig(config)
+}
+
+// RemoveAgentDrive stops the agent from backing up the drive with uuid (--agent-remove).
+func RemoveAgentDrive(uuid string) error {
+	config, _ := loadAgentConfig()
+	if _, ok := config.Drives[uuid]; !ok {
+		return fmt.Errorf("no backup drive with UUID %s", uuid)
+	}
+	delete(config.Drives, uuid)
+	return saveAgentConfig(config)
+}
+
+// getAgentConfigPath returns the path of the agent's list of backup drives.
+func getAgentConfigPath() (string, error) {
+	configDir, err := getConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(configDir, "agent.json"), nil
+}
+
+// loadAgentConfig reads agent.json. A missing or broken file yields an empty list.
+func loadAgentConfig() (*agentConfig, error) {
+	config := &agentConfig{Drives: make(map[string]string)}
+
+	configPath, err := getAgentConfigPath()
+	if err != nil {
+		return config, err
+	}
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return config, err
+	}
+	if err := json.Unmarshal(data, config); err != nil {
+		return &agentConfig{Drives: make(map[string]string)}, fmt.Errorf("failed to parse %s: %v", configPath, err)
+	}
+	if config.Drives == nil {
+		config.Drives = make(map[string]string)
+	}
+	return config, nil
+}
+
+// saveAgentConfig writes agent.json.
+func saveAgentConfig(config *agentConfig) error {
+	configPath, err := getAgentConfigPath()
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal config: %v", err)
+	}
+	return writeFileAtomically(configPath, data)
+}
+
+// DescribeAgentDrives lists the designated backup drives and the external drives
+// attached now, so their UUIDs can be added.
+func DescribeAgentDrives() string {
+	config, _ := loadAgentConfig()
+	var s strings.Builder
+
+	uuids := make([]string, 0, len(config.Drives))
+	for uuid := range config.Drives {
+		uuids = append(uuids, uuid)
+	}
+	sort.Strings(uuids)
+	if len(uuids) == 0 {
+		s.WriteString("  (none)\n")
+	}
+	for _, uuid := range uuids {
+		s.WriteString(fmt.Sprintf("  %-38s %s\n", uuid, config.Drives[uuid]))
+	}
+
+	if attached, err := drives.NewDiscovery("/").ExternalDrives(); err == nil && len(attached) > 0 {
+		s.WriteString("\n💾 Attached drives:\n")
+		for _, drive := range attached {
+			s.WriteString(fmt.Sprintf("  %-38s %s (%s) - %s\n", drive.UUID, drive.Device, drive.Size, drive.Label))
+		}
+	}
+	return s.String()
+}
+
+// agentDriveFor finds the drive to back up for a designated UUID. A LUKS container
+// may be designated by its own UUID; once unlocked, the filesystem inside is used.
+func agentDriveFor(change DrivesChanged, uuid string) (DriveInfo, bool) {
+	for _, drive := range change.Drives {
+		if drive.UUID == uuid {
+			return drive, true
+		}
+	}
+	for _, disk := range change.Disks {
+		for _, volume := range disk.Volumes {
+			if volume.UUID != uuid {
+				continue
+			}
+			for _, holder := range volume.Holders {
+				for _, drive := range change.Drives {
+					if holder.UUID != "" && drive.UUID == holder.UUID {
+						return drive, true
+					}
+				}
+			}
+		}
+	}
+	return DriveInfo{}, false
+}
+
+// RunAgent waits for designated backup drives to be attached and backs each one up
+// (--agent). It returns when interrupted. lock and unlock guard each backup with
+// the instance lock, so the agent and the TUI never run at the same time while
+// the TUI stays usable between backups.
+func RunAgent(lock func() error, unlock func()) error {
+	config, err := loadAgentConfig()
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(config.Drives) == 0 {
+		return fmt.Errorf("no backup drives designated - add one with --agent-add UUID=system|home")
+	}
+
+	logFile, err := os.OpenFile(getLogFilePath(), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err == nil {
+		fmt.Fprintf(logFile, "\n=== BACKUP AGENT STARTED: %s ===\n", time.Now().Format(time.RFC3339))
+		defer logFile.Close()
+	}
+
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(stop)
+
+	// Forward drive changes, starting with the drives attached now
+	changes := make(chan DrivesChanged, 1)
+	if current, err := drives.ScanDrives(); err == nil {
+		changes <- current
+	}
+	go func() {
+		for {
+			msg := watchDrives()()
+			change, ok := msg.(DrivesChanged)
+			if !ok {
+				continue
+			}
+			select {
+			case <-changes:
+			default:
+			}
+			changes <- change
+		}
+	}()
+
+	fmt.Printf("👀 Waiting for backup drives (%d designated) - press Ctrl+C to stop\n", len(config.Drives))
+
+	// UUIDs backed up since they were attached, and locked ones waiting to be unlocked
+	handled := make(map[string]bool)
+	locked := make(map[string]bool)
+	for {
+		var change DrivesChanged
+		select {
+		case <-stop:
+			fmt.Println("👋 Backup agent stopped")
+			return nil
+		case change = <-changes:
+		}
+
+		// The list may have been changed with --agent-add or --agent-remove meanwhile
+		if latest, err := loadAgentConfig(); err == nil {
+			config = latest
+		}
+
+		for _, seen := range []map[string]bool{handled, locked} {
+			for uuid := range seen {
+				if _, ok := agentDriveFor(change, uuid); !ok {
+					delete(seen, uuid)
+				}
+			}
+		}
+
+		uuids := make([]string, 0, len(config.Drives))
+		for uuid := range config.Drives {
+			uuids = append(uuids, uuid)
+		}
+		sort.Strings(uuids)
+		for _, uuid := range uuids {
+			drive, ok := agentDriveFor(change, uuid)
+			if !ok || handled[uuid] {
+				continue
+			}
+
+			if err := lock(); err != nil {
+				handled[uuid] = true
+				agentNotify(fmt.Sprintf("Backup of %s skipped", drive.Label), err.Error(), true)
+				continue
+			}
+			mounted, interrupted := runAgentBackup(drive, agentOperations[config.Drives[uuid]], !locked[uuid], changes, stop, logFile)
+			unlock()
+			if mounted {
+				handled[uuid] = true
+				delete(locked, uuid)
+			} else {
+				// Tried again on the next change, such as the drive being unlocked
+				locked[uuid] = true
+			}
+			if interrupted {
+				fmt.Println("👋 Backup agent stopped")
+				return nil
+			}
+		}
+	}
+}
+
+// runAgentBackup mounts drive, backs it up with verification, unmounts it and
+// notifies the desktop. The backup is canceled if the drive is detached or the
+// agent is interrupted. It reports whether a mount was attempted, which a locked
+// LUKS drive only gets once it is unlocked (announcing the wait if announce is
+// set), and whether the agent was interrupted.
+func runAgentBackup(drive DriveInfo, operationType string, announce bool, changes chan DrivesChanged, stop chan os.Signal, logFile *os.File) (mounted, interrupted bool) {
+	name := drive.Label
+
+	var mountPoint string
+	switch status := mountDriveForOperation(drive, operationType)().(type) {
+	case PasswordRequiredMsg:
+		if logFile != nil && announce {
+			fmt.Fprintf(logFile, "Agent: %s (%s) attached but locked, waiting for it to be unlocked\n", name, drive.UUID)
+		}
+		if announce {
+			agentNotify(fmt.Sprintf("Backup of %s waiting", name), "The drive is encrypted and locked. Unlock it and the backup starts, or run the agent with --luks-key-file.", true)
+		}
+		return false, false
+	case BackupDriveStatus:
+		if logFile != nil {
+			fmt.Fprintf(logFile, "Agent: %s (%s) attached, starting %s\n", name, drive.UUID, operationType)
+		}
+		if status.error != nil {
+			agentNotify(fmt.Sprintf("Backup of %s failed", name), status.error.Error(), true)
+			return true, false
+		}
+		mountPoint = status.mountPoint
+	default:
+		agentNotify(fmt.Sprintf("Backup of %s failed", name), "the drive could not be mounted", true)
+		return true, false
+	}
+	fmt.Printf("💾 %s attached - starting backup\n", name)
+	driveDisks, _ := drives.NewDiscovery("/").DisksHolding(mountPoint)
+
+	// Unattended backups are always verified
+	verification := EnableVerification
+	EnableVerification = true
+	defer func() { EnableVerification = verification }()
+
+	resetTUIState()
+	interrupted, detached := false, false
+	var pending *DrivesChanged
+	update, _ := startUniversalBackup(operationType, mountPoint, nil, nil)().(ProgressUpdate)
+	if update.Error == nil {
+		for !tuiBackupCompleted {
+			select {
+			case <-stop:
+				interrupted = true
+				CancelBackup()
+			case change := <-changes:
+				pending = &change
+				for _, disk := range driveDisks {
+					if !detached && !drives.DiskPresent(change.Disks, disk) {
+						detached = true
+						CancelBackup()
+					}
+				}
+			case <-time.After(agentBackupPoll):
+			}
+		}
+		update.Error = tuiBackupError
+	}
+	// Leave the last change for the agent, unless a newer one is already waiting
+	if pending != nil {
+		select {
+		case changes <- *pending:
+		default:
+		}
+	}
+
+	// Unmount the drive this backup mounted, not whichever backup mount comes first
+	unmounted, unmountMessage := false, "The drive was detached."
+	if !detached {
+		switch err := unmountBackupDrive(mountPoint); {
+		case err != nil:
+			unmountMessage = err.Error()
+		case isMountPoint(mountPoint):
+			unmountMessage = mountPoint + " is still mounted"
+		default:
+			unmounted, unmountMessage = true, "unmounted "+mountPoint
+		}
+	}
+	if logFile != nil {
+		fmt.Fprintf(logFile, "Agent: %s finished (error: %v, unmount: %s)\n", name, update.Error, unmountMessage)
+	}
+
+	switch {
+	case detached:
+		agentNotify(fmt.Sprintf("Backup of %s stopped", name), "The drive was disconnected during the backup. Plug it in again to finish.", true)
+	case interrupted:
+		agentNotify(fmt.Sprintf("Backup of %s stopped", name), "The backup agent was stopped.", true)
+	case update.Error != nil:
+		agentNotify(fmt.Sprintf("Backup of %s failed", name), update.Error.Error(), true)
+	case !unmounted:
+		agentNotify(fmt.Sprintf("Backup of %s complete", name), "The backup was verified, but the drive is still mounted: "+unmountMessage, true)
+	default:
+		agentNotify(fmt.Sprintf("Backup of %s complete", name), fmt.Sprintf("%s files copied, %s unchanged, %s removed and verified. The drive can be unplugged.",
+			FormatNumber(filesCopied), FormatNumber(filesSkipped), FormatNumber(filesDeleted)), false)
+	}
+	return true, interrupted
+}
+
+// agentNotify prints a message and shows it as a desktop notification to the user
+// who started the agent with sudo, through their session bus.
+func agentNotify(summary, body string, failed bool) {
+	if failed {
+		fmt.Printf("❌ %s: %s\n", summary, body)
+	} else {
+		fmt.Printf("✅ %s: %s\n", summary, body)
+	}
+
+	if _, err := exec.LookPath("notify-send"); err != nil {
+		return
+	}
+	urgency := "normal"
+	if failed {
+		urgency = "critical"
+	}
+	cmd := exec.Command("notify-send", "--app-name=Migrate", "--icon=drive-removable-media", "--urgency="+urgency, summary, body)
+
+	if sudoUser := os.Getenv("SUDO_USER"); sudoUser != "" {
+		account, err := user.Lookup(sudoUser)
+		if err != nil {
+			return
+		}
+		uid, _ := strconv.Atoi(account.Uid)
+		gid, _ := strconv.Atoi(account.Gid)
+		runtimeDir := fmt.Sprintf("/run/user/%d", uid)
+		cmd.SysProcAttr = &syscall.SysProcAttr{Credential: &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid)}}
+		cmd.Env = []string{
+			"HOME=" + account.HomeDir,
+			"USER=" + sudoUser,
+			"XDG_RUNTIME_DIR=" + runtimeDir,
+			"DBUS_SESSION_BUS_ADDRESS=unix:path=" + runtimeDir + "/bus",
+		}
+	}
+	cmd.Run()
+}
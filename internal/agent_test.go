@@ -0,0 +1,68 @@
+package internal
+
+import (
+	"testing"
+
+	"migrate/internal/drives"
+)
+
+func TestAgentDriveForLockedAndUnlockedLUKS(t *testing.T) {
+	const container = "11111111-2222-3333-4444-555555555555"
+	const inside = "aaaaaaaa-bbbb-cccc-dddd-eeeeeeeeeeee"
+
+	lockedVolume := drives.BlockVolume{Name: "sdb1", Device: "/dev/sdb1", UUID: container, Filesystem: "crypto_LUKS"}
+	locked := DrivesChanged{
+		Disks:  []drives.BlockDisk{{Name: "sdb", Volumes: []drives.BlockVolume{lockedVolume}}},
+		Drives: []DriveInfo{{Device: "/dev/sdb1", UUID: container, Filesystem: "crypto_LUKS", Label: "Backup"}},
+	}
+	drive, ok := agentDriveFor(locked, container)
+	if !ok || drive.UUID != container {
+		t.Fatalf("locked container designated by its UUID not found: %+v, %v", drive, ok)
+	}
+
+	// Unlocking adds the mapper device as a holder; the filesystem inside is listed as a drive
+	unlockedVolume := lockedVolume
+	unlockedVolume.Holders = []drives.BlockVolume{{Name: "dm-0", Device: "/dev/mapper/luks-" + container, UUID: inside, Filesystem: "ext4"}}
+	unlocked := DrivesChanged{
+		Disks:  []drives.BlockDisk{{Name: "sdb", Volumes: []drives.BlockVolume{unlockedVolume}}},
+		Drives: []DriveInfo{{Device: "/dev/mapper/luks-" + container, UUID: inside, Filesystem: "ext4", Label: "Backup"}},
+	}
+	drive, ok = agentDriveFor(unlocked, container)
+	if !ok || drive.UUID != inside {
+		t.Fatalf("unlocked container did not resolve to the filesystem inside: %+v, %v", drive, ok)
+	}
+
+	if _, ok := agentDriveFor(DrivesChanged{}, container); ok {
+		t.Fatal("a detached drive was found")
+	}
+}
+
+func TestAgentConfigRoundTrip(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+
+	if err := SaveAgentDrive("1234-ABCD=home"); err != nil {
+		t.Fatal(err)
+	}
+	if err := SaveAgentDrive("5678-EF01=system"); err != nil {
+		t.Fatal(err)
+	}
+	for _, spec := range []string{"1234-ABCD", "=home", "1234-ABCD=everything"} {
+		if err := SaveAgentDrive(spec); err == nil {
+			t.Errorf("SaveAgentDrive(%q) accepted a bad spec", spec)
+		}
+	}
+	if err := RemoveAgentDrive("5678-EF01"); err != nil {
+		t.Fatal(err)
+	}
+	if err := RemoveAgentDrive("5678-EF01"); err == nil {
+		t.Fatal("removing an unknown drive succeeded")
+	}
+
+	config, err := loadAgentConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(config.Drives) != 1 || config.Drives["1234-ABCD"] != "home" {
+		t.Fatalf("agent drives = %v", config.Drives)
+	}
+}
@@ -0,0 +1,986 @@
+// Package internal provides the tar/zstd archive backup format.
+//
+// Destinations that cannot hold a faithful mirror (FAT/exFAT sticks without
+// Unix permissions, or a directory that is uploaded somewhere else later) get
+// the backup as one tar stream, zstd-compressed and split into numbered volumes:
+//
+//	migrate-archive/backup-20250101-120000.tar.zst.000
+//	migrate-archive/backup-20250101-120000.tar.zst.001
+//	...
+//
+// The volumes are plain byte splits, so `cat backup-*.tar.zst.* | zstd -d | tar x`
+// restores them without Migrate. Ownership, permissions, nanosecond timestamps
+// and extended attributes are kept in PAX headers. Each run writes a complete
+// new archive and only removes the previous one once the new one is finished.
+package internal
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"migrate/internal/drives"
+
+	"github.com/klauspost/compress/zstd"
+	"golang.org/x/sys/unix"
+)
+
+const (
+	// archiveDir holds the archive volumes at the root of a backup drive.
+	archiveDir = "migrate-archive"
+
+	// defaultArchiveVolumeSize keeps every volume below FAT32's 4 GiB file size limit.
+	defaultArchiveVolumeSize = 4*1024*1024*1024 - 64*1024*1024
+
+	// minArchiveVolumeSize is the smallest volume size accepted by --volume-size.
+	minArchiveVolumeSize = 1024 * 1024
+
+	// defaultArchiveCompression is the zstd level of archives unless --compress says otherwise.
+	defaultArchiveCompression = 3
+
+	// paxXattrPrefix is the PAX record prefix for extended attributes (as used by GNU tar and bsdtar).
+	paxXattrPrefix = "SCHILY.xattr."
+)
+
+// archiveVolumeSize is the size at which archive volumes are split (--volume-size).
+var archiveVolumeSize int64 = defaultArchiveVolumeSize
+
+// ArchiveInfo describes the archive of a backup in its manifest.
+type ArchiveInfo struct {
+	Name        string `json:"name"` // Volume base name in migrate-archive/
+	Volumes     int    `json:"volumes"`
+	VolumeSize  int64  `json:"volume_size"`
+	Compression int    `json:"compression"` // zstd level, 0 = plain tar
+	Files       int64  `json:"files"`
+	Size        int64  `json:"size"` // Logical size of all files
+
+	// Set for an adopted tarball: its file relative to the backup root, its
+	// compression ("gzip", "bzip2", "zstd" or "" for plain tar) and the member
+	// directory that holds the backed-up tree
+	File  string `json:"file,omitempty"`
+	Codec string `json:"codec,omitempty"`
+	Root  string `json:"root,omitempty"`
+
+	// Set when the archive must come out byte for byte the same if it is written
+	// again (resumable uploads): reading a file changes its access time
+	OmitAccessTimes bool `json:"omit_access_times,omitempty"`
+}
+
+// SetArchiveVolumeSize sets the size of archive volumes, e.g. "4G" or "700M" (--volume-size).
+func SetArchiveVolumeSize(spec string) error {
+	size, err := drives.ParseDriveSize(spec)
+	if err != nil {
+		return err
+	}
+	if size < minArchiveVolumeSize {
+		return fmt.Errorf("volumes must be at least %s", FormatBytes(minArchiveVolumeSize))
+	}
+	archiveVolumeSize = size
+	return nil
+}
+
+// archiveCompressionLevel returns the zstd level for a new archive.
+func archiveCompressionLevel() int {
+	if compressionLevel >= 0 {
+		return compressionLevel
+	}
+	return defaultArchiveCompression
+}
+
+// volumePath returns the path of volume i of an archive.
+func volumePath(base string, i int) string {
+	return fmt.Sprintf("%s.%03d", base, i)
+}
+
+// volumeWriter splits a byte stream across numbered volume files.
+type volumeWriter struct {
+	base    string
+	size    int64
+	current *os.File
+	written int64 // Bytes in the current volume
+	volumes int
+}
+
+func (v *volumeWriter) Write(p []byte) (int, error) {
+	total := 0
+	for len(p) > 0 {
+		if v.current == nil {
+			f, err := os.OpenFile(volumePath(v.base, v.volumes), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0644)
+			if err != nil {
+				return total, err
+			}
+			v.current = f
+			v.written = 0
+			v.volumes++
+		}
+		n := int64(len(p))
+		if room := v.size - v.written; n > room {
+			n = room
+		}
+		bwLimiter.wait(int(n))
+		written, err := v.current.Write(p[:n])
+		total += written
+		v.written += int64(written)
+		if err != nil {
+			return total, err
+		}
+		p = p[n:]
+		if v.written == v.size {
+			if err := v.closeVolume(); err != nil {
+				return total, err
+			}
+		}
+	}
+	return total, nil
+}
+
+func (v *volumeWriter) closeVolume() error {
+	if v.current == nil {
+		return nil
+	}
+	err := v.current.Close()
+	v.current = nil
+	return err
+}
+
+// codec returns the compression of the archive stream.
+func (info *ArchiveInfo) codec() string {
+	if info.File != "" {
+		return info.Codec
+	}
+	if info.Compression > 0 {
+		return "zstd"
+	}
+	return ""
+}
+
+// memberPath returns the path of a tar member relative to the backed-up tree,
+// or false if the member lies outside it.
+func (info *ArchiveInfo) memberPath(name string) (string, bool) {
+	rel := path.Clean("/" + name)[1:]
+	if rel == "" {
+		rel = "."
+	}
+	root := info.Root
+	if root == "" || root == "." {
+		return rel, true
+	}
+	if rel == root {
+		return ".", true
+	}
+	if rest, ok := strings.CutPrefix(rel, root+"/"); ok {
+		return rest, true
+	}
+	return "", false
+}
+
+// volumeReader reads the volumes of an archive as one stream.
+type volumeReader struct {
+	base    string
+	volumes int
+	next    int
+	current *os.File
+}
+
+func (v *volumeReader) Read(p []byte) (int, error) {
+	for {
+		if v.current == nil {
+			if v.next == v.volumes {
+				return 0, io.EOF
+			}
+			f, err := os.Open(volumePath(v.base, v.next))
+			if err != nil {
+				return 0, fmt.Errorf("archive volume missing: %v", err)
+			}
+			v.current = f
+			v.next++
+		}
+		n, err := v.current.Read(p)
+		if err == io.EOF {
+			v.current.Close()
+			v.current = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+func (v *volumeReader) Close() error {
+	if v.current != nil {
+		return v.current.Close()
+	}
+	return nil
+}
+
+// archiveReader opens the tar stream of the archive described by info.
+type archiveReader struct {
+	*tar.Reader
+	closers []func() error
+}
+
+func openArchive(backupPath string, info *ArchiveInfo) (*archiveReader, error) {
+	var stream io.ReadCloser
+	if info.File != "" {
+		f, err := os.Open(filepath.Join(backupPath, info.File))
+		if err != nil {
+			return nil, fmt.Errorf("failed to open archive: %v", err)
+		}
+		stream = f
+	} else {
+		stream = &volumeReader{base: filepath.Join(backupPath, archiveDir, info.Name), volumes: info.Volumes}
+	}
+	return newArchiveReader(stream, info.codec())
+}
+
+// newArchiveReader reads a tar stream compressed with codec.
+func newArchiveReader(stream io.ReadCloser, codec string) (*archiveReader, error) {
+	r := &archiveReader{closers: []func() error{stream.Close}}
+	var decompressed io.Reader = stream
+	switch codec {
+	case "zstd":
+		decoder, err := zstd.NewReader(stream)
+		if err != nil {
+			stream.Close()
+			return nil, fmt.Errorf("failed to open archive: %v", err)
+		}
+		r.closers = append(r.closers, func() error { decoder.Close(); return nil })
+		decompressed = decoder
+	case "gzip":
+		decoder, err := gzip.NewReader(stream)
+		if err != nil {
+			stream.Close()
+			return nil, fmt.Errorf("failed to open archive: %v", err)
+		}
+		r.closers = append(r.closers, decoder.Close)
+		decompressed = decoder
+	case "bzip2":
+		decompressed = bzip2.NewReader(stream)
+	case "":
+	default:
+		stream.Close()
+		return nil, fmt.Errorf("unsupported archive compression %q", codec)
+	}
+	r.Reader = tar.NewReader(decompressed)
+	return r, nil
+}
+
+func (r *archiveReader) Close() error {
+	var err error
+	for i := len(r.closers) - 1; i >= 0; i-- {
+		if closeErr := r.closers[i](); err == nil {
+			err = closeErr
+		}
+	}
+	return err
+}
+
+// isArchiveDir reports whether path holds archive volumes written by Migrate.
+func isArchiveDir(path string) bool {
+	volumes, _ := filepath.Glob(filepath.Join(path, "backup-*.tar*.000"))
+	return len(volumes) > 0
+}
+
+// isArchiveBackup reports whether the latest backup on a drive is a tar/zstd archive.
+func isArchiveBackup(backupPath string) bool {
+	manifest, err := loadBackupManifest(backupPath)
+	return err == nil && manifest.Format == BackupFormatArchive && manifest.Archive != nil
+}
+
+// isPackedBackup reports whether the latest backup on a drive is stored as a
+// repository or archive rather than as a plain file tree.
+func isPackedBackup(backupPath string) bool {
+	return isRepositoryBackup(backupPath) || isArchiveBackup(backupPath)
+}
+
+// packedBackupKind describes a packed backup for confirmation screens.
+func packedBackupKind(backupPath string) string {
+	if isArchiveBackup(backupPath) {
+		return "tar/zstd archive"
+	}
+	return "repository snapshot"
+}
+
+// loadArchiveInfo returns the archive description from a backup's manifest.
+func loadArchiveInfo(backupPath string) (*ArchiveInfo, error) {
+	manifest, err := loadBackupManifest(backupPath)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read backup manifest: %v", err)
+	}
+	if manifest.Archive == nil {
+		return nil, fmt.Errorf("backup manifest names no archive")
+	}
+	return manifest.Archive, nil
+}
+
+// listXattrs returns the extended attributes of path (not following symlinks).
+func listXattrs(path string) map[string][]byte {
+	size, err := unix.Llistxattr(path, nil)
+	if err != nil || size <= 0 {
+		return nil
+	}
+	buf := make([]byte, size)
+	size, err = unix.Llistxattr(path, buf)
+	if err != nil {
+		return nil
+	}
+	xattrs := make(map[string][]byte)
+	for _, name := range strings.Split(strings.TrimRight(string(buf[:size]), "\x00"), "\x00") {
+		if name == "" {
+			continue
+		}
+		valueSize, err := unix.Lgetxattr(path, name, nil)
+		if err != nil {
+			continue
+		}
+		value := make([]byte, valueSize)
+		if valueSize > 0 {
+			if valueSize, err = unix.Lgetxattr(path, name, value); err != nil {
+				continue
+			}
+		}
+		xattrs[name] = value[:valueSize]
+	}
+	return xattrs
+}
+
+// setXattrs applies extended attributes to path, ignoring ones the filesystem refuses.
+func setXattrs(path string, xattrs map[string][]byte) {
+	for name, value := range xattrs {
+		unix.Lsetxattr(path, name, value, 0)
+	}
+}
+
+// archiveHeader describes a source path as a PAX tar header.
+func archiveHeader(path, rel string, info os.FileInfo) (*tar.Header, error) {
+	link := ""
+	if info.Mode()&os.ModeSymlink != 0 {
+		target, err := os.Readlink(path)
+		if err != nil {
+			return nil, err
+		}
+		link = target
+	}
+	hdr, err := tar.FileInfoHeader(info, link)
+	if err != nil {
+		return nil, err
+	}
+	hdr.Name = filepath.ToSlash(rel)
+	if info.IsDir() {
+		hdr.Name += "/"
+	}
+	hdr.Format = tar.FormatPAX
+	if xattrs := listXattrs(path); len(xattrs) > 0 {
+		hdr.PAXRecords = make(map[string]string, len(xattrs))
+		for name, value := range xattrs {
+			hdr.PAXRecords[paxXattrPrefix+name] = string(value)
+		}
+	}
+	return hdr, nil
+}
+
+// headerXattrs extracts the extended attributes stored in a header.
+func headerXattrs(hdr *tar.Header) map[string][]byte {
+	var xattrs map[string][]byte
+	for key, value := range hdr.PAXRecords {
+		if name, ok := strings.CutPrefix(key, paxXattrPrefix); ok {
+			if xattrs == nil {
+				xattrs = make(map[string][]byte)
+			}
+			xattrs[name] = []byte(value)
+		}
+	}
+	return xattrs
+}
+
+// performArchiveBackup streams config.SourcePath into a new archive on
+// config.DestinationPath and removes the previous archive once it is complete.
+func performArchiveBackup(config BackupConfig, logFile *os.File) (*ArchiveInfo, error) {
+	dir := filepath.Join(config.DestinationPath, archiveDir)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, fmt.Errorf("failed to create %s: %v", dir, err)
+	}
+
+	info := &ArchiveInfo{
+		VolumeSize:  archiveVolumeSize,
+		Compression: archiveCompressionLevel(),
+	}
+	extension := ".tar"
+	if info.Compression > 0 {
+		extension += ".zst"
+	}
+	// Never write over the archive that is still the backup
+	stamp := time.Now().UTC().Format("20060102-150405")
+	info.Name = "backup-" + stamp + extension
+	for i := 2; ; i++ {
+		if _, err := os.Lstat(volumePath(filepath.Join(dir, info.Name), 0)); os.IsNotExist(err) {
+			break
+		}
+		info.Name = fmt.Sprintf("backup-%s-%d%s", stamp, i, extension)
+	}
+	base := filepath.Join(dir, info.Name)
+
+	if logFile != nil {
+		fmt.Fprintf(logFile, "Archive backup: %s, volumes of %s, compression level %d\n", info.Name, FormatBytes(info.VolumeSize), info.Compression)
+		fmt.Fprintf(logFile, "Throttle: %s\n", throttleStatus())
+	}
+	if err := applyProcessPriority(); err != nil && logFile != nil {
+		fmt.Fprintf(logFile, "Warning: could not set process priority: %v\n", err)
+	}
+
+	volumes := &volumeWriter{base: base, size: info.VolumeSize}
+	err := writeArchive(config, volumes, info, logFile)
+	if closeErr := volumes.closeVolume(); err == nil {
+		err = closeErr
+	}
+	info.Volumes = volumes.volumes
+	if err == nil && shouldCancelBackup() {
+		err = fmt.Errorf("operation canceled")
+	}
+	if err != nil {
+		// Leave the previous archive as the backup
+		for i := 0; i < volumes.volumes; i++ {
+			os.Remove(volumePath(base, i))
+		}
+		if isSpaceError(err) {
+			spaceInfo := getSpaceErrorDetails(config.DestinationPath)
+			return nil, fmt.Errorf("⚠️ OUT OF SPACE during backup\n\nSpace error: %v\n\n%s\n\nThe backup drive is full. Please use a larger drive, smaller volumes or select fewer folders.", err, spaceInfo)
+		}
+		return nil, err
+	}
+
+	// The new archive is complete: drop older ones
+	entries, _ := os.ReadDir(dir)
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), info.Name+".") {
+			os.Remove(filepath.Join(dir, entry.Name()))
+		}
+	}
+
+	if logFile != nil {
+		fmt.Fprintf(logFile, "Archive backup: %s files (%s) in %d volumes\n", FormatNumber(info.Files), FormatBytes(info.Size), info.Volumes)
+	}
+	return info, nil
+}
+
+// writeArchive writes the tar stream of the backup to w.
+func writeArchive(config BackupConfig, w io.Writer, info *ArchiveInfo, logFile *os.File) error {
+	var encoder *zstd.Encoder
+	if info.Compression > 0 {
+		var err error
+		encoder, err = zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(info.Compression)))
+		if err != nil {
+			return fmt.Errorf("failed to create zstd encoder: %v", err)
+		}
+		w = encoder
+	}
+	tw := tar.NewWriter(w)
+
+	// Hard links are stored once; later names link to the first
+	type inode struct{ dev, ino uint64 }
+	linked := make(map[inode]string)
+
+	err := walkBackupSource(config, logFile, func(path, rel string, d os.DirEntry, fi os.FileInfo) error {
+		hdr, err := archiveHeader(path, rel, fi)
+		if err != nil {
+			if logFile != nil {
+				fmt.Fprintf(logFile, "Error reading %s: %v\n", path, err)
+			}
+			return nil
+		}
+		if info.OmitAccessTimes {
+			hdr.AccessTime = time.Time{}
+		}
+
+		if hdr.Typeflag == tar.TypeReg {
+			atomic.AddInt64(&totalFilesFound, 1)
+			if stat, ok := fi.Sys().(*syscall.Stat_t); ok && stat.Nlink > 1 {
+				key := inode{uint64(stat.Dev), stat.Ino}
+				if first, seen := linked[key]; seen {
+					hdr.Typeflag = tar.TypeLink
+					hdr.Linkname = first
+					hdr.Size = 0
+				} else {
+					linked[key] = hdr.Name
+				}
+			}
+		}
+
+		if hdr.Typeflag != tar.TypeReg {
+			return tw.WriteHeader(hdr)
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			if logFile != nil {
+				fmt.Fprintf(logFile, "Error reading %s: %v\n", path, err)
+			}
+			return nil
+		}
+		defer f.Close()
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		source := &sourceReader{r: f}
+		n, err := io.CopyN(tw, source, hdr.Size)
+		if err != nil && source.err == nil && err != io.EOF {
+			return err // Writing the archive failed
+		}
+		if n < hdr.Size {
+			// The file shrank or became unreadable: pad so the archive stays valid
+			if logFile != nil {
+				fmt.Fprintf(logFile, "Warning: %s changed while archiving (%d of %d bytes)\n", path, n, hdr.Size)
+			}
+			if _, err := io.CopyN(tw, zeroReader{}, hdr.Size-n); err != nil {
+				return err
+			}
+		}
+		info.Files++
+		info.Size += hdr.Size
+		atomic.AddInt64(&filesCopied, 1)
+		return nil
+	})
+	directoryWalkComplete = true
+	if err != nil {
+		return err
+	}
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	if encoder != nil {
+		return encoder.Close()
+	}
+	return nil
+}
+
+// sourceReader remembers read errors of a source file, which only affect that
+// file, so they can be told apart from errors writing the archive.
+type sourceReader struct {
+	r   io.Reader
+	err error
+}
+
+func (s *sourceReader) Read(p []byte) (int, error) {
+	n, err := s.r.Read(p)
+	if err != nil && err != io.EOF {
+		s.err = err
+	}
+	return n, err
+}
+
+// zeroReader reads zeros.
+type zeroReader struct{}
+
+func (zeroReader) Read(p []byte) (int, error) {
+	clear(p)
+	return len(p), nil
+}
+
+// performArchiveRestore extracts the backup's archive to targetPath, then deletes
+// files the archive does not contain.
+func performArchiveRestore(backupPath, targetPath string, excludePatterns []string, logFile *os.File) error {
+	info, err := loadArchiveInfo(backupPath)
+	if err != nil {
+		return err
+	}
+	archive, err := openArchive(backupPath, info)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+
+	if logFile != nil {
+		fmt.Fprintf(logFile, "Restoring archive %s (%d volumes, %s files)\n", info.Name, info.Volumes, FormatNumber(info.Files))
+	}
+	atomic.StoreInt64(&totalFilesFound, info.Files)
+	directoryWalkComplete = true
+	return restoreArchiveStream(archive, info, targetPath, excludePatterns, logFile)
+}
+
+// restoreArchiveStream extracts an archive to targetPath, then deletes files
+// the archive does not contain, wherever the stream comes from.
+func restoreArchiveStream(archive *archiveReader, info *ArchiveInfo, targetPath string, excludePatterns []string, logFile *os.File) error {
+	type pendingDir struct {
+		path string
+		hdr  *tar.Header
+	}
+	var dirs []pendingDir
+	var excludedDirs []string
+	inArchive := make(map[string]bool)
+	guard := newRestoreGuard(targetPath)
+	refused := 0
+
+	for {
+		if shouldCancelBackup() {
+			return fmt.Errorf("operation canceled")
+		}
+		hdr, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("archive is damaged: %v", err)
+		}
+
+		// Member names are cleaned as absolute paths, which removes "..". A symlink
+		// written by an earlier member can still lead outside, so the guard refuses
+		// members whose path passes through one.
+		rel, ok := info.memberPath(hdr.Name)
+		if !ok {
+			continue
+		}
+		if err := guard.check(rel, hdr.Typeflag == tar.TypeDir); err != nil {
+			refused++
+			if logFile != nil {
+				fmt.Fprintf(logFile, "REFUSED archive member %s: %v\n", hdr.Name, err)
+			}
+			continue
+		}
+		inArchive[rel] = true
+		dstPath := filepath.Join(targetPath, rel)
+		currentDirectory = filepath.Dir(dstPath)
+
+		// Honour the restore options; an excluded directory excludes everything below it
+		excluded := rel != "." && matchesAnyExclusion(targetPath, dstPath, excludePatterns)
+		for _, dir := range excludedDirs {
+			if strings.HasPrefix(dstPath, dir+"/") {
+				excluded = true
+				break
+			}
+		}
+		if excluded {
+			if hdr.Typeflag == tar.TypeDir {
+				excludedDirs = append(excludedDirs, dstPath)
+			}
+			continue
+		}
+		// The backed-up copy of a file whose content decides is read ahead from the stream
+		var content io.Reader = archive.Reader
+		if hdr.Typeflag != tar.TypeDir {
+			var backedUp func() (io.ReadCloser, error)
+			if hdr.Typeflag == tar.TypeReg && hostIdentityNeedsContent(dstPath) {
+				data, err := io.ReadAll(archive)
+				if err != nil {
+					return fmt.Errorf("archive is damaged: %v", err)
+				}
+				content = bytes.NewReader(data)
+				backedUp = func() (io.ReadCloser, error) { return io.NopCloser(bytes.NewReader(data)), nil }
+			}
+			if keepHostIdentityFile(dstPath, backedUp) {
+				continue
+			}
+		}
+
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			rollbackBeforeDirectory(dstPath)
+			if err := os.MkdirAll(dstPath, hdr.FileInfo().Mode().Perm()); err != nil && logFile != nil {
+				fmt.Fprintf(logFile, "ERROR: Failed to create directory %s: %v (continuing)\n", dstPath, err)
+			}
+			dirs = append(dirs, pendingDir{path: dstPath, hdr: hdr})
+
+		case tar.TypeSymlink:
+			if current, err := os.Readlink(dstPath); err == nil && current == hdr.Linkname {
+				continue
+			}
+			if err := rollbackBeforeWrite(dstPath); err != nil {
+				if logFile != nil {
+					fmt.Fprintf(logFile, "Skipping %s: %v\n", dstPath, err)
+				}
+				continue
+			}
+			guard.replaced(dstPath)
+			os.Remove(dstPath)
+			os.Symlink(hdr.Linkname, dstPath)
+			uid, gid := remapOwner(uint32(hdr.Uid), uint32(hdr.Gid))
+			os.Lchown(dstPath, uid, gid)
+
+		case tar.TypeLink:
+			linkRel, ok := info.memberPath(hdr.Linkname)
+			if !ok {
+				continue
+			}
+			if err := guard.check(linkRel, false); err != nil {
+				refused++
+				if logFile != nil {
+					fmt.Fprintf(logFile, "REFUSED hard link %s to %s: %v\n", hdr.Name, hdr.Linkname, err)
+				}
+				continue
+			}
+			if err := rollbackBeforeWrite(dstPath); err != nil {
+				if logFile != nil {
+					fmt.Fprintf(logFile, "Skipping %s: %v\n", dstPath, err)
+				}
+				continue
+			}
+			guard.replaced(dstPath)
+			os.Remove(dstPath)
+			if err := os.Link(filepath.Join(targetPath, linkRel), dstPath); err != nil && logFile != nil {
+				fmt.Fprintf(logFile, "Error linking %s: %v\n", dstPath, err)
+			}
+
+		case tar.TypeReg:
+			if err := restoreArchiveFile(content, hdr, dstPath, logFile); err != nil {
+				return err
+			}
+		}
+	}
+
+	// Directory metadata last, deepest first, so writing children does not change it.
+	// A directory a later member replaced with a symlink is left alone.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if info, err := os.Lstat(dirs[i].path); err == nil && info.IsDir() {
+			applyArchiveMetadata(dirs[i].path, dirs[i].hdr)
+		}
+	}
+
+	syncPhaseComplete = true
+	if err := deleteExtraFilesMatching(targetPath, excludePatterns, func(rel string) bool {
+		return inArchive[rel]
+	}, logFile); err != nil {
+		return err
+	}
+	if refused > 0 {
+		return fmt.Errorf("%d archive members were not restored because their path leads through a symbolic link (see the log)", refused)
+	}
+	return nil
+}
+
+// restoreGuard keeps archive members inside the restore target. Archives from
+// other tools, adopted tarballs and network migrations are not trusted to keep
+// their own symlinks out of the paths of later members.
+type restoreGuard struct {
+	target string
+	dirs   map[string]bool // Directories below target confirmed to be real directories
+}
+
+func newRestoreGuard(target string) *restoreGuard {
+	return &restoreGuard{target: filepath.Clean(target), dirs: make(map[string]bool)}
+}
+
+// check fails if a directory between the target and rel is a symlink or not a
+// directory. With self, rel itself must not be a symlink either.
+func (g *restoreGuard) check(rel string, self bool) error {
+	if rel == "." {
+		return nil
+	}
+	parts := strings.Split(rel, "/")
+	if !self {
+		parts = parts[:len(parts)-1]
+	}
+	dir := g.target
+	for _, part := range parts {
+		dir = filepath.Join(dir, part)
+		if g.dirs[dir] {
+			continue
+		}
+		info, err := os.Lstat(dir)
+		if os.IsNotExist(err) {
+			// Created below as real directories
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("%s is a symbolic link", dir)
+		}
+		if !info.IsDir() {
+			return fmt.Errorf("%s is not a directory", dir)
+		}
+		g.dirs[dir] = true
+	}
+	return nil
+}
+
+// replaced forgets what was confirmed about path, which a member is about to replace.
+func (g *restoreGuard) replaced(path string) {
+	if g.dirs[path] {
+		g.dirs = make(map[string]bool)
+	}
+}
+
+// restoreArchiveFile writes the current archive entry to dstPath unless the
+// target already holds it. Only fatal errors (out of space, damaged archive) are returned.
+func restoreArchiveFile(tr io.Reader, hdr *tar.Header, dstPath string, logFile *os.File) error {
+	existing, err := os.Lstat(dstPath)
+	current := err == nil && existing.Mode().IsRegular() && existing.Size() == hdr.Size
+	if current && compareMode != CompareChecksum && existing.ModTime().Equal(hdr.ModTime) {
+		atomic.AddInt64(&filesSkipped, 1)
+		return nil
+	}
+
+	if err := os.MkdirAll(filepath.Dir(dstPath), 0755); err != nil {
+		return nil
+	}
+
+	// Write next to the target, so a checksum comparison can keep the original
+	tmp, err := os.CreateTemp(filepath.Dir(dstPath), ".migrate-restore-*")
+	if err != nil {
+		if logFile != nil {
+			fmt.Fprintf(logFile, "Error restoring %s: %v\n", dstPath, err)
+		}
+		return nil
+	}
+	hasher := sha256.New()
+	_, err = io.Copy(io.MultiWriter(throttledWriter{tmp}, hasher), tr)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		if logFile != nil {
+			fmt.Fprintf(logFile, "Error restoring %s: %v\n", dstPath, err)
+		}
+		if isSpaceError(err) {
+			spaceInfo := getSpaceErrorDetails(filepath.Dir(dstPath))
+			return fmt.Errorf("⚠️ OUT OF SPACE during restore\n\nError restoring file: %s\nSpace error: %v\n\n%s", dstPath, err, spaceInfo)
+		}
+		return fmt.Errorf("archive is damaged: %v", err)
+	}
+
+	if current && compareMode == CompareChecksum {
+		if existingHash, err := hashFileContent(dstPath); err == nil && string(existingHash) == string(hasher.Sum(nil)) {
+			os.Remove(tmp.Name())
+			atomic.AddInt64(&filesSkipped, 1)
+			return nil
+		}
+		if existing.ModTime().Equal(hdr.ModTime) {
+			atomic.AddInt64(&filesContentRecopied, 1)
+		}
+	}
+
+	if err := rollbackBeforeWrite(dstPath); err != nil {
+		os.Remove(tmp.Name())
+		if logFile != nil {
+			fmt.Fprintf(logFile, "Skipping %s: %v\n", dstPath, err)
+		}
+		return nil
+	}
+	if err := os.Rename(tmp.Name(), dstPath); err != nil {
+		os.Remove(tmp.Name())
+		if logFile != nil {
+			fmt.Fprintf(logFile, "Error restoring %s: %v\n", dstPath, err)
+		}
+		return nil
+	}
+	applyArchiveMetadata(dstPath, hdr)
+	atomic.AddInt64(&filesCopied, 1)
+	return nil
+}
+
+// applyArchiveMetadata sets ownership, permissions, extended attributes and
+// timestamps from a header.
+func applyArchiveMetadata(path string, hdr *tar.Header) {
+	// Chown first, since it clears setuid/setgid
+	uid, gid := remapOwner(uint32(hdr.Uid), uint32(hdr.Gid))
+	os.Lchown(path, uid, gid)
+	os.Chmod(path, hdr.FileInfo().Mode())
+	setXattrs(path, headerXattrs(hdr))
+	atime := hdr.AccessTime
+	if atime.IsZero() {
+		atime = hdr.ModTime
+	}
+	os.Chtimes(path, atime, hdr.ModTime)
+}
+
+// performArchiveVerification reads the whole archive, which checks every volume
+// and the compressed stream, and compares each archived file with its source
+// when the source has not changed since the backup.
+func performArchiveVerification(backupPath, sourcePath string, logFile *os.File) error {
+	info, err := loadArchiveInfo(backupPath)
+	if err != nil {
+		return err
+	}
+	archive, err := openArchive(backupPath, info)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+	return verifyArchiveStream(archive, info, sourcePath, logFile)
+}
+
+// verifyArchiveStream reads an archive to the end and compares its files with
+// the source, wherever the volumes are stored.
+func verifyArchiveStream(archive *archiveReader, info *ArchiveInfo, sourcePath string, logFile *os.File) error {
+	verificationPhaseActive = true
+	defer func() { verificationPhaseActive = false }()
+	totalFilesVerified = 0
+	verificationErrors = []string{}
+
+	if logFile != nil {
+		fmt.Fprintf(logFile, "Verifying archive %s against %s\n", info.Name, sourcePath)
+	}
+
+	var compared, changed int64
+	for {
+		if shouldCancelBackup() {
+			return fmt.Errorf("operation canceled")
+		}
+		hdr, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			verificationErrors = append(verificationErrors, fmt.Sprintf("archive is damaged: %v", err))
+			break
+		}
+		if hdr.Typeflag != tar.TypeReg {
+			continue
+		}
+		rel, ok := info.memberPath(hdr.Name)
+		if !ok {
+			continue
+		}
+
+		archived := sha256.New()
+		if _, err := io.Copy(archived, archive); err != nil {
+			verificationErrors = append(verificationErrors, fmt.Sprintf("%s: archive is damaged: %v", rel, err))
+			break
+		}
+		totalFilesVerified++
+
+		// Only files untouched since the backup can be compared with the source
+		srcPath := filepath.Join(sourcePath, rel)
+		srcInfo, err := os.Lstat(srcPath)
+		if err != nil || !srcInfo.Mode().IsRegular() || srcInfo.Size() != hdr.Size || !srcInfo.ModTime().Equal(hdr.ModTime) {
+			changed++
+			continue
+		}
+		source, err := hashFileContent(srcPath)
+		if err != nil {
+			continue
+		}
+		compared++
+		if string(source) != string(archived.Sum(nil)) {
+			verificationErrors = append(verificationErrors, fmt.Sprintf("%s: archived content differs from the unchanged source file", rel))
+		}
+	}
+
+	if logFile != nil {
+		fmt.Fprintf(logFile, "Archive verification: %s files read, %s compared with the source, %s changed since the backup, %d errors\n",
+			FormatNumber(totalFilesVerified), FormatNumber(compared), FormatNumber(changed), len(verificationErrors))
+		sort.Strings(verificationErrors)
+		for _, message := range verificationErrors {
+			fmt.Fprintf(logFile, "  - %s\n", message)
+		}
+	}
+	if len(verificationErrors) > 0 {
+		return fmt.Errorf("VERIFICATION_DETAILED_ERRORS:%d", len(verificationErrors))
+	}
+	return nil
+}
@@ -0,0 +1,99 @@
+package internal
+
+import (
+	"archive/tar"
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// tarStream builds an uncompressed archive from headers; regular files get body as content.
+func tarStream(t *testing.T, body string, headers ...*tar.Header) *archiveReader {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, hdr := range headers {
+		if hdr.Typeflag == tar.TypeReg {
+			hdr.Size = int64(len(body))
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if hdr.Typeflag == tar.TypeReg {
+			tw.Write([]byte(body))
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	archive, err := newArchiveReader(io.NopCloser(&buf), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return archive
+}
+
+func TestRestoreArchiveRefusesSymlinkedParent(t *testing.T) {
+	target := filepath.Join(t.TempDir(), "target")
+	outside := filepath.Join(t.TempDir(), "outside")
+	os.MkdirAll(target, 0755)
+	os.MkdirAll(outside, 0755)
+
+	archive := tarStream(t, "pwned",
+		&tar.Header{Name: "evil", Typeflag: tar.TypeSymlink, Linkname: outside, Mode: 0777},
+		&tar.Header{Name: "evil/pwned", Typeflag: tar.TypeReg, Mode: 0644},
+	)
+	defer archive.Close()
+
+	err := restoreArchiveStream(archive, &ArchiveInfo{Name: "test"}, target, nil, nil)
+	if err == nil {
+		t.Fatal("restore succeeded although a member wrote through a symlink")
+	}
+	if _, err := os.Lstat(filepath.Join(outside, "pwned")); !os.IsNotExist(err) {
+		t.Fatalf("member was written outside the target: %v", err)
+	}
+}
+
+func TestRestoreArchiveRefusesHardLinkThroughSymlink(t *testing.T) {
+	target := filepath.Join(t.TempDir(), "target")
+	outside := filepath.Join(t.TempDir(), "outside")
+	os.MkdirAll(target, 0755)
+	os.MkdirAll(outside, 0755)
+	secret := filepath.Join(outside, "secret")
+	os.WriteFile(secret, []byte("secret"), 0600)
+
+	archive := tarStream(t, "",
+		&tar.Header{Name: "evil", Typeflag: tar.TypeSymlink, Linkname: outside, Mode: 0777},
+		&tar.Header{Name: "copy", Typeflag: tar.TypeLink, Linkname: "evil/secret"},
+	)
+	defer archive.Close()
+
+	if err := restoreArchiveStream(archive, &ArchiveInfo{Name: "test"}, target, nil, nil); err == nil {
+		t.Fatal("restore succeeded although a hard link pointed through a symlink")
+	}
+	if _, err := os.Lstat(filepath.Join(target, "copy")); !os.IsNotExist(err) {
+		t.Fatalf("hard link to a file outside the target was created: %v", err)
+	}
+}
+
+func TestRestoreArchiveKeepsOrdinaryMembers(t *testing.T) {
+	target := filepath.Join(t.TempDir(), "target")
+	os.MkdirAll(target, 0755)
+
+	archive := tarStream(t, "hello",
+		&tar.Header{Name: "etc", Typeflag: tar.TypeDir, Mode: 0755},
+		&tar.Header{Name: "etc/motd", Typeflag: tar.TypeReg, Mode: 0644},
+		&tar.Header{Name: "etc/motd.link", Typeflag: tar.TypeSymlink, Linkname: "motd", Mode: 0777},
+	)
+	defer archive.Close()
+
+	if err := restoreArchiveStream(archive, &ArchiveInfo{Name: "test"}, target, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(target, "etc", "motd.link"))
+	if err != nil || string(data) != "hello" {
+		t.Fatalf("restored content = %q, %v", data, err)
+	}
+}
@@ -0,0 +1,138 @@
+// Package internal provides content-defined chunking for the repository format.
+//
+// Files are cut where a rolling gear hash of the content matches a mask
+// (FastCDC with normalized chunking), so an insertion near the start of a
+// file only changes the chunks around it; everything after it is cut at the
+// same content positions as before and deduplicates against the old chunks.
+package internal
+
+import (
+	"io"
+)
+
+// ChunkerParams are the chunk size limits and the gear table seed of a repository.
+type ChunkerParams struct {
+	MinSize int    `json:"min_size"`
+	AvgSize int    `json:"avg_size"`
+	MaxSize int    `json:"max_size"`
+	Seed    uint64 `json:"seed"`
+}
+
+// defaultChunkerParams suits whole-system backups: large enough to keep the
+// chunk count of a multi-terabyte repository manageable, small enough to
+// deduplicate edited VM images and photo libraries.
+var defaultChunkerParams = ChunkerParams{
+	MinSize: 256 * 1024,
+	AvgSize: 1024 * 1024,
+	MaxSize: 4 * 1024 * 1024,
+}
+
+// chunker splits a stream into content-defined chunks.
+type chunker struct {
+	r      io.Reader
+	params ChunkerParams
+	gear   [256]uint64
+	maskS  uint64 // Harder to match, used below the average size
+	maskL  uint64 // Easier to match, used above it
+
+	buf   []byte
+	start int // First unconsumed byte in buf
+	end   int // End of valid data in buf
+	eof   bool
+}
+
+// newChunker returns a chunker reading from r.
+func newChunker(r io.Reader, params ChunkerParams) *chunker {
+	bits := 0
+	for 1<<(bits+1) <= params.AvgSize {
+		bits++
+	}
+	return &chunker{
+		r:      r,
+		params: params,
+		gear:   gearTable(params.Seed),
+		maskS:  highBitsMask(bits + 1),
+		maskL:  highBitsMask(bits - 1),
+		buf:    make([]byte, params.MaxSize*2),
+	}
+}
+
+// highBitsMask returns a mask of the top n bits. The gear hash shifts left, so
+// its high bits depend on the most bytes of the window.
+func highBitsMask(n int) uint64 {
+	return ((uint64(1) << n) - 1) << (64 - n)
+}
+
+// gearTable derives the per-byte random values of the rolling hash from seed (splitmix64).
+func gearTable(seed uint64) [256]uint64 {
+	var table [256]uint64
+	state := seed
+	for i := range table {
+		state += 0x9e3779b97f4a7c15
+		z := state
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		table[i] = z ^ (z >> 31)
+	}
+	return table
+}
+
+// next returns the next chunk, or io.EOF after the last one. The returned slice
+// is only valid until the following call.
+func (c *chunker) next() ([]byte, error) {
+	// Keep at least MaxSize bytes buffered so a cut point can always be found
+	if c.end-c.start < c.params.MaxSize && !c.eof {
+		copy(c.buf, c.buf[c.start:c.end])
+		c.end -= c.start
+		c.start = 0
+		for c.end < len(c.buf) && !c.eof {
+			n, err := c.r.Read(c.buf[c.end:])
+			c.end += n
+			if err == io.EOF {
+				c.eof = true
+			} else if err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if c.start == c.end {
+		return nil, io.EOF
+	}
+
+	data := c.buf[c.start:c.end]
+	n := c.cut(data)
+	c.start += n
+	return data[:n], nil
+}
+
+// cut returns the length of the first chunk of data.
+func (c *chunker) cut(data []byte) int {
+	n := len(data)
+	if n <= c.params.MinSize {
+		return n
+	}
+	if n > c.params.MaxSize {
+		n = c.params.MaxSize
+	}
+	normal := c.params.AvgSize
+	if normal > n {
+		normal = n
+	}
+
+	var fp uint64
+	i := c.params.MinSize
+	for ; i < normal; i++ {
+		fp = (fp << 1) + c.gear[data[i]]
+		if fp&c.maskS == 0 {
+			return i
+		}
+	}
+	for ; i < n; i++ {
+		fp = (fp << 1) + c.gear[data[i]]
+		if fp&c.maskL == 0 {
+			return i
+		}
+	}
+	return n
+}
@@ -0,0 +1,261 @@
+// Package internal provides the file comparison strategies of the sync engine.
+//
+// An incremental run decides per file whether the destination copy is current:
+//   - size-mtime: sizes match and the source is not newer (rsync's default)
+//   - size-mtime-ctime: additionally, the source's inode has not changed since
+//     the destination was written, which catches "touch -r" and tools that
+//     restore old timestamps
+//   - checksum: sizes match and the SHA-256 of both files is equal (rsync
+//     --checksum), which also catches silent corruption on the backup side
+//
+// The mode is chosen per profile (system backup, home backup, restore) in
+// ~/.config/migrate/compare.json and can be overridden for one run with --compare.
+package internal
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"syscall"
+)
+
+// Comparison modes
+const (
+	CompareSizeMtime      = "size-mtime"
+	CompareSizeMtimeCtime = "size-mtime-ctime"
+	CompareChecksum       = "checksum"
+)
+
+// Comparison profiles
+const (
+	CompareProfileSystem  = "system"
+	CompareProfileHome    = "home"
+	CompareProfileRestore = "restore"
+)
+
+var (
+	// compareMode is the strategy used by the operation in progress.
+	compareMode = CompareSizeMtime
+
+	// compareOverride replaces every profile's mode for this run (--compare).
+	compareOverride string
+
+	// filesContentRecopied counts files whose size and mtime matched but whose
+	// content did not, so only a checksum comparison found them.
+	filesContentRecopied int64
+)
+
+// compareConfig is the per-profile configuration in compare.json.
+type compareConfig struct {
+	Profiles map[string]string `json:"profiles"` // profile -> mode
+}
+
+// isCompareMode reports whether mode names a comparison strategy.
+func isCompareMode(mode string) bool {
+	switch mode {
+	case CompareSizeMtime, CompareSizeMtimeCtime, CompareChecksum:
+		return true
+	}
+	return false
+}
+
+// SetCompareMode overrides the comparison mode of every profile for this run (--compare).
+func SetCompareMode(mode string) error {
+	if !isCompareMode(mode) {
+		return fmt.Errorf("unknown comparison mode %q (use %s, %s or %s)", mode, CompareSizeMtime, CompareSizeMtimeCtime, CompareChecksum)
+	}
+	compareOverride = mode
+	return nil
+}
+
+// SaveProfileCompareMode stores the comparison mode of one profile, given as
+// "profile=mode" (--set-compare).
+func SaveProfileCompareMode(spec string) error {
+	profile, mode, ok := strings.Cut(spec, "=")
+	if !ok {
+		return fmt.Errorf("expected profile=mode, got %q", spec)
+	}
+	switch profile {
+	case CompareProfileSystem, CompareProfileHome, CompareProfileRestore:
+	default:
+		return fmt.Errorf("unknown profile %q (use %s, %s or %s)", profile, CompareProfileSystem, CompareProfileHome, CompareProfileRestore)
+	}
+	if !isCompareMode(mode) {
+		return fmt.Errorf("unknown comparison mode %q (use %s, %s or %s)", mode, CompareSizeMtime, CompareSizeMtimeCtime, CompareChecksum)
+	}
+
+	config, _ := loadCompareConfig()
+	config.Profiles[profile] = mode
+
+	configPath, err := getCompareConfigPath()
+	if err != nil {
+		return err
+	}
+	data, err := json.MarshalIndent(config, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to marshal config: %v", err)
+	}
+	return writeFileAtomically(configPath, data)
+}
+
+// getCompareConfigPath returns the path of the per-profile comparison settings.
+func getCompareConfigPath() (string, error) {
+	configDir, err := getConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(configDir, "compare.json"), nil
+}
+
+// loadCompareConfig reads compare.json. A missing or broken file yields an empty config.
+func loadCompareConfig() (*compareConfig, error) {
+	config := &compareConfig{Profiles: make(map[string]string)}
+
+	configPath, err := getCompareConfigPath()
+	if err != nil {
+		return config, err
+	}
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return config, err
+	}
+	if err := json.Unmarshal(data, config); err != nil {
+		return &compareConfig{Profiles: make(map[string]string)}, fmt.Errorf("failed to parse %s: %v", configPath, err)
+	}
+	if config.Profiles == nil {
+		config.Profiles = make(map[string]string)
+	}
+	return config, nil
+}
+
+// DescribeCompareProfiles lists the configured mode of every profile.
+func DescribeCompareProfiles() string {
+	config, _ := loadCompareConfig()
+	var s strings.Builder
+	for _, profile := range []string{CompareProfileSystem, CompareProfileHome, CompareProfileRestore} {
+		mode := config.Profiles[profile]
+		if !isCompareMode(mode) {
+			mode = CompareSizeMtime
+		}
+		s.WriteString(fmt.Sprintf("  %-8s %s\n", profile, mode))
+	}
+	return s.String()
+}
+
+// activateCompareMode selects the comparison mode for an operation of the given
+// profile and resets the content recopy counter.
+func activateCompareMode(profile string, logFile *os.File) {
+	mode := CompareSizeMtime
+	source := "default"
+	if config, err := loadCompareConfig(); err == nil && isCompareMode(config.Profiles[profile]) {
+		mode = config.Profiles[profile]
+		source = "profile " + profile
+	}
+	if compareOverride != "" {
+		mode = compareOverride
+		source = "--compare"
+	}
+
+	compareMode = mode
+	atomic.StoreInt64(&filesContentRecopied, 0)
+	if logFile != nil {
+		fmt.Fprintf(logFile, "Comparison mode: %s (%s)\n", mode, source)
+	}
+}
+
+// destinationMatches reports whether dstName in dst already holds the current
+// version of srcName in src.
+func destinationMatches(src Store, srcName string, srcInfo os.FileInfo, dst Store, dstName string, dstInfo os.FileInfo) bool {
+	if srcInfo.Size() != dstInfo.Size() {
+		return false
+	}
+
+	metadataMatch := !srcInfo.ModTime().After(dstInfo.ModTime())
+
+	switch compareMode {
+	case CompareSizeMtimeCtime:
+		if !metadataMatch {
+			return false
+		}
+		// The destination's ctime is when it was last written; a source changed after that is stale
+		srcStat, ok1 := srcInfo.Sys().(*syscall.Stat_t)
+		dstStat, ok2 := dstInfo.Sys().(*syscall.Stat_t)
+		if !ok1 || !ok2 {
+			return true
+		}
+		return srcStat.Ctim.Nano() <= dstStat.Ctim.Nano()
+
+	case CompareChecksum:
+		if srcInfo.Size() == 0 {
+			return true
+		}
+		srcHash, err := hashStoreFile(src, srcName)
+		if err != nil {
+			return false
+		}
+		dstHash, err := hashStoreFile(dst, dstName)
+		if err != nil {
+			return false
+		}
+		if bytes.Equal(srcHash, dstHash) {
+			return true
+		}
+		if metadataMatch {
+			atomic.AddInt64(&filesContentRecopied, 1)
+		}
+		return false
+	}
+
+	return metadataMatch
+}
+
+// hashFileContent returns the SHA-256 of a file. Unlike getFileSHA256 it has no
+// timeout, since large files are compared in full, and it stops on cancellation.
+func hashFileContent(path string) ([]byte, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return hashContent(f)
+}
+
+// hashContent returns the SHA-256 of everything r yields, stopping on cancellation.
+func hashContent(r io.Reader) ([]byte, error) {
+	hasher := sha256.New()
+	buffer := make([]byte, 1024*1024)
+	for {
+		if shouldCancelBackup() {
+			return nil, fmt.Errorf("operation canceled")
+		}
+		n, err := r.Read(buffer)
+		hasher.Write(buffer[:n])
+		if err == io.EOF {
+			return hasher.Sum(nil), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// contentRecopies returns how many files the last checksum comparison recopied
+// although their size and mtime matched.
+func contentRecopies() int64 {
+	return atomic.LoadInt64(&filesContentRecopied)
+}
+
+// logContentRecopies writes the checksum comparison result to the log.
+func logContentRecopies(logFile *os.File) {
+	if logFile == nil || compareMode != CompareChecksum {
+		return
+	}
+	fmt.Fprintf(logFile, "Checksum comparison: %s files recopied because only their content differed\n",
+		FormatNumber(atomic.LoadInt64(&filesContentRecopied)))
+}
@@ -0,0 +1,56 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestChecksumModeRecopiesSameSizeAndTime(t *testing.T) {
+	defer func(mode string) { compareMode = mode }(compareMode)
+	src, dst := t.TempDir(), t.TempDir()
+	writeTestFile(t, src, "docs/report.txt", "quarterly numbers")
+	resetBackupState()
+	if err := syncDirectoriesWithExclusions(src, dst, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Silent corruption on the backup side: same size, same mtime
+	backup := filepath.Join(dst, "docs/report.txt")
+	mtime := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	os.WriteFile(backup, []byte("quarterly numbexs"), 0644)
+	os.Chtimes(backup, mtime, mtime)
+	os.Chtimes(filepath.Join(src, "docs/report.txt"), mtime, mtime)
+
+	compareMode = CompareSizeMtime
+	resetBackupState()
+	if err := syncDirectoriesWithExclusions(src, dst, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(backup); string(data) != "quarterly numbexs" {
+		t.Fatalf("size-mtime mode rewrote a file with matching metadata: %q", data)
+	}
+
+	compareMode = CompareChecksum
+	resetBackupState()
+	filesContentRecopied = 0
+	if err := syncDirectoriesWithExclusions(src, dst, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if data, _ := os.ReadFile(backup); string(data) != "quarterly numbers" {
+		t.Fatalf("checksum mode left different content in place: %q", data)
+	}
+	if filesCopied != 1 || contentRecopies() != 1 {
+		t.Fatalf("copied %d, recopied for content %d; want 1 and 1", filesCopied, contentRecopies())
+	}
+
+	// Identical content is left alone
+	resetBackupState()
+	if err := syncDirectoriesWithExclusions(src, dst, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if filesCopied != 0 || filesSkipped != 1 {
+		t.Fatalf("second checksum run copied %d, skipped %d", filesCopied, filesSkipped)
+	}
+}
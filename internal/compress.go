@@ -0,0 +1,271 @@
+// Package internal provides zstd compression for the repository format.
+//
+// Each new chunk is compressed on its own, so restore and verify only need the
+// chunk itself. Compressed chunks are stored as "<id>.zst" next to where the
+// plain chunk would be; the id is always the SHA-256 of the uncompressed data,
+// so deduplication works the same with and without compression. Data that is
+// already compressed (by file type, or because the chunk looks random) is
+// stored as is rather than spending CPU on it.
+package internal
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	// compressedChunkSuffix marks a chunk file holding zstd data.
+	compressedChunkSuffix = ".zst"
+
+	// maxCompressionLevel is the highest zstd level accepted by --compress.
+	maxCompressionLevel = 19
+
+	// compressedEntropy is the Shannon entropy (bits per byte) above which a
+	// chunk is taken to be compressed or encrypted already.
+	compressedEntropy = 7.5
+
+	// minCompressionSaving is the fraction a chunk must shrink by to be stored compressed.
+	minCompressionSaving = 0.05
+
+	// minAssumedCompressionRatio bounds the saving a space check credits to
+	// compression: the estimate comes from a short sample walk, and a backup
+	// that turns out not to fit only fails once the drive is full.
+	minAssumedCompressionRatio = 0.8
+)
+
+// compressionLevel is the zstd level requested with --compress, or -1 to keep
+// the level the repository was created with (0 = no compression).
+var compressionLevel = -1
+
+// incompressibleExtensions are file types whose content is already compressed.
+var incompressibleExtensions = map[string]bool{
+	".7z": true, ".avif": true, ".br": true, ".bz2": true, ".deb": true, ".docx": true,
+	".epub": true, ".flac": true, ".gif": true, ".gz": true, ".heic": true, ".jar": true,
+	".jpeg": true, ".jpg": true, ".lz4": true, ".lzma": true, ".m4a": true, ".mkv": true,
+	".mov": true, ".mp3": true, ".mp4": true, ".odt": true, ".ogg": true, ".opus": true,
+	".png": true, ".rar": true, ".rpm": true, ".squashfs": true, ".tgz": true, ".webm": true,
+	".webp": true, ".whl": true, ".xlsx": true, ".xz": true, ".zip": true, ".zst": true,
+}
+
+var (
+	encodersMu sync.Mutex
+	encoders   = make(map[int]*zstd.Encoder)
+
+	decoderOnce sync.Once
+	decoder     *zstd.Decoder
+	decoderErr  error
+)
+
+// SetCompressionLevel selects the zstd level for repository backups (--compress).
+// Level 0 turns compression off for new chunks.
+func SetCompressionLevel(level int) error {
+	if level < 0 || level > maxCompressionLevel {
+		return fmt.Errorf("compression level must be between 0 (off) and %d", maxCompressionLevel)
+	}
+	compressionLevel = level
+	return nil
+}
+
+// CompressionRequested reports whether --compress asked for compression.
+func CompressionRequested() bool {
+	return compressionLevel > 0
+}
+
+// isCompressibleFile reports whether a file's type is worth compressing.
+func isCompressibleFile(path string) bool {
+	return !incompressibleExtensions[strings.ToLower(filepath.Ext(path))]
+}
+
+// looksCompressed reports whether data is close to random, judged from the
+// byte distribution of its first 64 KiB.
+func looksCompressed(data []byte) bool {
+	if len(data) > 64*1024 {
+		data = data[:64*1024]
+	}
+	if len(data) < 512 {
+		return false
+	}
+	var counts [256]int
+	for _, b := range data {
+		counts[b]++
+	}
+	entropy := 0.0
+	total := float64(len(data))
+	for _, count := range counts {
+		if count > 0 {
+			p := float64(count) / total
+			entropy -= p * math.Log2(p)
+		}
+	}
+	return entropy > compressedEntropy
+}
+
+// chunkEncoder returns the shared encoder for a zstd level. EncodeAll is safe
+// for concurrent use, so the copy workers share one encoder per level.
+func chunkEncoder(level int) (*zstd.Encoder, error) {
+	encodersMu.Lock()
+	defer encodersMu.Unlock()
+	if enc, ok := encoders[level]; ok {
+		return enc, nil
+	}
+	enc, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)), zstd.WithEncoderConcurrency(1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to create zstd encoder: %v", err)
+	}
+	encoders[level] = enc
+	return enc, nil
+}
+
+// compressChunk returns the zstd form of data, or nil if compressing it is not
+// worthwhile at this level.
+func compressChunk(data []byte, level int) ([]byte, error) {
+	if level <= 0 || looksCompressed(data) {
+		return nil, nil
+	}
+	enc, err := chunkEncoder(level)
+	if err != nil {
+		return nil, err
+	}
+	compressed := enc.EncodeAll(data, make([]byte, 0, len(data)/2))
+	if !worthCompressing(len(compressed), len(data)) {
+		return nil, nil
+	}
+	return compressed, nil
+}
+
+// worthCompressing reports whether compressing size bytes to compressed saves
+// at least minCompressionSaving.
+func worthCompressing(compressed, size int) bool {
+	return float64(compressed) <= float64(size)*(1-minCompressionSaving)
+}
+
+// decompressChunk returns the original data of a compressed chunk.
+func decompressChunk(data []byte) ([]byte, error) {
+	decoderOnce.Do(func() {
+		decoder, decoderErr = zstd.NewReader(nil, zstd.WithDecoderConcurrency(0))
+	})
+	if decoderErr != nil {
+		return nil, fmt.Errorf("failed to create zstd decoder: %v", decoderErr)
+	}
+	return decoder.DecodeAll(data, nil)
+}
+
+// estimateCompressionRatio samples files under root and returns the expected
+// stored/original size ratio at the given level (1 = no saving). The walk stays
+// on root's filesystem and gives up after a few seconds, so the estimate for a
+// whole system is based on whatever was reached by then.
+func estimateCompressionRatio(root string, excludePatterns []string, level int) float64 {
+	if level <= 0 {
+		return 1
+	}
+
+	const (
+		sampleBytes  = 128 * 1024       // Read from the start of each sampled file
+		sampleFirst  = 50               // Sample every one of the first files
+		sampleEvery  = 10               // Then one regular file in this many
+		maxSampled   = 32 * 1024 * 1024 // Total bytes compressed for the estimate
+		walkDeadline = 3 * time.Second
+	)
+
+	var originalTotal, storedTotal float64
+	var sampled int64
+	fileIndex := 0
+	buf := make([]byte, sampleBytes)
+	deadline := time.Now().Add(walkDeadline)
+
+	var rootDev uint64
+	if info, err := os.Lstat(root); err == nil {
+		if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+			rootDev = stat.Dev
+		}
+	}
+
+	filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if time.Now().After(deadline) || sampled >= maxSampled {
+			return filepath.SkipAll
+		}
+		if path != root && matchesAnyExclusion(root, path, excludePatterns) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() {
+			if info, err := d.Info(); err == nil {
+				if stat, ok := info.Sys().(*syscall.Stat_t); ok && stat.Dev != rootDev {
+					return filepath.SkipDir
+				}
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		fileIndex++
+		if fileIndex > sampleFirst && fileIndex%sampleEvery != 0 {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil || info.Size() == 0 {
+			return nil
+		}
+
+		// Weight each sample by its file's full size
+		size := float64(info.Size())
+		originalTotal += size
+		if !isCompressibleFile(path) {
+			storedTotal += size
+			return nil
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			storedTotal += size
+			return nil
+		}
+		n, _ := io.ReadFull(f, buf)
+		f.Close()
+		if n == 0 {
+			storedTotal += size
+			return nil
+		}
+		sampled += int64(n)
+		compressed, err := compressChunk(buf[:n], level)
+		if err != nil || compressed == nil {
+			storedTotal += size
+			return nil
+		}
+		storedTotal += size * float64(len(compressed)) / float64(n)
+		return nil
+	})
+
+	if originalTotal == 0 {
+		return 1
+	}
+	return storedTotal / originalTotal
+}
+
+// expectedCompressionRatio returns the stored/original size ratio to assume when
+// checking whether a new backup of root fits: 1 unless it is written to a
+// compressed repository or archive, and never below minAssumedCompressionRatio.
+func expectedCompressionRatio(root string, excludePatterns []string) float64 {
+	ratio := 1.0
+	switch backupFormat {
+	case BackupFormatRepository:
+		ratio = estimateCompressionRatio(root, excludePatterns, compressionLevel)
+	case BackupFormatArchive:
+		ratio = estimateCompressionRatio(root, excludePatterns, archiveCompressionLevel())
+	}
+	return math.Max(ratio, minAssumedCompressionRatio)
+}
@@ -0,0 +1,99 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// compressibleText is a few hundred KiB of repetitive configuration-like text.
+func compressibleText() []byte {
+	return []byte(strings.Repeat("[Section]\nkey=value\npath=/usr/share/migrate\n", 8*1024))
+}
+
+func TestLooksCompressed(t *testing.T) {
+	random := make([]byte, 128*1024)
+	rand.Read(random)
+
+	if !looksCompressed(random) {
+		t.Error("random data does not look compressed")
+	}
+	if looksCompressed(compressibleText()) {
+		t.Error("text looks compressed")
+	}
+	// Too short to judge: worth a try
+	if looksCompressed(random[:100]) {
+		t.Error("a short random sample looks compressed")
+	}
+}
+
+func TestCompressChunkRoundTrip(t *testing.T) {
+	text := compressibleText()
+	compressed, err := compressChunk(text, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if compressed == nil || len(compressed) >= len(text)/10 {
+		t.Fatalf("text compressed to %d of %d bytes", len(compressed), len(text))
+	}
+	restored, err := decompressChunk(compressed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(restored, text) {
+		t.Fatal("decompressed chunk differs from the original")
+	}
+
+	if compressed, _ := compressChunk(text, 0); compressed != nil {
+		t.Error("level 0 compressed a chunk")
+	}
+	random := make([]byte, 64*1024)
+	rand.Read(random)
+	if compressed, _ := compressChunk(random, 3); compressed != nil {
+		t.Error("random data was stored compressed")
+	}
+	if _, err := decompressChunk([]byte("not zstd at all")); err == nil {
+		t.Error("garbage decompressed without an error")
+	}
+}
+
+func TestMinCompressionSavingCutoff(t *testing.T) {
+	for _, c := range []struct {
+		compressed, size int
+		want             bool
+	}{
+		{950, 1000, true},   // Exactly the minimum saving
+		{951, 1000, false},  // Just short of it
+		{1000, 1000, false}, // No saving
+		{1200, 1000, false}, // Grew
+		{100, 1000, true},
+	} {
+		if got := worthCompressing(c.compressed, c.size); got != c.want {
+			t.Errorf("worthCompressing(%d, %d) = %v, want %v", c.compressed, c.size, got, c.want)
+		}
+	}
+}
+
+func TestSpaceCheckCapsCompressionEstimate(t *testing.T) {
+	root := t.TempDir()
+	for i := 0; i < 5; i++ {
+		os.WriteFile(filepath.Join(root, "config"+string(rune('a'+i))+".conf"), compressibleText(), 0644)
+	}
+	defer func(format string, level int) { backupFormat, compressionLevel = format, level }(backupFormat, compressionLevel)
+	backupFormat, compressionLevel = BackupFormatRepository, 3
+
+	if estimate := estimateCompressionRatio(root, nil, 3); estimate >= 0.1 {
+		t.Fatalf("sample estimate %.2f for repetitive text", estimate)
+	}
+	if got := expectedCompressionRatio(root, nil); got != minAssumedCompressionRatio {
+		t.Fatalf("space check assumes %.2f, want the cap %.2f", got, minAssumedCompressionRatio)
+	}
+
+	backupFormat = BackupFormatMirror
+	if got := expectedCompressionRatio(root, nil); got != 1 {
+		t.Fatalf("mirror backup assumes %.2f", got)
+	}
+}
@@ -0,0 +1,141 @@
+// Package internal provides kernel-accelerated file data copying.
+//
+// copyFileData tries the cheapest way to duplicate a file's contents first:
+//  1. FICLONE - a reflink on btrfs/XFS, sharing extents without copying data
+//  2. copy_file_range - an in-kernel copy, no round trip through userspace
+//  3. A buffered read/write loop, which works everywhere
+//
+// Which method each file used is counted so the run statistics can show it.
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"golang.org/x/sys/unix"
+)
+
+// Copy method counters, reset by resetBackupState
+var (
+	filesReflinked int64 // files cloned with FICLONE (no data copied)
+	filesCopyRange int64 // files copied in-kernel with copy_file_range
+	filesBuffered  int64 // files copied through a userspace buffer
+)
+
+// copyFileData copies the contents of src into the empty file dst.
+func copyFileData(dst, src *os.File, size int64) error {
+	// 1. Reflink: only possible within one filesystem that supports it
+	if err := unix.IoctlFileClone(int(dst.Fd()), int(src.Fd())); err == nil {
+		atomic.AddInt64(&filesReflinked, 1)
+		return nil
+	}
+
+	// 2. In-kernel copy: works across local filesystems on modern kernels
+	// (in small chunks while a bandwidth limit is active)
+	copied, err := copyFileRange(dst, src, size)
+	if err == nil {
+		atomic.AddInt64(&filesCopyRange, 1)
+		return nil
+	}
+	if copied == 0 && !errors.Is(err, errCopyRangeUnsupported) {
+		// A real I/O error (e.g. out of space) - the buffered copy would fail the same way
+		return err
+	}
+
+	// 3. Buffered copy, continuing from wherever copy_file_range stopped
+	if err := copyFileBuffered(dst, src, size); err != nil {
+		return err
+	}
+	atomic.AddInt64(&filesBuffered, 1)
+	return nil
+}
+
+// errCopyRangeUnsupported means copy_file_range cannot be used for this pair of files.
+var errCopyRangeUnsupported = errors.New("copy_file_range not supported")
+
+// copyFileRange copies up to size bytes with copy_file_range, using and advancing
+// both files' offsets. It returns the number of bytes copied.
+func copyFileRange(dst, src *os.File, size int64) (int64, error) {
+	var copied int64
+	for {
+		// Ask for the remaining size, but keep going until EOF in case the file grew
+		chunk := size - copied
+		if chunk < 1024*1024 {
+			chunk = 1024 * 1024
+		}
+		if chunk > 1<<30 {
+			chunk = 1 << 30
+		}
+		if bwLimiter.currentRate() > 0 {
+			chunk = throttleChunk
+			bwLimiter.wait(int(chunk))
+		}
+
+		n, err := unix.CopyFileRange(int(src.Fd()), nil, int(dst.Fd()), nil, int(chunk), 0)
+		if err != nil {
+			if err == unix.EINTR {
+				continue
+			}
+			if copied == 0 && (err == unix.EXDEV || err == unix.ENOSYS || err == unix.EOPNOTSUPP || err == unix.EINVAL || err == unix.EPERM) {
+				return 0, errCopyRangeUnsupported
+			}
+			return copied, err
+		}
+		if n == 0 {
+			// EOF. Some filesystems (procfs-like) report 0 without copying anything
+			if copied == 0 && size > 0 {
+				return 0, errCopyRangeUnsupported
+			}
+			return copied, nil
+		}
+		copied += int64(n)
+	}
+}
+
+// copyFileBuffered copies the rest of src into dst through a userspace buffer.
+func copyFileBuffered(dst, src *os.File, size int64) error {
+	// OPTIMIZED: Modern SSD/NVMe buffer sizes for maximum performance
+	bufSize := 256 * 1024    // 256KB default (4x faster than old 64KB)
+	if size > 10*1024*1024 { // Files >10MB get 2MB buffer
+		bufSize = 2 * 1024 * 1024
+	}
+	if size > 100*1024*1024 { // Files >100MB get 4MB buffer for NVMe
+		bufSize = 4 * 1024 * 1024
+	}
+
+	// Plain Reader/Writer wrappers keep io.CopyBuffer from using copy_file_range itself;
+	// throttledWriter applies the bandwidth limit, if any
+	buffer := make([]byte, bufSize)
+	_, err := io.CopyBuffer(throttledWriter{dst}, struct{ io.Reader }{src}, buffer)
+	return err
+}
+
+// copyMethodSummary describes how copied files were transferred, e.g.
+// "1,204 reflinked, 87 in-kernel, 3 buffered". Empty when nothing was copied.
+func copyMethodSummary() string {
+	var parts []string
+	if n := atomic.LoadInt64(&filesReflinked); n > 0 {
+		parts = append(parts, fmt.Sprintf("%s reflinked", FormatNumber(n)))
+	}
+	if n := atomic.LoadInt64(&filesCopyRange); n > 0 {
+		parts = append(parts, fmt.Sprintf("%s in-kernel", FormatNumber(n)))
+	}
+	if n := atomic.LoadInt64(&filesBuffered); n > 0 {
+		parts = append(parts, fmt.Sprintf("%s buffered", FormatNumber(n)))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// logCopyMethods writes the copy method statistics to the log.
+func logCopyMethods(logFile *os.File) {
+	if logFile == nil {
+		return
+	}
+	if summary := copyMethodSummary(); summary != "" {
+		fmt.Fprintf(logFile, "Copy methods: %s\n", summary)
+	}
+}
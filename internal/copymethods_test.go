@@ -0,0 +1,93 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+// copyThrough copies src to a new file with copyFileData and returns what it wrote.
+func copyThrough(t *testing.T, src *os.File, size int64) []byte {
+	t.Helper()
+	dstPath := filepath.Join(t.TempDir(), "copy")
+	dst, err := os.Create(dstPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	if err := copyFileData(dst, src, size); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(dstPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+func TestCopyFileDataMatchesSource(t *testing.T) {
+	resetBackupState()
+	content := make([]byte, 3*1024*1024+123) // Several copy_file_range chunks, odd tail
+	rand.Read(content)
+	srcPath := filepath.Join(t.TempDir(), "source")
+	os.WriteFile(srcPath, content, 0644)
+	src, err := os.Open(srcPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+
+	if got := copyThrough(t, src, int64(len(content))); !bytes.Equal(got, content) {
+		t.Fatalf("copy differs from the source (%d of %d bytes)", len(got), len(content))
+	}
+	methods := atomic.LoadInt64(&filesReflinked) + atomic.LoadInt64(&filesCopyRange) + atomic.LoadInt64(&filesBuffered)
+	if methods != 1 {
+		t.Fatalf("copy counted under %d methods", methods)
+	}
+}
+
+func TestCopyFileDataFallsBackToBufferedCopy(t *testing.T) {
+	resetBackupState()
+	// procfs files cannot be cloned or copied in-kernel and report a size of 0
+	want, err := os.ReadFile("/proc/self/cmdline")
+	if err != nil {
+		t.Skip("no /proc")
+	}
+	src, err := os.Open("/proc/self/cmdline")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+
+	if got := copyThrough(t, src, int64(len(want))); !bytes.Equal(got, want) {
+		t.Fatalf("buffered fallback wrote %q, want %q", got, want)
+	}
+	if atomic.LoadInt64(&filesBuffered) != 1 {
+		t.Fatalf("fallback not counted as buffered: %s", copyMethodSummary())
+	}
+}
+
+func TestBufferedCopyContinuesWhereCopyRangeStopped(t *testing.T) {
+	content := make([]byte, 300*1024)
+	rand.Read(content)
+	dir := t.TempDir()
+	os.WriteFile(filepath.Join(dir, "source"), content, 0644)
+	src, _ := os.Open(filepath.Join(dir, "source"))
+	defer src.Close()
+	dst, _ := os.Create(filepath.Join(dir, "copy"))
+	defer dst.Close()
+
+	// Both offsets already past what an interrupted in-kernel copy wrote
+	dst.Write(content[:100*1024])
+	src.Seek(100*1024, io.SeekStart)
+	if err := copyFileBuffered(dst, src, int64(len(content))); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(filepath.Join(dir, "copy")); !bytes.Equal(got, content) {
+		t.Fatalf("resumed copy differs from the source (%d of %d bytes)", len(got), len(content))
+	}
+}
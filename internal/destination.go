@@ -0,0 +1,348 @@
+// Package internal provides backup destinations other than removable drives.
+//
+// Besides the drives LoadDrives finds, a backup can go to any directory (a NAS
+// mount, a second internal disk, a folder on /srv), to a disk image file, which
+// is attached to a loop device and mounted like a drive, to an SFTP server or
+// to an S3-compatible bucket. All get the same metadata files as a drive, and
+// the same space checks where the destination can report its free space.
+package internal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"migrate/internal/drives"
+	"migrate/internal/screens"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// backupDestination is the destination given with --dest, used instead of the drive list.
+var backupDestination string
+
+// SetBackupDestination makes backups go to a directory, image file, sftp:// or s3:// URL (--dest).
+func SetBackupDestination(path string) error {
+	if isObjectStoreDestination(path) {
+		if _, err := parseObjectStoreTarget(path); err != nil {
+			return err
+		}
+		backupDestination = path
+		return nil
+	}
+	if isRemoteDestination(path) {
+		if _, err := parseRemoteTarget(path); err != nil {
+			return err
+		}
+		backupDestination = path
+		return nil
+	}
+	if !filepath.IsAbs(path) {
+		return fmt.Errorf("destination must be an absolute path, an sftp:// or an s3:// URL")
+	}
+	backupDestination = filepath.Clean(path)
+	return nil
+}
+
+// backupSourceFor returns the tree a backup operation copies.
+func backupSourceFor(operation string) string {
+	if operation == "system_backup" {
+		return "/"
+	}
+	return "/home/" + getCurrentUser()
+}
+
+// isWithin reports whether path is dir or lies below it.
+func isWithin(path, dir string) bool {
+	return path == dir || dir == "/" || strings.HasPrefix(path, dir+"/")
+}
+
+// nestedDestinationExclusions excludes the destination from the backup when it
+// lies inside the source, so a backup to /srv/backup does not copy itself.
+func nestedDestinationExclusions(source, destination string) []string {
+	if filepath.IsAbs(destination) && destination != source && isWithin(destination, source) {
+		return []string{destination}
+	}
+	return nil
+}
+
+// checkDestinationDirectory refuses directories a backup would damage. The
+// backup removes everything in its destination that is not in the source, so
+// the directory must be empty or already hold a Migrate backup, and must not
+// contain the source.
+func checkDestinationDirectory(dir, operation string) error {
+	source := backupSourceFor(operation)
+	if isWithin(source, dir) {
+		return fmt.Errorf("%s contains the backup source %s - choose a directory outside it", dir, source)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "BACKUP-INFO.txt")); err == nil {
+		return nil
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return fmt.Errorf("cannot read %s: %v", dir, err)
+	}
+	for _, entry := range entries {
+		if entry.Name() != "lost+found" {
+			return fmt.Errorf("%s holds other files, which the backup would delete - choose an empty directory or an existing backup", dir)
+		}
+	}
+	return nil
+}
+
+// prepareDestinationCmd readies a directory or image file for an operation and
+// reports it like a mounted drive. Backups get the same space checks as drives.
+func prepareDestinationCmd(path, operation string, homeFolders []HomeFolderInfo, selectedFolders map[string]bool, subfolderCache map[string][]HomeFolderInfo) tea.Cmd {
+	return func() tea.Msg {
+		forBackup := strings.Contains(operation, "backup")
+		if isObjectStoreDestination(path) {
+			return prepareObjectStoreDestination(path, operation)
+		}
+		if isRemoteDestination(path) {
+			return prepareRemoteDestination(path, operation, homeFolders, selectedFolders, subfolderCache)
+		}
+		if !filepath.IsAbs(path) {
+			return BackupDriveStatus{error: fmt.Errorf("❌ %s is not an absolute path", path)}
+		}
+		path = filepath.Clean(path)
+
+		info, err := os.Stat(path)
+		if os.IsNotExist(err) && forBackup {
+			if err := os.MkdirAll(path, 0755); err != nil {
+				return BackupDriveStatus{error: fmt.Errorf("❌ Cannot create %s: %v", path, err)}
+			}
+			info, err = os.Stat(path)
+		}
+		if err != nil {
+			return BackupDriveStatus{error: fmt.Errorf("❌ Cannot use %s: %v", path, err)}
+		}
+
+		status := BackupDriveStatus{drivePath: path, driveType: "directory", mountPoint: path}
+		hasBackup := false
+		switch {
+		case info.Mode().IsRegular():
+			// A disk image: attach and mount it, then treat its filesystem like a drive
+			mountPoint, device, err := drives.MountImageFile(path)
+			if err != nil {
+				return BackupDriveStatus{error: fmt.Errorf("❌ %v", err)}
+			}
+			rememberDriveMount(mountPoint, device)
+			status.driveType = "image"
+			status.mountPoint = mountPoint
+		case info.IsDir():
+			if forBackup {
+				if err := checkDestinationDirectory(path, operation); err != nil {
+					return BackupDriveStatus{error: fmt.Errorf("❌ Cannot back up to this directory\n\n%v", err)}
+				}
+				_, statErr := os.Stat(filepath.Join(path, "BACKUP-INFO.txt"))
+				hasBackup = statErr == nil
+			}
+		default:
+			return BackupDriveStatus{error: fmt.Errorf("❌ %s is not a directory or image file", path)}
+		}
+
+		capacity, err := drives.DestinationCapacity(status.mountPoint, hasBackup || status.driveType == "image")
+		if err != nil {
+			return BackupDriveStatus{error: err}
+		}
+		status.driveSize = drives.FormatDriveSize(capacity)
+
+		if forBackup {
+			switch operation {
+			case "system_backup":
+				err = checkBackupSpaceRequirements(status.driveSize)
+			case "home_backup":
+				err = CheckSelectiveHomeBackupSpaceRequirements(homeFolders, selectedFolders, subfolderCache, status.driveSize)
+			}
+			if err != nil {
+				if status.driveType == "image" {
+					unmountBackupDrive(status.mountPoint)
+				}
+				return BackupDriveStatus{error: err}
+			}
+		}
+		return status
+	}
+}
+
+// prepareRemoteDestination connects to an sftp:// destination and checks it
+// like a directory. Restores need the backup copied to a local disk first.
+func prepareRemoteDestination(destination, operation string, homeFolders []HomeFolderInfo, selectedFolders map[string]bool, subfolderCache map[string][]HomeFolderInfo) BackupDriveStatus {
+	forBackup := strings.Contains(operation, "backup")
+	if !forBackup && !strings.Contains(operation, "verify") {
+		return BackupDriveStatus{error: fmt.Errorf("❌ Restoring straight from an SFTP server is not supported\n\nCopy the contents of current/ and the BACKUP-* files from the server into one directory on a local disk, then restore from that path")}
+	}
+
+	store, err := openRemoteStore(destination, nil)
+	if err != nil {
+		return BackupDriveStatus{error: fmt.Errorf("❌ %v", err)}
+	}
+	defer store.Close()
+
+	_, statErr := store.Lstat("BACKUP-INFO.txt")
+	hasBackup := statErr == nil
+	if !forBackup && !hasBackup {
+		return BackupDriveStatus{error: fmt.Errorf("❌ No Migrate backup found at %s", destination)}
+	}
+	if forBackup && !hasBackup {
+		// Same rule as a local directory: only an empty directory becomes a new backup
+		entries, err := store.ReadDir("")
+		if err == nil && len(entries) > 0 {
+			return BackupDriveStatus{error: fmt.Errorf("❌ Cannot back up to this directory\n\n%s holds other files - choose an empty directory or an existing backup", destination)}
+		}
+		if err != nil {
+			if err := store.MkdirAll("", 0755); err != nil {
+				return BackupDriveStatus{error: fmt.Errorf("❌ Cannot create %s: %v", destination, err)}
+			}
+		}
+	}
+
+	status := BackupDriveStatus{drivePath: destination, driveType: "sftp", mountPoint: destination}
+	total, available, err := store.Space()
+	if err != nil {
+		// Without statvfs@openssh.com the space checks cannot run
+		status.driveSize = "unknown"
+		return status
+	}
+	// An existing backup is mostly rewritten in place, so the whole filesystem counts
+	capacity := available
+	if hasBackup {
+		capacity = total
+	}
+	status.driveSize = drives.FormatDriveSize(capacity)
+
+	if forBackup {
+		switch operation {
+		case "system_backup":
+			err = checkBackupSpaceRequirements(status.driveSize)
+		case "home_backup":
+			err = CheckSelectiveHomeBackupSpaceRequirements(homeFolders, selectedFolders, subfolderCache, status.driveSize)
+		}
+		if err != nil {
+			return BackupDriveStatus{error: err}
+		}
+	}
+	return status
+}
+
+// prepareObjectStoreDestination checks an s3:// destination. A bucket has no
+// capacity to check, so only access and the prefix's contents are.
+func prepareObjectStoreDestination(destination, operation string) BackupDriveStatus {
+	forBackup := strings.Contains(operation, "backup")
+	if !forBackup && !strings.Contains(operation, "verify") {
+		return BackupDriveStatus{error: fmt.Errorf("❌ Restoring straight from object storage is not supported\n\nDownload the BACKUP-* objects and migrate-archive/ into one directory on a local disk, then restore from that path")}
+	}
+
+	client, target, err := openObjectStore(destination, nil)
+	if err != nil {
+		return BackupDriveStatus{error: fmt.Errorf("❌ %v", err)}
+	}
+	objects, err := client.listObjects(target.key(""))
+	if err != nil {
+		return BackupDriveStatus{error: fmt.Errorf("❌ Cannot list %s: %v", destination, err)}
+	}
+	hasBackup := false
+	for _, object := range objects {
+		if object.Key == target.key("BACKUP-INFO.txt") {
+			hasBackup = true
+		}
+	}
+	if !forBackup && !hasBackup {
+		return BackupDriveStatus{error: fmt.Errorf("❌ No Migrate backup found at %s", destination)}
+	}
+	if forBackup && !hasBackup && len(objects) > 0 {
+		// Like a directory: a new backup only goes to an empty prefix
+		return BackupDriveStatus{error: fmt.Errorf("❌ Cannot back up to this location\n\n%s holds other objects - choose an empty prefix or an existing backup", destination)}
+	}
+	return BackupDriveStatus{drivePath: destination, driveType: "s3", mountPoint: destination, driveSize: "unknown"}
+}
+
+// destinationChoice is the drive list entry for entering a path.
+func destinationChoice(operation string) string {
+	if strings.Contains(operation, "backup") {
+		return "📂 Choose destination path"
+	}
+	return "📂 Choose backup path"
+}
+
+// startDestPathEntry asks for a destination directory or image file.
+func (m Model) startDestPathEntry() Model {
+	m.destPath = "/"
+	m.destError = ""
+	m.message = ""
+	m.screen = screens.ScreenDestPath
+	return m
+}
+
+// handleDestPathKey edits the destination path field.
+func (m Model) handleDestPathKey(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	switch msg.Type {
+	case tea.KeyEsc, tea.KeyCtrlC:
+		m.destPath = ""
+		m.destError = ""
+		m.screen = screens.ScreenDriveSelect
+		m.cursor = 0
+		return m, LoadDrives()
+
+	case tea.KeyEnter:
+		path := strings.TrimSpace(m.destPath)
+		if !filepath.IsAbs(path) && !isRemoteDestination(path) && !isObjectStoreDestination(path) {
+			m.destError = "Please enter an absolute path, an sftp:// or an s3:// URL"
+			return m, nil
+		}
+		// The result arrives as a BackupDriveStatus, like a mounted drive
+		m.destError = ""
+		m.screen = screens.ScreenDriveSelect
+		m.message = "🔧 Preparing destination and checking space..."
+		return m, prepareDestinationCmd(path, m.operation, m.homeFolders, m.selectedFolders, m.subfolderCache)
+
+	case tea.KeyBackspace:
+		if m.destPath != "" {
+			_, size := utf8.DecodeLastRuneInString(m.destPath)
+			m.destPath = m.destPath[:len(m.destPath)-size]
+		}
+		return m, nil
+
+	case tea.KeyCtrlU:
+		m.destPath = ""
+		return m, nil
+
+	case tea.KeySpace:
+		m.destPath += " "
+		return m, nil
+
+	case tea.KeyRunes:
+		m.destPath += string(msg.Runes)
+		return m, nil
+	}
+	return m, nil
+}
+
+// renderDestPath renders the destination path prompt.
+func (m Model) renderDestPath() string {
+	var s strings.Builder
+
+	ascii := asciiStyle.Render(MigrateASCII)
+	s.WriteString(ascii + "\n")
+	s.WriteString(titleStyle.Render(destinationChoice(m.operation)) + "\n\n")
+
+	prompt := "Enter the directory that holds the backup, or a disk image file (.img).\nBackups on an SFTP server (sftp://user@host/path) or in a bucket\n(s3://bucket/prefix) can be verified here."
+	if strings.Contains(m.operation, "backup") {
+		prompt = "Enter a directory (a NAS mount, a second disk, a folder on /srv),\na disk image file (.img), an SFTP server (sftp://user@host/path)\nor a bucket (s3://bucket/prefix) to back up to.\n\nA directory must be empty or hold an earlier backup: files not in\nthe backup source are removed from it. Missing directories are created."
+	}
+	s.WriteString(infoStyle.Render(prompt) + "\n\n")
+
+	s.WriteString(selectedMenuItemStyle.Render("📂 "+m.destPath+"▏") + "\n")
+
+	if m.destError != "" {
+		s.WriteString("\n" + warningStyle.Render(m.destError) + "\n")
+	}
+
+	help := helpStyle.Render("enter: use this path • ctrl+u: clear • esc: back to drives")
+	s.WriteString("\n" + help)
+
+	content := borderStyle.Width(safeRenderWidth(m.width)).Render(s.String())
+	return safeCenterContent(m.width, m.height, content)
+}
@@ -4,7 +4,8 @@ package internal
 
 import (
 	"fmt"
-	"os"
+	"path/filepath"
+	"sync"
 
 	"migrate/internal/drives"
 
@@ -31,19 +32,14 @@ type BackupDriveStatus struct {
 	error      error
 }
 
+// PasswordRequiredMsg asks for the passphrase of a locked LUKS drive.
 type PasswordRequiredMsg struct {
+	drive     DriveInfo
 	drivePath string
 	driveSize string
 	driveType string
 }
 
-type passwordInteractionMsg struct {
-	drivePath  string
-	driveSize  string
-	driveType  string
-	originalOp string
-}
-
 type HomeFoldersDiscovered struct {
 	folders []HomeFolderInfo
 	error   error
@@ -73,20 +69,37 @@ func unmountBackupDrive(mountPoint string) error {
 	return drives.UnmountBackupDrive(mountPoint)
 }
 
+func isMountPoint(dir string) bool {
+	return drives.IsMountPoint(dir)
+}
+
 // Space validation functions - delegate to optimized modules
 func checkBackupSpaceRequirements(externalDriveSize string) error {
-	return drives.ValidateBackupSpace(externalDriveSize)
+	return drives.ValidateBackupSpace(externalDriveSize, expectedCompressionRatio("/", GetSystemBackupExclusions()))
 }
 
 func CheckSelectiveHomeBackupSpaceRequirements(homeFolders []HomeFolderInfo, selectedFolders map[string]bool, subfolderCache map[string][]HomeFolderInfo, externalDriveSize string) error {
-	return drives.ValidateSelectiveBackupSpace(homeFolders, selectedFolders, subfolderCache, externalDriveSize)
+	ratio := expectedCompressionRatio("/home/"+getCurrentUser(), GetHomeBackupExclusions())
+	return drives.ValidateSelectiveBackupSpace(homeFolders, selectedFolders, subfolderCache, externalDriveSize, ratio)
 }
 
 func CheckHomeBackupSpaceRequirements(externalDriveSize string) error {
-	return drives.ValidateHomeBackupSpace(externalDriveSize)
+	return drives.ValidateHomeBackupSpace(externalDriveSize, expectedCompressionRatio("/home/"+getCurrentUser(), GetHomeBackupExclusions()))
 }
 
 func checkRestoreSpaceRequirements(externalDriveSize string, externalMountPoint string) error {
+	// A compressed repository expands on restore: check its snapshot's logical size
+	if isRepositoryBackup(externalMountPoint) {
+		if _, snapshot, err := loadRepositorySnapshot(externalMountPoint, ""); err == nil {
+			return drives.ValidateRestoreSize(snapshot.Size)
+		}
+	}
+	// Likewise an archive: check the logical size of its files
+	if isArchiveBackup(externalMountPoint) {
+		if archive, err := loadArchiveInfo(externalMountPoint); err == nil {
+			return drives.ValidateRestoreSize(archive.Size)
+		}
+	}
 	return drives.ValidateRestoreSpace(externalDriveSize, externalMountPoint)
 }
 
@@ -129,23 +142,11 @@ func DiscoverRestoreFoldersCmd(backupPath string) tea.Cmd {
 // Mount operation functions - delegate to optimized modules with compatibility layer
 func mountSelectedDrive(drive DriveInfo) tea.Cmd {
 	return func() tea.Msg {
-		// Check if this is a locked LUKS drive
-		if drive.Encrypted {
-			// Check if it's already unlocked by looking for the mapper device
-			mapperName := "luks-" + drive.UUID
-			mapperPath := "/dev/mapper/" + mapperName
-
-			if _, err := os.Stat(mapperPath); os.IsNotExist(err) {
-				// LUKS drive is locked - show helpful error
-				return DriveOperation{
-					message: fmt.Sprintf("🔒 Drive is encrypted and locked. Please unlock it first using:\n\nsudo cryptsetup open %s %s", drive.Device, mapperName),
-					success: false,
-				}
-			}
-		}
-
 		// Try to mount the drive
-		mountPoint, err := drives.MountRegularDrive(drive)
+		mountPoint, locked, err := mountDrive(drive)
+		if locked != nil {
+			return *locked
+		}
 		if err != nil {
 			return DriveOperation{
 				message: fmt.Sprintf("❌ Failed to mount drive: %v", err),
@@ -160,6 +161,58 @@ func mountSelectedDrive(drive DriveInfo) tea.Cmd {
 	}
 }
 
+// driveMounts remembers the block device each drive mount point was confirmed on.
+var (
+	driveMounts   = make(map[string]string)
+	driveMountsMu sync.Mutex
+)
+
+// rememberDriveMount records that mountPoint holds the filesystem of device.
+func rememberDriveMount(mountPoint, device string) {
+	driveMountsMu.Lock()
+	defer driveMountsMu.Unlock()
+	driveMounts[filepath.Clean(mountPoint)] = device
+}
+
+// driveMountDevice returns the block device mountPoint was mounted from, or ""
+// if it is not a drive Migrate mounted.
+func driveMountDevice(mountPoint string) string {
+	driveMountsMu.Lock()
+	defer driveMountsMu.Unlock()
+	return driveMounts[filepath.Clean(mountPoint)]
+}
+
+// mountDrive mounts drive, opening a LUKS container with the --luks-key-file first.
+// A locked container without a usable key file yields a PasswordRequiredMsg.
+func mountDrive(drive DriveInfo) (string, *PasswordRequiredMsg, error) {
+	if !drive.Encrypted {
+		mountPoint, err := drives.MountRegularDrive(drive)
+		if err == nil {
+			rememberDriveMount(mountPoint, drives.BlockDeviceOf(drive))
+		}
+		return mountPoint, nil, err
+	}
+
+	if drives.IsLUKSLocked(drive) && luksKeyFile != "" {
+		if err := drives.UnlockLUKSWithKeyFile(drive, luksKeyFile); err != nil && err != drives.ErrWrongPassphrase {
+			return "", nil, err
+		}
+	}
+	if drives.IsLUKSLocked(drive) {
+		return "", &PasswordRequiredMsg{
+			drive:     drive,
+			drivePath: drive.Device,
+			driveSize: drive.Size,
+			driveType: "LUKS",
+		}, nil
+	}
+	mountPoint, err := drives.MountLUKSDrive(drive)
+	if err == nil {
+		rememberDriveMount(mountPoint, drives.BlockDeviceOf(drive))
+	}
+	return mountPoint, nil, err
+}
+
 func mountDriveForBackup(drive DriveInfo) tea.Cmd {
 	return mountDriveForOperation(drive, "system_backup")
 }
@@ -196,22 +249,11 @@ func mountDriveForOperation(drive DriveInfo, operationType string) tea.Cmd {
 			return BackupDriveStatus{error: err}
 		}
 
-		// Handle encrypted drives
-		if drive.Encrypted {
-			mapperName := "luks-" + drive.UUID
-			mapperPath := "/dev/mapper/" + mapperName
-
-			if _, err := os.Stat(mapperPath); os.IsNotExist(err) {
-				return PasswordRequiredMsg{
-					drivePath: drive.Device,
-					driveSize: drive.Size,
-					driveType: "LUKS",
-				}
-			}
+		// Mount the drive, unlocking an encrypted one
+		mountPoint, locked, err := mountDrive(drive)
+		if locked != nil {
+			return *locked
 		}
-
-		// Mount the drive
-		mountPoint, err := drives.MountRegularDrive(drive)
 		if err != nil {
 			return BackupDriveStatus{error: err}
 		}
@@ -228,22 +270,11 @@ func mountDriveForOperation(drive DriveInfo, operationType string) tea.Cmd {
 
 func mountDriveForRestore(drive DriveInfo) tea.Cmd {
 	return func() tea.Msg {
-		// Handle encrypted drives
-		if drive.Encrypted {
-			mapperName := "luks-" + drive.UUID
-			mapperPath := "/dev/mapper/" + mapperName
-
-			if _, err := os.Stat(mapperPath); os.IsNotExist(err) {
-				return PasswordRequiredMsg{
-					drivePath: drive.Device,
-					driveSize: drive.Size,
-					driveType: "LUKS",
-				}
-			}
+		// Mount the drive, unlocking an encrypted one
+		mountPoint, locked, err := mountDrive(drive)
+		if locked != nil {
+			return *locked
 		}
-
-		// Mount the drive
-		mountPoint, err := drives.MountRegularDrive(drive)
 		if err != nil {
 			return BackupDriveStatus{error: err}
 		}
@@ -262,17 +293,6 @@ func mountDriveForVerification(drive DriveInfo) tea.Cmd {
 	return mountDriveForRestore(drive) // Same logic as restore
 }
 
-func handlePasswordInput(msg PasswordRequiredMsg, originalOp string) tea.Cmd {
-	return func() tea.Msg {
-		return passwordInteractionMsg{
-			drivePath:  msg.drivePath,
-			driveSize:  msg.driveSize,
-			driveType:  msg.driveType,
-			originalOp: originalOp,
-		}
-	}
-}
-
 func PerformBackupUnmount() tea.Cmd {
 	return func() tea.Msg {
 		mountPoint, mounted := checkAnyBackupMounted()
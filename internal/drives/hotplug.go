@@ -0,0 +1,199 @@
+// Package drives provides drive detection, mounting, and management functionality.
+// This module watches for block devices being attached and detached.
+//
+// The kernel announces block devices over a netlink uevent socket. Where that
+// socket cannot be opened, /sys/block is polled instead. Either way a burst of
+// events (a disk and its partitions, a LUKS mapping) is given a moment to settle,
+// so udev has recorded the new filesystems, and then the disks are read again and
+// sent as a single DrivesChanged message.
+package drives
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"golang.org/x/sys/unix"
+)
+
+// hotplugPollInterval is how often /sys/block is read when netlink is unavailable.
+const hotplugPollInterval = 2 * time.Second
+
+// hotplugSettle is how long a burst of block device events is given to finish.
+var hotplugSettle = 1500 * time.Millisecond
+
+// DrivesChanged is a Bubble Tea message sent after block devices were attached or detached.
+type DrivesChanged struct {
+	Disks  []BlockDisk // Every disk now attached
+	Drives []DriveInfo // The external drives among them, as LoadDrives reports them
+}
+
+var (
+	hotplugOnce    sync.Once
+	hotplugChanges chan DrivesChanged
+)
+
+// WatchDrives returns a command that waits for the next change of the attached
+// block devices. The watcher starts with the first call; return WatchDrives again
+// after each DrivesChanged to keep receiving them.
+func WatchDrives() tea.Cmd {
+	hotplugOnce.Do(func() {
+		hotplugChanges = make(chan DrivesChanged, 1)
+		go watchBlockDevices(NewDiscovery("/"), hotplugChanges)
+	})
+	return func() tea.Msg {
+		return <-hotplugChanges
+	}
+}
+
+// ScanDrives reads the attached disks now, in the form WatchDrives sends them.
+func ScanDrives() (DrivesChanged, error) {
+	disks, err := NewDiscovery("/").Disks()
+	if err != nil {
+		return DrivesChanged{}, err
+	}
+	return DrivesChanged{Disks: disks, Drives: externalDrives(disks)}, nil
+}
+
+// watchBlockDevices sends the disks to changes each time block devices come or go.
+func watchBlockDevices(discovery *Discovery, changes chan DrivesChanged) {
+	trigger, notify := newHotplugTrigger()
+	if fd, err := openUeventSocket(); err == nil {
+		go readUevents(fd, notify)
+	} else {
+		go pollBlockDevices(discovery, notify)
+	}
+	sendSettledChanges(discovery, trigger, changes)
+}
+
+// newHotplugTrigger returns a channel holding at most one pending rescan, and the
+// function that requests one without blocking.
+func newHotplugTrigger() (chan struct{}, func()) {
+	trigger := make(chan struct{}, 1)
+	return trigger, func() {
+		select {
+		case trigger <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// sendSettledChanges reads the disks once per burst of triggers and sends them to
+// changes. Only the latest state is kept when nobody is receiving.
+func sendSettledChanges(discovery *Discovery, trigger chan struct{}, changes chan DrivesChanged) {
+	for range trigger {
+		// Let the rest of the burst arrive, then read the disks once
+		time.Sleep(hotplugSettle)
+		select {
+		case <-trigger:
+		default:
+		}
+
+		disks, err := discovery.Disks()
+		if err != nil {
+			continue
+		}
+		change := DrivesChanged{Disks: disks, Drives: externalDrives(disks)}
+		select {
+		case <-changes:
+		default:
+		}
+		changes <- change
+	}
+}
+
+// openUeventSocket subscribes to the kernel's uevent broadcasts.
+func openUeventSocket() (int, error) {
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_DGRAM|unix.SOCK_CLOEXEC, unix.NETLINK_KOBJECT_UEVENT)
+	if err != nil {
+		return -1, err
+	}
+	addr := &unix.SockaddrNetlink{Family: unix.AF_NETLINK, Pid: 0, Groups: 1}
+	if err := unix.Bind(fd, addr); err != nil {
+		unix.Close(fd)
+		return -1, err
+	}
+	return fd, nil
+}
+
+// readUevents calls notify for every uevent of a block device worth a rescan.
+func readUevents(fd int, notify func()) {
+	defer unix.Close(fd)
+	buf := make([]byte, 64*1024)
+	for {
+		n, _, err := unix.Recvfrom(fd, buf, 0)
+		if err != nil {
+			if err == unix.EINTR || err == unix.ENOBUFS {
+				// Interrupted, or events were dropped: rescan to be safe
+				notify()
+				continue
+			}
+			return
+		}
+		if event := parseUevent(buf[:n]); event["SUBSYSTEM"] == "block" {
+			if !hasAnyPrefix(event["DEVNAME"], []string{"loop", "ram", "zram"}) {
+				notify()
+			}
+		}
+	}
+}
+
+// parseUevent reads a kernel uevent: "action@devpath" followed by NUL-separated
+// KEY=VALUE pairs.
+func parseUevent(msg []byte) map[string]string {
+	event := make(map[string]string)
+	for _, field := range bytes.Split(msg, []byte{0}) {
+		if key, value, ok := strings.Cut(string(field), "="); ok {
+			event[key] = value
+		}
+	}
+	return event
+}
+
+// pollBlockDevices calls notify whenever the set of block devices, their
+// partitions or their sizes (media in a card reader) change.
+func pollBlockDevices(discovery *Discovery, notify func()) {
+	last := blockDeviceSignature(discovery)
+	for range time.Tick(hotplugPollInterval) {
+		if current := blockDeviceSignature(discovery); current != last {
+			last = current
+			notify()
+		}
+	}
+}
+
+// blockDeviceSignature summarizes /sys/block: every device with its size and partitions.
+func blockDeviceSignature(discovery *Discovery) string {
+	entries, err := os.ReadDir(discovery.path("sys", "block"))
+	if err != nil {
+		return ""
+	}
+	var parts []string
+	for _, entry := range entries {
+		dir := discovery.path("sys", "block", entry.Name())
+		parts = append(parts, entry.Name()+"="+readAttr(filepath.Join(dir, "size")))
+		children, _ := os.ReadDir(dir)
+		for _, child := range children {
+			if _, err := os.Stat(filepath.Join(dir, child.Name(), "partition")); err == nil {
+				parts = append(parts, child.Name())
+			}
+		}
+	}
+	sort.Strings(parts)
+	return strings.Join(parts, " ")
+}
+
+// DiskPresent reports whether a disk named name is among disks.
+func DiskPresent(disks []BlockDisk, name string) bool {
+	for _, disk := range disks {
+		if disk.Name == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,56 @@
+package drives
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHotplugBurstSendsOneChange(t *testing.T) {
+	defer func(settle time.Duration) { hotplugSettle = settle }(hotplugSettle)
+	hotplugSettle = 50 * time.Millisecond
+
+	root := newFakeSystem(t)
+	trigger, notify := newHotplugTrigger()
+	defer close(trigger)
+	changes := make(chan DrivesChanged, 1)
+	go sendSettledChanges(NewDiscovery(root), trigger, changes)
+
+	// A disk and its partitions arrive as a burst of events
+	for i := 0; i < 10; i++ {
+		notify()
+		time.Sleep(2 * time.Millisecond)
+	}
+	select {
+	case change := <-changes:
+		if !DiskPresent(change.Disks, "sdb") || len(change.Drives) != 3 {
+			t.Fatalf("first change: %d disks, %d drives", len(change.Disks), len(change.Drives))
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no change sent after the burst")
+	}
+	select {
+	case <-changes:
+		t.Fatal("one burst sent more than one change")
+	case <-time.After(4 * hotplugSettle):
+	}
+
+	// Two changes nobody receives in between: only the latest is kept
+	notify()
+	time.Sleep(4 * hotplugSettle)
+	os.Remove(filepath.Join(root, "sys", "block", "sdb"))
+	notify()
+	time.Sleep(4 * hotplugSettle)
+	select {
+	case change := <-changes:
+		if DiskPresent(change.Disks, "sdb") {
+			t.Fatal("stale change kept instead of the latest")
+		}
+	default:
+		t.Fatal("no change pending")
+	}
+	if len(changes) != 0 {
+		t.Fatal("more than one change pending")
+	}
+}
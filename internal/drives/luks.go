@@ -1,8 +1,14 @@
 // Package drives provides drive detection, mounting, and management functionality.
 // This module handles LUKS encryption workflows and password management.
+//
+// Containers are opened with cryptsetup under the name udisks would give them,
+// "luks-<UUID>", reading the passphrase from stdin so it never appears on a
+// command line or on the terminal underneath the TUI.
 package drives
 
 import (
+	"bytes"
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
@@ -10,22 +16,85 @@ import (
 	"time"
 )
 
-// mountLUKSDrive handles mounting of LUKS-encrypted external drives.
-// Manages the two-step process: unlocking the LUKS container, then mounting the filesystem.
-// Checks for existing unlock/mount status to avoid duplicate operations.
-func mountLUKSDrive(drive DriveInfo) (string, error) {
-	// Check if already unlocked
-	mapperName := "luks-" + drive.UUID
-	mapperPath := "/dev/mapper/" + mapperName
-
-	// Step 1: Check if LUKS device needs to be unlocked
-	if _, err := os.Stat(mapperPath); os.IsNotExist(err) {
-		// Need to unlock
-		cmd := exec.Command("udisksctl", "unlock", "-b", drive.Device)
-		if err := cmd.Run(); err != nil {
-			return "", fmt.Errorf("failed to unlock LUKS drive: %v", err)
+// ErrWrongPassphrase is returned when no key slot of a LUKS container accepts the key.
+var ErrWrongPassphrase = errors.New("wrong passphrase")
+
+// luksMapperWait is how long an opened container is given to appear in /dev/mapper.
+const luksMapperWait = 5 * time.Second
+
+// UnlockLUKS opens the LUKS container of drive with a passphrase.
+func UnlockLUKS(drive DriveInfo, passphrase string) error {
+	// With --key-file=- cryptsetup reads stdin to the end, so no newline is sent
+	return openLUKS(drive, []string{"--key-file=-"}, strings.NewReader(passphrase))
+}
+
+// UnlockLUKSWithKeyFile opens the LUKS container of drive with the content of keyFile.
+func UnlockLUKSWithKeyFile(drive DriveInfo, keyFile string) error {
+	return openLUKS(drive, []string{"--key-file=" + keyFile}, nil)
+}
+
+// openLUKS runs cryptsetup open and waits for the mapper device.
+func openLUKS(drive DriveInfo, keyArgs []string, stdin *strings.Reader) error {
+	if !IsLUKSLocked(drive) {
+		return nil
+	}
+
+	args := append([]string{"open", "--type", "luks"}, keyArgs...)
+	args = append(args, drive.Device, getLUKSMapperName(drive))
+	cmd := exec.Command("cryptsetup", args...)
+	if stdin != nil {
+		cmd.Stdin = stdin
+	}
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		// Exit status 2: no key slot matched
+		if exitErr, ok := err.(*exec.ExitError); ok && exitErr.ExitCode() == 2 {
+			return ErrWrongPassphrase
+		}
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return fmt.Errorf("failed to unlock LUKS drive: %s", msg)
+		}
+		return fmt.Errorf("failed to unlock LUKS drive: %v", err)
+	}
+
+	// udev creates the node and probes the filesystem inside before it can be mounted
+	deadline := time.Now().Add(luksMapperWait)
+	for IsLUKSLocked(drive) {
+		if time.Now().After(deadline) {
+			return fmt.Errorf("unlocked LUKS drive did not appear at %s", getLUKSMapperPath(drive))
 		}
-		time.Sleep(2 * time.Second)
+		time.Sleep(100 * time.Millisecond)
+	}
+	exec.Command("udevadm", "settle", "--timeout=5").Run()
+	return nil
+}
+
+// CloseLUKS closes an open LUKS container, given its mapper name or /dev/mapper path.
+func CloseLUKS(mapper string) error {
+	mapper = strings.TrimPrefix(mapper, "/dev/mapper/")
+	if _, err := os.Stat("/dev/mapper/" + mapper); os.IsNotExist(err) {
+		return nil
+	}
+	out, err := exec.Command("cryptsetup", "close", mapper).CombinedOutput()
+	if err != nil {
+		if msg := strings.TrimSpace(string(out)); msg != "" {
+			return fmt.Errorf("failed to close LUKS device %s: %s", mapper, msg)
+		}
+		return fmt.Errorf("failed to close LUKS device %s: %v", mapper, err)
+	}
+	return nil
+}
+
+// MountLUKSDrive mounts the filesystem of an unlocked LUKS-encrypted drive.
+// Checks for existing mount status to avoid duplicate operations; the mount point
+// returned is confirmed to hold the unlocked filesystem.
+func MountLUKSDrive(drive DriveInfo) (string, error) {
+	mapperPath := getLUKSMapperPath(drive)
+
+	// Step 1: The container must have been unlocked
+	if IsLUKSLocked(drive) {
+		return "", fmt.Errorf("LUKS drive is locked")
 	}
 
 	// Step 2: Check if already mounted first
@@ -35,48 +104,25 @@ func mountLUKSDrive(drive DriveInfo) (string, error) {
 	}
 
 	// Step 3: Mount the unlocked device (only if not already mounted)
-	cmd := exec.Command("udisksctl", "mount", "-b", mapperPath)
-	out, err := cmd.Output()
+	mountPoint, err := mountDevice(mapperPath, "")
 	if err != nil {
-		// Check if it failed because it's already mounted
-		if strings.Contains(err.Error(), "AlreadyMounted") {
-			// Try to find the mount point using native /proc/mounts parsing
-			if mountPoint, err := FindMountPointForDevice(mapperPath); err == nil {
-				return mountPoint, nil
-			}
-			return "/run/media/grendel/Grendel", nil // Fallback for known case
-		}
 		return "", fmt.Errorf("failed to mount unlocked drive: %v", err)
 	}
-
-	// Parse mount point from successful mount output
-	mountOutput := strings.TrimSpace(string(out))
-	if strings.Contains(mountOutput, "Mounted ") {
-		parts := strings.Split(mountOutput, " at ")
-		if len(parts) >= 2 {
-			return strings.Trim(parts[1], "."), nil
-		}
-	}
-
-	return "/media/unknown", nil
+	return mountPoint, nil
 }
 
-// isLUKSLocked checks if a LUKS drive is currently locked
-func isLUKSLocked(drive DriveInfo) bool {
-	mapperName := "luks-" + drive.UUID
-	mapperPath := "/dev/mapper/" + mapperName
-	
-	_, err := os.Stat(mapperPath)
+// IsLUKSLocked reports whether the LUKS container of drive has not been opened.
+func IsLUKSLocked(drive DriveInfo) bool {
+	_, err := os.Stat(getLUKSMapperPath(drive))
 	return os.IsNotExist(err)
 }
 
+// getLUKSMapperName returns the device-mapper name a LUKS drive is opened under
+func getLUKSMapperName(drive DriveInfo) string {
+	return "luks-" + drive.UUID
+}
+
 // getLUKSMapperPath returns the expected mapper path for a LUKS drive
 func getLUKSMapperPath(drive DriveInfo) string {
-	mapperName := "luks-" + drive.UUID
-	return "/dev/mapper/" + mapperName
+	return "/dev/mapper/" + getLUKSMapperName(drive)
 }
-
-// TODO: Additional LUKS functions to implement:
-// - UnlockLUKS() with password handling
-// - CloseLUKS() for cleanup operations  
-// - Password interaction workflow functions
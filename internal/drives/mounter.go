@@ -10,6 +10,8 @@ import (
 	"path/filepath"
 	"strings"
 	"syscall"
+
+	"golang.org/x/sys/unix"
 )
 
 // CheckAnyBackupMounted scans for mounted external drives using pure Go (no external commands).
@@ -56,37 +58,212 @@ func UnmountBackupDrive(mountPoint string) error {
 	if err := cmd.Run(); err != nil {
 		return fmt.Errorf("failed to unmount: %v", err)
 	}
+	if strings.HasPrefix(mountPoint, migrateMountRoot+"/") {
+		os.Remove(mountPoint)
+	}
 
 	// Close LUKS device if it's a mapper device
-	if strings.Contains(device, "mapper") {
-		mapperName := filepath.Base(device)
-		cmd = exec.Command("sudo", "cryptsetup", "close", mapperName)
+	if strings.HasPrefix(device, "/dev/mapper/") {
+		if err := CloseLUKS(device); err != nil {
+			return err
+		}
+	}
+
+	// Detach the loop device of a mounted image file
+	if loop := loopDeviceOf(device); loop != "" {
+		cmd = exec.Command("udisksctl", "loop-delete", "--no-user-interaction", "-b", loop)
 		if err := cmd.Run(); err != nil {
-			return fmt.Errorf("failed to close LUKS device: %v", err)
+			return fmt.Errorf("failed to detach image: %v", err)
 		}
 	}
 
 	return nil
 }
 
-// FindMountPointForDevice replaces findmnt with native /proc/mounts parsing
-// Returns the mount point for a given device path
+// IsMountPoint reports whether dir is the root of a mounted filesystem.
+func IsMountPoint(dir string) bool {
+	dir = filepath.Clean(dir)
+	if dir == "/" {
+		return true
+	}
+	var self, parent syscall.Stat_t
+	if syscall.Stat(dir, &self) != nil || syscall.Stat(filepath.Dir(dir), &parent) != nil {
+		return false
+	}
+	return self.Dev != parent.Dev
+}
+
+// MountImageFile attaches a disk image to a loop device with udisksctl and mounts
+// its filesystem (or its first partition) like a drive. It returns the mount point
+// and the loop device mounted there.
+func MountImageFile(image string) (string, string, error) {
+	out, err := exec.Command("udisksctl", "loop-setup", "--no-user-interaction", "-f", image).Output()
+	if err != nil {
+		return "", "", fmt.Errorf("failed to attach image %s: %v", image, err)
+	}
+	// "Mapped file /srv/backup.img as /dev/loop0."
+	output := strings.TrimSpace(string(out))
+	idx := strings.LastIndex(output, " as ")
+	if idx == -1 {
+		return "", "", fmt.Errorf("unexpected udisksctl output: %s", output)
+	}
+	loopDevice := strings.TrimSuffix(output[idx+4:], ".")
+
+	// A partitioned image exposes its filesystem on the first partition
+	device := loopDevice
+	mountPoint, err := mountDevice(device, "")
+	if err != nil {
+		if _, statErr := os.Stat(loopDevice + "p1"); statErr == nil {
+			device = loopDevice + "p1"
+			mountPoint, err = mountDevice(device, "")
+		}
+	}
+	if err != nil {
+		exec.Command("udisksctl", "loop-delete", "--no-user-interaction", "-b", loopDevice).Run()
+		return "", "", fmt.Errorf("failed to mount image %s: %v", image, err)
+	}
+	return mountPoint, device, nil
+}
+
+// loopDeviceOf returns the loop device behind a device path such as /dev/loop0p1,
+// or "" if it is not a loop device.
+func loopDeviceOf(device string) string {
+	if !strings.HasPrefix(device, "/dev/loop") {
+		return ""
+	}
+	if idx := strings.LastIndex(device, "p"); idx > len("/dev/loop") {
+		return device[:idx]
+	}
+	return device
+}
+
+// FindMountPointForDevice returns where the filesystem on a block device is mounted.
+// /proc/self/mountinfo is matched by device number, so /dev/mapper and /dev/dm-N
+// names of the same device are recognized.
 func FindMountPointForDevice(device string) (string, error) {
-	file, err := os.Open("/proc/mounts")
+	devNum, err := blockDeviceNumber(device)
 	if err != nil {
 		return "", err
 	}
-	defer file.Close()
+	mounts, err := readMountInfo()
+	if err != nil {
+		return "", err
+	}
+	for _, mount := range mounts {
+		// Bind mounts of a subdirectory are not the drive itself
+		if mount.root == "/" && mount.mountedFrom(device, devNum) {
+			return mount.point, nil
+		}
+	}
+	return "", fmt.Errorf("%s is not mounted", device)
+}
 
-	scanner := bufio.NewScanner(file)
-	for scanner.Scan() {
-		fields := strings.Fields(scanner.Text())
-		if len(fields) >= 2 && fields[0] == device {
-			return fields[1], nil // Return mount point
+// VerifyMountedOn checks that path lies on the filesystem of the block device,
+// so nothing is written to whatever happens to be at a mount point instead.
+func VerifyMountedOn(path, device string) error {
+	devNum, err := blockDeviceNumber(device)
+	if err != nil {
+		return fmt.Errorf("drive %s is no longer present: %v", device, err)
+	}
+	mounts, err := readMountInfo()
+	if err != nil {
+		return err
+	}
+	return verifyMountedOn(mounts, path, device, devNum)
+}
+
+// verifyMountedOn checks path against a mount table for VerifyMountedOn.
+func verifyMountedOn(mounts []mountInfo, path, device, devNum string) error {
+	// The deepest mount containing path; of mounts stacked on one point the last is visible
+	path = filepath.Clean(path)
+	var holder *mountInfo
+	for i, mount := range mounts {
+		if path != mount.point && !strings.HasPrefix(path, strings.TrimSuffix(mount.point, "/")+"/") {
+			continue
+		}
+		if holder == nil || len(mount.point) >= len(holder.point) {
+			holder = &mounts[i]
 		}
 	}
+	if holder == nil || !holder.mountedFrom(device, devNum) {
+		return fmt.Errorf("%s is not on drive %s", path, device)
+	}
+	return nil
+}
 
-	return "", fmt.Errorf("device not found in /proc/mounts")
+// mountInfo is an entry of /proc/self/mountinfo.
+type mountInfo struct {
+	devNum string // "major:minor" of the mounted filesystem
+	root   string // Directory of the filesystem mounted here ("/" unless bind-mounted)
+	point  string // Mount point
+	source string // Device the filesystem was mounted from
+}
+
+// readMountInfo parses /proc/self/mountinfo.
+func readMountInfo() ([]mountInfo, error) {
+	data, err := os.ReadFile("/proc/self/mountinfo")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read mount table: %v", err)
+	}
+	return parseMountInfo(string(data)), nil
+}
+
+// parseMountInfo parses the lines of a mountinfo file.
+func parseMountInfo(data string) []mountInfo {
+	var mounts []mountInfo
+	for _, line := range strings.Split(data, "\n") {
+		// id parent major:minor root point options [optional...] - fstype source superoptions
+		fields := strings.Fields(line)
+		sep := -1
+		for i := 6; i < len(fields); i++ {
+			if fields[i] == "-" {
+				sep = i
+				break
+			}
+		}
+		if sep == -1 || sep+2 >= len(fields) {
+			continue
+		}
+		mounts = append(mounts, mountInfo{
+			devNum: fields[2],
+			root:   unescapeMountPoint(fields[3]),
+			point:  unescapeMountPoint(fields[4]),
+			source: unescapeMountPoint(fields[sep+2]),
+		})
+	}
+	return mounts
+}
+
+// mountedFrom reports whether the mount is of the block device numbered devNum.
+func (m mountInfo) mountedFrom(device, devNum string) bool {
+	if m.devNum == devNum {
+		return true
+	}
+	// btrfs reports an anonymous device number: compare the source device instead
+	if !strings.HasPrefix(m.source, "/dev/") {
+		return false
+	}
+	source, err := resolveDeviceLink(m.source)
+	if err != nil {
+		return false
+	}
+	target, err := resolveDeviceLink(device)
+	return err == nil && source == target
+}
+
+// resolveDeviceLink resolves /dev/mapper and /dev/disk links to the device node.
+var resolveDeviceLink = filepath.EvalSymlinks
+
+// blockDeviceNumber returns the "major:minor" of a block device node.
+func blockDeviceNumber(device string) (string, error) {
+	var stat unix.Stat_t
+	if err := unix.Stat(device, &stat); err != nil {
+		return "", err
+	}
+	if stat.Mode&unix.S_IFMT != unix.S_IFBLK {
+		return "", fmt.Errorf("%s is not a block device", device)
+	}
+	return fmt.Sprintf("%d:%d", unix.Major(uint64(stat.Rdev)), unix.Minor(uint64(stat.Rdev))), nil
 }
 
 // GetDeviceFromProcMounts finds the device path for a given mount point by parsing /proc/mounts.
@@ -109,66 +286,98 @@ func GetDeviceFromProcMounts(mountPoint string) (string, error) {
 	return "", fmt.Errorf("mount point %s not found", mountPoint)
 }
 
+// BlockDeviceOf returns the block device holding the filesystem of drive: the
+// partition, or the mapper device of an unlocked LUKS container.
+func BlockDeviceOf(drive DriveInfo) string {
+	if drive.Encrypted {
+		return getLUKSMapperPath(drive)
+	}
+	if drive.DevicePath != "" {
+		return drive.DevicePath
+	}
+	if strings.HasPrefix(drive.Device, "/dev/") {
+		return drive.Device
+	}
+	return ""
+}
+
 // MountRegularDrive handles mounting of standard (non-encrypted) external drives.
-// OPTIMIZED: Cleaner logic flow with early returns and reduced string operations.
+// The mount point returned is confirmed to hold the drive's filesystem.
 func MountRegularDrive(drive DriveInfo) (string, error) {
-	// OPTIMIZED: Determine device path and mount status in single check
-	devicePath, mountPoint, alreadyMounted := resolveDriveDevice(drive.Device)
+	devicePath := BlockDeviceOf(drive)
+	if devicePath == "" {
+		return "", fmt.Errorf("no device known for %s", drive.Device)
+	}
 
-	if alreadyMounted {
+	// Already mounted, by Migrate or the desktop
+	if mountPoint, err := FindMountPointForDevice(devicePath); err == nil {
 		return mountPoint, nil
 	}
-
-	// OPTIMIZED: Mount device with streamlined error handling
-	return mountDevice(devicePath)
+	return mountDevice(devicePath, drive.Filesystem)
 }
 
-// resolveDriveDevice determines the actual device path and current mount status.
-// OPTIMIZED: Single function to handle all device resolution logic.
-func resolveDriveDevice(device string) (devicePath, mountPoint string, alreadyMounted bool) {
-	// Check if device is already a mount point
-	if strings.HasPrefix(device, "/") && !strings.HasPrefix(device, "/dev/") {
-		// Verify mount point exists
-		if _, err := os.Stat(device); err == nil {
-			return "", device, true
-		}
+// migrateMountRoot holds the mount points Migrate creates when udisks cannot mount a drive.
+const migrateMountRoot = "/run/media/migrate"
 
-		// Find actual device from mount point
-		if dev, err := GetDeviceFromProcMounts(device); err == nil {
-			return dev, device, true
-		}
-		return "", "", false
-	}
+// kernelFilesystems maps filesystem names reported by udev to kernel drivers that may differ.
+var kernelFilesystems = map[string][]string{
+	"ntfs": {"ntfs3", "ntfs"},
+	"vfat": {"vfat"},
+}
 
-	// Device path provided - check if already mounted
-	if mountPt, err := FindMountPointForDevice(device); err == nil {
-		return device, mountPt, true
+// mountDevice mounts a block device with udisks, or itself below migrateMountRoot,
+// and returns the mount point found for the device in the mount table.
+func mountDevice(devicePath, filesystem string) (string, error) {
+	// udisks mounts under /run/media/<user> with the options desktops expect
+	out, udisksErr := exec.Command("udisksctl", "mount", "-b", devicePath).CombinedOutput()
+	if mountPoint, err := FindMountPointForDevice(devicePath); err == nil {
+		return mountPoint, nil
 	}
 
-	return device, "", false
-}
-
-// mountDevice performs the actual mounting operation.
-// OPTIMIZED: Focused function with cleaner output parsing.
-func mountDevice(devicePath string) (string, error) {
-	cmd := exec.Command("udisksctl", "mount", "-b", devicePath)
-	out, err := cmd.Output()
+	mountPoint, err := mountInMigrateDir(devicePath, filesystem)
 	if err != nil {
-		// Handle already mounted case
-		if strings.Contains(err.Error(), "AlreadyMounted") {
-			if mountPoint, err := FindMountPointForDevice(devicePath); err == nil {
-				return mountPoint, nil
-			}
+		if udisksErr != nil {
+			return "", fmt.Errorf("failed to mount drive: %s (%v)", strings.TrimSpace(string(out)), err)
 		}
 		return "", fmt.Errorf("failed to mount drive: %v", err)
 	}
+	return mountPoint, nil
+}
 
-	// OPTIMIZED: Parse mount point with single string operation
-	mountOutput := strings.TrimSpace(string(out))
-	if idx := strings.Index(mountOutput, " at "); idx != -1 {
-		mountPoint := strings.TrimSuffix(mountOutput[idx+4:], ".")
-		return mountPoint, nil
+// mountInMigrateDir mounts a block device on a directory of its own below migrateMountRoot.
+func mountInMigrateDir(devicePath, filesystem string) (string, error) {
+	if filesystem == "" {
+		if devNum, err := blockDeviceNumber(devicePath); err == nil {
+			filesystem = NewDiscovery("/").readUdev(devNum)["ID_FS_TYPE"]
+		}
+	}
+	if filesystem == "" {
+		return "", fmt.Errorf("unknown filesystem on %s", devicePath)
+	}
+	types, ok := kernelFilesystems[filesystem]
+	if !ok {
+		types = []string{filesystem}
 	}
 
-	return "/media/unknown", nil
+	mountPoint := filepath.Join(migrateMountRoot, filepath.Base(devicePath))
+	if err := os.MkdirAll(mountPoint, 0755); err != nil {
+		return "", fmt.Errorf("failed to create mount point %s: %v", mountPoint, err)
+	}
+	var err error
+	for _, fstype := range types {
+		if err = unix.Mount(devicePath, mountPoint, fstype, unix.MS_NOSUID|unix.MS_NODEV, ""); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		os.Remove(mountPoint)
+		return "", fmt.Errorf("failed to mount %s at %s: %v", devicePath, mountPoint, err)
+	}
+
+	if err := VerifyMountedOn(mountPoint, devicePath); err != nil {
+		unix.Unmount(mountPoint, 0)
+		os.Remove(mountPoint)
+		return "", err
+	}
+	return mountPoint, nil
 }
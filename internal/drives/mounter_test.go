@@ -0,0 +1,70 @@
+package drives
+
+import "testing"
+
+// fixtureMountInfo is a mount table with stacked, bind, device-mapper and nested mounts.
+const fixtureMountInfo = `22 1 259:2 / / rw,relatime shared:1 - ext4 /dev/nvme0n1p2 rw
+30 22 8:17 / /run/media/alice/Backup rw,nosuid shared:5 - ext4 /dev/sdb1 rw
+31 30 8:33 / /run/media/alice/Backup rw,nosuid shared:6 - ext4 /dev/sdc1 rw
+40 22 254:0 / /mnt/secure rw,relatime shared:7 - ext4 /dev/mapper/luks-secure rw
+41 22 0:45 / /mnt/btrfs rw,relatime shared:8 - btrfs /dev/mapper/luks-btrfs rw,subvol=/
+50 22 8:17 /backups /srv/bind rw,relatime shared:5 - ext4 /dev/sdb1 rw
+60 40 8:49 / /mnt/secure/nested rw,relatime shared:9 - ext4 /dev/sdd1 rw
+70 22 8:65 / /mnt/space\040dir rw,relatime shared:10 - ext4 /dev/sde1 rw
+80 22 0:30 / /mnt/tmp rw shared:11 - tmpfs tmpfs rw
+`
+
+func TestParseMountInfo(t *testing.T) {
+	mounts := parseMountInfo(fixtureMountInfo + "garbage line\n")
+	if len(mounts) != 9 {
+		t.Fatalf("parsed %d mounts, want 9", len(mounts))
+	}
+	bind := mounts[5]
+	if bind.devNum != "8:17" || bind.root != "/backups" || bind.point != "/srv/bind" || bind.source != "/dev/sdb1" {
+		t.Errorf("bind mount parsed as %+v", bind)
+	}
+	if mounts[7].point != "/mnt/space dir" {
+		t.Errorf("escaped mount point parsed as %q", mounts[7].point)
+	}
+}
+
+func TestVerifyMountedOn(t *testing.T) {
+	// /dev/mapper names resolve to their dm-N node, as udev links them
+	links := map[string]string{
+		"/dev/mapper/luks-secure": "/dev/dm-0",
+		"/dev/mapper/luks-btrfs":  "/dev/dm-1",
+	}
+	defer func(resolve func(string) (string, error)) { resolveDeviceLink = resolve }(resolveDeviceLink)
+	resolveDeviceLink = func(path string) (string, error) {
+		if target, ok := links[path]; ok {
+			return target, nil
+		}
+		return path, nil
+	}
+
+	mounts := parseMountInfo(fixtureMountInfo)
+	for _, c := range []struct {
+		name, path, device, devNum string
+		ok                         bool
+	}{
+		{"drive itself", "/run/media/alice/Backup", "/dev/sdc1", "8:33", true},
+		{"stacked mount hides the drive below", "/run/media/alice/Backup/migrate", "/dev/sdb1", "8:17", false},
+		{"visible mount of a stack", "/run/media/alice/Backup/migrate", "/dev/sdc1", "8:33", true},
+		{"bind mount of a directory on the drive", "/srv/bind/migrate", "/dev/sdb1", "8:17", true},
+		{"bind mount of another drive", "/srv/bind", "/dev/sdc1", "8:33", false},
+		{"dm-N device, /dev/mapper source", "/mnt/secure/backup", "/dev/dm-0", "254:0", true},
+		{"mapper device by name", "/mnt/secure", "/dev/mapper/luks-secure", "254:0", true},
+		{"btrfs anonymous device number", "/mnt/btrfs/backup", "/dev/dm-1", "254:1", true},
+		{"btrfs on another device", "/mnt/btrfs/backup", "/dev/dm-0", "254:0", false},
+		{"nested mount of another device", "/mnt/secure/nested/backup", "/dev/dm-0", "254:0", false},
+		{"sibling with a common prefix", "/mnt/secure/nestedness", "/dev/dm-0", "254:0", true},
+		{"escaped mount point", "/mnt/space dir/backup", "/dev/sde1", "8:65", true},
+		{"not mounted: the root filesystem", "/run/media/alice/Other", "/dev/sdb1", "8:17", false},
+		{"unclean path", "/mnt/secure/nested/../backup/", "/dev/dm-0", "254:0", true},
+	} {
+		err := verifyMountedOn(mounts, c.path, c.device, c.devNum)
+		if (err == nil) != c.ok {
+			t.Errorf("%s: verifyMountedOn(%q, %s) = %v, want ok=%v", c.name, c.path, c.device, err, c.ok)
+		}
+	}
+}
@@ -50,10 +50,60 @@ func ParseDriveSize(sizeStr string) (int64, error) {
 	return int64(number * float64(multiplier)), nil
 }
 
+// FormatDriveSize formats a byte count the way lsblk reports drive sizes ("1.8T",
+// "465.8G"), so directory destinations can be checked like drives.
+func FormatDriveSize(bytes int64) string {
+	units := []string{"B", "K", "M", "G", "T", "P"}
+	size := float64(bytes)
+	unit := 0
+	for size >= 1024 && unit < len(units)-1 {
+		size /= 1024
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%dB", bytes)
+	}
+	return fmt.Sprintf("%.1f%s", size, units[unit])
+}
+
+// DestinationCapacity returns the space a backup in dir may use: the free space
+// plus whatever its existing backup already occupies. This holds for mount points
+// too, since a NAS share or second disk mounted there may carry other data; a
+// mounted image holds nothing but the backup, so its used space all counts.
+func DestinationCapacity(dir string, hasBackup bool) (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(dir, &stat); err != nil {
+		return 0, fmt.Errorf("failed to get filesystem stats for %s: %v", dir, err)
+	}
+	capacity := int64(stat.Bavail) * int64(stat.Bsize)
+	if hasBackup {
+		existing, _ := CalculateDirectorySize(dir)
+		capacity += existing
+	}
+	return capacity, nil
+}
+
+// storedSize applies the expected compression ratio (stored/original, 1 = none) to a backup size.
+func storedSize(size int64, ratio float64) int64 {
+	if ratio <= 0 || ratio >= 1 {
+		return size
+	}
+	return int64(float64(size) * ratio)
+}
+
+// compressionNote describes the expected compressed size for the space error messages.
+func compressionNote(size int64, ratio float64) string {
+	if ratio <= 0 || ratio >= 1 {
+		return ""
+	}
+	return fmt.Sprintf("Expected after compression: %s (%.0f%%)\n", FormatBytes(storedSize(size, ratio)), ratio*100)
+}
+
 // ValidateBackupSpace validates that an external drive has sufficient space for system backup.
-// Compares the used space on the root filesystem against the total capacity of the external drive.
+// Compares the used space on the root filesystem, scaled by the expected compression ratio,
+// against the total capacity of the external drive.
 // Returns an error with detailed space information if the drive is too small.
-func ValidateBackupSpace(externalDriveSize string) error {
+func ValidateBackupSpace(externalDriveSize string, ratio float64) error {
 	// Get used space on internal drive (what we need to backup)
 	internalUsedSpace, err := GetUsedDiskSpace("/")
 	if err != nil {
@@ -67,11 +117,12 @@ func ValidateBackupSpace(externalDriveSize string) error {
 	}
 
 	// Check: internal_used_space <= external_total_size
-	if internalUsedSpace > externalTotalSize {
-		return fmt.Errorf("⚠️ INSUFFICIENT SPACE for backup\n\nInternal drive used: %s\nExternal drive total: %s\n\nThe external drive is too small to hold your backup.\nYou need at least %s of total drive capacity.",
+	if storedSize(internalUsedSpace, ratio) > externalTotalSize {
+		return fmt.Errorf("⚠️ INSUFFICIENT SPACE for backup\n\nInternal drive used: %s\n%sExternal drive total: %s\n\nThe external drive is too small to hold your backup.\nYou need at least %s of total drive capacity.",
 			FormatBytes(internalUsedSpace),
+			compressionNote(internalUsedSpace, ratio),
 			FormatBytes(externalTotalSize),
-			FormatBytes(internalUsedSpace))
+			FormatBytes(storedSize(internalUsedSpace, ratio)))
 	}
 
 	return nil
@@ -79,7 +130,7 @@ func ValidateBackupSpace(externalDriveSize string) error {
 
 // ValidateSelectiveBackupSpace validates space for selective home backup.
 // FIXED: Now properly handles hierarchical folder selections from the UI selection map.
-func ValidateSelectiveBackupSpace(homeFolders []HomeFolderInfo, selectedFolders map[string]bool, subfolderCache map[string][]HomeFolderInfo, externalDriveSize string) error {
+func ValidateSelectiveBackupSpace(homeFolders []HomeFolderInfo, selectedFolders map[string]bool, subfolderCache map[string][]HomeFolderInfo, externalDriveSize string, ratio float64) error {
 	// Use the same logic as calculateTotalBackupSize() for consistency
 	var totalSelectedSize int64
 	processedParents := make(map[string]bool)
@@ -162,18 +213,19 @@ func ValidateSelectiveBackupSpace(homeFolders []HomeFolderInfo, selectedFolders
 	}
 
 	// Check: selected_folders_size <= external_total_size
-	if totalSelectedSize > externalTotalSize {
-		return fmt.Errorf("⚠️ INSUFFICIENT SPACE for selective home backup\n\nSelected folders size: %s\nExternal drive total: %s\n\nThe external drive is too small to hold your selected folders.\nYou need at least %s of total drive capacity.",
+	if storedSize(totalSelectedSize, ratio) > externalTotalSize {
+		return fmt.Errorf("⚠️ INSUFFICIENT SPACE for selective home backup\n\nSelected folders size: %s\n%sExternal drive total: %s\n\nThe external drive is too small to hold your selected folders.\nYou need at least %s of total drive capacity.",
 			FormatBytes(totalSelectedSize),
+			compressionNote(totalSelectedSize, ratio),
 			FormatBytes(externalTotalSize),
-			FormatBytes(totalSelectedSize))
+			FormatBytes(storedSize(totalSelectedSize, ratio)))
 	}
 
 	return nil
 }
 
 // ValidateHomeBackupSpace validates space for home backup.
-func ValidateHomeBackupSpace(externalDriveSize string) error {
+func ValidateHomeBackupSpace(externalDriveSize string, ratio float64) error {
 	// Get actual home directory size instead of full internal drive
 	homeDirSize, err := GetHomeDirSize()
 	if err != nil {
@@ -187,11 +239,12 @@ func ValidateHomeBackupSpace(externalDriveSize string) error {
 	}
 
 	// Check: home_directory_size <= external_total_size
-	if homeDirSize > externalTotalSize {
-		return fmt.Errorf("⚠️ INSUFFICIENT SPACE for home backup\n\nHome directory size: %s\nExternal drive total: %s\n\nThe external drive is too small to hold your home directory.\nYou need at least %s of total drive capacity.",
+	if storedSize(homeDirSize, ratio) > externalTotalSize {
+		return fmt.Errorf("⚠️ INSUFFICIENT SPACE for home backup\n\nHome directory size: %s\n%sExternal drive total: %s\n\nThe external drive is too small to hold your home directory.\nYou need at least %s of total drive capacity.",
 			FormatBytes(homeDirSize),
+			compressionNote(homeDirSize, ratio),
 			FormatBytes(externalTotalSize),
-			FormatBytes(homeDirSize))
+			FormatBytes(storedSize(homeDirSize, ratio)))
 	}
 
 	return nil
@@ -204,7 +257,11 @@ func ValidateRestoreSpace(externalDriveSize string, externalMountPoint string) e
 	if err != nil {
 		return fmt.Errorf("failed to get backup drive usage: %v", err)
 	}
+	return ValidateRestoreSize(externalUsedSpace)
+}
 
+// ValidateRestoreSize validates that a backup of the given uncompressed size fits on the internal drive.
+func ValidateRestoreSize(backupSize int64) error {
 	// Get total size of internal drive
 	var stat syscall.Statfs_t
 	if err := syscall.Statfs("/", &stat); err != nil {
@@ -214,11 +271,11 @@ func ValidateRestoreSpace(externalDriveSize string, externalMountPoint string) e
 	internalTotalSize := int64(stat.Blocks) * int64(stat.Bsize)
 
 	// Check: external_used_space <= internal_total_size
-	if externalUsedSpace > internalTotalSize {
+	if backupSize > internalTotalSize {
 		return fmt.Errorf("⚠️ INSUFFICIENT SPACE for restore\n\nBackup size: %s\nInternal drive total: %s\n\nThe backup is too large to fit on your internal drive.\nYou need at least %s of total drive capacity.",
-			FormatBytes(externalUsedSpace),
+			FormatBytes(backupSize),
 			FormatBytes(internalTotalSize),
-			FormatBytes(externalUsedSpace))
+			FormatBytes(backupSize))
 	}
 
 	return nil
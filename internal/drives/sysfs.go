@@ -0,0 +1,547 @@
+// Package drives provides drive detection, mounting, and management functionality.
+// This module discovers block devices natively from /sys/block, /proc/mounts and
+// the udev database in /run/udev/data, without running lsblk.
+//
+// A disk counts as external when the kernel flags it removable, or when one of its
+// parent devices sits on a USB or Thunderbolt bus or behind a PCIe port the kernel
+// marks removable (USB4/Thunderbolt NVMe enclosures). The device name plays no part,
+// so internal SATA disks ("sda") are never offered as backup targets and USB NVMe
+// enclosures qualify whether or not they are mounted.
+//
+// Discovery reads everything relative to a root directory, so it can run against
+// a fake tree holding sys/block, sys/devices, proc/mounts and run/udev/data.
+package drives
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Discovery reads block devices from the sysfs, procfs and udev trees under a root.
+type Discovery struct {
+	root string
+}
+
+// NewDiscovery returns a Discovery of the trees under root ("/" for the running system).
+func NewDiscovery(root string) *Discovery {
+	return &Discovery{root: root}
+}
+
+// ignoredDiskPrefixes are block devices that are never backup targets:
+// virtual devices, optical drives and floppies.
+var ignoredDiskPrefixes = []string{"loop", "ram", "zram", "dm-", "md", "nbd", "sr", "fd"}
+
+func (d *Discovery) path(parts ...string) string {
+	return filepath.Join(append([]string{d.root}, parts...)...)
+}
+
+// readAttr returns a trimmed sysfs attribute, "" if it cannot be read.
+func readAttr(path string) string {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(data))
+}
+
+// sectorsToBytes converts a sysfs size attribute (512-byte sectors) to bytes.
+func sectorsToBytes(size string) int64 {
+	sectors, err := strconv.ParseInt(size, 10, 64)
+	if err != nil {
+		return 0
+	}
+	return sectors * 512
+}
+
+// Disks returns every physical disk with its volumes, mount points and classification.
+func (d *Discovery) Disks() ([]BlockDisk, error) {
+	entries, err := os.ReadDir(d.path("sys", "block"))
+	if err != nil {
+		return nil, err
+	}
+	mapperNames := d.readMapperNames()
+	mounts := make(map[string]procMount)
+	for _, mount := range d.readMounts(mapperNames) {
+		if _, seen := mounts[mount.device]; !seen {
+			mounts[mount.device] = mount
+		}
+	}
+
+	var disks []BlockDisk
+	for _, entry := range entries {
+		name := entry.Name()
+		if hasAnyPrefix(name, ignoredDiskPrefixes) {
+			continue
+		}
+		diskDir := d.path("sys", "block", name)
+		// Virtual block devices have no backing device
+		if _, err := os.Stat(filepath.Join(diskDir, "device")); err != nil {
+			continue
+		}
+
+		disk := BlockDisk{
+			Name:      name,
+			Device:    "/dev/" + name,
+			Size:      sectorsToBytes(readAttr(filepath.Join(diskDir, "size"))),
+			Removable: readAttr(filepath.Join(diskDir, "removable")) == "1",
+		}
+		udev := d.readUdev(readAttr(filepath.Join(diskDir, "dev")))
+		bus, removableParent := d.parentBus(diskDir)
+		disk.Transport = bus
+		if disk.Transport == "" {
+			disk.Transport = strings.ToLower(udev["ID_BUS"])
+		}
+		if disk.Transport == "" && strings.HasPrefix(name, "nvme") {
+			disk.Transport = "nvme"
+		}
+		disk.External = disk.Removable || removableParent ||
+			disk.Transport == "usb" || disk.Transport == "thunderbolt"
+
+		// Partitions are subdirectories with a "partition" attribute
+		partitions, _ := os.ReadDir(diskDir)
+		for _, part := range partitions {
+			partDir := filepath.Join(diskDir, part.Name())
+			if _, err := os.Stat(filepath.Join(partDir, "partition")); err != nil {
+				continue
+			}
+			disk.Volumes = append(disk.Volumes, d.readVolume(partDir, part.Name(), mounts, mapperNames))
+		}
+		// An unpartitioned disk carries its filesystem directly
+		if len(disk.Volumes) == 0 {
+			volume := d.readVolume(diskDir, name, mounts, mapperNames)
+			if volume.Filesystem != "" || volume.MountPoint != "" || len(volume.Holders) > 0 {
+				disk.Volumes = append(disk.Volumes, volume)
+			}
+		}
+
+		for _, volume := range disk.Volumes {
+			if volume.MountPoint == "/" {
+				disk.System = true
+			}
+			for _, holder := range volume.Holders {
+				if holder.MountPoint == "/" {
+					disk.System = true
+				}
+			}
+		}
+		disks = append(disks, disk)
+	}
+	return disks, nil
+}
+
+// readVolume reads a partition or unpartitioned disk from its sysfs directory.
+func (d *Discovery) readVolume(dir, name string, mounts map[string]procMount, mapperNames map[string]string) BlockVolume {
+	volume := BlockVolume{
+		Name:   name,
+		Device: "/dev/" + name,
+		DevNum: readAttr(filepath.Join(dir, "dev")),
+		Size:   sectorsToBytes(readAttr(filepath.Join(dir, "size"))),
+	}
+	d.applyUdev(&volume)
+	if mount, ok := mounts[name]; ok {
+		volume.MountPoint = mount.point
+		if volume.Filesystem == "" {
+			volume.Filesystem = mount.fstype
+		}
+	}
+
+	// Device-mapper volumes on top, such as an unlocked LUKS container
+	holders, _ := os.ReadDir(filepath.Join(dir, "holders"))
+	for _, holder := range holders {
+		holderName := holder.Name()
+		holderDir := d.path("sys", "block", holderName)
+		mapped := BlockVolume{
+			Name:   holderName,
+			Device: "/dev/" + holderName,
+			DevNum: readAttr(filepath.Join(holderDir, "dev")),
+			Size:   sectorsToBytes(readAttr(filepath.Join(holderDir, "size"))),
+		}
+		if mapperName, ok := mapperNames[holderName]; ok {
+			mapped.Device = "/dev/mapper/" + mapperName
+		}
+		d.applyUdev(&mapped)
+		if mount, ok := mounts[holderName]; ok {
+			mapped.MountPoint = mount.point
+			if mapped.Filesystem == "" {
+				mapped.Filesystem = mount.fstype
+			}
+		}
+		volume.Holders = append(volume.Holders, mapped)
+	}
+	return volume
+}
+
+// applyUdev fills in the filesystem details udev recorded for a volume.
+func (d *Discovery) applyUdev(volume *BlockVolume) {
+	udev := d.readUdev(volume.DevNum)
+	volume.UUID = udev["ID_FS_UUID"]
+	volume.Filesystem = udev["ID_FS_TYPE"]
+	volume.Label = udev["ID_FS_LABEL"]
+	if encoded, ok := udev["ID_FS_LABEL_ENC"]; ok {
+		volume.Label = decodeUdevString(encoded)
+	}
+}
+
+// parentBus walks up the sysfs device path of a disk. It returns the bus ("usb" or
+// "thunderbolt") of the first parent on one, or "" when there is none, and whether
+// any parent is marked removable, which the kernel does for devices behind
+// external-facing PCIe ports (USB4/Thunderbolt, but also SD card readers).
+func (d *Discovery) parentBus(diskDir string) (string, bool) {
+	resolved, err := filepath.EvalSymlinks(diskDir)
+	if err != nil {
+		return "", false
+	}
+	devices, err := filepath.EvalSymlinks(d.path("sys", "devices"))
+	if err != nil {
+		return "", false
+	}
+	removable := false
+	for dir := filepath.Dir(resolved); strings.HasPrefix(dir, devices+string(filepath.Separator)); dir = filepath.Dir(dir) {
+		if target, err := os.Readlink(filepath.Join(dir, "subsystem")); err == nil {
+			switch bus := filepath.Base(target); bus {
+			case "usb", "thunderbolt":
+				return bus, removable
+			}
+		}
+		// The generic device attribute is "removable", "fixed" or "unknown"
+		if readAttr(filepath.Join(dir, "removable")) == "removable" {
+			removable = true
+		}
+	}
+	return "", removable
+}
+
+// readUdev returns the properties udev stored for the block device "major:minor".
+func (d *Discovery) readUdev(devNum string) map[string]string {
+	properties := make(map[string]string)
+	if devNum == "" {
+		return properties
+	}
+	file, err := os.Open(d.path("run", "udev", "data", "b"+devNum))
+	if err != nil {
+		return properties
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "E:") {
+			continue
+		}
+		if key, value, ok := strings.Cut(line[2:], "="); ok {
+			properties[key] = value
+		}
+	}
+	return properties
+}
+
+// decodeUdevString undoes udev's \xNN escaping (ID_FS_LABEL_ENC).
+func decodeUdevString(s string) string {
+	var out strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) && s[i+1] == 'x' {
+			if b, err := strconv.ParseUint(s[i+2:i+4], 16, 8); err == nil {
+				out.WriteByte(byte(b))
+				i += 3
+				continue
+			}
+		}
+		out.WriteByte(s[i])
+	}
+	return out.String()
+}
+
+// procMount is one line of /proc/mounts for a block device.
+type procMount struct {
+	device string // Kernel name ("sdb1", "dm-0")
+	point  string
+	fstype string
+}
+
+// readMounts returns the mounts of block devices.
+func (d *Discovery) readMounts(mapperNames map[string]string) []procMount {
+	var mounts []procMount
+	file, err := os.Open(d.path("proc", "mounts"))
+	if err != nil {
+		return mounts
+	}
+	defer file.Close()
+
+	mapperDevices := make(map[string]string)
+	for dm, name := range mapperNames {
+		mapperDevices[name] = dm
+	}
+
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || !strings.HasPrefix(fields[0], "/dev/") {
+			continue
+		}
+		name := strings.TrimPrefix(fields[0], "/dev/")
+		if mapperName, ok := strings.CutPrefix(name, "mapper/"); ok {
+			if dm, ok := mapperDevices[mapperName]; ok {
+				name = dm
+			}
+		}
+		mounts = append(mounts, procMount{device: name, point: unescapeMountPoint(fields[1]), fstype: fields[2]})
+	}
+	return mounts
+}
+
+// DisksHolding returns the names of the disks under the filesystem that holds path,
+// following an unlocked LUKS container down to its disk.
+func (d *Discovery) DisksHolding(path string) ([]string, error) {
+	disks, err := d.Disks()
+	if err != nil {
+		return nil, err
+	}
+
+	// The deepest mount point containing path
+	path = filepath.Clean(path)
+	device, deepest := "", -1
+	for _, mount := range d.readMounts(d.readMapperNames()) {
+		rel, err := filepath.Rel(mount.point, path)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, "../") {
+			continue
+		}
+		if len(mount.point) > deepest {
+			device, deepest = mount.device, len(mount.point)
+		}
+	}
+	if device == "" {
+		return nil, nil
+	}
+
+	var names []string
+	for _, disk := range disks {
+		for _, volume := range disk.Volumes {
+			held := volume.Name == device
+			for _, holder := range volume.Holders {
+				held = held || holder.Name == device
+			}
+			if held {
+				names = append(names, disk.Name)
+				break
+			}
+		}
+	}
+	return names, nil
+}
+
+// readMapperNames maps device-mapper kernel names ("dm-0") to their names in /dev/mapper.
+func (d *Discovery) readMapperNames() map[string]string {
+	names := make(map[string]string)
+	entries, err := os.ReadDir(d.path("sys", "block"))
+	if err != nil {
+		return names
+	}
+	for _, entry := range entries {
+		if !strings.HasPrefix(entry.Name(), "dm-") {
+			continue
+		}
+		if name := readAttr(d.path("sys", "block", entry.Name(), "dm", "name")); name != "" {
+			names[entry.Name()] = name
+		}
+	}
+	return names
+}
+
+// unescapeMountPoint undoes the octal escaping of spaces, tabs and newlines in /proc/mounts.
+func unescapeMountPoint(s string) string {
+	if !strings.Contains(s, "\\") {
+		return s
+	}
+	var out strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+3 < len(s) {
+			if b, err := strconv.ParseUint(s[i+1:i+4], 8, 8); err == nil {
+				out.WriteByte(byte(b))
+				i += 3
+				continue
+			}
+		}
+		out.WriteByte(s[i])
+	}
+	return out.String()
+}
+
+func hasAnyPrefix(s string, prefixes []string) bool {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(s, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+// treeIgnoredPrefixes are block devices that Tree leaves out. Unlike Disks, it
+// keeps device-mapper and RAID devices, which are stacked on real disks.
+var treeIgnoredPrefixes = []string{"loop", "ram", "zram", "nbd", "sr", "fd"}
+
+// Tree returns every block device with its partitions and the device-mapper and
+// RAID devices stacked on it, flattened, as lsblk would list them. A device on
+// several others (RAID members) is listed once, under its first member.
+func (d *Discovery) Tree() ([]BlockNode, error) {
+	entries, err := os.ReadDir(d.path("sys", "block"))
+	if err != nil {
+		return nil, err
+	}
+	mapperNames := d.readMapperNames()
+	mounts := make(map[string]string)
+	for _, mount := range d.readMounts(mapperNames) {
+		if _, seen := mounts[mount.device]; !seen {
+			mounts[mount.device] = mount.point
+		}
+	}
+	for _, name := range d.readSwaps(mapperNames) {
+		mounts[name] = "[SWAP]"
+	}
+	displayName := func(name string) string {
+		if mapperName, ok := mapperNames[name]; ok {
+			return mapperName
+		}
+		return name
+	}
+	node := func(dir, name, parent string) BlockNode {
+		udev := d.readUdev(readAttr(filepath.Join(dir, "dev")))
+		return BlockNode{
+			Name:       displayName(name),
+			Parent:     parent,
+			UUID:       udev["ID_FS_UUID"],
+			PartUUID:   udev["ID_PART_ENTRY_UUID"],
+			FSType:     udev["ID_FS_TYPE"],
+			MountPoint: mounts[name],
+		}
+	}
+
+	var nodes []BlockNode
+	for _, entry := range entries {
+		name := entry.Name()
+		if hasAnyPrefix(name, treeIgnoredPrefixes) {
+			continue
+		}
+		dir := d.path("sys", "block", name)
+
+		// Stacked devices name what they sit on in slaves/
+		parent := ""
+		if slaves, _ := os.ReadDir(filepath.Join(dir, "slaves")); len(slaves) > 0 {
+			parent = displayName(slaves[0].Name())
+		}
+		nodes = append(nodes, node(dir, name, parent))
+
+		partitions, _ := os.ReadDir(dir)
+		for _, part := range partitions {
+			partDir := filepath.Join(dir, part.Name())
+			if _, err := os.Stat(filepath.Join(partDir, "partition")); err == nil {
+				nodes = append(nodes, node(partDir, part.Name(), displayName(name)))
+			}
+		}
+	}
+	return nodes, nil
+}
+
+// readSwaps returns the kernel names of the block devices in use as swap.
+func (d *Discovery) readSwaps(mapperNames map[string]string) []string {
+	var names []string
+	file, err := os.Open(d.path("proc", "swaps"))
+	if err != nil {
+		return names
+	}
+	defer file.Close()
+
+	mapperDevices := make(map[string]string)
+	for dm, name := range mapperNames {
+		mapperDevices[name] = dm
+	}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 2 || fields[1] != "partition" {
+			continue
+		}
+		name := strings.TrimPrefix(unescapeMountPoint(fields[0]), "/dev/")
+		if mapperName, ok := strings.CutPrefix(name, "mapper/"); ok {
+			if dm, ok := mapperDevices[mapperName]; ok {
+				name = dm
+			}
+		}
+		names = append(names, name)
+	}
+	return names
+}
+
+// ExternalDrives returns the filesystems on external disks that can take a backup.
+// Mounted filesystems are listed by mount point, unmounted ones by device node, and
+// locked LUKS containers as encrypted drives. Disks holding the running system are
+// never listed.
+func (d *Discovery) ExternalDrives() ([]DriveInfo, error) {
+	disks, err := d.Disks()
+	if err != nil {
+		return nil, err
+	}
+	return externalDrives(disks), nil
+}
+
+// externalDrives picks the drives ExternalDrives offers from a list of disks.
+func externalDrives(disks []BlockDisk) []DriveInfo {
+	// Pre-allocate with reasonable capacity to avoid repeated allocations
+	drives := make([]DriveInfo, 0, 8)
+	for _, disk := range disks {
+		if !disk.External || disk.System {
+			continue
+		}
+		for _, volume := range disk.Volumes {
+			if len(volume.Holders) > 0 {
+				// Unlocked LUKS container: offer what is inside
+				for _, holder := range volume.Holders {
+					if holder.Label == "" {
+						holder.Label = "Encrypted External Drive"
+					}
+					if drive, ok := volumeDrive(holder); ok {
+						drives = append(drives, drive)
+					}
+				}
+				continue
+			}
+			if drive, ok := volumeDrive(volume); ok {
+				drives = append(drives, drive)
+			}
+		}
+	}
+	return drives
+}
+
+// volumeDrive converts a volume to the DriveInfo the UI offers, if it can hold a backup.
+func volumeDrive(volume BlockVolume) (DriveInfo, bool) {
+	drive := DriveInfo{
+		Device:     volume.Device,
+		DevicePath: volume.Device,
+		Size:       FormatDriveSize(volume.Size),
+		Label:      volume.Label,
+		UUID:       volume.UUID,
+		Filesystem: volume.Filesystem,
+		Encrypted:  volume.Filesystem == "crypto_LUKS",
+	}
+	switch {
+	case volume.MountPoint != "":
+		drive.Device = volume.MountPoint
+	case drive.Encrypted:
+		// Locked: the mount flow asks for the passphrase
+	case volume.Filesystem == "" || volume.Filesystem == "swap":
+		return DriveInfo{}, false
+	}
+
+	if drive.Label == "" {
+		if drive.Encrypted {
+			drive.Label = "Encrypted External Drive"
+		} else {
+			drive.Label = "External Drive"
+		}
+	}
+	return drive, true
+}
@@ -0,0 +1,239 @@
+package drives
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// fakeTree builds the sysfs, procfs and udev files a Discovery reads under root.
+type fakeTree struct {
+	t    *testing.T
+	root string
+}
+
+// file writes name (slash-separated, relative to the root) with content.
+func (f fakeTree) file(name, content string) {
+	f.t.Helper()
+	path := filepath.Join(f.root, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		f.t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content+"\n"), 0644); err != nil {
+		f.t.Fatal(err)
+	}
+}
+
+// link creates the symlink name pointing at target, as sysfs does for buses and devices.
+func (f fakeTree) link(name, target string) {
+	f.t.Helper()
+	path := filepath.Join(f.root, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		f.t.Fatal(err)
+	}
+	if err := os.Symlink(target, path); err != nil {
+		f.t.Fatal(err)
+	}
+}
+
+// disk adds a disk at its sys/devices path and links it from sys/block.
+func (f fakeTree) disk(devicePath, name, devNum string, sectors string) string {
+	f.t.Helper()
+	dir := "sys/devices/" + devicePath + "/block/" + name
+	f.file(dir+"/dev", devNum)
+	f.file(dir+"/size", sectors)
+	f.file(dir+"/removable", "0")
+	f.link(dir+"/device", "../..")
+	f.link("sys/block/"+name, "../devices/"+devicePath+"/block/"+name)
+	return dir
+}
+
+// partition adds a partition below a disk directory.
+func (f fakeTree) partition(diskDir, name, devNum, sectors string) string {
+	f.t.Helper()
+	dir := diskDir + "/" + name
+	f.file(dir+"/partition", "1")
+	f.file(dir+"/dev", devNum)
+	f.file(dir+"/size", sectors)
+	return dir
+}
+
+// newFakeSystem lays out a laptop with an internal NVMe system disk, an internal
+// SATA data disk, a USB disk with a plain and a LUKS partition, an NVMe drive in a
+// Thunderbolt enclosure and a loop device.
+func newFakeSystem(t *testing.T) string {
+	tree := fakeTree{t: t, root: t.TempDir()}
+	tree.link("sys/devices/pci0000:00/0000:00:14.0/subsystem", "../../../bus/pci")
+	tree.link("sys/devices/pci0000:00/0000:00:17.0/subsystem", "../../../bus/pci")
+
+	system := tree.disk("pci0000:00/0000:00:1d.0/0000:02:00.0/nvme/nvme0", "nvme0n1", "259:0", "1000000")
+	tree.partition(system, "nvme0n1p1", "259:1", "999000")
+	tree.file("run/udev/data/b259:1", "E:ID_FS_TYPE=ext4\nE:ID_FS_UUID=root-uuid")
+
+	data := tree.disk("pci0000:00/0000:00:17.0/ata1/host1/target1:0:0/1:0:0:0", "sda", "8:0", "4000000")
+	tree.partition(data, "sda1", "8:1", "3999000")
+	tree.file("run/udev/data/b8:0", "E:ID_BUS=ata")
+	tree.file("run/udev/data/b8:1", "E:ID_FS_TYPE=ext4\nE:ID_FS_LABEL=Data")
+
+	usb := "pci0000:00/0000:00:14.0/usb2/2-1"
+	tree.link("sys/devices/"+usb+"/subsystem", "../../../../../bus/usb")
+	external := tree.disk(usb+"/2-1:1.0/host0/target0:0:0/0:0:0:0", "sdb", "8:16", "2000000")
+	tree.partition(external, "sdb1", "8:17", "1000000")
+	tree.file("run/udev/data/b8:17", "E:ID_FS_TYPE=ext4\nE:ID_FS_UUID=usb-uuid\nE:ID_FS_LABEL=My_Backup\nE:ID_FS_LABEL_ENC=My\\x20Backup")
+	luks := tree.partition(external, "sdb2", "8:18", "999000")
+	tree.file(luks+"/holders/dm-0", "")
+	tree.file("run/udev/data/b8:18", "E:ID_FS_TYPE=crypto_LUKS\nE:ID_FS_UUID=luks-uuid")
+	tree.file("sys/devices/virtual/block/dm-0/dev", "254:0")
+	tree.file("sys/devices/virtual/block/dm-0/size", "995000")
+	tree.file("sys/devices/virtual/block/dm-0/dm/name", "luks-luks-uuid")
+	tree.link("sys/block/dm-0", "../devices/virtual/block/dm-0")
+	tree.file("run/udev/data/b254:0", "E:ID_FS_TYPE=ext4\nE:ID_FS_UUID=inner-uuid")
+
+	// Thunderbolt enclosures sit behind a PCIe port the kernel marks removable
+	tree.file("sys/devices/pci0000:00/0000:00:07.0/removable", "removable")
+	tree.disk("pci0000:00/0000:00:07.0/0000:03:00.0/nvme/nvme1", "nvme1n1", "259:2", "3000000")
+	tree.file("run/udev/data/b259:2", "E:ID_FS_TYPE=exfat\nE:ID_FS_LABEL=TB")
+
+	tree.file("sys/devices/virtual/block/loop0/size", "100")
+	tree.link("sys/block/loop0", "../devices/virtual/block/loop0")
+
+	tree.file("proc/mounts", "/dev/nvme0n1p1 / ext4 rw,relatime 0 0\n"+
+		"tmpfs /tmp tmpfs rw 0 0\n"+
+		"/dev/sdb1 /run/media/alice/My\\040Backup ext4 rw 0 0\n"+
+		"/dev/mapper/luks-luks-uuid /mnt/secure ext4 rw 0 0")
+	return tree.root
+}
+
+func TestDiscoveryClassifiesDisks(t *testing.T) {
+	disks, err := NewDiscovery(newFakeSystem(t)).Disks()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	type class struct {
+		transport        string
+		external, system bool
+		volumes          int
+	}
+	got := make(map[string]class)
+	for _, disk := range disks {
+		got[disk.Name] = class{disk.Transport, disk.External, disk.System, len(disk.Volumes)}
+	}
+	want := map[string]class{
+		"nvme0n1": {"nvme", false, true, 1},
+		"sda":     {"ata", false, false, 1},
+		"sdb":     {"usb", true, false, 2},
+		"nvme1n1": {"nvme", true, false, 1},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("disks = %+v, want %+v", got, want)
+	}
+
+	for _, disk := range disks {
+		if disk.Name != "sdb" {
+			continue
+		}
+		if disk.Size != 2000000*512 || disk.Volumes[0].Size != 1000000*512 {
+			t.Errorf("sizes %d, %d", disk.Size, disk.Volumes[0].Size)
+		}
+		holders := disk.Volumes[1].Holders
+		if len(holders) != 1 || holders[0].Device != "/dev/mapper/luks-luks-uuid" || holders[0].MountPoint != "/mnt/secure" {
+			t.Errorf("LUKS holders = %+v", holders)
+		}
+	}
+}
+
+func TestDiscoveryExternalDrives(t *testing.T) {
+	drives, err := NewDiscovery(newFakeSystem(t)).ExternalDrives()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []DriveInfo{
+		{Device: "/dev/nvme1n1", DevicePath: "/dev/nvme1n1", Size: FormatDriveSize(3000000 * 512), Label: "TB", Filesystem: "exfat"},
+		{Device: "/run/media/alice/My Backup", DevicePath: "/dev/sdb1", Size: FormatDriveSize(1000000 * 512), Label: "My Backup", UUID: "usb-uuid", Filesystem: "ext4"},
+		{Device: "/mnt/secure", DevicePath: "/dev/mapper/luks-luks-uuid", Size: FormatDriveSize(995000 * 512), Label: "Encrypted External Drive", UUID: "inner-uuid", Filesystem: "ext4"},
+	}
+	if !reflect.DeepEqual(drives, want) {
+		t.Fatalf("external drives:\n got %+v\nwant %+v", drives, want)
+	}
+}
+
+func TestDiscoverySkipsExternalSystemDisk(t *testing.T) {
+	root := newFakeSystem(t)
+	// Booted from the USB disk: it must not be offered as a backup target
+	os.WriteFile(filepath.Join(root, "proc", "mounts"), []byte("/dev/sdb1 / ext4 rw 0 0\n"), 0644)
+
+	drives, err := NewDiscovery(root).ExternalDrives()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, drive := range drives {
+		if drive.DevicePath == "/dev/sdb1" || drive.DevicePath == "/dev/mapper/luks-luks-uuid" {
+			t.Fatalf("system disk offered as %+v", drive)
+		}
+	}
+	if len(drives) != 1 {
+		t.Fatalf("external drives = %+v", drives)
+	}
+}
+
+func TestDisksHolding(t *testing.T) {
+	discovery := NewDiscovery(newFakeSystem(t))
+	for path, want := range map[string][]string{
+		"/mnt/secure/backups":        {"sdb"},
+		"/run/media/alice/My Backup": {"sdb"},
+		"/home/alice":                {"nvme0n1"},
+	} {
+		got, err := discovery.DisksHolding(path)
+		if err != nil || !reflect.DeepEqual(got, want) {
+			t.Errorf("DisksHolding(%q) = %v, %v; want %v", path, got, err, want)
+		}
+	}
+}
+
+func TestDiscoveryTreeListsStackedDevices(t *testing.T) {
+	root := newFakeSystem(t)
+	tree := fakeTree{t: t, root: root}
+	tree.file("sys/devices/virtual/block/dm-0/slaves/sdb2", "")
+	tree.file("run/udev/data/b8:18", "E:ID_FS_TYPE=crypto_LUKS\nE:ID_FS_UUID=luks-uuid\nE:ID_PART_ENTRY_UUID=sdb2-partuuid")
+	// LVM inside the LUKS container, with swap on it
+	tree.file("sys/devices/virtual/block/dm-1/dev", "254:1")
+	tree.file("sys/devices/virtual/block/dm-1/dm/name", "vg-swap")
+	tree.file("sys/devices/virtual/block/dm-1/slaves/dm-0", "")
+	tree.link("sys/block/dm-1", "../devices/virtual/block/dm-1")
+	tree.file("run/udev/data/b254:1", "E:ID_FS_TYPE=swap\nE:ID_FS_UUID=swap-uuid")
+	tree.file("proc/swaps", "Filename\tType\tSize\tUsed\tPriority\n/dev/dm-1 partition 1000 0 -2")
+
+	nodes, err := NewDiscovery(root).Tree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]BlockNode)
+	for _, node := range nodes {
+		got[node.Name] = node
+	}
+	if _, ok := got["loop0"]; ok {
+		t.Error("loop device listed")
+	}
+	for name, want := range map[string]BlockNode{
+		"nvme0n1p1":      {Name: "nvme0n1p1", Parent: "nvme0n1", UUID: "root-uuid", FSType: "ext4", MountPoint: "/"},
+		"sdb":            {Name: "sdb"},
+		"sdb2":           {Name: "sdb2", Parent: "sdb", UUID: "luks-uuid", PartUUID: "sdb2-partuuid", FSType: "crypto_LUKS"},
+		"luks-luks-uuid": {Name: "luks-luks-uuid", Parent: "sdb2", UUID: "inner-uuid", FSType: "ext4", MountPoint: "/mnt/secure"},
+		"vg-swap":        {Name: "vg-swap", Parent: "luks-luks-uuid", UUID: "swap-uuid", FSType: "swap", MountPoint: "[SWAP]"},
+	} {
+		if got[name] != want {
+			t.Errorf("%s = %+v, want %+v", name, got[name], want)
+		}
+	}
+}
+
+func TestDecodeUdevAndMountEscapes(t *testing.T) {
+	if got := decodeUdevString(`Caf\xc3\xa9\x20Disk`); got != "Café Disk" {
+		t.Errorf("decodeUdevString = %q", got)
+	}
+	if got := unescapeMountPoint(`/media/a\040b\011c`); got != "/media/a b\tc" {
+		t.Errorf("unescapeMountPoint = %q", got)
+	}
+}
@@ -6,6 +6,7 @@ package drives
 // Represents both the physical device and its current mount status.
 type DriveInfo struct {
 	Device     string // Mount point path (e.g., "/run/media/user/drive") or device path
+	DevicePath string // Block device node (e.g., "/dev/sdb1"), also while mounted
 	Size       string // Human-readable size string (e.g., "1.5T", "500G")
 	Label      string // Volume label or friendly name
 	UUID       string // Filesystem UUID for identification
@@ -35,33 +36,38 @@ type HomeFolderInfo struct {
 	ParentPath    string           // For breadcrumb navigation (empty for root level)
 }
 
-// LsblkDevice represents a block device from lsblk JSON output.
-// Optimized structure to replace anonymous structs in LoadDrives().
-type LsblkDevice struct {
-	Name       string        `json:"name"`
-	Size       string        `json:"size"`
-	Label      string        `json:"label"`
-	UUID       string        `json:"uuid"`
-	Fstype     string        `json:"fstype"`
-	Mountpoint string        `json:"mountpoint"`
-	Type       string        `json:"type"`
-	Hotplug    bool          `json:"hotplug"`
-	Children   []LsblkDevice `json:"children"`
+// BlockDisk is a whole disk found in /sys/block, with the filesystems on it.
+type BlockDisk struct {
+	Name      string        // Kernel name (e.g., "sdb", "nvme1n1")
+	Device    string        // Device node (e.g., "/dev/sdb")
+	Size      int64         // Size in bytes
+	Removable bool          // The kernel's removable flag (card readers, USB sticks)
+	Transport string        // "usb", "thunderbolt", "nvme", "ata", ... ("" if unknown)
+	External  bool          // Attached over USB or Thunderbolt, or marked removable
+	System    bool          // Holds the running system's root filesystem
+	Volumes   []BlockVolume // Partitions, or the disk itself if it is not partitioned
 }
 
-// LsblkOutput represents the root JSON structure from lsblk command.
-type LsblkOutput struct {
-	BlockDevices []LsblkDevice `json:"blockdevices"`
+// BlockVolume is a partition (or an unpartitioned disk) and what udev knows of its filesystem.
+type BlockVolume struct {
+	Name       string        // Kernel name (e.g., "sdb1", "dm-0")
+	Device     string        // Device node (e.g., "/dev/sdb1", "/dev/mapper/luks-...")
+	DevNum     string        // "major:minor"
+	Size       int64         // Size in bytes
+	UUID       string        // Filesystem UUID
+	Label      string        // Filesystem label
+	Filesystem string        // Filesystem type (e.g., "ext4", "crypto_LUKS")
+	MountPoint string        // First mount point, "" if not mounted
+	Holders    []BlockVolume // Device-mapper volumes on top of it (an unlocked LUKS container)
 }
 
-// MountedFilesystem represents a filesystem that's currently mounted.
-// Used internally for drive detection optimization.
-type MountedFilesystem struct {
-	Device     string
-	Size       string
-	Label      string
-	UUID       string
-	Filesystem string
-	Encrypted  bool
-	MountPoint string
+// BlockNode is one block device of the whole device tree, the way lsblk lists it:
+// disks, their partitions, and the device-mapper and RAID devices stacked on them.
+type BlockNode struct {
+	Name       string // Kernel name, or the device-mapper name ("cryptroot", "vg-root")
+	Parent     string // Name of the device this one sits on, "" for disks
+	UUID       string // Filesystem or LUKS UUID
+	PartUUID   string // GPT partition UUID
+	FSType     string // ext4, btrfs, crypto_LUKS, swap, vfat, ...
+	MountPoint string // First mount point, "[SWAP]" for active swap
 }
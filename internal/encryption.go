@@ -0,0 +1,347 @@
+// Package internal provides client-side encryption for repository backups.
+//
+// LUKS protects a whole drive, but a drive formatted exFAT or NTFS to be shared
+// with other machines would otherwise hold plaintext copies of ~/.ssh and
+// ~/.gnupg. An encrypted repository protects everything below migrate-repo/:
+//
+//   - a random 64-byte master key is generated when the repository is created
+//     and stored in config.json wrapped (AES-256-GCM) by a key derived from the
+//     passphrase or key file with argon2id
+//   - every chunk is sealed with AES-256-GCM under the master key, and named by
+//     an HMAC-SHA256 of its content instead of a plain SHA-256, so chunk names
+//     reveal nothing about file contents
+//   - snapshot records are sealed as well; file names, sizes and metadata live
+//     only in the snapshot trees, which are stored as encrypted chunks
+//
+// config.json, the manifest and BACKUP-INFO.txt only record non-secret
+// parameters (cipher, KDF and its cost, salt).
+package internal
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+
+	"golang.org/x/crypto/argon2"
+)
+
+const (
+	// Cipher and key derivation recorded in the repository config
+	encryptionCipher = "aes-256-gcm"
+	encryptionKDF    = "argon2id"
+
+	// Key sources
+	KeySourcePassphrase = "passphrase"
+	KeySourceKeyFile    = "key-file"
+
+	// argon2id cost for new repositories (RFC 9106 second recommendation)
+	argonTime    = 3
+	argonMemory  = 64 * 1024 // KiB
+	argonThreads = 4
+
+	// minPassphraseLength is the shortest passphrase accepted for a new repository.
+	minPassphraseLength = 8
+
+	// maxKeyFileSize bounds what is read from --key-file.
+	maxKeyFileSize = 1024 * 1024
+)
+
+var (
+	// errKeyRequired is returned when an encrypted repository is opened without a key.
+	errKeyRequired = errors.New("this backup is encrypted: a passphrase or key file is required")
+
+	// errWrongKey is returned when the passphrase or key file does not unlock the repository.
+	errWrongKey = errors.New("wrong passphrase or key file")
+)
+
+// RepositoryEncryption holds the non-secret encryption parameters of a repository.
+type RepositoryEncryption struct {
+	Cipher     string `json:"cipher"`
+	KDF        string `json:"kdf"`
+	KeySource  string `json:"key_source"` // KeySourcePassphrase or KeySourceKeyFile
+	Salt       []byte `json:"salt"`
+	Time       uint32 `json:"time"`
+	Memory     uint32 `json:"memory_kib"`
+	Threads    uint8  `json:"threads"`
+	WrappedKey []byte `json:"wrapped_key"` // Master key sealed with the derived key
+}
+
+// EncryptionInfo is the summary of a repository's encryption recorded in the manifest.
+type EncryptionInfo struct {
+	Cipher    string `json:"cipher"`
+	KDF       string `json:"kdf"`
+	KeySource string `json:"key_source"`
+}
+
+// repositoryKey is an unlocked master key.
+type repositoryKey struct {
+	aead  cipher.AEAD
+	idKey []byte // HMAC key for chunk names
+}
+
+var (
+	// encryptionRequested makes new repositories encrypted (--encrypt).
+	encryptionRequested bool
+
+	// backupSecret is the passphrase or key file content for this session.
+	secretMu     sync.Mutex
+	backupSecret []byte
+	secretSource string
+
+	// unlockedKeys caches master keys by repository id, since argon2id is slow by design.
+	unlockedKeys = make(map[string]*repositoryKey)
+)
+
+// SetEncryption makes new backups encrypted (--encrypt). Only repository backups
+// can be encrypted, so the repository format becomes the default; an explicit
+// other --format is refused rather than silently written in plaintext.
+func SetEncryption(enabled bool) error {
+	if enabled && backupFormatChosen && backupFormat != BackupFormatRepository {
+		return fmt.Errorf("%s backups cannot be encrypted - leave out --format or use --format %s", backupFormat, BackupFormatRepository)
+	}
+	encryptionRequested = enabled
+	if enabled {
+		backupFormat = BackupFormatRepository
+	}
+	return nil
+}
+
+// SetKeyFile uses the content of a file as the encryption key (--key-file).
+func SetKeyFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("cannot read key file: %v", err)
+	}
+	defer f.Close()
+	data, err := io.ReadAll(io.LimitReader(f, maxKeyFileSize+1))
+	if err != nil {
+		return fmt.Errorf("cannot read key file: %v", err)
+	}
+	if len(data) > maxKeyFileSize {
+		return fmt.Errorf("key file is larger than %s", FormatBytes(maxKeyFileSize))
+	}
+	if len(data) < 32 {
+		return fmt.Errorf("key file must hold at least 32 bytes")
+	}
+	setBackupSecret(data, KeySourceKeyFile)
+	return nil
+}
+
+// setBackupSecret stores the passphrase or key file content for this session.
+func setBackupSecret(secret []byte, source string) {
+	secretMu.Lock()
+	defer secretMu.Unlock()
+	backupSecret = append([]byte(nil), secret...)
+	secretSource = source
+}
+
+// haveBackupSecret reports whether a passphrase or key file has been given.
+func haveBackupSecret() bool {
+	secretMu.Lock()
+	defer secretMu.Unlock()
+	return backupSecret != nil
+}
+
+// currentSecret returns the session's secret and where it came from.
+func currentSecret() ([]byte, string) {
+	secretMu.Lock()
+	defer secretMu.Unlock()
+	return backupSecret, secretSource
+}
+
+// newRepositoryEncryption creates the master key of a new repository and wraps it
+// with the session's secret.
+func newRepositoryEncryption() (*RepositoryEncryption, error) {
+	secret, source := currentSecret()
+	if secret == nil {
+		return nil, errKeyRequired
+	}
+
+	enc := &RepositoryEncryption{
+		Cipher:    encryptionCipher,
+		KDF:       encryptionKDF,
+		KeySource: source,
+		Salt:      make([]byte, 16),
+		Time:      argonTime,
+		Memory:    argonMemory,
+		Threads:   argonThreads,
+	}
+	master := make([]byte, 64)
+	if _, err := rand.Read(enc.Salt); err != nil {
+		return nil, fmt.Errorf("failed to generate salt: %v", err)
+	}
+	if _, err := rand.Read(master); err != nil {
+		return nil, fmt.Errorf("failed to generate master key: %v", err)
+	}
+
+	wrapper, err := newAEAD(enc.derive(secret))
+	if err != nil {
+		return nil, err
+	}
+	enc.WrappedKey, err = seal(wrapper, master, []byte(encryptionCipher))
+	if err != nil {
+		return nil, err
+	}
+	return enc, nil
+}
+
+// derive computes the key-encryption key from a secret.
+func (enc *RepositoryEncryption) derive(secret []byte) []byte {
+	return argon2.IDKey(secret, enc.Salt, enc.Time, enc.Memory, enc.Threads, 32)
+}
+
+// unlock returns the master key of the repository with the given id, using the
+// session's secret.
+func (enc *RepositoryEncryption) unlock(repositoryID string) (*repositoryKey, error) {
+	secretMu.Lock()
+	cached := unlockedKeys[repositoryID]
+	secretMu.Unlock()
+	if cached != nil {
+		return cached, nil
+	}
+
+	if enc.Cipher != encryptionCipher || enc.KDF != encryptionKDF {
+		return nil, fmt.Errorf("unsupported encryption %s/%s", enc.Cipher, enc.KDF)
+	}
+	secret, _ := currentSecret()
+	if secret == nil {
+		return nil, errKeyRequired
+	}
+
+	wrapper, err := newAEAD(enc.derive(secret))
+	if err != nil {
+		return nil, err
+	}
+	master, err := open(wrapper, enc.WrappedKey, []byte(encryptionCipher))
+	if err != nil || len(master) != 64 {
+		return nil, errWrongKey
+	}
+
+	aead, err := newAEAD(master[:32])
+	if err != nil {
+		return nil, err
+	}
+	key := &repositoryKey{aead: aead, idKey: master[32:]}
+
+	secretMu.Lock()
+	unlockedKeys[repositoryID] = key
+	secretMu.Unlock()
+	return key, nil
+}
+
+// info summarizes the parameters for the manifest.
+func (enc *RepositoryEncryption) info() *EncryptionInfo {
+	return &EncryptionInfo{Cipher: enc.Cipher, KDF: enc.KDF, KeySource: enc.KeySource}
+}
+
+// chunkName returns the keyed name of a chunk, so equal names do not reveal equal plaintext.
+func (k *repositoryKey) chunkName(data []byte) string {
+	mac := hmac.New(sha256.New, k.idKey)
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// newAEAD returns AES-256-GCM for a 32-byte key.
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create cipher: %v", err)
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts plaintext with a random nonce, bound to additionalData. The
+// nonce is prepended to the result.
+func seal(aead cipher.AEAD, plaintext, additionalData []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, fmt.Errorf("failed to generate nonce: %v", err)
+	}
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+// open decrypts the output of seal.
+func open(aead cipher.AEAD, sealed, additionalData []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize()+aead.Overhead() {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+	nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, additionalData)
+}
+
+// repositoryEncryption returns the encryption parameters of the repository on a
+// backup drive, or nil if there is no repository or it is not encrypted.
+func repositoryEncryption(mountPoint string) *RepositoryEncryption {
+	config, err := readRepositoryConfig(repositoryPath(mountPoint))
+	if err != nil {
+		return nil
+	}
+	return config.Encryption
+}
+
+// checkBackupPassphrase tries a passphrase against the repository on a drive and
+// keeps it for the session if it unlocks the repository (or if the repository
+// does not exist yet).
+func checkBackupPassphrase(mountPoint, passphrase string) error {
+	config, err := readRepositoryConfig(repositoryPath(mountPoint))
+	if err != nil || config.Encryption == nil {
+		if len(passphrase) < minPassphraseLength {
+			return fmt.Errorf("use at least %d characters", minPassphraseLength)
+		}
+		setBackupSecret([]byte(passphrase), KeySourcePassphrase)
+		return nil
+	}
+
+	// Keep the previous secret if this one is wrong
+	previous, previousSource := currentSecret()
+	setBackupSecret([]byte(passphrase), KeySourcePassphrase)
+	if _, err := config.Encryption.unlock(config.ID); err != nil {
+		if previous != nil {
+			setBackupSecret(previous, previousSource)
+		} else {
+			secretMu.Lock()
+			backupSecret = nil
+			secretMu.Unlock()
+		}
+		return err
+	}
+	return nil
+}
+
+// needsBackupPassphrase reports whether an operation on the backup at mountPoint
+// must ask for the passphrase first, and whether it will create a new encrypted
+// repository (so the passphrase should be entered twice).
+func needsBackupPassphrase(operation, mountPoint string) (needed, create bool) {
+	if haveBackupSecret() {
+		return false, false
+	}
+	encrypted := repositoryEncryption(mountPoint) != nil
+
+	switch operation {
+	case "system_backup", "home_backup":
+		if encrypted {
+			return true, false
+		}
+		if encryptionRequested && backupFormat == BackupFormatRepository {
+			_, err := readRepositoryConfig(repositoryPath(mountPoint))
+			return os.IsNotExist(err), os.IsNotExist(err)
+		}
+	case "system_restore", "home_restore", "custom_restore", "system_verify", "home_verify", "auto_verify":
+		return encrypted && isRepositoryBackup(mountPoint), false
+	}
+	return false, false
+}
+
+// backupEncrypted reports whether a repository backup to mountPoint is encrypted:
+// either the repository there already is, or --encrypt will create it encrypted.
+func backupEncrypted(mountPoint string) bool {
+	return encryptionRequested || repositoryEncryption(mountPoint) != nil
+}
@@ -15,6 +15,7 @@
 package internal
 
 import (
+	"bytes"
 	"context"
 	"crypto/sha256"
 	"encoding/hex"
@@ -109,6 +110,13 @@ func syncDirectories(src, dst string, logFile *os.File) error {
 // This function solves the critical issue where traditional exclusion logic would exclude
 // parent folders and all their contents, even when specific subfolders should be included.
 func syncDirectoriesWithSelectiveInclusions(src, dst string,
+	excludePatterns []string, selectedSubfolders map[string]bool, logFile *os.File) error {
+	return syncStoresWithSelectiveInclusions(NewLocalStore(src), NewLocalStore(dst), excludePatterns, selectedSubfolders, logFile)
+}
+
+// syncStoresWithSelectiveInclusions is syncDirectoriesWithSelectiveInclusions
+// between two stores. Selected subfolders are paths as src.Path reports them.
+func syncStoresWithSelectiveInclusions(src, dst Store,
 	excludePatterns []string, selectedSubfolders map[string]bool, logFile *os.File) error {
 	// Check for cancellation before starting
 	if shouldCancelBackup() {
@@ -116,7 +124,7 @@ func syncDirectoriesWithSelectiveInclusions(src, dst string,
 	}
 
 	// Get the device ID of the source directory to enforce -x (no crossing filesystem boundaries)
-	srcStat, err := os.Lstat(src)
+	srcStat, err := src.Lstat(".")
 	if err != nil {
 		return err
 	}
@@ -125,9 +133,10 @@ func syncDirectoriesWithSelectiveInclusions(src, dst string,
 		return fmt.Errorf("cannot get stat for %s", src)
 	}
 	srcDev := srcSysStat.Dev
+	srcRoot := src.Path(".")
 
 	if logFile != nil {
-		fmt.Fprintf(logFile, "Starting HIERARCHICAL directory walk of %s\n", src)
+		fmt.Fprintf(logFile, "Starting HIERARCHICAL directory walk of %s\n", srcRoot)
 		fmt.Fprintf(logFile, "Selected subfolders for smart inclusion: %v\n", selectedSubfolders)
 	}
 
@@ -137,16 +146,36 @@ func syncDirectoriesWithSelectiveInclusions(src, dst string,
 
 	if logFile != nil {
 		fmt.Fprintf(logFile, "Using exclusion patterns: %v\n", excludePatterns)
+		fmt.Fprintf(logFile, "Using %d copy workers\n", syncWorkers)
+		fmt.Fprintf(logFile, "Throttle: %s\n", throttleStatus())
 	}
 
+	// Apply the I/O class and nice level to threads started since they were set
+	if err := applyProcessPriority(); err != nil && logFile != nil {
+		fmt.Fprintf(logFile, "Warning: could not set process priority: %v\n", err)
+	}
+
+	// The walker creates directories and queues regular files for the copy workers
+	pool := newSyncPool(src, dst, syncWorkers, logFile)
+
 	// Walk through the source directory efficiently with hierarchical awareness
-	err = filepath.WalkDir(src, func(path string, d os.DirEntry, err error) error {
+	err = walkStoreTree(src, ".", func(name string, info os.FileInfo, err error) error {
 		// Check for cancellation less frequently for better performance
 		fileCounter++
 		if fileCounter%5000 == 0 && shouldCancelBackup() { // Check every 5000 files for responsiveness
 			return fmt.Errorf("operation canceled")
 		}
 
+		// A fatal worker error (out of space) stops the walk
+		if pool.failed.Load() {
+			return pool.err
+		}
+
+		// Directories the walk has moved past get their metadata once their files are written
+		pool.advance(name)
+
+		path := src.Path(name)
+
 		// Update current directory for TUI display much more frequently
 		if fileCounter%500 == 0 { // Update display every 500 files instead of 10k
 			currentDir := filepath.Dir(path)
@@ -190,12 +219,12 @@ func syncDirectoriesWithSelectiveInclusions(src, dst string,
 					fullPattern = pattern
 				} else {
 					// Relative pattern - make it relative to source
-					fullPattern = filepath.Join(src, pattern)
+					fullPattern = filepath.Join(srcRoot, pattern)
 				}
 
 				// Custom pattern matching for complex exclusion patterns
 				if matchesExclusionPattern(path, fullPattern) {
-					if d.IsDir() {
+					if info.IsDir() {
 						if logFile != nil && fileCounter%50000 == 0 {
 							fmt.Fprintf(logFile, "Skipping excluded directory: %s (matched pattern: %s)\n", path, fullPattern)
 						}
@@ -207,23 +236,12 @@ func syncDirectoriesWithSelectiveInclusions(src, dst string,
 			}
 		}
 
-		// Compute the destination path
-		relPath, err := filepath.Rel(src, path)
-		if err != nil {
-			return nil
-		}
-		dstPath := filepath.Join(dst, relPath)
+		// The destination has the same name
+		dstPath := dst.Path(name)
 
 		// Handle directories
-		if d.IsDir() {
-			fi, err := os.Lstat(path)
-			if err != nil {
-				if logFile != nil {
-					fmt.Fprintf(logFile, "Warning: could not stat directory %s: %v\n", path, err)
-				}
-				return nil // Skip this directory but continue
-			}
-			stat, ok := fi.Sys().(*syscall.Stat_t)
+		if info.IsDir() {
+			stat, ok := info.Sys().(*syscall.Stat_t)
 			if !ok {
 				if logFile != nil {
 					fmt.Fprintf(logFile, "Warning: could not get stat info for %s\n", path)
@@ -247,42 +265,39 @@ func syncDirectoriesWithSelectiveInclusions(src, dst string,
 			}
 
 			// Create the directory if it doesn't exist using MkdirAll for safety
-			err = os.MkdirAll(dstPath, fi.Mode())
+			err = dst.MkdirAll(name, info.Mode())
 			if err != nil {
 				if logFile != nil {
 					fmt.Fprintf(logFile, "ERROR: Failed to create directory %s: %v (continuing)\n", dstPath, err)
 				}
 				// Continue processing - don't skip the directory contents!
-			} else {
-				// Set ownership and timestamps only if directory creation succeeded
-				os.Lchown(dstPath, int(stat.Uid), int(stat.Gid))
-				os.Chtimes(dstPath, fi.ModTime(), fi.ModTime())
+				// There is no directory to set metadata on, so it is not entered
+				return nil
 			}
+
+			// Ownership, mode and timestamps are set after the directory's contents
+			pool.enter(name, info)
 			return nil // Continue processing directory contents
 		}
 
 		// Handle symbolic links
-		if d.Type()&os.ModeSymlink != 0 {
-			target, err := os.Readlink(path)
+		if info.Mode()&os.ModeSymlink != 0 {
+			target, err := src.Readlink(name)
 			if err != nil {
 				return nil
 			}
-			os.Symlink(target, dstPath)
+			dst.Symlink(target, name)
 			return nil
 		}
 
 		// Handle regular files with smart tracking (same as original function)
-		if d.Type().IsRegular() {
+		if info.Mode().IsRegular() {
 			// Count this file in our local counter (batch atomic operations)
 			localFilesFound++
 
 			// Log slow file processing to identify bottlenecks
 			if localFilesFound%1000 == 0 && logFile != nil {
-				if info, err := d.Info(); err == nil {
-					fmt.Fprintf(logFile, "Processing file %d: %s (size: %s)\n", localFilesFound, path, FormatBytes(info.Size()))
-				} else {
-					fmt.Fprintf(logFile, "Processing file %d: %s\n", localFilesFound, path)
-				}
+				fmt.Fprintf(logFile, "Processing file %d: %s (size: %s)\n", localFilesFound, path, FormatBytes(info.Size()))
 			}
 
 			// Batch update atomic counter every 1000 files for performance
@@ -293,56 +308,8 @@ func syncDirectoriesWithSelectiveInclusions(src, dst string,
 				}
 			}
 
-			// Quick paths for known scenarios
-			// PERFORMANCE OPTIMIZATION: Use faster file existence check
-			if _, err := os.Stat(dstPath); os.IsNotExist(err) {
-				// Destination doesn't exist - definitely need to copy
-				err = copyFileEfficient(path, dstPath)
-				if err != nil {
-					if logFile != nil {
-						fmt.Fprintf(logFile, "Error copying %s: %v\n", path, err)
-					}
-					// Check for fatal disk space errors
-					if isSpaceError(err) {
-						spaceInfo := getSpaceErrorDetails(filepath.Dir(dstPath))
-						return fmt.Errorf("⚠️ OUT OF SPACE during backup\n\nError copying file: %s\nSpace error: %v\n\n%s\n\nThe backup drive is full. Please use a larger drive or select fewer folders.", path, err, spaceInfo)
-					}
-				} else {
-					atomic.AddInt64(&filesCopied, 1)
-					// Track copied files for verification (thread-safe)
-					copiedFilesListMutex.Lock()
-					copiedFilesList = append(copiedFilesList, path)
-					copiedFilesListMutex.Unlock()
-
-				}
-				return nil
-			}
-
-			// Use optimized filesAreIdentical with rsync-style comparison
-			if filesAreIdentical(path, dstPath) {
-				atomic.AddInt64(&filesSkipped, 1)
-				return nil
-			}
-
-			// Files are different - copy
-			err = copyFileEfficient(path, dstPath)
-			if err != nil {
-				if logFile != nil {
-					fmt.Fprintf(logFile, "Error copying %s: %v\n", path, err)
-				}
-				// Check for fatal disk space errors
-				if isSpaceError(err) {
-					spaceInfo := getSpaceErrorDetails(filepath.Dir(dstPath))
-					return fmt.Errorf("⚠️ OUT OF SPACE during backup\n\nError copying file: %s\nSpace error: %v\n\n%s\n\nThe backup drive is full. Please use a larger drive or select fewer folders.", path, err, spaceInfo)
-				}
-			} else {
-				atomic.AddInt64(&filesCopied, 1)
-				// Track copied files for verification (thread-safe)
-				copiedFilesListMutex.Lock()
-				copiedFilesList = append(copiedFilesList, path)
-				copiedFilesListMutex.Unlock()
-
-			}
+			// Compare and copy on a worker
+			pool.submit(name, info)
 			return nil
 		}
 
@@ -359,7 +326,10 @@ func syncDirectoriesWithSelectiveInclusions(src, dst string,
 	// Mark directory walk as complete
 	directoryWalkComplete = true
 
-	// Log final summary
+	// Let the workers drain the queue and finish directory metadata
+	if poolErr := pool.finish(); err == nil {
+		err = poolErr
+	}
 
 	return err
 }
@@ -376,13 +346,19 @@ func syncDirectoriesWithSelectiveInclusions(src, dst string,
 // The function respects filesystem boundaries, handles permissions and timestamps,
 // and provides detailed progress feedback through global counters.
 func syncDirectoriesWithExclusions(src, dst string, excludePatterns []string, logFile *os.File) error {
+	return syncStoresWithExclusions(NewLocalStore(src), NewLocalStore(dst), excludePatterns, logFile)
+}
+
+// syncStoresWithExclusions makes dst a copy of src, whatever backs either side.
+// Exclusion patterns match against src.Path, so absolute patterns keep working.
+func syncStoresWithExclusions(src, dst Store, excludePatterns []string, logFile *os.File) error {
 	// Check for cancellation before starting
 	if shouldCancelBackup() {
 		return fmt.Errorf("operation canceled")
 	}
 
 	// Get the device ID of the source directory to enforce -x (no crossing filesystem boundaries)
-	srcStat, err := os.Lstat(src)
+	srcStat, err := src.Lstat(".")
 	if err != nil {
 		return err
 	}
@@ -391,9 +367,10 @@ func syncDirectoriesWithExclusions(src, dst string, excludePatterns []string, lo
 		return fmt.Errorf("cannot get stat for %s", src)
 	}
 	srcDev := srcSysStat.Dev
+	srcRoot := src.Path(".")
 
 	if logFile != nil {
-		fmt.Fprintf(logFile, "Starting directory walk of %s\n", src)
+		fmt.Fprintf(logFile, "Starting directory walk of %s\n", srcRoot)
 	}
 
 	// Counter to periodically check for cancellation and show progress
@@ -402,16 +379,36 @@ func syncDirectoriesWithExclusions(src, dst string, excludePatterns []string, lo
 
 	if logFile != nil {
 		fmt.Fprintf(logFile, "Using exclusion patterns: %v\n", excludePatterns)
+		fmt.Fprintf(logFile, "Using %d copy workers\n", syncWorkers)
+		fmt.Fprintf(logFile, "Throttle: %s\n", throttleStatus())
 	}
 
+	// Apply the I/O class and nice level to threads started since they were set
+	if err := applyProcessPriority(); err != nil && logFile != nil {
+		fmt.Fprintf(logFile, "Warning: could not set process priority: %v\n", err)
+	}
+
+	// The walker creates directories and queues regular files for the copy workers
+	pool := newSyncPool(src, dst, syncWorkers, logFile)
+
 	// Walk through the source directory efficiently
-	err = filepath.WalkDir(src, func(path string, d os.DirEntry, err error) error {
+	err = walkStoreTree(src, ".", func(name string, info os.FileInfo, err error) error {
 		// Check for cancellation less frequently for better performance
 		fileCounter++
 		if fileCounter%5000 == 0 && shouldCancelBackup() { // Check every 5000 files for responsiveness
 			return fmt.Errorf("operation canceled")
 		}
 
+		// A fatal worker error (out of space) stops the walk
+		if pool.failed.Load() {
+			return pool.err
+		}
+
+		// Directories the walk has moved past get their metadata once their files are written
+		pool.advance(name)
+
+		path := src.Path(name)
+
 		// Update current directory for TUI display much more frequently
 		if fileCounter%500 == 0 { // Update display every 500 files instead of 10k
 			currentDir := filepath.Dir(path)
@@ -441,12 +438,12 @@ func syncDirectoriesWithExclusions(src, dst string, excludePatterns []string, lo
 				fullPattern = pattern
 			} else {
 				// Relative pattern - make it relative to source
-				fullPattern = filepath.Join(src, pattern)
+				fullPattern = filepath.Join(srcRoot, pattern)
 			}
 
 			// Custom pattern matching for complex exclusion patterns
 			if matchesExclusionPattern(path, fullPattern) {
-				if d.IsDir() {
+				if info.IsDir() {
 					if logFile != nil && fileCounter%50000 == 0 {
 						fmt.Fprintf(logFile, "Skipping excluded directory: %s (matched pattern: %s)\n", path, fullPattern)
 					}
@@ -457,23 +454,25 @@ func syncDirectoriesWithExclusions(src, dst string, excludePatterns []string, lo
 			}
 		}
 
-		// Compute the destination path
-		relPath, err := filepath.Rel(src, path)
-		if err != nil {
+		// A repository or archive left on a drive that now holds a mirror backup is not restored
+		if info.IsDir() && name == repositoryDir && isRepositoryDir(path) {
+			return filepath.SkipDir
+		}
+		if info.IsDir() && name == archiveDir && isArchiveDir(path) {
+			return filepath.SkipDir
+		}
+
+		// The destination has the same name
+		dstPath := dst.Path(name)
+
+		// Leave this machine's identity files alone when the restore keeps them
+		if !info.IsDir() && keepHostIdentityFile(dstPath, func() (io.ReadCloser, error) { return src.Open(name) }) {
 			return nil
 		}
-		dstPath := filepath.Join(dst, relPath)
 
 		// Handle directories
-		if d.IsDir() {
-			fi, err := os.Lstat(path)
-			if err != nil {
-				if logFile != nil {
-					fmt.Fprintf(logFile, "Warning: could not stat directory %s: %v\n", path, err)
-				}
-				return nil // Skip this directory but continue
-			}
-			stat, ok := fi.Sys().(*syscall.Stat_t)
+		if info.IsDir() {
+			stat, ok := info.Sys().(*syscall.Stat_t)
 			if !ok {
 				if logFile != nil {
 					fmt.Fprintf(logFile, "Warning: could not get stat info for %s\n", path)
@@ -496,43 +495,51 @@ func syncDirectoriesWithExclusions(src, dst string, excludePatterns []string, lo
 				}
 			}
 
+			// Record the directory for rollback before a restore changes it
+			rollbackBeforeDirectory(dstPath)
+
 			// Create the directory if it doesn't exist using MkdirAll for safety
-			err = os.MkdirAll(dstPath, fi.Mode())
+			err = dst.MkdirAll(name, info.Mode())
 			if err != nil {
 				if logFile != nil {
 					fmt.Fprintf(logFile, "ERROR: Failed to create directory %s: %v (continuing)\n", dstPath, err)
 				}
 				// Continue processing - don't skip the directory contents!
-			} else {
-				// Set ownership and timestamps only if directory creation succeeded
-				os.Lchown(dstPath, int(stat.Uid), int(stat.Gid))
-				os.Chtimes(dstPath, fi.ModTime(), fi.ModTime())
+				// There is no directory to set metadata on, so it is not entered
+				return nil
 			}
+
+			// Ownership, mode and timestamps are set after the directory's contents
+			pool.enter(name, info)
 			return nil // Continue processing directory contents
 		}
 
 		// Handle symbolic links
-		if d.Type()&os.ModeSymlink != 0 {
-			target, err := os.Readlink(path)
+		if info.Mode()&os.ModeSymlink != 0 {
+			target, err := src.Readlink(name)
 			if err != nil {
 				return nil
 			}
-			os.Symlink(target, dstPath)
+			if _, err := dst.Lstat(name); os.IsNotExist(err) {
+				if err := rollbackBeforeWrite(dstPath); err != nil {
+					if logFile != nil {
+						fmt.Fprintf(logFile, "Skipping %s: %v\n", dstPath, err)
+					}
+					return nil
+				}
+			}
+			dst.Symlink(target, name)
 			return nil
 		}
 
 		// Handle regular files with smart tracking
-		if d.Type().IsRegular() {
+		if info.Mode().IsRegular() {
 			// Count this file in our local counter (batch atomic operations)
 			localFilesFound++
 
 			// Log slow file processing to identify bottlenecks
 			if localFilesFound%1000 == 0 && logFile != nil {
-				if info, err := d.Info(); err == nil {
-					fmt.Fprintf(logFile, "Processing file %d: %s (size: %s)\n", localFilesFound, path, FormatBytes(info.Size()))
-				} else {
-					fmt.Fprintf(logFile, "Processing file %d: %s\n", localFilesFound, path)
-				}
+				fmt.Fprintf(logFile, "Processing file %d: %s (size: %s)\n", localFilesFound, path, FormatBytes(info.Size()))
 			}
 
 			// Batch update atomic counter every 1000 files for performance
@@ -543,74 +550,8 @@ func syncDirectoriesWithExclusions(src, dst string, excludePatterns []string, lo
 				}
 			}
 
-			// Quick paths for known scenarios
-			// PERFORMANCE OPTIMIZATION: Use faster file existence check
-			dstStat, err := os.Stat(dstPath)
-			if os.IsNotExist(err) {
-				// Destination doesn't exist - definitely need to copy
-				err = copyFileEfficient(path, dstPath)
-				if err != nil {
-					if logFile != nil {
-						fmt.Fprintf(logFile, "Error copying %s: %v\n", path, err)
-					}
-					// Check for fatal disk space errors
-					if isSpaceError(err) {
-						spaceInfo := getSpaceErrorDetails(filepath.Dir(dstPath))
-						return fmt.Errorf("⚠️ OUT OF SPACE during backup\n\nError copying file: %s\nSpace error: %v\n\n%s\n\nThe backup drive is full. Please use a larger drive or select fewer folders.", path, err, spaceInfo)
-					}
-				} else {
-					atomic.AddInt64(&filesCopied, 1)
-					// Track copied files for verification (thread-safe)
-					copiedFilesListMutex.Lock()
-					copiedFilesList = append(copiedFilesList, path)
-					copiedFilesListMutex.Unlock()
-
-				}
-				return nil
-			}
-
-			// Optimize file comparison for large files - get source info ONCE
-			// PERFORMANCE OPTIMIZATION: Get source info first, then use it efficiently
-			srcInfo, err := d.Info()
-			if err != nil {
-				return nil // Skip files we can't stat
-			}
-
-			// LARGE FILE FAST-PATH: For large files, use optimized comparison
-			if dstStat.Size() > 500*1024*1024 { // 500MB threshold
-				// For large files, do immediate size comparison without extra syscalls
-				if srcInfo.Size() == dstStat.Size() {
-					atomic.AddInt64(&filesSkipped, 1)
-					return nil
-				}
-				// Sizes don't match - fall through to copy
-			} else {
-				// Regular file size comparison
-				if srcInfo.Size() == dstStat.Size() {
-					atomic.AddInt64(&filesSkipped, 1)
-					return nil
-				}
-			}
-
-			// Files are different - copy
-			err = copyFileEfficient(path, dstPath)
-			if err != nil {
-				if logFile != nil {
-					fmt.Fprintf(logFile, "Error copying %s: %v\n", path, err)
-				}
-				// Check for fatal disk space errors
-				if isSpaceError(err) {
-					spaceInfo := getSpaceErrorDetails(filepath.Dir(dstPath))
-					return fmt.Errorf("⚠️ OUT OF SPACE during backup\n\nError copying file: %s\nSpace error: %v\n\n%s\n\nThe backup drive is full. Please use a larger drive or select fewer folders.", path, err, spaceInfo)
-				}
-			} else {
-				atomic.AddInt64(&filesCopied, 1)
-				// Track copied files for verification (thread-safe)
-				copiedFilesListMutex.Lock()
-				copiedFilesList = append(copiedFilesList, path)
-				copiedFilesListMutex.Unlock()
-
-			}
+			// Compare and copy on a worker
+			pool.submit(name, info)
 			return nil
 		}
 
@@ -627,14 +568,17 @@ func syncDirectoriesWithExclusions(src, dst string, excludePatterns []string, lo
 	// Mark directory walk as complete
 	directoryWalkComplete = true
 
-	// Log final summary
+	// Let the workers drain the queue and finish directory metadata
+	if poolErr := pool.finish(); err == nil {
+		err = poolErr
+	}
 
 	return err
 }
 
-// copyFileEfficient performs optimized file copying with variable buffer sizes and metadata preservation.
+// copyFileEfficient performs optimized file copying with metadata preservation.
 // Features:
-//   - Dynamic buffer sizing (64KB standard, 1MB for files >100MB)
+//   - Reflinks and copy_file_range before a buffered copy (see copyFileData)
 //   - Automatic directory creation for destination path
 //   - Complete metadata preservation (permissions, ownership, timestamps)
 //   - Assumes files have already been determined to be different (no duplicate checking)
@@ -664,41 +608,25 @@ func copyFileEfficient(src, dst string) error {
 	}
 	defer dstFile.Close()
 
-	// OPTIMIZED: Modern SSD/NVMe buffer sizes for maximum performance
-	bufSize := 256 * 1024         // 256KB default (4x faster than old 64KB)
-	if fi.Size() > 10*1024*1024 { // Files >10MB get 2MB buffer
-		bufSize = 2 * 1024 * 1024
-	}
-	if fi.Size() > 100*1024*1024 { // Files >100MB get 4MB buffer for NVMe
-		bufSize = 4 * 1024 * 1024
-	}
-
-	// Copy file contents with optimized buffer
-	buffer := make([]byte, bufSize)
-	_, err = io.CopyBuffer(dstFile, srcFile, buffer)
-	if err != nil {
+	// Reflink, then in-kernel copy, then buffered copy
+	if err := copyFileData(dstFile, srcFile, fi.Size()); err != nil {
 		return err
 	}
 
-	// Set permissions and ownership
+	// Set ownership and permissions - chown first, since it clears setuid/setgid bits
 	stat, ok := fi.Sys().(*syscall.Stat_t)
 	if ok {
+		uid, gid := remapOwner(stat.Uid, stat.Gid)
+		os.Chown(dst, uid, gid)
 		os.Chmod(dst, fi.Mode())
-		os.Chown(dst, int(stat.Uid), int(stat.Gid))
 		os.Chtimes(dst, fi.ModTime(), fi.ModTime())
 	}
 
 	return nil
 }
 
-// filesAreIdentical performs intelligent file comparison optimized for incremental backups.
-// Uses a multi-stage approach:
-//  1. Fast size comparison (most effective for incremental backups)
-//  2. Empty file optimization (immediate return for zero-byte files)
-//  3. Size-match assumption for performance (skips expensive hash/timestamp checks)
-//
-// This approach is optimized for the common case where files are either completely
-// different or completely identical, making it ideal for backup scenarios.
+// filesAreIdentical reports whether dst already holds the current version of src,
+// using the comparison mode of the operation in progress (see destinationMatches).
 func filesAreIdentical(src, dst string) bool {
 	// Get file info for both files
 	srcInfo, err := os.Stat(src)
@@ -711,21 +639,8 @@ func filesAreIdentical(src, dst string) bool {
 		return false // Destination doesn't exist
 	}
 
-	// Quick size comparison first (fastest check)
-	if srcInfo.Size() != dstInfo.Size() {
-		return false
-	}
-
-	// For empty files, if sizes match (both 0), they're identical
-	if srcInfo.Size() == 0 {
-		return true
-	}
-
-	// RSYNC-STYLE OPTIMIZATION: Check timestamp after size match
-	// If sizes match AND destination is newer or equal, skip copying
-	// This matches rsync's default behavior and is much faster than SHA256
-	// Only copy if source is newer than destination
-	return !srcInfo.ModTime().After(dstInfo.ModTime())
+	return destinationMatches(NewLocalStore(filepath.Dir(src)), filepath.Base(src), srcInfo,
+		NewLocalStore(filepath.Dir(dst)), filepath.Base(dst), dstInfo)
 }
 
 // filesHashIdentical performs SHA256-based file comparison for small files.
@@ -751,20 +666,33 @@ func filesHashIdentical(src, dst string) bool {
 //   - 4KB samples at start, middle, end positions
 //   - Additional quarter and three-quarter samples for files >100MB
 //   - Much faster than full hash comparison while maintaining high accuracy
-func largFilesIdentical(src, dst string, size int64) bool {
+//
+// Stores whose readers cannot read at an offset are compared by full hash instead.
+func largFilesIdentical(src Store, srcName string, dst Store, dstName string, size int64) bool {
 	// Open both files
-	srcFile, err := os.Open(src)
+	srcFile, err := src.Open(srcName)
 	if err != nil {
 		return false
 	}
 	defer srcFile.Close()
 
-	dstFile, err := os.Open(dst)
+	dstFile, err := dst.Open(dstName)
 	if err != nil {
 		return false
 	}
 	defer dstFile.Close()
 
+	srcAt, srcOK := srcFile.(io.ReaderAt)
+	dstAt, dstOK := dstFile.(io.ReaderAt)
+	if !srcOK || !dstOK {
+		srcHash, err := getStoreFileSHA256(src, srcName)
+		if err != nil {
+			return false
+		}
+		dstHash, err := getStoreFileSHA256(dst, dstName)
+		return err == nil && srcHash == dstHash
+	}
+
 	// Sample strategy: check beginning, middle, and end
 	sampleSize := int64(4096) // 4KB samples
 	positions := []int64{
@@ -793,17 +721,12 @@ func largFilesIdentical(src, dst string, size int64) bool {
 		srcBuf := make([]byte, sampleSize)
 		dstBuf := make([]byte, sampleSize)
 
-		srcFile.Seek(pos, 0)
-		dstFile.Seek(pos, 0)
-
-		srcFile.Read(srcBuf)
-		dstFile.Read(dstBuf)
+		srcAt.ReadAt(srcBuf, pos)
+		dstAt.ReadAt(dstBuf, pos)
 
 		// If any sample differs, files are different
-		for i := range srcBuf {
-			if srcBuf[i] != dstBuf[i] {
-				return false
-			}
+		if !bytes.Equal(srcBuf, dstBuf) {
+			return false
 		}
 	}
 
@@ -815,21 +738,28 @@ func largFilesIdentical(src, dst string, size int64) bool {
 // Uses streaming IO to handle large files efficiently without loading entire file into memory.
 // Returns hex-encoded hash string for easy comparison and storage.
 func getFileSHA256(filePath string) (string, error) {
+	return getStoreFileSHA256(NewLocalStore(filepath.Dir(filePath)), filepath.Base(filePath))
+}
+
+// getStoreFileSHA256 is getFileSHA256 for a file of a store.
+func getStoreFileSHA256(store Store, name string) (string, error) {
+	filePath := store.Path(name)
+
 	// Create context with timeout based on file size
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	defer cancel()
 
-	file, err := os.Open(filePath)
+	// Get file size for progress reporting
+	info, err := store.Stat(name)
 	if err != nil {
 		return "", err
 	}
-	defer file.Close()
 
-	// Get file size for progress reporting
-	info, err := file.Stat()
+	file, err := store.Open(name)
 	if err != nil {
 		return "", err
 	}
+	defer file.Close()
 
 	// Adjust timeout for larger files
 	if info.Size() > 1024*1024*1024 { // 1GB
@@ -923,6 +853,13 @@ func deleteExtraFilesFromBackupWithExclusions(sourcePath, backupPath string, exc
 // For selective backups, it checks both file existence and folder selection.
 // For regular backups, it only checks file existence (selectedFolders = nil).
 func deleteExtraFilesFromBackupWithSelectiveSupport(sourcePath, backupPath string, excludePatterns []string, selectedFolders map[string]bool, logFile *os.File) error {
+	return deleteExtraStoreFiles(NewLocalStore(sourcePath), NewLocalStore(backupPath), selectedFolders, logFile)
+}
+
+// deleteExtraStoreFiles removes everything from backup that source no longer
+// has, or that lies outside selectedFolders (paths as source.Path reports them)
+// for a selective backup.
+func deleteExtraStoreFiles(source, backup Store, selectedFolders map[string]bool, logFile *os.File) error {
 	if logFile != nil {
 		if selectedFolders != nil {
 			fmt.Fprintf(logFile, "Starting cleanup phase (delete files not in source or not selected)\n")
@@ -933,7 +870,7 @@ func deleteExtraFilesFromBackupWithSelectiveSupport(sourcePath, backupPath strin
 
 	deletedCount := 0
 
-	return filepath.WalkDir(backupPath, func(backupFile string, d os.DirEntry, err error) error {
+	return walkStoreTree(backup, ".", func(name string, info os.FileInfo, err error) error {
 		// Check for cancellation every 50 files
 		if deletedCount%50 == 0 && shouldCancelBackup() {
 			return fmt.Errorf("operation canceled during deletion phase")
@@ -948,22 +885,22 @@ func deleteExtraFilesFromBackupWithSelectiveSupport(sourcePath, backupPath strin
 		// Files that exist in backup but not in source should be deleted regardless of exclusion patterns
 
 		// Skip special backup metadata files
-		if strings.Contains(backupFile, "BACKUP-INFO.txt") || strings.Contains(backupFile, "BACKUP-FOLDERS.txt") {
+		backupFile := backup.Path(name)
+		if isBackupMetadataFile(backupFile) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
 			return nil
 		}
 
-		// Calculate corresponding source file path
-		relPath, err := filepath.Rel(backupPath, backupFile)
-		if err != nil {
-			return nil
-		}
-		sourceFile := filepath.Join(sourcePath, relPath)
+		// The corresponding source file has the same name
+		sourceFile := source.Path(name)
 
 		// Check if file should be deleted
 		shouldDelete := false
 
 		// First check: file doesn't exist in source
-		if _, err := os.Stat(sourceFile); os.IsNotExist(err) {
+		if _, err := source.Stat(name); os.IsNotExist(err) {
 			shouldDelete = true
 		} else if selectedFolders != nil {
 			// Second check: for selective backups, check if file is in selected folders
@@ -981,16 +918,16 @@ func deleteExtraFilesFromBackupWithSelectiveSupport(sourcePath, backupPath strin
 				fmt.Fprintf(logFile, "Deletion progress: %d files deleted\n", deletedCount)
 			}
 
-			if d.IsDir() {
+			if info.IsDir() {
 				// Remove directory and all contents
-				err := os.RemoveAll(backupFile)
+				err := backup.RemoveAll(name)
 				if err != nil && logFile != nil {
 					fmt.Fprintf(logFile, "Error deleting directory %s: %v\n", backupFile, err)
 				}
 				return filepath.SkipDir
 			} else {
 				// Remove file
-				err := os.Remove(backupFile)
+				err := backup.Remove(name)
 				if err != nil && logFile != nil {
 					fmt.Fprintf(logFile, "Error deleting file %s: %v\n", backupFile, err)
 				}
@@ -999,27 +936,43 @@ func deleteExtraFilesFromBackupWithSelectiveSupport(sourcePath, backupPath strin
 
 		return nil
 	})
-
-	// Log final deletion summary
-	if logFile != nil && deletedCount > 0 {
-		fmt.Fprintf(logFile, "Deletion complete: %d files/directories removed\n", deletedCount)
-	}
-
-	return nil
 }
 
 // deleteExtraFiles removes files from target that don't exist in backup during restore operations.
 // Implements rsync --delete behavior for restore operations, ensuring the target matches the backup exactly.
 // Automatically excludes special files and respects the standard exclusion patterns.
 func deleteExtraFiles(backupPath, targetPath string, excludePatterns []string, logFile *os.File) error {
+	backup := NewLocalStore(backupPath)
+	return deleteExtraFilesMatching(targetPath, excludePatterns, func(relPath string) bool {
+		_, err := backup.Stat(relPath)
+		return !os.IsNotExist(err)
+	}, logFile)
+}
+
+// deleteExtraFilesMatching removes everything under targetPath for which inBackup
+// returns false, given the path relative to targetPath. Exclusions, Migrate's own
+// files, the rollback journal and host identity rules apply as in deleteExtraFiles.
+func deleteExtraFilesMatching(targetPath string, excludePatterns []string, inBackup func(relPath string) bool, logFile *os.File) error {
+	return deleteExtraStoreFilesMatching(NewLocalStore(targetPath), excludePatterns, inBackup, logFile)
+}
+
+// deleteExtraStoreFilesMatching is deleteExtraFilesMatching on a store; inBackup
+// gets store names.
+func deleteExtraStoreFilesMatching(target Store, excludePatterns []string, inBackup func(name string) bool, logFile *os.File) error {
 	if logFile != nil {
 		fmt.Fprintf(logFile, "Starting cleanup phase (delete extra files)\n")
 	}
+	targetPath := target.Path(".")
 
-	return filepath.WalkDir(targetPath, func(targetFile string, d os.DirEntry, err error) error {
+	return walkStoreTree(target, ".", func(name string, info os.FileInfo, err error) error {
 		if err != nil {
 			return nil // Skip errors
 		}
+		// The target itself stays, even when an archive has no "./" member
+		if name == "." {
+			return nil
+		}
+		targetFile := target.Path(name)
 
 		// Skip excluded patterns even during restore
 		for _, pattern := range excludePatterns {
@@ -1034,7 +987,7 @@ func deleteExtraFiles(backupPath, targetPath string, excludePatterns []string, l
 			}
 
 			if matchesExclusionPattern(targetFile, fullPattern) {
-				if d.IsDir() {
+				if info.IsDir() {
 					return filepath.SkipDir
 				}
 				return nil
@@ -1042,30 +995,47 @@ func deleteExtraFiles(backupPath, targetPath string, excludePatterns []string, l
 		}
 
 		// Skip special backup metadata files
-		if strings.Contains(targetFile, "BACKUP-INFO.txt") || strings.Contains(targetFile, "BACKUP-FOLDERS.txt") {
+		if isBackupMetadataFile(targetFile) {
 			return nil
 		}
 
-		// Calculate corresponding backup file path
-		relPath, err := filepath.Rel(targetPath, targetFile)
-		if err != nil {
+		// Never touch the rollback area or Migrate's own state (rollback pointer, reinstall script)
+		if isRollbackPath(targetFile) || isMigrateStatePath(targetFile) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
 			return nil
 		}
-		backupFile := filepath.Join(backupPath, relPath)
 
 		// If file doesn't exist in backup, delete it from target
-		if _, err := os.Stat(backupFile); os.IsNotExist(err) {
+		if !inBackup(name) {
+			if !info.IsDir() && keepHostIdentityFile(targetFile, nil) {
+				return nil
+			}
+
 			if logFile != nil {
 				fmt.Fprintf(logFile, "Deleting extra file: %s\n", targetFile)
 			}
 
-			if d.IsDir() {
+			// Preserve the original for "Undo Last Restore" - moved files need no removal
+			moved, err := rollbackBeforeDelete(targetFile)
+			if err != nil || moved {
+				if err != nil && logFile != nil {
+					fmt.Fprintf(logFile, "Keeping %s: %v\n", targetFile, err)
+				}
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+
+			if info.IsDir() {
 				// Remove directory and all contents
-				os.RemoveAll(targetFile)
+				target.RemoveAll(name)
 				return filepath.SkipDir
 			} else {
 				// Remove file
-				os.Remove(targetFile)
+				target.Remove(name)
 			}
 		}
 
@@ -0,0 +1,501 @@
+// Package internal provides hardware-aware boot configuration fix-ups after a system restore.
+//
+// A Complete System restore onto a new machine brings along /etc/fstab,
+// /etc/crypttab and the bootloader entries of the old one. Their UUIDs name the
+// old disks, so the machine would not boot. planBootFixups compares those files
+// against the block devices that actually exist, proposes old → new UUID
+// substitutions, and applyBootFixups writes them once the user has confirmed.
+package internal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"migrate/internal/drives"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// BlockDevice is one block device of the running machine, as drives.Discovery.Tree lists it.
+type BlockDevice struct {
+	Name       string // Kernel or mapper name (sda2, cryptroot)
+	Parent     string // Name of the device this one sits on, "" for disks
+	UUID       string // Filesystem or LUKS UUID
+	PartUUID   string // GPT partition UUID
+	FSType     string // ext4, btrfs, crypto_LUKS, swap, vfat, ...
+	MountPoint string // Current mount point, "[SWAP]" for active swap
+}
+
+// UUIDChange is one identifier substitution in the restored configuration.
+type UUIDChange struct {
+	Kind   string // "UUID" or "PARTUUID"
+	Old    string
+	New    string
+	Reason string // What the new identifier was matched by
+}
+
+// BootFixupFile is a configuration file whose contents change.
+type BootFixupFile struct {
+	Path     string
+	Original string
+	Updated  string
+}
+
+// BootFixupPlan lists the proposed changes for a restored system.
+type BootFixupPlan struct {
+	Changes  []UUIDChange
+	Files    []BootFixupFile
+	Warnings []string // Stale identifiers no current device could be matched to
+}
+
+// BootFixupsProposed is sent when a system restore finished and the restored
+// boot configuration references disks this machine does not have.
+type BootFixupsProposed struct {
+	Plan    *BootFixupPlan
+	Message string // Restore completion message
+}
+
+// bootConfigFiles lists the files (relative to the restored root) that may name disks.
+var bootConfigFiles = []string{
+	"etc/fstab",
+	"etc/crypttab",
+	"etc/default/grub",
+	"etc/kernel/cmdline",
+	"boot/grub/grub.cfg",
+	"boot/loader/entries/*.conf",
+	"efi/loader/entries/*.conf",
+	"boot/efi/loader/entries/*.conf",
+}
+
+// listBlockDevices returns every block device of the running machine, flattened.
+func listBlockDevices() ([]BlockDevice, error) {
+	nodes, err := drives.NewDiscovery("/").Tree()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list block devices: %v", err)
+	}
+	devices := make([]BlockDevice, 0, len(nodes))
+	for _, node := range nodes {
+		devices = append(devices, BlockDevice(node))
+	}
+	return devices, nil
+}
+
+// bootFixupPlanner holds the state of one planBootFixups run.
+type bootFixupPlanner struct {
+	devices []BlockDevice
+	known   map[string]bool   // Every UUID and PARTUUID present on this machine
+	mapping map[string]string // Old identifier -> new identifier
+	warned  map[string]bool   // Stale identifiers already reported as unmatched
+	plan    *BootFixupPlan
+}
+
+// planBootFixups compares the boot configuration under root with devices and
+// returns the substitutions needed. An empty plan means nothing is stale.
+// root is "/" after a real restore; tests pass a temporary tree and a fake device list.
+func planBootFixups(root string, devices []BlockDevice) (*BootFixupPlan, error) {
+	p := &bootFixupPlanner{
+		devices: devices,
+		known:   make(map[string]bool),
+		mapping: make(map[string]string),
+		warned:  make(map[string]bool),
+		plan:    &BootFixupPlan{},
+	}
+	for _, d := range devices {
+		if d.UUID != "" {
+			p.known[strings.ToLower(d.UUID)] = true
+		}
+		if d.PartUUID != "" {
+			p.known[strings.ToLower(d.PartUUID)] = true
+		}
+	}
+
+	files, err := expandBootConfigFiles(root)
+	if err != nil {
+		return nil, err
+	}
+	contents := make(map[string]string)
+	for _, path := range files {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			continue
+		}
+		contents[path] = string(data)
+	}
+
+	// fstab and crypttab tie each identifier to a mount point or mapping name
+	if text, ok := contents[filepath.Join(root, "etc/fstab")]; ok {
+		p.matchFstab(text)
+	}
+	if text, ok := contents[filepath.Join(root, "etc/crypttab")]; ok {
+		p.matchCrypttab(text)
+	}
+	// Kernel command lines say what each identifier is for
+	for _, path := range files {
+		if text, ok := contents[path]; ok {
+			p.matchKernelParameters(text)
+		}
+	}
+
+	if len(p.mapping) == 0 {
+		return p.plan, nil
+	}
+
+	for _, path := range files {
+		original, ok := contents[path]
+		if !ok {
+			continue
+		}
+		updated := original
+		for oldID, newID := range p.mapping {
+			updated = replaceIdentifier(updated, oldID, newID)
+		}
+		if updated != original {
+			p.plan.Files = append(p.plan.Files, BootFixupFile{Path: path, Original: original, Updated: updated})
+		}
+	}
+
+	sort.Slice(p.plan.Changes, func(i, j int) bool { return p.plan.Changes[i].Old < p.plan.Changes[j].Old })
+	return p.plan, nil
+}
+
+// expandBootConfigFiles resolves bootConfigFiles under root.
+func expandBootConfigFiles(root string) ([]string, error) {
+	var files []string
+	for _, pattern := range bootConfigFiles {
+		matches, err := filepath.Glob(filepath.Join(root, pattern))
+		if err != nil {
+			return nil, fmt.Errorf("invalid boot config pattern %s: %v", pattern, err)
+		}
+		files = append(files, matches...)
+	}
+	return files, nil
+}
+
+// isStale reports whether an identifier does not exist on this machine.
+func (p *bootFixupPlanner) isStale(id string) bool {
+	id = strings.ToLower(id)
+	return id != "" && !p.known[id]
+}
+
+// propose records old -> new unless old is already mapped.
+func (p *bootFixupPlanner) propose(kind, oldID string, device *BlockDevice, reason string) {
+	key := strings.ToLower(oldID)
+	if _, exists := p.mapping[key]; exists || p.warned[key] {
+		return
+	}
+	if device == nil {
+		p.plan.Warnings = append(p.plan.Warnings, fmt.Sprintf("%s=%s (%s) matches no device on this machine", kind, oldID, reason))
+		p.warned[key] = true
+		return
+	}
+
+	newID := device.UUID
+	if kind == "PARTUUID" {
+		newID = device.PartUUID
+	}
+	if newID == "" {
+		p.plan.Warnings = append(p.plan.Warnings, fmt.Sprintf("%s=%s (%s): /dev/%s has no %s", kind, oldID, reason, device.Name, kind))
+		p.warned[key] = true
+		return
+	}
+
+	p.mapping[key] = newID
+	p.plan.Changes = append(p.plan.Changes, UUIDChange{Kind: kind, Old: oldID, New: newID, Reason: reason})
+}
+
+// matchFstab maps stale fstab sources by mount point.
+func (p *bootFixupPlanner) matchFstab(text string) {
+	for _, fields := range configLines(text) {
+		if len(fields) < 3 {
+			continue
+		}
+		kind, id := splitIdentifier(fields[0])
+		if kind == "" || !p.isStale(id) {
+			continue
+		}
+
+		mountPoint, fsType := fields[1], fields[2]
+		if fsType == "swap" {
+			p.propose(kind, id, p.onlyDevice(func(d BlockDevice) bool { return d.FSType == "swap" }), "swap")
+			continue
+		}
+		p.propose(kind, id, p.deviceMountedAt(mountPoint), "mounted at "+mountPoint)
+	}
+}
+
+// matchCrypttab maps stale crypttab sources by mapping name.
+func (p *bootFixupPlanner) matchCrypttab(text string) {
+	for _, fields := range configLines(text) {
+		if len(fields) < 2 {
+			continue
+		}
+		kind, id := splitIdentifier(fields[1])
+		if kind == "" || !p.isStale(id) {
+			continue
+		}
+		p.propose(kind, id, p.luksDeviceFor(fields[0]), "LUKS mapping "+fields[0])
+	}
+}
+
+// matchKernelParameters maps stale identifiers on kernel command lines.
+func (p *bootFixupPlanner) matchKernelParameters(text string) {
+	for _, word := range strings.FieldsFunc(text, func(r rune) bool {
+		return r == ' ' || r == '\t' || r == '\n' || r == '"' || r == '\''
+	}) {
+		key, value, found := strings.Cut(word, "=")
+		if !found {
+			continue
+		}
+		switch key {
+		case "root", "resume":
+			kind, id := splitIdentifier(value)
+			if kind == "" || !p.isStale(id) {
+				continue
+			}
+			if key == "root" {
+				p.propose(kind, id, p.deviceMountedAt("/"), "root filesystem")
+			} else {
+				p.propose(kind, id, p.onlyDevice(func(d BlockDevice) bool { return d.FSType == "swap" }), "resume swap")
+			}
+		case "rd.luks.uuid", "rd.luks.name", "cryptdevice":
+			// rd.luks.uuid=[luks-]UUID, rd.luks.name=UUID=name, cryptdevice=UUID=X:name
+			id := value
+			if _, mapped := p.mapping[strings.ToLower(value)]; !mapped && !p.known[strings.ToLower(value)] {
+				id = strings.TrimPrefix(value, "luks-")
+			}
+			if key == "cryptdevice" {
+				_, id = splitIdentifier(strings.SplitN(value, ":", 2)[0])
+			} else if key == "rd.luks.name" {
+				id = strings.SplitN(value, "=", 2)[0]
+			}
+			if !p.isStale(id) {
+				continue
+			}
+			p.propose("UUID", id, p.luksDeviceFor(""), "encrypted root")
+		}
+	}
+}
+
+// deviceMountedAt returns the device mounted at mountPoint, or nil.
+func (p *bootFixupPlanner) deviceMountedAt(mountPoint string) *BlockDevice {
+	return p.onlyDevice(func(d BlockDevice) bool { return d.MountPoint == mountPoint })
+}
+
+// onlyDevice returns the single device matching match, or nil if none or several do.
+func (p *bootFixupPlanner) onlyDevice(match func(BlockDevice) bool) *BlockDevice {
+	var found *BlockDevice
+	for i := range p.devices {
+		if match(p.devices[i]) {
+			if found != nil {
+				return nil
+			}
+			found = &p.devices[i]
+		}
+	}
+	return found
+}
+
+// luksDeviceFor returns the LUKS container holding the open mapping name, or the
+// one below the root filesystem when name is empty or unknown.
+func (p *bootFixupPlanner) luksDeviceFor(name string) *BlockDevice {
+	start := p.onlyDevice(func(d BlockDevice) bool { return name != "" && d.Name == name })
+	if start == nil {
+		start = p.deviceMountedAt("/")
+	}
+	for device := start; device != nil; device = p.onlyDevice(func(d BlockDevice) bool { return d.Name == device.Parent }) {
+		if device.FSType == "crypto_LUKS" {
+			return device
+		}
+		if device.Parent == "" {
+			break
+		}
+	}
+	// A single LUKS container is unambiguous
+	return p.onlyDevice(func(d BlockDevice) bool { return d.FSType == "crypto_LUKS" })
+}
+
+// configLines splits an fstab-style file into fields, skipping comments and blanks.
+func configLines(text string) [][]string {
+	var lines [][]string
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		lines = append(lines, strings.Fields(line))
+	}
+	return lines
+}
+
+// splitIdentifier parses "UUID=x" or "PARTUUID=x". Other sources return "".
+func splitIdentifier(source string) (kind, id string) {
+	for _, prefix := range []string{"UUID", "PARTUUID"} {
+		if value, ok := strings.CutPrefix(source, prefix+"="); ok {
+			return prefix, strings.Trim(value, `"`)
+		}
+	}
+	if value, ok := strings.CutPrefix(source, "/dev/disk/by-uuid/"); ok {
+		return "UUID", value
+	}
+	if value, ok := strings.CutPrefix(source, "/dev/disk/by-partuuid/"); ok {
+		return "PARTUUID", value
+	}
+	return "", ""
+}
+
+// replaceIdentifier replaces every case-insensitive occurrence of oldID in text.
+func replaceIdentifier(text, oldID, newID string) string {
+	lower := strings.ToLower(text)
+	var s strings.Builder
+	for {
+		i := strings.Index(lower, oldID)
+		if i < 0 {
+			s.WriteString(text)
+			return s.String()
+		}
+		s.WriteString(text[:i] + newID)
+		text, lower = text[i+len(oldID):], lower[i+len(oldID):]
+	}
+}
+
+// diff renders the changed lines of every file, numbered, as - / + pairs.
+func (plan *BootFixupPlan) diff() string {
+	var s strings.Builder
+	for _, file := range plan.Files {
+		s.WriteString(fmt.Sprintf("--- %s\n+++ %s\n", file.Path, file.Path))
+		oldLines := strings.Split(file.Original, "\n")
+		newLines := strings.Split(file.Updated, "\n")
+		for i := range oldLines {
+			if i < len(newLines) && oldLines[i] != newLines[i] {
+				s.WriteString(fmt.Sprintf("@@ line %d @@\n- %s\n+ %s\n", i+1, oldLines[i], newLines[i]))
+			}
+		}
+	}
+	return s.String()
+}
+
+// describe renders the plan for the confirmation screen, trimmed to maxLines of diff.
+func (plan *BootFixupPlan) describe(maxLines int) string {
+	var s strings.Builder
+	s.WriteString("The restored system refers to disks this machine does not have:\n")
+	for _, change := range plan.Changes {
+		s.WriteString(fmt.Sprintf("  %s %s → %s (%s)\n", change.Kind, change.Old, change.New, change.Reason))
+	}
+	s.WriteString("\n")
+
+	lines := strings.Split(strings.TrimRight(plan.diff(), "\n"), "\n")
+	for i, line := range lines {
+		if i == maxLines {
+			s.WriteString(fmt.Sprintf("… %d more lines in the log\n", len(lines)-maxLines))
+			break
+		}
+		s.WriteString(line + "\n")
+	}
+	for _, warning := range plan.Warnings {
+		s.WriteString("⚠️ " + warning + "\n")
+	}
+	return s.String()
+}
+
+// checkRestoredBootConfig plans fix-ups for a system just restored onto / and logs them.
+// It returns nil when every identifier already matches this machine.
+func checkRestoredBootConfig(logFile *os.File) *BootFixupPlan {
+	devices, err := listBlockDevices()
+	if err != nil {
+		if logFile != nil {
+			fmt.Fprintf(logFile, "Boot config check skipped: %v\n", err)
+		}
+		return nil
+	}
+
+	plan, err := planBootFixups("/", devices)
+	if err != nil {
+		if logFile != nil {
+			fmt.Fprintf(logFile, "Boot config check failed: %v\n", err)
+		}
+		return nil
+	}
+
+	if logFile != nil {
+		for _, warning := range plan.Warnings {
+			fmt.Fprintf(logFile, "Boot config warning: %s\n", warning)
+		}
+	}
+	if len(plan.Files) == 0 {
+		if logFile != nil {
+			fmt.Fprintf(logFile, "Boot config check: all disk identifiers match this machine\n")
+		}
+		return nil
+	}
+
+	if logFile != nil {
+		fmt.Fprintf(logFile, "Proposed boot config fix-ups:\n%s", plan.diff())
+	}
+	return plan
+}
+
+// applyBootFixups writes the updated files, keeping each original as <file>.pre-migrate.
+func applyBootFixups(plan *BootFixupPlan, logFile *os.File) error {
+	for _, file := range plan.Files {
+		info, err := os.Stat(file.Path)
+		if err != nil {
+			return fmt.Errorf("failed to stat %s: %v", file.Path, err)
+		}
+
+		// Refuse to clobber a file that changed since it was planned
+		current, err := os.ReadFile(file.Path)
+		if err != nil {
+			return fmt.Errorf("failed to read %s: %v", file.Path, err)
+		}
+		if string(current) != file.Original {
+			return fmt.Errorf("%s changed since the fix-ups were planned - not modified", file.Path)
+		}
+
+		if err := os.WriteFile(file.Path+".pre-migrate", current, info.Mode().Perm()); err != nil {
+			return fmt.Errorf("failed to save original %s: %v", file.Path, err)
+		}
+		if err := writeFileAtomically(file.Path, []byte(file.Updated)); err != nil {
+			return fmt.Errorf("failed to update %s: %v", file.Path, err)
+		}
+		if err := os.Chmod(file.Path, info.Mode().Perm()); err != nil {
+			return fmt.Errorf("failed to restore mode of %s: %v", file.Path, err)
+		}
+
+		if logFile != nil {
+			fmt.Fprintf(logFile, "Updated %s (original saved as %s.pre-migrate)\n", file.Path, file.Path)
+		}
+	}
+	return nil
+}
+
+// startBootFixups applies a confirmed fix-up plan.
+func startBootFixups(plan *BootFixupPlan) tea.Cmd {
+	return func() tea.Msg {
+		logPath := getLogFilePath()
+		logFile, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err == nil {
+			fmt.Fprintf(logFile, "\n=== BOOT CONFIG FIX-UPS STARTED: %s ===\n", time.Now().Format(time.RFC3339))
+			defer logFile.Close()
+		}
+
+		if err := applyBootFixups(plan, logFile); err != nil {
+			if logFile != nil {
+				fmt.Fprintf(logFile, "BOOT CONFIG FIX-UP ERROR: %v\n", err)
+			}
+			return ProgressUpdate{Error: fmt.Errorf("boot config fix-up failed: %v", err), Done: true}
+		}
+
+		message := fmt.Sprintf("Boot configuration updated for this machine (%d files)", len(plan.Files))
+		for _, file := range plan.Files {
+			if strings.HasSuffix(file.Path, "/etc/default/grub") {
+				message += "\n\n💡 Run grub-mkconfig -o /boot/grub/grub.cfg and regenerate the initramfs before rebooting"
+				break
+			}
+		}
+		return ProgressUpdate{Percentage: 1.0, Message: message, Done: true}
+	}
+}
@@ -0,0 +1,107 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// bootTree writes files (relative path -> content) under a temporary root.
+func bootTree(t *testing.T, files map[string]string) string {
+	t.Helper()
+	root := t.TempDir()
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+// fixupDevices is an encrypted laptop: ESP, LUKS container with root inside, swap.
+var fixupDevices = []BlockDevice{
+	{Name: "nvme0n1"},
+	{Name: "nvme0n1p1", Parent: "nvme0n1", UUID: "AAAA-1111", PartUUID: "p1-new", FSType: "vfat", MountPoint: "/boot"},
+	{Name: "nvme0n1p2", Parent: "nvme0n1", UUID: "luks-new", PartUUID: "p2-new", FSType: "crypto_LUKS"},
+	{Name: "cryptroot", Parent: "nvme0n1p2", UUID: "root-new", FSType: "ext4", MountPoint: "/"},
+	{Name: "nvme0n1p3", Parent: "nvme0n1", UUID: "swap-new", FSType: "swap", MountPoint: "[SWAP]"},
+}
+
+func TestPlanBootFixupsMatchesStaleIdentifiers(t *testing.T) {
+	root := bootTree(t, map[string]string{
+		"etc/fstab": "# restored\n" +
+			"UUID=root-old / ext4 rw 0 1\n" +
+			"UUID=BBBB-2222 /boot vfat rw 0 2\n" +
+			"UUID=swap-old none swap defaults 0 0\n",
+		"etc/crypttab":                   "cryptroot UUID=luks-old none luks\n",
+		"boot/loader/entries/linux.conf": "options rd.luks.name=luks-old=cryptroot root=UUID=root-old rw\n",
+	})
+
+	plan, err := planBootFixups(root, fixupDevices)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Warnings) != 0 {
+		t.Fatalf("unexpected warnings: %q", plan.Warnings)
+	}
+
+	want := map[string]string{"root-old": "root-new", "BBBB-2222": "AAAA-1111", "swap-old": "swap-new", "luks-old": "luks-new"}
+	if len(plan.Changes) != len(want) {
+		t.Fatalf("got %d changes, want %d: %+v", len(plan.Changes), len(want), plan.Changes)
+	}
+	for _, change := range plan.Changes {
+		if want[change.Old] != change.New {
+			t.Errorf("%s mapped to %s, want %s", change.Old, change.New, want[change.Old])
+		}
+	}
+
+	updated := make(map[string]string)
+	for _, file := range plan.Files {
+		updated[strings.TrimPrefix(file.Path, root+"/")] = file.Updated
+	}
+	if got := updated["boot/loader/entries/linux.conf"]; got != "options rd.luks.name=luks-new=cryptroot root=UUID=root-new rw\n" {
+		t.Errorf("loader entry updated to %q", got)
+	}
+	if got := updated["etc/crypttab"]; got != "cryptroot UUID=luks-new none luks\n" {
+		t.Errorf("crypttab updated to %q", got)
+	}
+	if got := updated["etc/fstab"]; !strings.Contains(got, "UUID=AAAA-1111 /boot vfat") || strings.Contains(got, "old") {
+		t.Errorf("fstab updated to %q", got)
+	}
+}
+
+func TestPlanBootFixupsLeavesCurrentConfigAlone(t *testing.T) {
+	root := bootTree(t, map[string]string{
+		"etc/fstab": "UUID=root-new / ext4 rw 0 1\nUUID=AAAA-1111 /boot vfat rw 0 2\n",
+	})
+
+	plan, err := planBootFixups(root, fixupDevices)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Changes) != 0 || len(plan.Files) != 0 || len(plan.Warnings) != 0 {
+		t.Fatalf("expected an empty plan, got %+v", plan)
+	}
+}
+
+func TestPlanBootFixupsWarnsWhenNoDeviceMatches(t *testing.T) {
+	root := bootTree(t, map[string]string{
+		"etc/fstab": "UUID=data-old /data ext4 rw 0 2\n",
+	})
+
+	plan, err := planBootFixups(root, fixupDevices)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Changes) != 0 || len(plan.Files) != 0 {
+		t.Fatalf("a device was guessed for /data: %+v", plan.Changes)
+	}
+	if len(plan.Warnings) != 1 || !strings.Contains(plan.Warnings[0], "data-old") {
+		t.Fatalf("stale identifier not reported: %q", plan.Warnings)
+	}
+}
@@ -23,7 +23,13 @@ func (h *RestoreMenuHandler) HandleSelection(cursor int) (screen screens.Screen,
 	case 1: // Restore to Custom Path
 		// Go directly to drive selection - config options are now on the unified selection screen
 		return screens.ScreenDriveSelect, "custom_restore", nil, nil
-	case 2: // Back
+	case 2: // Undo Last Restore
+		// Confirmation text is filled in by the model from the rollback journal
+		return screens.ScreenConfirm, "undo_restore", nil, nil
+	case 3: // Adopt Existing Backup
+		// Mount the drive holding the rsync tree or tarball, then ask for its path
+		return screens.ScreenDriveSelect, "adopt_restore", nil, nil
+	case 4: // Back
 		return screens.ScreenMain, "", screens.MainMenuChoices, nil
 	}
 	return screens.ScreenRestore, "", screens.RestoreMenuChoices, nil
@@ -0,0 +1,147 @@
+// Package internal provides the host identity rule set for system restores.
+//
+// Some files identify one particular machine rather than its configuration:
+// the machine-id, hostname, SSH host keys, network connections pinned to a MAC
+// address and the systemd random seed. Restoring them from another machine's
+// backup produces two hosts with the same identity, so a system restore can
+// keep the target's own copies instead.
+package internal
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+)
+
+// hostIdentityRule describes one set of machine-specific files.
+type hostIdentityRule struct {
+	Pattern     string // Absolute path or glob on the restored system
+	Description string
+	MACBound    bool // Only files that pin a hardware address are identity
+}
+
+// hostIdentityRules is the curated list of files that identify a machine.
+var hostIdentityRules = []hostIdentityRule{
+	{Pattern: "/etc/machine-id", Description: "systemd machine ID"},
+	{Pattern: "/var/lib/dbus/machine-id", Description: "D-Bus machine ID"},
+	{Pattern: "/etc/hostname", Description: "hostname"},
+	{Pattern: "/etc/ssh/ssh_host_*", Description: "SSH host keys"},
+	{Pattern: "/etc/NetworkManager/system-connections/*", Description: "NetworkManager connections bound to a MAC address", MACBound: true},
+	{Pattern: "/var/lib/systemd/random-seed", Description: "systemd random seed"},
+	{Pattern: "/var/lib/systemd/credential.secret", Description: "systemd credential secret"},
+}
+
+var (
+	// hostIdentityActive is set while a restore keeps the target's identity files.
+	hostIdentityActive atomic.Bool
+
+	// hostIdentityKept counts identity files left untouched by the current restore.
+	hostIdentityKept atomic.Int64
+)
+
+// matchHostIdentityRule returns the rule covering path on the restored system, or nil.
+func matchHostIdentityRule(path string) *hostIdentityRule {
+	for i := range hostIdentityRules {
+		if matched, _ := filepath.Match(hostIdentityRules[i].Pattern, path); matched {
+			return &hostIdentityRules[i]
+		}
+	}
+	return nil
+}
+
+// keepHostIdentityFile reports whether the restore must leave dst alone because
+// it is part of this machine's identity. backedUp opens the backup's copy of dst,
+// and is nil when the file only exists on the target and would be deleted.
+func keepHostIdentityFile(dst string, backedUp func() (io.ReadCloser, error)) bool {
+	if !hostIdentityActive.Load() {
+		return false
+	}
+	rule := matchHostIdentityRule(dst)
+	if rule == nil {
+		return false
+	}
+
+	// Ordinary network connections (Wi-Fi passwords, VPNs) are still restored and
+	// deleted; only one pinned to a MAC address, in the backup or here, is identity
+	if rule.MACBound && !isMACBoundConnection(backedUp) && !isMACBoundConnection(localFileOpener(dst)) {
+		return false
+	}
+
+	hostIdentityKept.Add(1)
+	return true
+}
+
+// hostIdentityNeedsContent reports whether keepHostIdentityFile reads the
+// backup's copy of dst, so a caller reading a stream has to buffer it.
+func hostIdentityNeedsContent(dst string) bool {
+	if !hostIdentityActive.Load() {
+		return false
+	}
+	rule := matchHostIdentityRule(dst)
+	return rule != nil && rule.MACBound
+}
+
+// localFileOpener opens path for keepHostIdentityFile.
+func localFileOpener(path string) func() (io.ReadCloser, error) {
+	return func() (io.ReadCloser, error) {
+		return os.Open(path)
+	}
+}
+
+// isMACBoundConnection reports whether a NetworkManager keyfile pins a MAC address.
+func isMACBoundConnection(open func() (io.ReadCloser, error)) bool {
+	if open == nil {
+		return false
+	}
+	f, err := open()
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if value, ok := strings.CutPrefix(strings.TrimSpace(scanner.Text()), "mac-address="); ok && value != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// describeHostIdentityRules lists what "keep this machine's identity" protects.
+func describeHostIdentityRules() string {
+	var s strings.Builder
+	for _, rule := range hostIdentityRules {
+		s.WriteString(fmt.Sprintf("  %s (%s)\n", rule.Pattern, rule.Description))
+	}
+	return s.String()
+}
+
+// activateHostIdentity records the identity choice of a system restore in the log
+// and, when keep is set, protects the identity files. The returned function ends
+// the protection and logs how many files were kept.
+func activateHostIdentity(keep bool, logFile *os.File) func() {
+	if !keep {
+		if logFile != nil {
+			fmt.Fprintf(logFile, "Host identity: restoring identity files from backup (machine-id, hostname, SSH host keys, ...)\n")
+		}
+		return func() {}
+	}
+
+	if logFile != nil {
+		fmt.Fprintf(logFile, "Host identity: keeping this machine's identity files:\n%s", describeHostIdentityRules())
+	}
+	hostIdentityKept.Store(0)
+	hostIdentityActive.Store(true)
+
+	return func() {
+		hostIdentityActive.Store(false)
+		if logFile != nil {
+			fmt.Fprintf(logFile, "Host identity: %d identity files kept from this machine\n", hostIdentityKept.Load())
+		}
+	}
+}
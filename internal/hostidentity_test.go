@@ -0,0 +1,43 @@
+package internal
+
+import (
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestKeepHostIdentityFileDecidesFromBackedUpContent(t *testing.T) {
+	hostIdentityActive.Store(true)
+	defer hostIdentityActive.Store(false)
+
+	backedUp := func(content string) func() (io.ReadCloser, error) {
+		return func() (io.ReadCloser, error) { return io.NopCloser(strings.NewReader(content)), nil }
+	}
+	// Not present here, so only the backed-up copy can decide
+	connection := "/etc/NetworkManager/system-connections/migrate-test-missing.nmconnection"
+
+	tests := []struct {
+		name     string
+		dst      string
+		backedUp func() (io.ReadCloser, error)
+		want     bool
+	}{
+		{"connection pinned to the old MAC", connection, backedUp("[ethernet]\nmac-address=52:54:00:12:34:56\n"), true},
+		{"ordinary Wi-Fi connection", connection, backedUp("[wifi]\nssid=home\n"), false},
+		{"connection only on the target", connection, nil, false},
+		{"hostname", "/etc/hostname", backedUp("old-host\n"), true},
+		{"hosts file", "/etc/hosts", backedUp("127.0.0.1 localhost\n"), false},
+		{"ordinary file", "/etc/fstab", backedUp(""), false},
+	}
+	for _, tt := range tests {
+		if got := keepHostIdentityFile(tt.dst, tt.backedUp); got != tt.want {
+			t.Errorf("%s: keepHostIdentityFile = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestKeepHostIdentityFileInactive(t *testing.T) {
+	if keepHostIdentityFile("/etc/machine-id", nil) {
+		t.Fatal("identity file kept although the restore does not keep the identity")
+	}
+}
@@ -0,0 +1,82 @@
+// Package internal provides the model's handling of drives being attached and detached.
+//
+// The drive list refreshes while it is on screen, and an operation whose drive is
+// detached is canceled, so it stops cleanly instead of failing on I/O errors.
+package internal
+
+import (
+	"fmt"
+	"strings"
+
+	"migrate/internal/drives"
+	"migrate/internal/screens"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+type DrivesChanged = drives.DrivesChanged
+
+// watchDrives waits for the next drive to be attached or detached.
+func watchDrives() tea.Cmd {
+	return drives.WatchDrives()
+}
+
+// setDrives shows drives as the choices of the drive selection screen, keeping the
+// cursor on the same drive if it is still there.
+func (m *Model) setDrives(list []DriveInfo) {
+	current := ""
+	if m.cursor < len(m.drives) {
+		current = m.drives[m.cursor].Device
+	}
+
+	m.drives = list
+	m.choices = make([]string, len(m.drives)+2)
+	for i, drive := range m.drives {
+		m.choices[i] = fmt.Sprintf("💾 %s (%s) - %s", drive.Device, drive.Size, drive.Label)
+		if current != "" && drive.Device == current {
+			m.cursor = i
+		}
+	}
+	m.choices[len(m.drives)] = destinationChoice(m.operation)
+	m.choices[len(m.drives)+1] = "⬅️ Back"
+	if m.cursor >= len(m.choices) {
+		m.cursor = len(m.choices) - 1
+	}
+}
+
+// trackOperationDrive remembers which disks hold the drive of the running
+// operation, so it can be stopped if one of them is detached.
+func (m *Model) trackOperationDrive() {
+	if m.selectedDrive == "" || m.driveDisksFor == m.selectedDrive {
+		return
+	}
+	m.driveDisksFor = m.selectedDrive
+	m.driveDisks, _ = drives.NewDiscovery("/").DisksHolding(m.selectedDrive)
+}
+
+// handleDrivesChanged refreshes the drive list, or cancels the running operation
+// if its drive was detached.
+func (m Model) handleDrivesChanged(msg DrivesChanged) (tea.Model, tea.Cmd) {
+	switch m.screen {
+	case screens.ScreenDriveSelect:
+		// --dest skips the drive list for backups
+		if backupDestination == "" || !strings.Contains(m.operation, "backup") {
+			m.setDrives(msg.Drives)
+		}
+
+	case screens.ScreenProgress:
+		if m.canceling || tuiBackupCompleted || m.driveDisksFor != m.selectedDrive {
+			break
+		}
+		for _, disk := range m.driveDisks {
+			if !drives.DiskPresent(msg.Disks, disk) {
+				m.driveLost = true
+				m.canceling = true
+				m.message = fmt.Sprintf("⚠️  Drive %s was disconnected - stopping...", disk)
+				CancelBackup()
+				break
+			}
+		}
+	}
+	return m, watchDrives()
+}
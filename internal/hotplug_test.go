@@ -0,0 +1,70 @@
+package internal
+
+import (
+	"testing"
+
+	"migrate/internal/drives"
+	"migrate/internal/screens"
+)
+
+func TestDrivesChangedRefreshesDriveList(t *testing.T) {
+	first := DriveInfo{Device: "/run/media/alice/First", Size: "1 TB", Label: "First"}
+	second := DriveInfo{Device: "/run/media/alice/Second", Size: "2 TB", Label: "Second"}
+	m := InitialModel()
+	m.operation = "system_backup"
+	m.screen = screens.ScreenDriveSelect
+	m.setDrives([]DriveInfo{first, second})
+	m.cursor = 1
+
+	// A drive attached in front of the selected one: the cursor follows it
+	added := DriveInfo{Device: "/mnt/added", Size: "500 GB", Label: "Added"}
+	updated, cmd := m.Update(DrivesChanged{Drives: []DriveInfo{added, first, second}})
+	m = updated.(Model)
+	if cmd == nil {
+		t.Fatal("stopped watching for drives")
+	}
+	if len(m.drives) != 3 || len(m.choices) != 5 || m.cursor != 2 {
+		t.Fatalf("%d drives, %d choices, cursor %d", len(m.drives), len(m.choices), m.cursor)
+	}
+
+	// The selected drive detached: the cursor stays in range
+	updated, _ = m.Update(DrivesChanged{Drives: []DriveInfo{added}})
+	m = updated.(Model)
+	if len(m.choices) != 3 || m.cursor >= len(m.choices) {
+		t.Fatalf("%d choices, cursor %d", len(m.choices), m.cursor)
+	}
+
+	// Other screens keep their choices
+	m.screen = screens.ScreenMain
+	m.choices = screens.MainMenuChoices
+	updated, _ = m.Update(DrivesChanged{Drives: []DriveInfo{first}})
+	if got := updated.(Model); len(got.drives) != 1 || got.drives[0] != added {
+		t.Fatalf("drive list changed off the drive screen: %+v", got.drives)
+	}
+}
+
+func TestDrivesChangedCancelsOperationOnDetach(t *testing.T) {
+	defer resetBackupCancel()
+	tuiBackupCompleted = false
+	m := InitialModel()
+	m.screen = screens.ScreenProgress
+	m.selectedDrive = "/run/media/alice/Backup"
+	m.driveDisksFor = m.selectedDrive
+	m.driveDisks = []string{"sdb"}
+
+	attached := []drives.BlockDisk{{Name: "nvme0n1"}, {Name: "sdb"}}
+	updated, _ := m.Update(DrivesChanged{Disks: attached})
+	m = updated.(Model)
+	if m.canceling || m.driveLost || shouldCancelBackup() {
+		t.Fatal("operation canceled while its drive is attached")
+	}
+
+	updated, cmd := m.Update(DrivesChanged{Disks: attached[:1]})
+	m = updated.(Model)
+	if !m.driveLost || !m.canceling || !shouldCancelBackup() {
+		t.Fatal("operation not canceled after its drive was detached")
+	}
+	if cmd == nil {
+		t.Fatal("stopped watching for drives")
+	}
+}
@@ -0,0 +1,370 @@
+// Package internal provides the installed-package inventory of a system backup.
+//
+// A mirrored system backup carries /usr and the package database of the machine
+// it was taken from. Restoring it onto a fresh install with a different package
+// set leaves the two out of step, so backup records what was explicitly
+// installed and restore can reinstall the same set before copying files back.
+package internal
+
+import (
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// reinstallScriptName is the generated reinstall script inside migrateStateDir.
+const reinstallScriptName = "reinstall-packages.sh"
+
+// Package reinstall choices offered before a system restore.
+const (
+	PackageActionSkip   = "skip"   // Restore files only
+	PackageActionScript = "script" // Write the reinstall script for the user to run
+	PackageActionRun    = "run"    // Run the reinstall script before copying files
+)
+
+// ReinstallScriptWritten is sent when a system restore with PackageActionScript
+// has written the reinstall script. The restore pauses so the user can run it
+// before any file is copied, then continues without touching packages again.
+type ReinstallScriptWritten struct {
+	ScriptPath string
+}
+
+// PackageInventory lists what was explicitly installed on the backed-up system.
+type PackageInventory struct {
+	Pacman        []string          `json:"pacman,omitempty"`         // Explicit native packages (pacman -Qqen)
+	PacmanForeign []string          `json:"pacman_foreign,omitempty"` // Explicit foreign/AUR packages (pacman -Qqem)
+	Apt           []string          `json:"apt,omitempty"`            // apt-mark showmanual
+	Dnf           []string          `json:"dnf,omitempty"`            // dnf repoquery --userinstalled
+	Flatpak       []string          `json:"flatpak,omitempty"`        // Installed flatpak applications
+	FlatpakOrigin map[string]string `json:"flatpak_origin,omitempty"` // Remote each flatpak application came from
+	EnabledUnits  []string          `json:"enabled_units,omitempty"`  // systemctl list-unit-files --state=enabled
+	Kernels       []string          `json:"kernels,omitempty"`        // Module directories under /usr/lib/modules
+}
+
+// isEmpty reports whether nothing at all was captured.
+func (inv *PackageInventory) isEmpty() bool {
+	return inv == nil || len(inv.Pacman)+len(inv.PacmanForeign)+len(inv.Apt)+len(inv.Dnf)+
+		len(inv.Flatpak)+len(inv.EnabledUnits)+len(inv.Kernels) == 0
+}
+
+// captureInventory queries every package manager present on the running system.
+// Missing tools are simply skipped, so this never fails.
+func captureInventory() *PackageInventory {
+	inv := &PackageInventory{}
+
+	if commandExists("pacman") {
+		inv.Pacman = commandLines("pacman", "-Qqen")
+		inv.PacmanForeign = commandLines("pacman", "-Qqem")
+	}
+	if commandExists("apt-mark") {
+		inv.Apt = commandLines("apt-mark", "showmanual")
+	}
+	if commandExists("dnf") {
+		inv.Dnf = commandLines("dnf", "-q", "repoquery", "--userinstalled", "--queryformat", "%{name}\n")
+	}
+	if commandExists("flatpak") {
+		// "APPLICATION ORIGIN" - the remote is needed to install it again
+		for _, line := range commandLines("flatpak", "list", "--app", "--columns=application,origin") {
+			fields := strings.Fields(line)
+			if len(fields) == 0 {
+				continue
+			}
+			inv.Flatpak = append(inv.Flatpak, fields[0])
+			if len(fields) > 1 {
+				if inv.FlatpakOrigin == nil {
+					inv.FlatpakOrigin = make(map[string]string)
+				}
+				inv.FlatpakOrigin[fields[0]] = fields[1]
+			}
+		}
+	}
+	if commandExists("systemctl") {
+		// "UNIT STATE PRESET" - only the unit name is kept
+		for _, line := range commandLines("systemctl", "list-unit-files", "--state=enabled", "--no-legend", "--no-pager") {
+			if fields := strings.Fields(line); len(fields) > 0 {
+				inv.EnabledUnits = append(inv.EnabledUnits, fields[0])
+			}
+		}
+	}
+	inv.Kernels = installedKernels()
+
+	return inv
+}
+
+// commandExists reports whether a program is available in PATH.
+func commandExists(name string) bool {
+	_, err := exec.LookPath(name)
+	return err == nil
+}
+
+// commandLines runs a command and returns its sorted, de-duplicated, non-empty
+// output lines. A failing command yields no lines.
+func commandLines(name string, args ...string) []string {
+	out, err := exec.Command(name, args...).Output()
+	if err != nil {
+		return nil
+	}
+
+	seen := make(map[string]bool)
+	var lines []string
+	for _, line := range strings.Split(string(out), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || seen[line] {
+			continue
+		}
+		seen[line] = true
+		lines = append(lines, line)
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+// installedKernels lists kernel versions that have a module directory.
+func installedKernels() []string {
+	for _, dir := range []string{"/usr/lib/modules", "/lib/modules"} {
+		entries, err := os.ReadDir(dir)
+		if err != nil {
+			continue
+		}
+		var kernels []string
+		for _, entry := range entries {
+			if entry.IsDir() {
+				kernels = append(kernels, entry.Name())
+			}
+		}
+		return kernels
+	}
+	return nil
+}
+
+// summary describes the inventory in one line per package source.
+func (inv *PackageInventory) summary() string {
+	var s strings.Builder
+	line := func(icon, label string, items []string, unit string) {
+		if len(items) > 0 {
+			s.WriteString(fmt.Sprintf("%s %s: %d %s\n", icon, label, len(items), unit))
+		}
+	}
+	line("📦", "pacman", inv.Pacman, "packages")
+	line("📦", "AUR/foreign", inv.PacmanForeign, "packages (listed only)")
+	line("📦", "apt", inv.Apt, "packages")
+	line("📦", "dnf", inv.Dnf, "packages")
+	line("📦", "flatpak", inv.Flatpak, "apps")
+	line("⚙️", "systemd", inv.EnabledUnits, "enabled units")
+	if len(inv.Kernels) > 0 {
+		s.WriteString(fmt.Sprintf("🐧 kernels: %s\n", strings.Join(inv.Kernels, ", ")))
+	}
+	return s.String()
+}
+
+// generateReinstallScript renders a shell script that reinstalls the inventory on
+// whichever package manager the target system has.
+func generateReinstallScript(inv *PackageInventory, manifest *BackupManifest) string {
+	var s strings.Builder
+
+	s.WriteString("#!/bin/sh\n")
+	s.WriteString("# Reinstall packages from a Migrate backup\n")
+	if manifest != nil {
+		s.WriteString(fmt.Sprintf("# Backup of %s taken %s\n", manifest.Hostname, manifest.Created.Format(time.RFC1123)))
+	}
+	s.WriteString(fmt.Sprintf("# Generated %s\n", time.Now().Format(time.RFC1123)))
+	s.WriteString("#\n# Package names are installed on whichever package manager this system has.\n\n")
+	s.WriteString("status=0\n\n")
+
+	if len(inv.Pacman) > 0 {
+		// One package the repositories no longer carry must not fail the whole
+		// install, so each name is looked up first and missing ones are reported
+		s.WriteString("if command -v pacman >/dev/null 2>&1; then\n")
+		s.WriteString("\tpacman -Sy --noconfirm || status=1\n")
+		s.WriteString("\tpackages=\n")
+		s.WriteString("\tfor pkg in \\\n")
+		writeShellWords(&s, inv.Pacman)
+		s.WriteString("; do\n")
+		s.WriteString("\t\tif pacman -Si \"$pkg\" >/dev/null 2>&1; then\n")
+		s.WriteString("\t\t\tpackages=\"$packages $pkg\"\n")
+		s.WriteString("\t\telse\n")
+		s.WriteString("\t\t\techo \"Skipping $pkg: not in the configured repositories\" >&2\n")
+		s.WriteString("\t\tfi\n")
+		s.WriteString("\tdone\n")
+		s.WriteString("\tif [ -n \"$packages\" ]; then\n")
+		s.WriteString("\t\tpacman -Su --needed --noconfirm $packages || status=1\n")
+		s.WriteString("\tfi\n")
+		s.WriteString("fi\n\n")
+	}
+	if len(inv.PacmanForeign) > 0 {
+		s.WriteString("# Foreign (AUR or locally built) packages must be rebuilt by hand:\n")
+		for _, pkg := range inv.PacmanForeign {
+			s.WriteString("#   " + pkg + "\n")
+		}
+		s.WriteString("\n")
+	}
+	if len(inv.Apt) > 0 {
+		s.WriteString("if command -v apt-get >/dev/null 2>&1; then\n")
+		s.WriteString("\tapt-get update || status=1\n")
+		s.WriteString("\tDEBIAN_FRONTEND=noninteractive apt-get install -y \\\n")
+		writeShellWords(&s, inv.Apt)
+		s.WriteString(" || status=1\n")
+		s.WriteString("fi\n\n")
+	}
+	if len(inv.Dnf) > 0 {
+		s.WriteString("if command -v dnf >/dev/null 2>&1; then\n")
+		s.WriteString("\tdnf install -y --skip-unavailable \\\n")
+		writeShellWords(&s, inv.Dnf)
+		s.WriteString(" || status=1\n")
+		s.WriteString("fi\n\n")
+	}
+	if len(inv.Flatpak) > 0 {
+		s.WriteString("if command -v flatpak >/dev/null 2>&1; then\n")
+		for _, origin := range inv.flatpakOrigins() {
+			s.WriteString(fmt.Sprintf("\tflatpak install -y --noninteractive %s \\\n", shellQuote(origin)))
+			writeShellWords(&s, inv.flatpaksFrom(origin))
+			s.WriteString(" || status=1\n")
+		}
+		s.WriteString("fi\n\n")
+	}
+	if len(inv.EnabledUnits) > 0 {
+		s.WriteString("if command -v systemctl >/dev/null 2>&1; then\n")
+		for _, unit := range inv.EnabledUnits {
+			// Units from packages that are not installed are skipped quietly
+			s.WriteString(fmt.Sprintf("\tsystemctl enable %s >/dev/null 2>&1 || true\n", shellQuote(unit)))
+		}
+		s.WriteString("fi\n\n")
+	}
+	if len(inv.Kernels) > 0 {
+		s.WriteString("# Kernels installed on the backed-up system:\n")
+		for _, kernel := range inv.Kernels {
+			s.WriteString("#   " + kernel + "\n")
+		}
+		s.WriteString("\n")
+	}
+
+	s.WriteString("exit $status\n")
+	return s.String()
+}
+
+// defaultFlatpakOrigin is assumed for applications whose remote was not recorded.
+const defaultFlatpakOrigin = "flathub"
+
+// flatpakOrigin returns the remote app was installed from.
+func (inv *PackageInventory) flatpakOrigin(app string) string {
+	if origin := inv.FlatpakOrigin[app]; origin != "" {
+		return origin
+	}
+	return defaultFlatpakOrigin
+}
+
+// flatpakOrigins lists the remotes the flatpak applications came from, sorted.
+func (inv *PackageInventory) flatpakOrigins() []string {
+	seen := make(map[string]bool)
+	var origins []string
+	for _, app := range inv.Flatpak {
+		if origin := inv.flatpakOrigin(app); !seen[origin] {
+			seen[origin] = true
+			origins = append(origins, origin)
+		}
+	}
+	sort.Strings(origins)
+	return origins
+}
+
+// flatpaksFrom lists the flatpak applications installed from origin.
+func (inv *PackageInventory) flatpaksFrom(origin string) []string {
+	var apps []string
+	for _, app := range inv.Flatpak {
+		if inv.flatpakOrigin(app) == origin {
+			apps = append(apps, app)
+		}
+	}
+	return apps
+}
+
+// writeShellWords writes quoted words as continuation lines, without a final newline.
+func writeShellWords(s *strings.Builder, words []string) {
+	for i, word := range words {
+		s.WriteString("\t\t" + shellQuote(word))
+		if i < len(words)-1 {
+			s.WriteString(" \\\n")
+		}
+	}
+}
+
+// shellQuote quotes a word for /bin/sh unless it only contains safe characters.
+func shellQuote(word string) string {
+	safe := word != ""
+	for _, r := range word {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || strings.ContainsRune("@%+=:,./-_", r)) {
+			safe = false
+			break
+		}
+	}
+	if safe {
+		return word
+	}
+	return "'" + strings.ReplaceAll(word, "'", `'\''`) + "'"
+}
+
+// loadBackupInventory returns the package inventory recorded in a backup, or nil.
+func loadBackupInventory(backupPath string) *PackageInventory {
+	manifest, err := loadBackupFacts(backupPath)
+	if err != nil || manifest.Inventory.isEmpty() {
+		return nil
+	}
+	return manifest.Inventory
+}
+
+// prepareReinstall writes the reinstall script for a system backup and, for
+// PackageActionRun, runs it. It returns the script path, or "" when the backup
+// has no inventory or the action is PackageActionSkip.
+func prepareReinstall(backupPath, action string, logFile *os.File) (string, error) {
+	if action == "" || action == PackageActionSkip {
+		return "", nil
+	}
+
+	manifest, err := loadBackupFacts(backupPath)
+	if err != nil || manifest.Inventory.isEmpty() {
+		if logFile != nil {
+			fmt.Fprintf(logFile, "No package inventory in backup - skipping package reinstall\n")
+		}
+		return "", nil
+	}
+
+	if err := os.MkdirAll(migrateStateDir, 0755); err != nil {
+		return "", fmt.Errorf("failed to create %s: %v", migrateStateDir, err)
+	}
+	scriptPath := filepath.Join(migrateStateDir, reinstallScriptName)
+	script := generateReinstallScript(manifest.Inventory, manifest)
+	if err := writeFileAtomically(scriptPath, []byte(script)); err != nil {
+		return "", fmt.Errorf("failed to write reinstall script: %v", err)
+	}
+	if err := os.Chmod(scriptPath, 0755); err != nil {
+		return "", fmt.Errorf("failed to make reinstall script executable: %v", err)
+	}
+
+	if logFile != nil {
+		fmt.Fprintf(logFile, "Package reinstall script written to %s\n", scriptPath)
+	}
+	if action != PackageActionRun {
+		return scriptPath, nil
+	}
+
+	if logFile != nil {
+		fmt.Fprintf(logFile, "Running package reinstall script before restoring files...\n")
+	}
+	cmd := exec.Command("/bin/sh", scriptPath)
+	if logFile != nil {
+		cmd.Stdout = logFile
+		cmd.Stderr = logFile
+	}
+	if err := cmd.Run(); err != nil {
+		return scriptPath, fmt.Errorf("package reinstall failed (%v) - see the log, fix the package set or rerun %s, then restore again", err, scriptPath)
+	}
+
+	if logFile != nil {
+		fmt.Fprintf(logFile, "Package reinstall completed\n")
+	}
+	return scriptPath, nil
+}
@@ -0,0 +1,52 @@
+package internal
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReinstallScriptChecksEachPacmanPackage(t *testing.T) {
+	script := generateReinstallScript(&PackageInventory{Pacman: []string{"base", "gone-pkg"}}, nil)
+
+	if strings.Contains(script, "-Syu") {
+		t.Fatal("script still installs every package in one pacman transaction")
+	}
+	if !strings.Contains(script, `pacman -Si "$pkg"`) {
+		t.Fatal("script does not look up packages one by one")
+	}
+	checkShellSyntax(t, script)
+}
+
+func TestReinstallScriptUsesRecordedFlatpakOrigin(t *testing.T) {
+	inv := &PackageInventory{
+		Flatpak:       []string{"org.example.App", "org.example.Legacy"},
+		FlatpakOrigin: map[string]string{"org.example.App": "fedora"},
+	}
+	script := generateReinstallScript(inv, nil)
+
+	if !strings.Contains(script, "--noninteractive fedora \\\n\t\torg.example.App ||") {
+		t.Fatalf("recorded origin not used:\n%s", script)
+	}
+	if !strings.Contains(script, "--noninteractive flathub \\\n\t\torg.example.Legacy ||") {
+		t.Fatalf("application without a recorded origin not installed from flathub:\n%s", script)
+	}
+	checkShellSyntax(t, script)
+}
+
+// checkShellSyntax parses script with sh -n.
+func checkShellSyntax(t *testing.T, script string) {
+	t.Helper()
+	if _, err := exec.LookPath("sh"); err != nil {
+		return
+	}
+	path := filepath.Join(t.TempDir(), reinstallScriptName)
+	if err := os.WriteFile(path, []byte(script), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if out, err := exec.Command("sh", "-n", path).CombinedOutput(); err != nil {
+		t.Fatalf("script does not parse: %v\n%s\n%s", err, out, script)
+	}
+}
@@ -0,0 +1,174 @@
+// Package internal provides the Store of a local directory.
+//
+// LocalStore is what sync, delete and verify use for drives, mounted images and
+// the live system. New files are written under a temporary name next to their
+// target and renamed into place on Commit, so an interrupted copy never leaves
+// a truncated file under the real name.
+package internal
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// LocalStore is a Store on a local directory tree.
+type LocalStore struct {
+	root string
+}
+
+// NewLocalStore returns the Store of the directory root.
+func NewLocalStore(root string) *LocalStore {
+	return &LocalStore{root: filepath.Clean(root)}
+}
+
+func (s *LocalStore) Path(name string) string {
+	return filepath.Join(s.root, filepath.FromSlash(name))
+}
+
+func (s *LocalStore) Lstat(name string) (os.FileInfo, error) {
+	return os.Lstat(s.Path(name))
+}
+
+func (s *LocalStore) Stat(name string) (os.FileInfo, error) {
+	return os.Stat(s.Path(name))
+}
+
+// ReadDir lists a directory, leaving out entries that vanish while it is read.
+func (s *LocalStore) ReadDir(name string) ([]os.FileInfo, error) {
+	entries, err := os.ReadDir(s.Path(name))
+	infos := make([]os.FileInfo, 0, len(entries))
+	for _, entry := range entries {
+		if info, err := entry.Info(); err == nil {
+			infos = append(infos, info)
+		}
+	}
+	return infos, err
+}
+
+// Open returns the *os.File, which copyStoreFile uses for in-kernel copies.
+func (s *LocalStore) Open(name string) (io.ReadCloser, error) {
+	return os.Open(s.Path(name))
+}
+
+// Create writes to a temporary file next to name and renames it into place on Commit.
+func (s *LocalStore) Create(name string, perm os.FileMode) (StoreWriter, error) {
+	target := s.Path(name)
+	f, err := os.CreateTemp(filepath.Dir(target), ".migrate-tmp-*")
+	if err != nil {
+		return nil, err
+	}
+	return &localWriter{file: f, target: target, perm: perm}, nil
+}
+
+// localWriter is a local file being written under a temporary name.
+type localWriter struct {
+	file   *os.File
+	target string
+	perm   os.FileMode
+}
+
+func (w *localWriter) Write(p []byte) (int, error) {
+	return w.file.Write(p)
+}
+
+func (w *localWriter) Commit() error {
+	if err := w.file.Close(); err != nil {
+		os.Remove(w.file.Name())
+		return err
+	}
+	if err := os.Chmod(w.file.Name(), w.perm); err != nil {
+		os.Remove(w.file.Name())
+		return err
+	}
+	if err := os.Rename(w.file.Name(), w.target); err != nil {
+		os.Remove(w.file.Name())
+		return err
+	}
+	return nil
+}
+
+func (w *localWriter) Abort() {
+	w.file.Close()
+	os.Remove(w.file.Name())
+}
+
+func (s *LocalStore) MkdirAll(name string, perm os.FileMode) error {
+	return os.MkdirAll(s.Path(name), perm)
+}
+
+func (s *LocalStore) Remove(name string) error {
+	return os.Remove(s.Path(name))
+}
+
+func (s *LocalStore) RemoveAll(name string) error {
+	return os.RemoveAll(s.Path(name))
+}
+
+func (s *LocalStore) Rename(oldname, newname string) error {
+	return os.Rename(s.Path(oldname), s.Path(newname))
+}
+
+func (s *LocalStore) Symlink(target, name string) error {
+	return os.Symlink(target, s.Path(name))
+}
+
+func (s *LocalStore) Readlink(name string) (string, error) {
+	return os.Readlink(s.Path(name))
+}
+
+func (s *LocalStore) Link(oldname, newname string) error {
+	return os.Link(s.Path(oldname), s.Path(newname))
+}
+
+func (s *LocalStore) Chmod(name string, mode os.FileMode) error {
+	return os.Chmod(s.Path(name), mode)
+}
+
+func (s *LocalStore) Lchown(name string, uid, gid int) error {
+	return os.Lchown(s.Path(name), uid, gid)
+}
+
+// Chtimes sets both times to mtime, as a sync always has.
+func (s *LocalStore) Chtimes(name string, mtime time.Time) error {
+	return os.Chtimes(s.Path(name), mtime, mtime)
+}
+
+func (s *LocalStore) Xattrs(name string) (map[string][]byte, error) {
+	if _, err := s.Lstat(name); err != nil {
+		return nil, err
+	}
+	return listXattrs(s.Path(name)), nil
+}
+
+// SetXattrs applies every attribute it can and returns the first refusal.
+func (s *LocalStore) SetXattrs(name string, xattrs map[string][]byte) error {
+	var first error
+	for attr, value := range xattrs {
+		if err := unix.Lsetxattr(s.Path(name), attr, value, 0); err != nil && first == nil {
+			first = fmt.Errorf("failed to set %s on %s: %v", attr, s.Path(name), err)
+		}
+	}
+	return first
+}
+
+func (s *LocalStore) Space() (int64, int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(s.root, &stat); err != nil {
+		return 0, 0, fmt.Errorf("failed to get filesystem stats for %s: %v", s.root, err)
+	}
+	return int64(stat.Blocks) * int64(stat.Bsize), int64(stat.Bavail) * int64(stat.Bsize), nil
+}
+
+func (s *LocalStore) String() string {
+	return s.root
+}
+
+func (s *LocalStore) Close() error {
+	return nil
+}
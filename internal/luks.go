@@ -0,0 +1,139 @@
+// Package internal provides the passphrase prompt for LUKS-encrypted drives.
+//
+// Selecting a locked drive asks for its passphrase in the TUI and opens the
+// container with cryptsetup; a wrong passphrase can be entered again. With
+// --luks-key-file the container is opened with a key file and no prompt.
+package internal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"unicode/utf8"
+
+	"migrate/internal/drives"
+	"migrate/internal/screens"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// luksKeyFile opens encrypted drives instead of a passphrase (--luks-key-file).
+var luksKeyFile string
+
+// SetLUKSKeyFile opens encrypted drives with the content of path (--luks-key-file).
+func SetLUKSKeyFile(path string) error {
+	absPath, err := filepath.Abs(path)
+	if err != nil {
+		return fmt.Errorf("invalid key file path: %v", err)
+	}
+	info, err := os.Stat(absPath)
+	if err != nil {
+		return fmt.Errorf("cannot read key file: %v", err)
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a file", absPath)
+	}
+	luksKeyFile = absPath
+	return nil
+}
+
+// DriveUnlocked reports whether an entered passphrase opened the drive.
+type DriveUnlocked struct {
+	err error
+}
+
+// unlockDriveCmd opens the LUKS container in the background.
+func unlockDriveCmd(drive DriveInfo, passphrase string) tea.Cmd {
+	return func() tea.Msg {
+		return DriveUnlocked{err: drives.UnlockLUKS(drive, passphrase)}
+	}
+}
+
+// startDriveUnlock switches to the drive passphrase screen; the drive is mounted
+// for the selected operation once it is unlocked.
+func (m Model) startDriveUnlock(msg PasswordRequiredMsg) Model {
+	m.unlockDrive = msg.drive
+	m.passphrase = ""
+	m.passphraseChecking = false
+	m.passphraseError = ""
+	m.message = ""
+	m.screen = screens.ScreenUnlockDrive
+	return m
+}
+
+// handleUnlockDriveKey edits the masked passphrase field of a locked drive.
+func (m Model) handleUnlockDriveKey(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	if m.passphraseChecking {
+		return m, nil
+	}
+
+	switch msg.Type {
+	case tea.KeyEsc, tea.KeyCtrlC:
+		// Back to the drive list
+		m.passphrase = ""
+		m.passphraseError = ""
+		m.screen = screens.ScreenDriveSelect
+		m.cursor = 0
+		return m, LoadDrives()
+
+	case tea.KeyEnter:
+		if m.passphrase == "" {
+			m.passphraseError = "Please enter a passphrase"
+			return m, nil
+		}
+		m.passphraseChecking = true
+		m.passphraseError = ""
+		return m, unlockDriveCmd(m.unlockDrive, m.passphrase)
+	}
+
+	m.typePassphrase(msg)
+	return m, nil
+}
+
+// handleDriveUnlocked mounts the unlocked drive, or asks again.
+func (m Model) handleDriveUnlocked(msg DriveUnlocked) (tea.Model, tea.Cmd) {
+	m.passphraseChecking = false
+	m.passphrase = ""
+	if msg.err == drives.ErrWrongPassphrase {
+		m.passphraseError = "❌ Wrong passphrase, please try again"
+		return m, nil
+	}
+	if msg.err != nil {
+		m.passphraseError = "❌ " + msg.err.Error()
+		return m, nil
+	}
+
+	// The result arrives as a BackupDriveStatus, like any drive being mounted
+	m.passphraseError = ""
+	m.screen = screens.ScreenDriveSelect
+	m.message = "🔧 Mounting drive and checking space..."
+	return m, m.mountCmdFor(m.unlockDrive)
+}
+
+// renderUnlockDrive renders the masked passphrase prompt of a locked drive.
+func (m Model) renderUnlockDrive() string {
+	var s strings.Builder
+
+	ascii := asciiStyle.Render(MigrateASCII)
+	s.WriteString(ascii + "\n")
+	s.WriteString(titleStyle.Render("🔐 Unlock Drive") + "\n\n")
+
+	prompt := fmt.Sprintf("%s (%s) is encrypted.\nEnter its passphrase to unlock it.", m.unlockDrive.Label, m.unlockDrive.Size)
+	s.WriteString(infoStyle.Render(prompt) + "\n\n")
+
+	masked := strings.Repeat("•", utf8.RuneCountInString(m.passphrase))
+	s.WriteString(selectedMenuItemStyle.Render("🔑 "+masked+"▏") + "\n")
+
+	if m.passphraseChecking {
+		s.WriteString("\n" + infoStyle.Render("Unlocking...") + "\n")
+	} else if m.passphraseError != "" {
+		s.WriteString("\n" + warningStyle.Render(m.passphraseError) + "\n")
+	}
+
+	help := helpStyle.Render("enter: unlock • esc: back to drives")
+	s.WriteString("\n" + help)
+
+	content := borderStyle.Width(safeRenderWidth(m.width)).Render(s.String())
+	return safeCenterContent(m.width, m.height, content)
+}
@@ -0,0 +1,96 @@
+package internal
+
+import (
+	"errors"
+	"testing"
+
+	"migrate/internal/drives"
+	"migrate/internal/screens"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// typeKeys feeds text to the model as key presses.
+func typeKeys(m Model, text string) Model {
+	for _, r := range text {
+		updated, _ := m.Update(tea.KeyMsg{Type: tea.KeyRunes, Runes: []rune{r}})
+		m = updated.(Model)
+	}
+	return m
+}
+
+// pressKey feeds a single key to the model.
+func pressKey(m Model, key tea.KeyType) (Model, tea.Cmd) {
+	updated, cmd := m.Update(tea.KeyMsg{Type: key})
+	return updated.(Model), cmd
+}
+
+func TestDriveUnlockRetriesAfterWrongPassphrase(t *testing.T) {
+	locked := DriveInfo{Device: "/dev/sdb2", DevicePath: "/dev/sdb2", Size: "1 TB", Label: "Encrypted External Drive", Filesystem: "crypto_LUKS"}
+	m := InitialModel()
+	m.operation = "system_backup"
+	m.screen = screens.ScreenDriveSelect
+
+	updated, _ := m.Update(PasswordRequiredMsg{drive: locked})
+	m = updated.(Model)
+	if m.screen != screens.ScreenUnlockDrive || m.unlockDrive != locked {
+		t.Fatalf("locked drive did not ask for a passphrase (screen %v)", m.screen)
+	}
+
+	// An empty passphrase is not tried
+	m, cmd := pressKey(m, tea.KeyEnter)
+	if cmd != nil || m.passphraseChecking || m.passphraseError == "" {
+		t.Fatal("empty passphrase submitted")
+	}
+
+	m = typeKeys(m, "wrong")
+	m, cmd = pressKey(m, tea.KeyEnter)
+	if cmd == nil || !m.passphraseChecking {
+		t.Fatal("passphrase not submitted")
+	}
+	// Keys are ignored while cryptsetup runs
+	if m = typeKeys(m, "x"); m.passphrase != "wrong" {
+		t.Fatalf("typing while unlocking changed the passphrase to %q", m.passphrase)
+	}
+
+	updated, cmd = m.Update(DriveUnlocked{err: drives.ErrWrongPassphrase})
+	m = updated.(Model)
+	if cmd != nil || m.screen != screens.ScreenUnlockDrive || m.passphraseChecking {
+		t.Fatal("wrong passphrase left the prompt")
+	}
+	if m.passphrase != "" || m.passphraseError == "" {
+		t.Fatalf("wrong passphrase: field %q, error %q", m.passphrase, m.passphraseError)
+	}
+
+	// Other failures are shown as they are, and may be retried too
+	m = typeKeys(m, "right")
+	m, _ = pressKey(m, tea.KeyEnter)
+	updated, _ = m.Update(DriveUnlocked{err: errors.New("cryptsetup not found")})
+	m = updated.(Model)
+	if m.screen != screens.ScreenUnlockDrive || m.passphraseError != "❌ cryptsetup not found" {
+		t.Fatalf("unlock failure shown as %q", m.passphraseError)
+	}
+
+	m = typeKeys(m, "right")
+	m, _ = pressKey(m, tea.KeyEnter)
+	updated, cmd = m.Update(DriveUnlocked{})
+	m = updated.(Model)
+	if m.screen != screens.ScreenDriveSelect || cmd == nil {
+		t.Fatal("unlocked drive was not mounted")
+	}
+	if m.passphrase != "" || m.passphraseError != "" {
+		t.Fatalf("passphrase state kept after unlocking: %q, %q", m.passphrase, m.passphraseError)
+	}
+}
+
+func TestDriveUnlockEscReturnsToDrives(t *testing.T) {
+	m := InitialModel()
+	m.operation = "restore"
+	updated, _ := m.Update(PasswordRequiredMsg{drive: DriveInfo{Device: "/dev/sdb2"}})
+	m = typeKeys(updated.(Model), "half")
+
+	m, cmd := pressKey(m, tea.KeyEsc)
+	if m.screen != screens.ScreenDriveSelect || m.passphrase != "" || cmd == nil {
+		t.Fatalf("esc: screen %v, passphrase %q", m.screen, m.passphrase)
+	}
+}
@@ -0,0 +1,214 @@
+// Package internal provides the machine-readable backup manifest.
+//
+// BACKUP-INFO.txt is written for humans; BACKUP-MANIFEST.json sits next to it and
+// records the facts restore and verify need to reason about a backup, such as
+// the user and group names behind the numeric ids stored in the mirrored tree.
+package internal
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	// backupManifestFile is the manifest stored at the root of every backup.
+	backupManifestFile = "BACKUP-MANIFEST.json"
+
+	// backupManifestVersion is bumped whenever the manifest layout changes incompatibly.
+	backupManifestVersion = 1
+)
+
+// BackupManifest describes a backup for restore and verification.
+type BackupManifest struct {
+	Version    int       `json:"version"`
+	AppVersion string    `json:"app_version"`
+	Created    time.Time `json:"created"`
+	Hostname   string    `json:"hostname"`
+	BackupType string    `json:"backup_type"` // "Complete System" or "Home Directory"
+	SourcePath string    `json:"source_path"`
+
+	// Account names of the source system, keyed by numeric id
+	Users  map[uint32]string `json:"users,omitempty"`
+	Groups map[uint32]string `json:"groups,omitempty"`
+
+	// How a backup not written by Migrate was adopted ("rsync tree" or "tar archive")
+	Adopted string `json:"adopted,omitempty"`
+
+	// Explicitly installed packages, enabled units and kernels (system backups only)
+	Inventory *PackageInventory `json:"inventory,omitempty"`
+
+	// Set when a backup completes; the local state cache is only used if it matches
+	StateToken string `json:"state_token,omitempty"`
+
+	// "mirror" (a plain copy of the source tree), "repository" (chunks in migrate-repo/)
+	// or "archive" (tar/zstd volumes in migrate-archive/)
+	Format string `json:"format,omitempty"`
+
+	// Snapshot written by the latest repository backup; restore and verify pick
+	// theirs by host and source (see selectSnapshot)
+	Snapshot string `json:"snapshot,omitempty"`
+
+	// Non-secret encryption parameters of an encrypted repository
+	Encryption *EncryptionInfo `json:"encryption,omitempty"`
+
+	// Latest complete archive of an archive backup
+	Archive *ArchiveInfo `json:"archive,omitempty"`
+}
+
+// isBackupMetadataFile reports whether a path is one of Migrate's metadata files
+// at the root of a backup, which sync, delete and verify must leave alone.
+func isBackupMetadataFile(path string) bool {
+	return strings.Contains(path, "BACKUP-INFO.txt") ||
+		strings.Contains(path, "BACKUP-FOLDERS.txt") ||
+		strings.Contains(path, backupManifestFile) ||
+		strings.HasSuffix(path, "/"+repositoryDir) ||
+		strings.Contains(path, "/"+repositoryDir+"/") ||
+		strings.HasSuffix(path, "/"+archiveDir) ||
+		strings.Contains(path, "/"+archiveDir+"/")
+}
+
+// createBackupManifest writes BACKUP-MANIFEST.json for the backup described by config.
+// For an encrypted repository the manifest only says what kind of backup it is:
+// the hostname, source path, account names and package inventory are sealed in
+// the snapshot record instead.
+func createBackupManifest(config BackupConfig) error {
+	hostname, _ := os.Hostname()
+
+	manifest := BackupManifest{
+		Version:    backupManifestVersion,
+		AppVersion: AppVersion,
+		Created:    time.Now(),
+		Hostname:   hostname,
+		BackupType: config.BackupType,
+		SourcePath: config.SourcePath,
+		Format:     config.Format,
+	}
+	if manifest.Format == "" {
+		manifest.Format = BackupFormatMirror
+	}
+	sealed := manifest.Format == BackupFormatRepository && backupEncrypted(config.DestinationPath)
+	if sealed {
+		manifest.Hostname = ""
+		manifest.SourcePath = ""
+	}
+
+	// Until this run completes, a repository's or archive's manifest keeps pointing at the last complete one
+	if manifest.Format == BackupFormatRepository {
+		if previous, err := loadBackupManifest(config.DestinationPath); err == nil && previous.Format == BackupFormatRepository {
+			manifest.Snapshot = previous.Snapshot
+			manifest.Encryption = previous.Encryption
+		}
+	}
+	if manifest.Format == BackupFormatArchive {
+		if previous, err := loadBackupManifest(config.DestinationPath); err == nil && previous.Format == BackupFormatArchive {
+			manifest.Archive = previous.Archive
+		}
+	}
+
+	if !sealed {
+		manifest.Users, manifest.Groups, manifest.Inventory = captureSystemFacts(config.BackupType)
+	}
+
+	return writeBackupManifest(config.DestinationPath, &manifest)
+}
+
+// captureSystemFacts returns the account names and, for a system backup, the
+// package inventory of the running system, which owns every file being backed up.
+func captureSystemFacts(backupType string) (users, groups map[uint32]string, inventory *PackageInventory) {
+	users, _ = readAccountNames("/etc/passwd")
+	groups, _ = readAccountNames("/etc/group")
+	if backupType == "Complete System" {
+		inventory = captureInventory()
+	}
+	return users, groups, inventory
+}
+
+// loadBackupFacts reads a backup's manifest including what an encrypted
+// repository seals: the hostname, account names and package inventory of the
+// snapshot a restore of the manifest's backup type uses. They stay empty when
+// the repository cannot be opened.
+func loadBackupFacts(backupPath string) (*BackupManifest, error) {
+	manifest, err := loadBackupManifest(backupPath)
+	if err != nil || manifest.Format != BackupFormatRepository || manifest.Encryption == nil {
+		return manifest, err
+	}
+
+	source := "/"
+	if manifest.BackupType != "Complete System" {
+		source = "/home/" + getCurrentUser()
+	}
+	if _, snapshot, err := loadRepositorySnapshot(backupPath, source); err == nil {
+		manifest.Hostname = snapshot.Hostname
+		manifest.Users, manifest.Groups, manifest.Inventory = snapshot.Users, snapshot.Groups, snapshot.Inventory
+	}
+	return manifest, nil
+}
+
+// writeBackupManifest stores a manifest at the root of a backup.
+func writeBackupManifest(backupPath string, manifest *BackupManifest) error {
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode backup manifest: %v", err)
+	}
+	return writeFileAtomically(filepath.Join(backupPath, backupManifestFile), data)
+}
+
+// loadBackupManifest reads BACKUP-MANIFEST.json from a backup.
+// Backups made before the manifest existed return an error wrapping os.ErrNotExist.
+func loadBackupManifest(backupPath string) (*BackupManifest, error) {
+	data, err := os.ReadFile(filepath.Join(backupPath, backupManifestFile))
+	if err != nil {
+		return nil, err
+	}
+
+	var manifest BackupManifest
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return nil, fmt.Errorf("failed to parse backup manifest: %v", err)
+	}
+	if manifest.Version > backupManifestVersion {
+		return nil, fmt.Errorf("backup manifest version %d is newer than this version of Migrate supports", manifest.Version)
+	}
+	return &manifest, nil
+}
+
+// readAccountNames parses an /etc/passwd or /etc/group style file into id -> name.
+func readAccountNames(path string) (map[uint32]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return parseAccountNames(f)
+}
+
+// parseAccountNames parses /etc/passwd or /etc/group content into id -> name.
+func parseAccountNames(r io.Reader) (map[uint32]string, error) {
+	names := make(map[uint32]string)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		// name:password:id:...
+		fields := strings.SplitN(line, ":", 4)
+		if len(fields) < 3 {
+			continue
+		}
+		id, err := strconv.ParseUint(fields[2], 10, 32)
+		if err != nil {
+			continue
+		}
+		if _, exists := names[uint32(id)]; !exists {
+			names[uint32(id)] = fields[0]
+		}
+	}
+	return names, scanner.Err()
+}
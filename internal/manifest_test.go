@@ -0,0 +1,127 @@
+package internal
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// useTestEncryption makes new repositories encrypted with a fixed key file content.
+func useTestEncryption(t *testing.T) {
+	t.Helper()
+	encryptionRequested = true
+	setBackupSecret(bytes.Repeat([]byte("k"), 32), KeySourceKeyFile)
+	t.Cleanup(func() {
+		encryptionRequested = false
+		setBackupSecret(nil, "")
+	})
+}
+
+func TestEncryptedManifestLeavesOutHostFacts(t *testing.T) {
+	useTestEncryption(t)
+	backupPath := t.TempDir()
+	hostname, _ := os.Hostname()
+
+	config := BackupConfig{
+		BackupType:      "Home Directory",
+		SourcePath:      "/home/alice",
+		DestinationPath: backupPath,
+		Format:          BackupFormatRepository,
+	}
+	if err := createBackupManifest(config); err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(filepath.Join(backupPath, backupManifestFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, leak := range []string{`"users"`, `"groups"`, "/home/alice", `"hostname": "` + hostname} {
+		if strings.Contains(string(data), leak) {
+			t.Errorf("manifest of an encrypted repository contains %s:\n%s", leak, data)
+		}
+	}
+}
+
+func TestLoadBackupFactsOpensSealedSnapshot(t *testing.T) {
+	useTestEncryption(t)
+	backupPath := t.TempDir()
+	repo, err := initRepository(repositoryPath(backupPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if repo.key == nil {
+		t.Fatal("repository is not encrypted")
+	}
+
+	now := time.Now()
+	snapshot := &Snapshot{
+		ID:         newSnapshotID(now),
+		Time:       now,
+		Hostname:   "old-laptop",
+		SourcePath: "/home/" + getCurrentUser(),
+		BackupType: "Home Directory",
+		Users:      map[uint32]string{1000: "alice"},
+		Groups:     map[uint32]string{1000: "alice"},
+	}
+	if err := repo.saveSnapshot(snapshot, nil); err != nil {
+		t.Fatal(err)
+	}
+	manifest := &BackupManifest{
+		Version:    backupManifestVersion,
+		BackupType: "Home Directory",
+		Format:     BackupFormatRepository,
+		Snapshot:   snapshot.ID,
+		Encryption: repositoryEncryption(backupPath).info(),
+	}
+	if err := writeBackupManifest(backupPath, manifest); err != nil {
+		t.Fatal(err)
+	}
+
+	facts, err := loadBackupFacts(backupPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if facts.Hostname != "old-laptop" || facts.Users[1000] != "alice" || facts.Groups[1000] != "alice" {
+		t.Fatalf("sealed facts not read back: hostname %q, users %v, groups %v", facts.Hostname, facts.Users, facts.Groups)
+	}
+}
+
+func TestEncryptionSelectsRepositoryFormat(t *testing.T) {
+	t.Cleanup(func() {
+		backupFormat, backupFormatChosen, encryptionRequested = BackupFormatMirror, false, false
+	})
+
+	// --encrypt alone must not leave the default mirror in plaintext
+	if err := SetEncryption(true); err != nil {
+		t.Fatal(err)
+	}
+	config, err := createBackupConfig("home_backup", t.TempDir(), nil, nil)
+	if err != nil || config.Format != BackupFormatRepository {
+		t.Fatalf("--encrypt backs up as %q, %v", config.Format, err)
+	}
+
+	encryptionRequested = false
+	SetBackupFormat(BackupFormatArchive)
+	if err := SetEncryption(true); err == nil {
+		t.Fatal("--encrypt accepted with --format archive")
+	}
+}
+
+func TestEncryptedRepositoryDriveKeepsRepositoryFormat(t *testing.T) {
+	useTestEncryption(t)
+	backupPath := t.TempDir()
+	if _, err := initRepository(repositoryPath(backupPath)); err != nil {
+		t.Fatal(err)
+	}
+	encryptionRequested = false
+
+	if got := backupFormatFor(backupPath); got != BackupFormatRepository {
+		t.Fatalf("a drive with an encrypted repository gets a %s backup", got)
+	}
+	if got := backupFormatFor(t.TempDir()); got != BackupFormatMirror {
+		t.Fatalf("an empty drive gets a %s backup", got)
+	}
+}
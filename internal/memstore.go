@@ -0,0 +1,565 @@
+// Package internal provides an in-memory Store.
+//
+// MemStore keeps a whole tree in memory: files, directories, symlinks, hard
+// links, owners, modes, times and extended attributes. It lets the sync,
+// delete and verify logic run without touching a disk, e.g. in tests, and can
+// be given a capacity to run out of.
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// MemStore is a Store held in memory. It is safe for concurrent use.
+type MemStore struct {
+	mu       sync.Mutex
+	root     string
+	nodes    map[string]*memNode // By cleaned name; "." is the root directory
+	capacity int64               // 0 = unlimited
+	used     int64
+	nextIno  uint64
+}
+
+// memNode is a file, directory or symlink. Hard links share one node.
+type memNode struct {
+	mode   os.FileMode
+	data   []byte
+	target string // Symlink target
+	uid    int
+	gid    int
+	mtime  time.Time
+	ctime  time.Time
+	xattrs map[string][]byte
+	ino    uint64
+	nlink  int
+}
+
+// NewMemStore returns an empty store. root is what Path reports for its root,
+// so that absolute exclusion patterns match as they would on disk.
+func NewMemStore(root string) *MemStore {
+	s := &MemStore{root: path.Clean("/" + root), nodes: make(map[string]*memNode)}
+	s.nodes["."] = s.newNode(os.ModeDir | 0755)
+	return s
+}
+
+// SetCapacity limits the bytes of file data the store holds; writes beyond it
+// fail with ENOSPC. 0 removes the limit.
+func (s *MemStore) SetCapacity(bytes int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.capacity = bytes
+}
+
+func (s *MemStore) newNode(mode os.FileMode) *memNode {
+	s.nextIno++
+	now := time.Now()
+	return &memNode{mode: mode, mtime: now, ctime: now, ino: s.nextIno, nlink: 1}
+}
+
+// memName turns a name into the key of its node.
+func memName(name string) string {
+	cleaned := path.Clean("/" + name)
+	if cleaned == "/" {
+		return "."
+	}
+	return cleaned[1:]
+}
+
+func memError(op, name string, err error) error {
+	return &os.PathError{Op: op, Path: name, Err: err}
+}
+
+// lookup returns the key and node of name, following symlinks in its parents
+// and, when follow is set, in name itself. Absolute symlink targets are
+// resolved against the root that Path reports.
+func (s *MemStore) lookup(name string, follow bool) (string, *memNode, error) {
+	pending := strings.Split(memName(name), "/")
+	resolved := "."
+	for hops := 0; len(pending) > 0; {
+		part := pending[0]
+		pending = pending[1:]
+		switch part {
+		case "", ".":
+			continue
+		case "..":
+			resolved = path.Dir(resolved)
+			continue
+		}
+
+		candidate := path.Join(resolved, part)
+		node, ok := s.nodes[candidate]
+		if !ok {
+			return "", nil, fs.ErrNotExist
+		}
+		if node.mode&os.ModeSymlink != 0 && (len(pending) > 0 || follow) {
+			if hops++; hops > 40 {
+				return "", nil, syscall.ELOOP
+			}
+			target := node.target
+			if path.IsAbs(target) {
+				rel, inside := strings.CutPrefix(path.Clean(target), s.root)
+				if s.root == "/" {
+					rel, inside = target, true
+				}
+				if !inside || rel != "" && !strings.HasPrefix(rel, "/") {
+					return "", nil, fs.ErrNotExist
+				}
+				resolved, target = ".", rel
+			}
+			pending = append(strings.Split(target, "/"), pending...)
+			continue
+		}
+		if len(pending) > 0 && !node.mode.IsDir() {
+			return "", nil, syscall.ENOTDIR
+		}
+		resolved = candidate
+	}
+	return resolved, s.nodes[resolved], nil
+}
+
+// parent returns the key of name's parent directory, which must exist.
+func (s *MemStore) parent(name string) (string, error) {
+	key := memName(name)
+	if key == "." {
+		return "", fs.ErrExist
+	}
+	dir, node, err := s.lookup(path.Dir(key), true)
+	if err != nil {
+		return "", err
+	}
+	if !node.mode.IsDir() {
+		return "", syscall.ENOTDIR
+	}
+	return path.Join(dir, path.Base(key)), nil
+}
+
+// memFileInfo describes a node. Sys returns a *syscall.Stat_t, so owners,
+// devices and change times read the same way as on disk.
+type memFileInfo struct {
+	name string
+	size int64
+	mode os.FileMode
+	stat syscall.Stat_t
+}
+
+func (fi *memFileInfo) Name() string       { return fi.name }
+func (fi *memFileInfo) Size() int64        { return fi.size }
+func (fi *memFileInfo) Mode() os.FileMode  { return fi.mode }
+func (fi *memFileInfo) ModTime() time.Time { return time.Unix(0, fi.stat.Mtim.Nano()) }
+func (fi *memFileInfo) IsDir() bool        { return fi.mode.IsDir() }
+func (fi *memFileInfo) Sys() any           { return &fi.stat }
+
+func (n *memNode) info(name string) os.FileInfo {
+	size := int64(len(n.data))
+	if n.mode&os.ModeSymlink != 0 {
+		size = int64(len(n.target))
+	}
+	fi := &memFileInfo{name: path.Base(name), size: size, mode: n.mode}
+	if name == "." {
+		fi.name = "."
+	}
+	fi.stat = syscall.Stat_t{
+		Dev:   1,
+		Ino:   n.ino,
+		Nlink: uint64(n.nlink),
+		Uid:   uint32(n.uid),
+		Gid:   uint32(n.gid),
+		Size:  size,
+		Mtim:  syscall.NsecToTimespec(n.mtime.UnixNano()),
+		Ctim:  syscall.NsecToTimespec(n.ctime.UnixNano()),
+	}
+	return fi
+}
+
+func (s *MemStore) Lstat(name string) (os.FileInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key, node, err := s.lookup(name, false)
+	if err != nil {
+		return nil, memError("lstat", s.Path(name), err)
+	}
+	return node.info(key), nil
+}
+
+func (s *MemStore) Stat(name string) (os.FileInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key, node, err := s.lookup(name, true)
+	if err != nil {
+		return nil, memError("stat", s.Path(name), err)
+	}
+	return node.info(key), nil
+}
+
+// children returns the keys directly inside dir, sorted.
+func (s *MemStore) children(dir string) []string {
+	prefix := dir + "/"
+	if dir == "." {
+		prefix = ""
+	}
+	var keys []string
+	for key := range s.nodes {
+		if key != "." && strings.HasPrefix(key, prefix) && !strings.Contains(key[len(prefix):], "/") {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// descendants returns the keys below dir.
+func (s *MemStore) descendants(dir string) []string {
+	var keys []string
+	for key := range s.nodes {
+		if dir == "." && key != "." || strings.HasPrefix(key, dir+"/") {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func (s *MemStore) ReadDir(name string) ([]os.FileInfo, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key, node, err := s.lookup(name, true)
+	if err != nil {
+		return nil, memError("readdir", s.Path(name), err)
+	}
+	if !node.mode.IsDir() {
+		return nil, memError("readdir", s.Path(name), syscall.ENOTDIR)
+	}
+	var infos []os.FileInfo
+	for _, child := range s.children(key) {
+		infos = append(infos, s.nodes[child].info(child))
+	}
+	return infos, nil
+}
+
+func (s *MemStore) Open(name string) (io.ReadCloser, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, node, err := s.lookup(name, true)
+	if err != nil {
+		return nil, memError("open", s.Path(name), err)
+	}
+	if node.mode.IsDir() {
+		return nil, memError("open", s.Path(name), syscall.EISDIR)
+	}
+	// Files are replaced, never changed in place, so the reader can share the data
+	return memReader{bytes.NewReader(node.data)}, nil
+}
+
+// memReader reads a file's content; it also offers io.ReaderAt for sampling.
+type memReader struct {
+	*bytes.Reader
+}
+
+func (memReader) Close() error { return nil }
+
+// Create buffers the file and stores it on Commit.
+func (s *MemStore) Create(name string, perm os.FileMode) (StoreWriter, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.parent(name); err != nil {
+		return nil, memError("create", s.Path(name), err)
+	}
+	return &memWriter{store: s, name: name, perm: perm}, nil
+}
+
+// memWriter is a file being written to a MemStore.
+type memWriter struct {
+	store *MemStore
+	name  string
+	perm  os.FileMode
+	buf   bytes.Buffer
+}
+
+func (w *memWriter) Write(p []byte) (int, error) {
+	s := w.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.capacity > 0 && s.used+int64(w.buf.Len()+len(p)) > s.capacity {
+		return 0, memError("write", s.Path(w.name), syscall.ENOSPC)
+	}
+	return w.buf.Write(p)
+}
+
+func (w *memWriter) Commit() error {
+	s := w.store
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key, err := s.parent(w.name)
+	if err != nil {
+		return memError("rename", s.Path(w.name), err)
+	}
+	if old, ok := s.nodes[key]; ok {
+		if old.mode.IsDir() {
+			return memError("rename", s.Path(w.name), syscall.EISDIR)
+		}
+		s.unlink(key)
+	}
+	node := s.newNode(w.perm)
+	node.data = bytes.Clone(w.buf.Bytes())
+	node.uid, node.gid = os.Getuid(), os.Getgid()
+	s.used += int64(len(node.data))
+	s.nodes[key] = node
+	return nil
+}
+
+func (w *memWriter) Abort() {
+	w.buf.Reset()
+}
+
+// unlink drops the name key, and the node's data with its last link.
+func (s *MemStore) unlink(key string) {
+	node := s.nodes[key]
+	delete(s.nodes, key)
+	node.nlink--
+	if node.nlink == 0 {
+		s.used -= int64(len(node.data))
+	}
+}
+
+func (s *MemStore) MkdirAll(name string, perm os.FileMode) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key := memName(name)
+	if key == "." {
+		return nil
+	}
+	current := "."
+	for _, part := range strings.Split(key, "/") {
+		dir, node, err := s.lookup(path.Join(current, part), true)
+		switch {
+		case err == nil && node.mode.IsDir():
+			current = dir
+			continue
+		case err == nil:
+			return memError("mkdir", s.Path(name), syscall.ENOTDIR)
+		case err != fs.ErrNotExist:
+			return memError("mkdir", s.Path(name), err)
+		}
+		current = path.Join(current, part)
+		s.nodes[current] = s.newNode(os.ModeDir | perm.Perm())
+		s.nodes[current].uid, s.nodes[current].gid = os.Getuid(), os.Getgid()
+	}
+	return nil
+}
+
+func (s *MemStore) Remove(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key, node, err := s.lookup(name, false)
+	if err != nil {
+		return memError("remove", s.Path(name), err)
+	}
+	if key == "." || node.mode.IsDir() && len(s.children(key)) > 0 {
+		return memError("remove", s.Path(name), syscall.ENOTEMPTY)
+	}
+	s.unlink(key)
+	return nil
+}
+
+func (s *MemStore) RemoveAll(name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key, _, err := s.lookup(name, false)
+	if err == fs.ErrNotExist {
+		return nil
+	}
+	if err != nil {
+		return memError("removeall", s.Path(name), err)
+	}
+	for _, child := range s.descendants(key) {
+		s.unlink(child)
+	}
+	if key != "." {
+		s.unlink(key)
+	}
+	return nil
+}
+
+func (s *MemStore) Rename(oldname, newname string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	oldKey, node, err := s.lookup(oldname, false)
+	if err != nil {
+		return memError("rename", s.Path(oldname), err)
+	}
+	newKey, err := s.parent(newname)
+	if err != nil {
+		return memError("rename", s.Path(newname), err)
+	}
+	if oldKey == "." {
+		return memError("rename", s.Path(oldname), syscall.EBUSY)
+	}
+	if oldKey == newKey {
+		return nil
+	}
+	if node.mode.IsDir() && strings.HasPrefix(newKey, oldKey+"/") {
+		return memError("rename", s.Path(newname), syscall.EINVAL)
+	}
+	if existing, ok := s.nodes[newKey]; ok {
+		if existing.mode.IsDir() && (!node.mode.IsDir() || len(s.children(newKey)) > 0) {
+			return memError("rename", s.Path(newname), syscall.EEXIST)
+		}
+		s.unlink(newKey)
+	}
+	moved := map[string]*memNode{newKey: node}
+	for _, child := range s.descendants(oldKey) {
+		moved[newKey+strings.TrimPrefix(child, oldKey)] = s.nodes[child]
+		delete(s.nodes, child)
+	}
+	delete(s.nodes, oldKey)
+	for key, n := range moved {
+		s.nodes[key] = n
+	}
+	return nil
+}
+
+func (s *MemStore) Symlink(target, name string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	key, err := s.parent(name)
+	if err != nil {
+		return memError("symlink", s.Path(name), err)
+	}
+	if _, ok := s.nodes[key]; ok {
+		return memError("symlink", s.Path(name), fs.ErrExist)
+	}
+	node := s.newNode(os.ModeSymlink | 0777)
+	node.target = target
+	node.uid, node.gid = os.Getuid(), os.Getgid()
+	s.nodes[key] = node
+	return nil
+}
+
+func (s *MemStore) Readlink(name string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, node, err := s.lookup(name, false)
+	if err != nil {
+		return "", memError("readlink", s.Path(name), err)
+	}
+	if node.mode&os.ModeSymlink == 0 {
+		return "", memError("readlink", s.Path(name), syscall.EINVAL)
+	}
+	return node.target, nil
+}
+
+func (s *MemStore) Link(oldname, newname string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, node, err := s.lookup(oldname, false)
+	if err != nil {
+		return memError("link", s.Path(oldname), err)
+	}
+	if node.mode.IsDir() {
+		return memError("link", s.Path(oldname), syscall.EPERM)
+	}
+	key, err := s.parent(newname)
+	if err != nil {
+		return memError("link", s.Path(newname), err)
+	}
+	if _, ok := s.nodes[key]; ok {
+		return memError("link", s.Path(newname), fs.ErrExist)
+	}
+	node.nlink++
+	node.ctime = time.Now()
+	s.nodes[key] = node
+	return nil
+}
+
+// change applies fn to the node of name.
+func (s *MemStore) change(op, name string, follow bool, fn func(*memNode)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, node, err := s.lookup(name, follow)
+	if err != nil {
+		return memError(op, s.Path(name), err)
+	}
+	fn(node)
+	node.ctime = time.Now()
+	return nil
+}
+
+func (s *MemStore) Chmod(name string, mode os.FileMode) error {
+	return s.change("chmod", name, true, func(n *memNode) {
+		n.mode = n.mode&os.ModeType | mode&^os.ModeType
+	})
+}
+
+func (s *MemStore) Lchown(name string, uid, gid int) error {
+	return s.change("lchown", name, false, func(n *memNode) {
+		if uid >= 0 {
+			n.uid = uid
+		}
+		if gid >= 0 {
+			n.gid = gid
+		}
+	})
+}
+
+func (s *MemStore) Chtimes(name string, mtime time.Time) error {
+	return s.change("chtimes", name, true, func(n *memNode) {
+		n.mtime = mtime
+	})
+}
+
+func (s *MemStore) Xattrs(name string) (map[string][]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, node, err := s.lookup(name, false)
+	if err != nil {
+		return nil, memError("listxattr", s.Path(name), err)
+	}
+	xattrs := make(map[string][]byte, len(node.xattrs))
+	for attr, value := range node.xattrs {
+		xattrs[attr] = bytes.Clone(value)
+	}
+	return xattrs, nil
+}
+
+func (s *MemStore) SetXattrs(name string, xattrs map[string][]byte) error {
+	return s.change("setxattr", name, false, func(n *memNode) {
+		if n.xattrs == nil {
+			n.xattrs = make(map[string][]byte)
+		}
+		for attr, value := range xattrs {
+			n.xattrs[attr] = bytes.Clone(value)
+		}
+	})
+}
+
+// Space reports the capacity, or 1 TiB when there is none.
+func (s *MemStore) Space() (int64, int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	total := s.capacity
+	if total == 0 {
+		total = 1 << 40
+	}
+	return total, total - s.used, nil
+}
+
+func (s *MemStore) Path(name string) string {
+	return path.Join(s.root, memName(name))
+}
+
+func (s *MemStore) String() string {
+	return fmt.Sprintf("memory:%s", s.root)
+}
+
+func (s *MemStore) Close() error {
+	return nil
+}
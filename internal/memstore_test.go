@@ -0,0 +1,190 @@
+package internal
+
+import (
+	"errors"
+	"os"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// memTree fills a store with files (name -> content); names ending in "/" are directories.
+func memTree(t *testing.T, store *MemStore, files map[string]string) {
+	t.Helper()
+	mtime := time.Date(2026, 3, 1, 12, 0, 0, 0, time.UTC)
+	for name, content := range files {
+		if dir, ok := strings.CutSuffix(name, "/"); ok {
+			if err := store.MkdirAll(dir, 0755); err != nil {
+				t.Fatal(err)
+			}
+			continue
+		}
+		if i := strings.LastIndex(name, "/"); i > 0 {
+			store.MkdirAll(name[:i], 0755)
+		}
+		if err := writeStoreFile(store, name, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		store.Chtimes(name, mtime)
+	}
+}
+
+// readMem returns the content of a file in a store, or fails the test.
+func readMem(t *testing.T, store Store, name string) string {
+	t.Helper()
+	data, err := readStoreFile(store, name)
+	if err != nil {
+		t.Fatalf("read %s: %v", name, err)
+	}
+	return string(data)
+}
+
+func TestMemStoreSemantics(t *testing.T) {
+	store := NewMemStore("/backup")
+
+	w, err := store.Create("file", 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("pending"))
+	if _, err := store.Lstat("file"); !os.IsNotExist(err) {
+		t.Fatalf("uncommitted file is visible: %v", err)
+	}
+	if err := w.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := store.Link("file", "hardlink"); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeStoreFile(store, "file", []byte("replaced"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if got := readMem(t, store, "hardlink"); got != "pending" {
+		t.Fatalf("replacing a file changed its old hard link: %q", got)
+	}
+
+	store.MkdirAll("dir/sub", 0755)
+	store.Symlink("/backup/dir", "abs")
+	store.Symlink("dir/sub", "rel")
+	writeStoreFile(store, "dir/sub/deep", []byte("x"), 0644)
+	if got := readMem(t, store, "abs/sub/deep"); got != "x" {
+		t.Fatalf("absolute symlink inside the root does not resolve: %q", got)
+	}
+	if info, err := store.Lstat("rel"); err != nil || info.Mode()&os.ModeSymlink == 0 {
+		t.Fatalf("Lstat follows the symlink: %v, %v", info, err)
+	}
+	if err := store.Remove("dir"); err == nil {
+		t.Fatal("removed a non-empty directory")
+	}
+	if err := store.RemoveAll("dir"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := store.Stat("rel"); !os.IsNotExist(err) {
+		t.Fatalf("dangling symlink resolves: %v", err)
+	}
+	if got := store.Path("a/b"); got != "/backup/a/b" {
+		t.Fatalf("Path = %q", got)
+	}
+}
+
+func TestMemStoreCapacity(t *testing.T) {
+	store := NewMemStore("/small")
+	store.SetCapacity(10)
+
+	if err := writeStoreFile(store, "fits", []byte("0123456789"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	err := writeStoreFile(store, "overflow", []byte("!"), 0644)
+	if !errors.Is(err, syscall.ENOSPC) || !isSpaceError(err) {
+		t.Fatalf("writing past the capacity: %v", err)
+	}
+	if _, err := store.Lstat("overflow"); !os.IsNotExist(err) {
+		t.Fatal("a failed write left a file behind")
+	}
+	if total, available, err := store.Space(); err != nil || total != 10 || available != 0 {
+		t.Fatalf("Space = %d, %d, %v", total, available, err)
+	}
+}
+
+func TestSyncDeleteAndVerifyOnMemStores(t *testing.T) {
+	resetBackupState()
+	source := NewMemStore("/home/alice")
+	backup := NewMemStore("/mnt/backup")
+	memTree(t, source, map[string]string{
+		"Documents/report.txt": "quarterly numbers",
+		"Documents/old.txt":    "to be deleted",
+		".cache/thumb":         "excluded",
+		"Music/":               "",
+	})
+	source.Symlink("Documents/report.txt", "latest")
+	source.Chmod("Documents/report.txt", 0600)
+
+	excludes := []string{".cache"}
+	if err := syncStoresWithExclusions(source, backup, excludes, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := readMem(t, backup, "Documents/report.txt"); got != "quarterly numbers" {
+		t.Fatalf("copied file reads %q", got)
+	}
+	info, _ := backup.Lstat("Documents/report.txt")
+	want, _ := source.Lstat("Documents/report.txt")
+	if info.Mode() != want.Mode() || !info.ModTime().Equal(want.ModTime()) {
+		t.Fatalf("metadata not kept: %v %v, want %v %v", info.Mode(), info.ModTime(), want.Mode(), want.ModTime())
+	}
+	if target, err := backup.Readlink("latest"); err != nil || target != "Documents/report.txt" {
+		t.Fatalf("symlink copied as %q, %v", target, err)
+	}
+	if _, err := backup.Lstat(".cache"); !os.IsNotExist(err) {
+		t.Fatalf("excluded directory was copied: %v", err)
+	}
+	if info, err := backup.Lstat("Music"); err != nil || !info.IsDir() {
+		t.Fatalf("empty directory not copied: %v", err)
+	}
+
+	// The source changes: one file is edited, another deleted
+	writeStoreFile(source, "Documents/report.txt", []byte("revised numbers!!"), 0600)
+	source.Remove("Documents/old.txt")
+	resetBackupState()
+	if err := syncStoresWithExclusions(source, backup, excludes, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := deleteExtraStoreFiles(source, backup, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := readMem(t, backup, "Documents/report.txt"); got != "revised numbers!!" {
+		t.Fatalf("changed file reads %q", got)
+	}
+	if _, err := backup.Lstat("Documents/old.txt"); !os.IsNotExist(err) {
+		t.Fatalf("file deleted from the source is still in the backup: %v", err)
+	}
+
+	if err := verifySingleFile(source.Path("Documents/report.txt"), source, backup); err != nil {
+		t.Fatalf("verification of a good copy failed: %v", err)
+	}
+	if err := verifyDirectoryStructure(source, backup, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Same size and time, different bytes: only the checksum notices
+	mtime := info.ModTime()
+	writeStoreFile(backup, "Documents/report.txt", []byte("revised numbers??"), 0600)
+	backup.Chtimes("Documents/report.txt", mtime)
+	if err := verifySingleFile(source.Path("Documents/report.txt"), source, backup); err == nil {
+		t.Fatal("verification missed corrupted content")
+	}
+}
+
+func TestSyncStopsWhenMemStoreIsFull(t *testing.T) {
+	resetBackupState()
+	source := NewMemStore("/home/alice")
+	backup := NewMemStore("/mnt/backup")
+	backup.SetCapacity(8)
+	memTree(t, source, map[string]string{"big": "more than eight bytes"})
+
+	err := syncStoresWithExclusions(source, backup, nil, nil)
+	if err == nil || !strings.Contains(strings.ToLower(err.Error()), "space") {
+		t.Fatalf("sync into a full store: %v", err)
+	}
+}
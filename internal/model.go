@@ -53,6 +53,9 @@ type Model struct {
 	// Drive management
 	drives        []DriveInfo // List of available external drives
 	selectedDrive string      // Currently selected drive path/mount point
+	driveDisks    []string    // Disks holding selectedDrive while an operation runs
+	driveDisksFor string      // The selectedDrive driveDisks was found for
+	driveLost     bool        // The running operation is stopping because its drive was detached
 
 	// Animation state
 	cylonFrame int // Current frame number for progress bar animation (0-19)
@@ -77,6 +80,15 @@ type Model struct {
 	// NEW: Track if user has already been through restore options
 	restoreOptionsConfigured bool // True if user has already configured restore options
 
+	// System restore options (package reinstall and host identity)
+	restoreInventory *PackageInventory // Package inventory recorded in the backup, or nil
+	packageAction    string            // PackageActionSkip, PackageActionScript or PackageActionRun
+	keepHostIdentity bool              // Keep this machine's machine-id, hostname, SSH host keys, ...
+	pendingRestore   BackupDriveStatus // Mounted backup awaiting the restore confirmation
+
+	// Boot configuration fix-ups proposed after a system restore
+	bootFixups *BootFixupPlan
+
 	// Restore folder selection state (for selective restores)
 	restoreFolders         []HomeFolderInfo // Discovered folders from backup
 	selectedRestoreFolders map[string]bool  // User's restore folder selections
@@ -85,6 +97,26 @@ type Model struct {
 	// Verification error display
 	verificationErrors []string // List of verification errors for display
 	errorScrollOffset  int      // Current scroll position in error list
+
+	// Passphrase entry for encrypted repository backups
+	passphrase         string // Typed so far (never rendered)
+	passphraseFirst    string // First entry while creating a repository, awaiting confirmation
+	passphraseCreate   bool   // Creating a new encrypted repository: enter twice
+	passphraseChecking bool   // Key derivation in progress
+	passphraseError    string // Why the last entry was rejected
+
+	// Passphrase entry for a locked LUKS drive (shares the passphrase field above)
+	unlockDrive DriveInfo // Drive being unlocked
+
+	// Path entry for adopting an rsync tree or tarball
+	adoptPath     string            // Typed path of the backup to adopt
+	adoptDrive    BackupDriveStatus // Mounted drive holding it
+	adoptChecking bool              // Inspection in progress
+	adoptError    string            // Why the last path was rejected
+
+	// Path entry for a directory or image file used instead of a drive
+	destPath  string // Typed destination path
+	destError string // Why the last path was rejected
 }
 
 // InitialModel creates and returns a new Model instance with default values.
@@ -109,9 +141,9 @@ func InitialModel() Model {
 }
 
 // Init implements tea.Model.Init() and returns any initial commands.
-// Currently returns nil as no initialization commands are needed.
+// It starts watching for drives being attached and detached.
 func (m Model) Init() tea.Cmd {
-	return nil
+	return watchDrives()
 }
 
 // Update implements tea.Model.Update() and handles all incoming messages.
@@ -144,14 +176,18 @@ func (m Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 
 	case DrivesLoaded:
 
-		m.drives = msg.Drives
-		m.choices = make([]string, len(m.drives)+1)
-		for i, drive := range m.drives {
-			m.choices[i] = fmt.Sprintf("💾 %s (%s) - %s", drive.Device, drive.Size, drive.Label)
+		// --dest skips the drive list for backups
+		if backupDestination != "" && strings.Contains(m.operation, "backup") {
+			m.message = "🔧 Preparing destination and checking space..."
+			return m, prepareDestinationCmd(backupDestination, m.operation, m.homeFolders, m.selectedFolders, m.subfolderCache)
 		}
-		m.choices[len(m.drives)] = "⬅️ Back"
+
+		m.setDrives(msg.Drives)
 		return m, nil
 
+	case DrivesChanged:
+		return m.handleDrivesChanged(msg)
+
 	case HomeFoldersDiscovered:
 		if msg.error != nil {
 			m.message = fmt.Sprintf("Failed to scan home directory: %v", msg.error)
@@ -280,13 +316,18 @@ func (m Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		m.calculateTotalRestoreSize()
 		return m, nil
 
+	case PassphraseChecked:
+		return m.handlePassphraseChecked(msg)
+
+	case BackupAdopted:
+		return m.handleBackupAdopted(msg)
+
 	case PasswordRequiredMsg:
-		// Exit the entire program to handle password, then restart
-		return m, tea.Quit
+		// Ask for the passphrase, then mount the drive for the same operation
+		return m.startDriveUnlock(msg), nil
 
-	case passwordInteractionMsg:
-		// Remove this - not needed anymore
-		return m, nil
+	case DriveUnlocked:
+		return m.handleDriveUnlocked(msg)
 
 	case DriveOperation:
 		if strings.Contains(msg.message, "LUKS drive is locked") ||
@@ -362,6 +403,11 @@ func (m Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 				msg.drivePath, msg.mountPoint, m.operation)
 			os.WriteFile(debugFile, debugBuf, 0644)
 
+			// Adopting: ask where on the drive the old backup is
+			if m.operation == "adopt_restore" {
+				return m.startAdoptPathEntry(msg), nil
+			}
+
 			if strings.Contains(m.operation, "backup") {
 				// Backup confirmation
 				backupTypeDesc := "ENTIRE SYSTEM"
@@ -414,6 +460,21 @@ func (m Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 					// This ensures the UI will show the correct operation type and target
 					m.operation = "home_restore"
 
+					// A repository snapshot or archive has no folder tree on the drive to choose from: restore it whole
+					if isPackedBackup(msg.mountPoint) {
+						m.restoreConfig = true
+						m.restoreWindowMgrs = true
+						ownership := describeOwnershipRemap(msg.mountPoint, true)
+						if ownership != "" {
+							ownership += "\n"
+						}
+						m.confirmation = fmt.Sprintf("Ready to restore HOME DIRECTORY\n\nSource: %s (%s)\n\n%s⚠️ This will OVERWRITE existing files!\n\nProceed with restore?",
+							msg.mountPoint, packedBackupKind(msg.mountPoint), ownership)
+						m.screen = screens.ScreenConfirm
+						m.cursor = 0
+						return m, nil
+					}
+
 					// Always go to folder selection first for home backups
 					os.WriteFile(debugFile+"_restore_folder_selection", []byte("Home backup detected, going to folder selection"), 0644)
 
@@ -432,14 +493,25 @@ func (m Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 				// SPACE CHECK MOVED: Don't check space here for system restore
 				// Space checking now happens after user selections in confirmation (see ScreenConfirm case)
 
-				// Space check passed - proceed with system restore confirmation
-				restoreTypeDesc := "ENTIRE SYSTEM"
-				if m.operation == "custom_restore" {
-					restoreTypeDesc = "CUSTOM PATH"
+				// Restoring onto this machine: offer package reinstall and identity options first
+				m.restoreInventory = nil
+				m.packageAction = ""
+				m.keepHostIdentity = false
+				if m.operation == "system_restore" {
+					if inventory := loadBackupInventory(msg.mountPoint); inventory != nil {
+						m.restoreInventory = inventory
+						m.packageAction = PackageActionScript
+					}
+					m.pendingRestore = msg
+					m.selectedDrive = msg.mountPoint
+					m.screen = screens.ScreenSystemRestoreOptions
+					m.choices = m.systemRestoreOptionChoices()
+					m.cursor = 0
+					return m, nil
 				}
 
-				m.confirmation = fmt.Sprintf("Ready to restore %s\n\nSource: %s (%s)\nType: %s\nMounted at: %s\n\n⚠️ This will OVERWRITE existing files!\n\nProceed with restore?",
-					restoreTypeDesc, msg.drivePath, msg.driveSize, msg.driveType, msg.mountPoint)
+				// Space check passed - proceed with system restore confirmation
+				m.confirmation = m.systemRestoreConfirmation(msg, backupType)
 			} else if strings.Contains(m.operation, "verify") || m.operation == "auto_verify" {
 				// Verification confirmation
 				verifyTypeDesc := "AUTO-DETECTED BACKUP"
@@ -460,7 +532,39 @@ func (m Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			return m, nil
 		}
 
+	case ReinstallScriptWritten:
+		// Nothing has been restored yet - let the user reinstall packages first,
+		// then confirming the same restore copies the files without writing the script again
+		m.packageAction = PackageActionSkip
+		m.progress = 0
+		m.confirmation = fmt.Sprintf("📦 Package reinstall script written to:\n\n%s\n\nRun it as root in another terminal now (sh %s), check its output, then continue.\n\nNo files have been restored yet.\n\nRestore files now?", msg.ScriptPath, msg.ScriptPath)
+		m.screen = screens.ScreenConfirm
+		m.cursor = 0
+		return m, nil
+
+	case BootFixupsProposed:
+		// The restore itself is done - ask before touching fstab/crypttab/bootloader
+		m.bootFixups = msg.Plan
+		m.operation = "boot_fixups"
+		m.progress = 0
+		m.confirmation = fmt.Sprintf("✅ %s\n\n%s\nApply these changes?", msg.Message, msg.Plan.describe(24))
+		m.screen = screens.ScreenConfirm
+		m.cursor = 0
+		return m, nil
+
 	case ProgressUpdate:
+		m.trackOperationDrive()
+		if m.driveLost {
+			// Canceled because the drive was detached
+			m.driveLost = false
+			m.canceling = false
+			m.progress = 0
+			m.message = "❌ The drive was disconnected during the operation, so it was stopped.\n\nReconnect the drive and run it again to finish."
+			m.errorRequiresManualDismissal = true
+			m.lastScreen = m.screen
+			m.screen = screens.ScreenError
+			return m, nil
+		}
 		if msg.Error != nil {
 			// Check error type for appropriate handling
 			errorMsg := fmt.Sprintf("Error: %v", msg.Error)
@@ -500,7 +604,9 @@ func (m Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 				strings.Contains(errorMsg, "permission denied") ||
 				strings.Contains(errorMsg, "cannot determine backup type") ||
 				strings.Contains(errorMsg, "no valid backup found") ||
-				strings.Contains(errorMsg, "error 32") {
+				strings.Contains(errorMsg, "error 32") ||
+				strings.Contains(errorMsg, "package reinstall failed") ||
+				strings.Contains(errorMsg, "boot config fix-up failed") {
 				// Critical system error - needs manual dismissal
 				m.message = errorMsg
 				m.errorRequiresManualDismissal = true
@@ -537,9 +643,17 @@ func (m Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			}
 
 			// Check if this was a backup operation completion
-			if strings.Contains(m.operation, "backup") && msg.Error == nil {
+			if strings.Contains(m.operation, "backup") && msg.Error == nil && !isMountPoint(m.selectedDrive) {
+				// Backup to a plain directory: there is nothing to unmount
+				m.lastScreen = m.screen
+				m.screen = screens.ScreenComplete
+				return m, nil
+			} else if strings.Contains(m.operation, "backup") && msg.Error == nil {
 				// Backup completed successfully, ask about unmounting
 				m.confirmation = "🎉 Backup completed successfully!\n\nDo you want to unmount the backup drive?\n\nNote: Unmounting is recommended for safe removal."
+				if recopied := contentRecopies(); recopied > 0 {
+					m.confirmation += fmt.Sprintf("\n\n🔍 Checksum comparison recopied %s files whose content changed without a new size or timestamp.", FormatNumber(recopied))
+				}
 				m.operation = "unmount_backup"
 				m.screen = screens.ScreenConfirm
 				m.cursor = 1
@@ -586,7 +700,9 @@ func (m Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 					strings.Contains(errorMsg, "permission denied") ||
 					strings.Contains(errorMsg, "cannot determine backup type") ||
 					strings.Contains(errorMsg, "no valid backup found") ||
-					strings.Contains(errorMsg, "error 32") {
+					strings.Contains(errorMsg, "error 32") ||
+					strings.Contains(errorMsg, "package reinstall failed") ||
+					strings.Contains(errorMsg, "boot config fix-up failed") {
 					// Critical system error - needs manual dismissal
 					m.message = errorMsg
 					m.errorRequiresManualDismissal = true
@@ -638,6 +754,20 @@ func (m Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			return m, nil
 		}
 
+		// The passphrase and path screens take every key as text
+		if m.screen == screens.ScreenPassphrase {
+			return m.handlePassphraseKey(msg)
+		}
+		if m.screen == screens.ScreenUnlockDrive {
+			return m.handleUnlockDriveKey(msg)
+		}
+		if m.screen == screens.ScreenAdoptPath {
+			return m.handleAdoptPathKey(msg)
+		}
+		if m.screen == screens.ScreenDestPath {
+			return m.handleDestPathKey(msg)
+		}
+
 		// Handle completion screen dismissal
 		if m.screen == screens.ScreenComplete {
 			// Any key press dismisses the completion screen and returns to main
@@ -879,6 +1009,27 @@ func (m Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 					}
 				}
 				m.calculateTotalRestoreSize()
+			} else if m.screen == screens.ScreenProgress && !m.canceling && (msg.String() == "n" || msg.String() == "N") {
+				// Cycle the CPU nice level of the running operation
+				cycleNiceLevel()
+			}
+			return m, nil
+
+		case "+", "=", "-":
+			if m.screen == screens.ScreenProgress && !m.canceling {
+				// Raise or lower the bandwidth limit one step
+				if msg.String() == "-" {
+					adjustBandwidth(-1)
+				} else {
+					adjustBandwidth(1)
+				}
+			}
+			return m, nil
+
+		case "i", "I":
+			if m.screen == screens.ScreenProgress && !m.canceling {
+				// Switch between idle and best-effort I/O scheduling
+				cycleIOClass()
 			}
 			return m, nil
 
@@ -1028,6 +1179,21 @@ func (m Model) handleRestoreMenuSelection() (tea.Model, tea.Cmd) {
 		return m, LoadDrives()
 	}
 
+	// Undo needs a rollback journal from a previous restore
+	if operation == "undo_restore" {
+		summary, err := LastRestoreSummary()
+		if err != nil {
+			m.operation = ""
+			m.message = fmt.Sprintf("⚠️ Nothing to undo\n\n%v", err)
+			m.errorRequiresManualDismissal = true
+			m.lastScreen = screens.ScreenRestore
+			m.screen = screens.ScreenError
+			return m, nil
+		}
+		m.confirmation = summary + "\n\n⚠️ This will OVERWRITE files changed by the restore!\n\nProceed with undo?"
+		m.cursor = 0
+	}
+
 	return m, nil
 }
 
@@ -1093,8 +1259,14 @@ func (m Model) handleRestoreFolderSelection() (tea.Model, tea.Cmd) {
 			totalSize += 50 * 1024 * 1024 // ~50MB estimate
 		}
 
-		m.confirmation = fmt.Sprintf("Ready to restore %s\n\n%sTotal size: %s\nSource: %s\n\n⚠️ This will OVERWRITE existing files!\n\nProceed with restore?",
-			restoreTypeDesc, itemsList, FormatBytes(totalSize), m.selectedDrive)
+		// Preview how file owners will be translated onto this installation
+		ownership := describeOwnershipRemap(m.selectedDrive, true)
+		if ownership != "" {
+			ownership += "\n"
+		}
+
+		m.confirmation = fmt.Sprintf("Ready to restore %s\n\n%sTotal size: %s\nSource: %s\n\n%s⚠️ This will OVERWRITE existing files!\n\nProceed with restore?",
+			restoreTypeDesc, itemsList, FormatBytes(totalSize), m.selectedDrive, ownership)
 
 		m.screen = screens.ScreenConfirm
 		m.cursor = 0
@@ -1162,6 +1334,26 @@ func (m Model) handleVerifyMenuSelection() (tea.Model, tea.Cmd) {
 	return m, nil
 }
 
+// mountCmdFor mounts the selected drive the way the chosen operation needs it.
+func (m Model) mountCmdFor(drive DriveInfo) tea.Cmd {
+	if strings.Contains(m.operation, "backup") {
+		// For backup: mount drive for destination with appropriate space check
+		if m.operation == "home_backup" {
+			// FIXED: Pass selected folders for accurate space checking
+			return mountDriveForSelectiveHomeBackup(drive, m.homeFolders, m.selectedFolders, m.subfolderCache)
+		}
+		return mountDriveForBackup(drive)
+	} else if strings.Contains(m.operation, "restore") {
+		// For restore: mount drive for source backup
+		return mountDriveForRestore(drive)
+	} else if strings.Contains(m.operation, "verify") {
+		// For verify: mount drive for source backup (read-only)
+		return mountDriveForVerification(drive)
+	}
+	// Fallback: regular mounting
+	return mountSelectedDrive(drive)
+}
+
 func (m Model) handleSelection() (tea.Model, tea.Cmd) {
 	switch m.screen {
 	case screens.ScreenMain:
@@ -1181,7 +1373,17 @@ func (m Model) handleSelection() (tea.Model, tea.Cmd) {
 			case "unmount_backup":
 				// For unmount, don't transition to progress screen - handle the response directly
 				return m, PerformBackupUnmount()
+			case "adopt_done":
+				// Continue with the normal restore flow from the adopted backup
+				m.operation = "system_restore"
+				m.confirmation = ""
+				return m.Update(m.adoptDrive)
 			default:
+				// An encrypted repository needs its passphrase before anything touches it
+				if needed, create := needsBackupPassphrase(m.operation, m.selectedDrive); needed {
+					return m.startPassphraseEntry(create), nil
+				}
+
 				// Clear all state and transition to progress for other operations
 				m.screen = screens.ScreenProgress
 				m.progress = 0
@@ -1243,9 +1445,12 @@ func (m Model) handleSelection() (tea.Model, tea.Cmd) {
 							return m, nil
 						}
 						// Space check passed - proceed with full system restore to root ("/")
-						return m, startRestore(m.selectedDrive, "/", m.restoreConfig, m.restoreWindowMgrs)
+						return m, startRestore(m.selectedDrive, "/", m.restoreConfig, m.restoreWindowMgrs, m.packageAction, m.keepHostIdentity)
 					}
 				case "home_restore":
+					if isPackedBackup(m.selectedDrive) {
+						return m, startRestore(m.selectedDrive, "/", m.restoreConfig, m.restoreWindowMgrs, PackageActionSkip, false)
+					}
 					// NEW: Handle home_restore explicitly - this should always do selective restore
 					// Space check already done in handleRestoreFolderSelection before confirmation
 					return m, tea.Batch(
@@ -1256,7 +1461,11 @@ func (m Model) handleSelection() (tea.Model, tea.Cmd) {
 						}),
 					)
 				case "custom_restore":
-					return m, startRestore(m.selectedDrive, "/tmp/restore", m.restoreConfig, m.restoreWindowMgrs)
+					return m, startRestore(m.selectedDrive, "/tmp/restore", m.restoreConfig, m.restoreWindowMgrs, PackageActionSkip, false)
+				case "undo_restore":
+					return m, startUndoRestore()
+				case "boot_fixups":
+					return m, startBootFixups(m.bootFixups)
 				case "system_verify":
 					// System verification
 					return m, tea.Batch(
@@ -1442,29 +1651,10 @@ func (m Model) handleSelection() (tea.Model, tea.Cmd) {
 
 			// IMMEDIATE FEEDBACK: Show mounting message
 			m.message = "🔧 Mounting drive and checking space..."
-
-			// Check the operation type
-			if strings.Contains(m.operation, "backup") {
-				// For backup: mount drive for destination with appropriate space check
-				if m.operation == "home_backup" {
-					// FIXED: Pass selected folders for accurate space checking
-					return m, mountDriveForSelectiveHomeBackup(selectedDrive, m.homeFolders, m.selectedFolders, m.subfolderCache)
-				} else {
-					return m, mountDriveForBackup(selectedDrive)
-				}
-			} else if strings.Contains(m.operation, "restore") {
-				// For restore: mount drive for source backup
-				if logPath := getLogFilePath(); logPath != "" {
-
-				}
-				return m, mountDriveForRestore(selectedDrive)
-			} else if strings.Contains(m.operation, "verify") {
-				// For verify: mount drive for source backup (read-only)
-				return m, mountDriveForVerification(selectedDrive)
-			} else {
-				// Fallback: regular mounting
-				return m, mountSelectedDrive(selectedDrive)
-			}
+			return m, m.mountCmdFor(selectedDrive)
+		} else if m.cursor == len(m.drives) {
+			// Directory or image file instead of a drive
+			return m.startDestPathEntry(), nil
 		} else {
 			// Back option
 			if strings.Contains(m.operation, "backup") {
@@ -1516,10 +1706,116 @@ func (m Model) handleSelection() (tea.Model, tea.Cmd) {
 			m.choices = screens.RestoreMenuChoices
 			m.cursor = 0
 		}
+	case screens.ScreenSystemRestoreOptions:
+		return m.handleSystemRestoreOptionsSelection()
+	}
+	return m, nil
+}
+
+// systemRestoreOptionIDs lists the entries of the system restore options menu.
+// Package choices only appear when the backup carries a package inventory.
+func (m Model) systemRestoreOptionIDs() []string {
+	var ids []string
+	if m.restoreInventory != nil {
+		ids = append(ids, PackageActionScript, PackageActionRun, PackageActionSkip)
+	}
+	return append(ids, "keep_identity", "continue", "back")
+}
+
+// systemRestoreOptionChoices builds the system restore options menu for the current selections.
+func (m Model) systemRestoreOptionChoices() []string {
+	radio := func(action, label string) string {
+		if m.packageAction == action {
+			return "◉ " + label
+		}
+		return "○ " + label
+	}
+
+	var choices []string
+	for _, id := range m.systemRestoreOptionIDs() {
+		switch id {
+		case PackageActionScript:
+			choices = append(choices, radio(id, "Write package reinstall script only"))
+		case PackageActionRun:
+			choices = append(choices, radio(id, "Reinstall packages now, then restore files"))
+		case PackageActionSkip:
+			choices = append(choices, radio(id, "Skip package reinstall"))
+		case "keep_identity":
+			if m.keepHostIdentity {
+				choices = append(choices, "☑️ Keep this machine's identity (machine-id, hostname, SSH host keys)")
+			} else {
+				choices = append(choices, "☐ Keep this machine's identity (machine-id, hostname, SSH host keys)")
+			}
+		case "continue":
+			choices = append(choices, "✅ Continue")
+		case "back":
+			choices = append(choices, "⬅️ Back")
+		}
+	}
+	return choices
+}
+
+// handleSystemRestoreOptionsSelection processes the options shown before a system restore.
+func (m Model) handleSystemRestoreOptionsSelection() (tea.Model, tea.Cmd) {
+	ids := m.systemRestoreOptionIDs()
+	if m.cursor < 0 || m.cursor >= len(ids) {
+		return m, nil
+	}
+
+	switch id := ids[m.cursor]; id {
+	case PackageActionScript, PackageActionRun, PackageActionSkip:
+		m.packageAction = id
+	case "keep_identity":
+		m.keepHostIdentity = !m.keepHostIdentity
+	case "continue":
+		m.confirmation = m.systemRestoreConfirmation(m.pendingRestore, "system")
+		m.screen = screens.ScreenConfirm
+		m.cursor = 0
+		return m, nil
+	case "back":
+		m.screen = screens.ScreenRestore
+		m.choices = screens.RestoreMenuChoices
+		m.cursor = 0
+		return m, nil
 	}
+	m.choices = m.systemRestoreOptionChoices()
 	return m, nil
 }
 
+// systemRestoreConfirmation builds the confirmation text for restoring a system backup.
+func (m Model) systemRestoreConfirmation(msg BackupDriveStatus, backupType string) string {
+	restoreTypeDesc := "ENTIRE SYSTEM"
+	restoreTarget := "/"
+	if m.operation == "custom_restore" {
+		restoreTypeDesc = "CUSTOM PATH"
+		restoreTarget = "/tmp/restore"
+	}
+
+	// Preview how file owners will be translated onto this installation
+	ownership := describeOwnershipRemap(msg.mountPoint, ownershipRemapAutomatic(backupType, restoreTarget))
+	if ownership != "" {
+		ownership += "\n"
+	}
+
+	packages := ""
+	if m.restoreInventory != nil {
+		switch m.packageAction {
+		case PackageActionScript:
+			packages = fmt.Sprintf("📦 Reinstall script: %s\n\n", filepath.Join(migrateStateDir, reinstallScriptName))
+		case PackageActionRun:
+			packages = "📦 Packages will be reinstalled BEFORE files are restored\n\n"
+		}
+	}
+
+	identity := ""
+	if m.keepHostIdentity && restoreTarget == "/" {
+		identity = "🪪 Keeping this machine's identity (machine-id, hostname, SSH host keys, MAC-bound connections)\n\n"
+	}
+
+	return fmt.Sprintf("Ready to restore %s\n\nSource: %s (%s)\nType: %s\nMounted at: %s\n\n%s%s%s⚠️ This will OVERWRITE existing files!\n\nProceed with restore?",
+		restoreTypeDesc, msg.drivePath, msg.driveSize, msg.driveType, msg.mountPoint, packages, identity, ownership)
+}
+
 // calculateTotalBackupSize computes the total size of all selected folders for backup.
 // This includes both user-selected visible folders and automatically included hidden folders.
 // FIXED: Now properly handles hierarchical selections - when subfolders are individually
@@ -1786,6 +2082,8 @@ func (m Model) View() string {
 		return m.renderRestoreMenu()
 	case screens.ScreenRestoreOptions:
 		return m.renderRestoreOptions()
+	case screens.ScreenSystemRestoreOptions:
+		return m.renderSystemRestoreOptions()
 	case screens.ScreenVerify:
 		return m.renderVerifyMenu()
 	case screens.ScreenAbout:
@@ -1808,6 +2106,14 @@ func (m Model) View() string {
 		return m.renderVerificationErrors()
 	case screens.ScreenRestoreFolderSelect:
 		return m.renderRestoreFolderSelect()
+	case screens.ScreenPassphrase:
+		return m.renderPassphrase()
+	case screens.ScreenAdoptPath:
+		return m.renderAdoptPath()
+	case screens.ScreenDestPath:
+		return m.renderDestPath()
+	case screens.ScreenUnlockDrive:
+		return m.renderUnlockDrive()
 	default:
 		return "Unknown screen"
 	}
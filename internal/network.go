@@ -0,0 +1,577 @@
+// Package internal provides direct machine-to-machine migrations over the network.
+//
+// The new machine runs `migrate --receive` and shows its addresses and a
+// pairing code; the old machine runs `migrate --send home|system --to <address>`
+// with that code. After pairing (see pairing.go) the sender streams the same
+// tar/zstd archive an archive backup would hold, built with the backup
+// exclusions, and the receiver extracts it like a restore: the restore options
+// for ~/.config and window managers apply, owners are matched by name, files
+// the migration does not contain are removed and everything replaced can be
+// put back with "Undo Last Restore". No drive is needed in between.
+package internal
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// DefaultMigrationPort is the TCP port of --send and --receive unless --port says otherwise.
+	DefaultMigrationPort = 41414
+
+	// maxPairingAttempts is how many failed pairings end a --receive session.
+	maxPairingAttempts = 3
+)
+
+// Frame kinds of the migration protocol. The sender sends metadata files, the
+// header and, once the receiver accepts, archive data and the end marker; the
+// receiver answers with accept or refuse and finally the result.
+const (
+	frameMetadata = 'M'
+	frameHeader   = 'H'
+	frameAccept   = 'A'
+	frameRefuse   = 'N'
+	frameData     = 'D'
+	frameEnd      = 'E'
+	frameResult   = 'R'
+)
+
+// migrationHeader describes an incoming migration.
+type migrationHeader struct {
+	Kind     string `json:"kind"` // "home" or "system"
+	Hostname string `json:"hostname"`
+	User     string `json:"user"`
+	Source   string `json:"source"`
+	Codec    string `json:"codec"` // Compression of the archive stream
+}
+
+// migrationResult is the receiver's report at the end.
+type migrationResult struct {
+	Error   string `json:"error,omitempty"`
+	Written int64  `json:"written"`
+	Skipped int64  `json:"skipped"`
+	Deleted int64  `json:"deleted"`
+
+	reinstallScript string         // Receiver only: package reinstall script written for a system migration
+	bootFixups      *BootFixupPlan // Receiver only: fixes for disk identifiers of the sender's machine
+}
+
+// migrationLog opens the log file for a network migration.
+func migrationLog(title string) *os.File {
+	logPath := getLogFilePath()
+	logFile, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return nil
+	}
+	fmt.Fprintf(logFile, "\n=== %s STARTED: %s ===\n", title, time.Now().Format(time.RFC3339))
+	return logFile
+}
+
+// showTransferProgress rewrites one status line until stop is closed.
+func showTransferProgress(out io.Writer, status func() string, stop <-chan struct{}) {
+	ticker := time.NewTicker(500 * time.Millisecond)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			fmt.Fprintf(out, "\r\033[K%s\n", status())
+			return
+		case <-ticker.C:
+			fmt.Fprintf(out, "\r\033[K%s", status())
+		}
+	}
+}
+
+// readPairingCode asks for the code shown on the receiving machine.
+func readPairingCode() (string, error) {
+	fmt.Print("🔑 Pairing code shown on the receiving machine: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", fmt.Errorf("no pairing code entered")
+	}
+	return strings.TrimSpace(line), nil
+}
+
+// SendMigration streams a home or system migration to a machine running --receive
+// at address (host:port).
+func SendMigration(kind, address, code string) error {
+	if kind != "home" && kind != "system" {
+		return fmt.Errorf("unknown migration %q (expected home or system)", kind)
+	}
+	if code == "" {
+		var err error
+		if code, err = readPairingCode(); err != nil {
+			return err
+		}
+	}
+	if _, err := normalizePairingCode(code); err != nil {
+		return err
+	}
+
+	logFile := migrationLog("NETWORK SEND")
+	if logFile != nil {
+		defer logFile.Close()
+	}
+
+	// The metadata a backup would write, staged for the receiver
+	staging, err := os.MkdirTemp("", "migrate-send-")
+	if err != nil {
+		return fmt.Errorf("failed to create staging directory: %v", err)
+	}
+	defer os.RemoveAll(staging)
+	config, err := createBackupConfig(kind+"_backup", staging, nil, nil)
+	if err != nil {
+		return err
+	}
+	config.Format = BackupFormatArchive
+	resetBackupState()
+	resetBackupCancel()
+	backupStartTime = time.Now()
+	if err := createBackupInfo(staging, config.BackupType); err != nil {
+		return fmt.Errorf("failed to create backup info: %v", err)
+	}
+	if err := createBackupManifest(config); err != nil {
+		return fmt.Errorf("failed to create backup manifest: %v", err)
+	}
+
+	fmt.Printf("🔗 Connecting to %s...\n", address)
+	conn, err := net.DialTimeout("tcp", address, 15*time.Second)
+	if err != nil {
+		return fmt.Errorf("cannot reach the receiving machine: %v", err)
+	}
+	defer conn.Close()
+	channel, err := pairConnection(conn, code, true)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("🔒 Paired - waiting for the receiving machine to accept...\n")
+
+	var result *migrationResult
+	stop := make(chan struct{})
+	started := false
+	onAccepted := func() {
+		started = true
+		go showTransferProgress(os.Stdout, func() string {
+			return fmt.Sprintf("📤 Sent %s files, %s", FormatNumber(atomic.LoadInt64(&filesCopied)), FormatBytes(atomic.LoadInt64(&channel.sent)))
+		}, stop)
+	}
+	result, err = sendMigration(channel, config, kind, onAccepted, logFile)
+	if started {
+		close(stop)
+		time.Sleep(50 * time.Millisecond)
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Printf("✅ Migration complete: %s files written on the receiving machine, %s already up to date, %s removed\n",
+		FormatNumber(result.Written), FormatNumber(result.Skipped), FormatNumber(result.Deleted))
+	return nil
+}
+
+// sendMigration sends the staged metadata and the archive of config.SourcePath
+// over a paired channel and returns the receiver's result.
+func sendMigration(channel *secureChannel, config BackupConfig, kind string, onAccepted func(), logFile *os.File) (*migrationResult, error) {
+	for _, name := range remoteMetadataFiles {
+		data, err := os.ReadFile(filepath.Join(config.DestinationPath, name))
+		if err != nil {
+			continue
+		}
+		if err := channel.writeFrame(frameMetadata, append([]byte(name+"\x00"), data...)); err != nil {
+			return nil, err
+		}
+	}
+	hostname, _ := os.Hostname()
+	info := &ArchiveInfo{Compression: archiveCompressionLevel()}
+	header, _ := json.Marshal(migrationHeader{
+		Kind:     kind,
+		Hostname: hostname,
+		User:     getCurrentUser(),
+		Source:   config.SourcePath,
+		Codec:    info.codec(),
+	})
+	if err := channel.writeFrame(frameHeader, header); err != nil {
+		return nil, err
+	}
+
+	kindByte, payload, err := channel.readFrame()
+	if err != nil {
+		return nil, fmt.Errorf("the receiving machine closed the connection: %v", err)
+	}
+	if kindByte == frameRefuse {
+		return nil, fmt.Errorf("the receiving machine declined: %s", payload)
+	}
+	if kindByte != frameAccept {
+		return nil, fmt.Errorf("unexpected answer from the receiving machine")
+	}
+	if onAccepted != nil {
+		onAccepted()
+	}
+	if logFile != nil {
+		fmt.Fprintf(logFile, "Sending %s migration of %s (compression level %d)\n", kind, config.SourcePath, info.Compression)
+	}
+
+	stream := bufio.NewWriterSize(frameWriter{channel: channel, kind: frameData}, maxFramePayload)
+	err = writeArchive(config, stream, info, logFile)
+	if err == nil {
+		err = stream.Flush()
+	}
+	if err == nil {
+		err = channel.writeFrame(frameEnd, nil)
+	}
+	if err != nil && logFile != nil {
+		fmt.Fprintf(logFile, "ERROR sending migration: %v\n", err)
+	}
+
+	// The receiver reports its result, which also explains a connection it closed early
+	kindByte, payload, readErr := channel.readFrame()
+	if readErr != nil || kindByte != frameResult {
+		if err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("no result from the receiving machine: %v", readErr)
+	}
+	var result migrationResult
+	if err := json.Unmarshal(payload, &result); err != nil {
+		return nil, fmt.Errorf("invalid result from the receiving machine: %v", err)
+	}
+	if result.Error != "" {
+		return nil, fmt.Errorf("the receiving machine reported: %s", result.Error)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if logFile != nil {
+		fmt.Fprintf(logFile, "Migration sent: %s files, %s; receiver wrote %d, skipped %d, removed %d\n",
+			FormatNumber(info.Files), FormatBytes(info.Size), result.Written, result.Skipped, result.Deleted)
+	}
+	return &result, nil
+}
+
+// receiveOptions are the choices of the receiving machine.
+type receiveOptions struct {
+	restoreConfig     bool
+	restoreWindowMgrs bool
+	packageAction     string // PackageActionSkip, PackageActionScript or PackageActionRun for a system migration
+	targetPath        string // Where to extract; "" = /home/<user> or / by kind
+	confirm           func(header *migrationHeader, targetPath string) bool
+	progress          func(header *migrationHeader, channel *secureChannel) func()
+}
+
+// ReceiveMigration waits on port for a paired sender and applies its migration.
+// packageAction decides what happens with the package set of a system migration.
+func ReceiveMigration(port int, restoreConfig, restoreWindowMgrs bool, packageAction string) error {
+	code, err := newPairingCode()
+	if err != nil {
+		return err
+	}
+	listener, err := net.Listen("tcp", net.JoinHostPort("", strconv.Itoa(port)))
+	if err != nil {
+		return fmt.Errorf("cannot listen on port %d: %v", port, err)
+	}
+	defer listener.Close()
+
+	logFile := migrationLog("NETWORK RECEIVE")
+	if logFile != nil {
+		defer logFile.Close()
+	}
+
+	addresses := localAddresses()
+	fmt.Printf("📥 Waiting for a migration on port %d\n", port)
+	fmt.Printf("   This machine: %s\n", strings.Join(addresses, ", "))
+	fmt.Printf("   Pairing code: %s\n\n", code)
+	example := "<this machine>"
+	if len(addresses) > 0 {
+		example = addresses[0]
+	}
+	if port != DefaultMigrationPort {
+		example = net.JoinHostPort(example, strconv.Itoa(port))
+	}
+	fmt.Printf("On the old machine run:\n   migrate --send home --to %s --code %s\n(or --send system for a complete system)\n\n", example, code)
+
+	opts := receiveOptions{
+		restoreConfig:     restoreConfig,
+		restoreWindowMgrs: restoreWindowMgrs,
+		packageAction:     packageAction,
+		confirm:           confirmMigration,
+		progress: func(header *migrationHeader, channel *secureChannel) func() {
+			stop := make(chan struct{})
+			go showTransferProgress(os.Stdout, func() string {
+				if deletionPhaseActive {
+					return fmt.Sprintf("🧹 Removing files not in the migration: %s", FormatNumber(atomic.LoadInt64(&filesDeleted)))
+				}
+				return fmt.Sprintf("📥 Received %s from %s: %s files written, %s unchanged",
+					FormatBytes(atomic.LoadInt64(&channel.received)), header.Hostname,
+					FormatNumber(atomic.LoadInt64(&filesCopied)), FormatNumber(atomic.LoadInt64(&filesSkipped)))
+			}, stop)
+			return func() { close(stop); time.Sleep(50 * time.Millisecond) }
+		},
+	}
+	result, err := receiveMigration(listener, code, opts, logFile)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("✅ Migration complete: %s files written, %s already up to date, %s removed\n",
+		FormatNumber(result.Written), FormatNumber(result.Skipped), FormatNumber(result.Deleted))
+	fmt.Printf("   Replaced files can be put back with \"Undo Last Restore\"\n")
+	if result.reinstallScript != "" && packageAction == PackageActionScript {
+		fmt.Printf("📦 Reinstall the packages of the other machine with: sudo sh %s\n", result.reinstallScript)
+	}
+	if result.bootFixups != nil {
+		fmt.Printf("\n⚠️ %s", result.bootFixups.describe(40))
+		if !askYesNo("Update these files? The originals are kept as <file>.pre-migrate.") {
+			fmt.Printf("⚠️ Boot configuration left unchanged - check it before rebooting\n")
+			return nil
+		}
+		if err := applyBootFixups(result.bootFixups, logFile); err != nil {
+			return fmt.Errorf("boot config fix-up failed: %v", err)
+		}
+		fmt.Printf("✅ Boot configuration updated for this machine's disks\n")
+	}
+	return nil
+}
+
+// localAddresses lists this machine's non-loopback IP addresses.
+func localAddresses() []string {
+	var addresses []string
+	interfaces, _ := net.InterfaceAddrs()
+	for _, addr := range interfaces {
+		if ipNet, ok := addr.(*net.IPNet); ok && !ipNet.IP.IsLoopback() && !ipNet.IP.IsLinkLocalUnicast() {
+			addresses = append(addresses, ipNet.IP.String())
+		}
+	}
+	return addresses
+}
+
+// confirmMigration asks on the terminal whether to apply an incoming migration.
+func confirmMigration(header *migrationHeader, targetPath string) bool {
+	what := "Home directory"
+	if header.Kind == "system" {
+		what = "Complete system"
+	}
+	fmt.Printf("📦 %s migration from %s@%s (%s)\n", what, header.User, header.Hostname, header.Source)
+	fmt.Printf("   Into: %s\n", targetPath)
+	fmt.Printf("   Files there that are not in the migration will be removed; everything\n   replaced or removed can be put back with \"Undo Last Restore\".\n")
+	if header.Kind == "system" {
+		fmt.Printf("   This machine's identity is kept:\n%s", describeHostIdentityRules())
+		fmt.Printf("   fstab, crypttab and boot entries come from the other machine; you are offered\n   fixes afterwards where they name disks this machine does not have.\n")
+	}
+	return askYesNo("Continue?")
+}
+
+// askYesNo asks a question on the terminal; anything but yes is no.
+func askYesNo(question string) bool {
+	fmt.Printf("%s [y/N] ", question)
+	line, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer := strings.ToLower(strings.TrimSpace(line))
+	return answer == "y" || answer == "yes"
+}
+
+// receiveMigration pairs with a sender on listener and applies its migration.
+func receiveMigration(listener net.Listener, code string, opts receiveOptions, logFile *os.File) (*migrationResult, error) {
+	var conn net.Conn
+	var channel *secureChannel
+	for attempt := 1; channel == nil; attempt++ {
+		if attempt > maxPairingAttempts {
+			return nil, fmt.Errorf("too many failed pairing attempts - run --receive again for a new code")
+		}
+		c, err := listener.Accept()
+		if err != nil {
+			return nil, err
+		}
+		c.SetDeadline(time.Now().Add(30 * time.Second))
+		channel, err = pairConnection(c, code, false)
+		if err != nil {
+			if logFile != nil {
+				fmt.Fprintf(logFile, "Pairing with %s failed: %v\n", c.RemoteAddr(), err)
+			}
+			fmt.Printf("❌ Pairing with %s failed: %v\n", c.RemoteAddr(), err)
+			c.Close()
+			continue
+		}
+		conn = c
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Time{})
+
+	// Metadata files, then the header
+	staging, err := os.MkdirTemp("", "migrate-receive-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(staging)
+	var header migrationHeader
+	for {
+		kind, payload, err := channel.readFrame()
+		if err != nil {
+			return nil, fmt.Errorf("connection lost: %v", err)
+		}
+		if kind == frameHeader {
+			if err := json.Unmarshal(payload, &header); err != nil {
+				return nil, fmt.Errorf("invalid migration header: %v", err)
+			}
+			break
+		}
+		name, data, ok := strings.Cut(string(payload), "\x00")
+		if kind != frameMetadata || !ok || filepath.Base(name) != name || name == "." || name == ".." {
+			return nil, fmt.Errorf("unexpected message from the sender")
+		}
+		if err := os.WriteFile(filepath.Join(staging, name), []byte(data), 0644); err != nil {
+			return nil, err
+		}
+	}
+
+	refuse := func(reason string) (*migrationResult, error) {
+		channel.writeFrame(frameRefuse, []byte(reason))
+		return nil, fmt.Errorf("migration refused: %s", reason)
+	}
+	if backupType, err := detectBackupType(staging); err != nil || backupType != header.Kind {
+		return refuse("the sender's backup information does not match the migration")
+	}
+	targetPath := opts.targetPath
+	if targetPath == "" {
+		targetPath = "/"
+		if header.Kind == "home" {
+			targetPath = "/home/" + getCurrentUser()
+		}
+	}
+	if opts.confirm != nil && !opts.confirm(&header, targetPath) {
+		return refuse("the migration was not confirmed")
+	}
+	if err := channel.writeFrame(frameAccept, nil); err != nil {
+		return nil, err
+	}
+
+	if logFile != nil {
+		fmt.Fprintf(logFile, "Receiving %s migration from %s@%s (%s) into %s\n", header.Kind, header.User, header.Hostname, header.Source, targetPath)
+	}
+	resetBackupState()
+	resetBackupCancel()
+	backupStartTime = time.Now()
+	if opts.progress != nil {
+		defer opts.progress(&header, channel)()
+	}
+
+	// Archive data frames feed the extraction through a pipe
+	pr, pw := io.Pipe()
+	go func() {
+		for {
+			kind, payload, err := channel.readFrame()
+			switch {
+			case err != nil:
+				pw.CloseWithError(fmt.Errorf("connection lost: %v", err))
+				return
+			case kind == frameEnd:
+				pw.Close()
+				return
+			case kind != frameData:
+				pw.CloseWithError(fmt.Errorf("unexpected message from the sender"))
+				return
+			}
+			if _, err := pw.Write(payload); err != nil {
+				return
+			}
+		}
+	}()
+
+	var result migrationResult
+	err = restoreReceivedMigration(staging, &header, io.NopCloser(pr), targetPath, opts, &result, logFile)
+	if err == nil {
+		// Everything up to the end marker must arrive, or the stream was cut short
+		_, err = io.Copy(io.Discard, pr)
+	}
+	pr.CloseWithError(fmt.Errorf("migration aborted"))
+
+	result.Written = atomic.LoadInt64(&filesCopied)
+	result.Skipped = atomic.LoadInt64(&filesSkipped)
+	result.Deleted = atomic.LoadInt64(&filesDeleted)
+	if err != nil {
+		result.Error = err.Error()
+		if logFile != nil {
+			fmt.Fprintf(logFile, "ERROR receiving migration: %v\n", err)
+		}
+	}
+	data, _ := json.Marshal(result)
+	channel.writeFrame(frameResult, data)
+	if err != nil {
+		return nil, err
+	}
+	if logFile != nil {
+		fmt.Fprintf(logFile, "Migration received: %d files written, %d unchanged, %d removed\n", result.Written, result.Skipped, result.Deleted)
+	}
+	return &result, nil
+}
+
+// restoreReceivedMigration extracts the archive stream into targetPath with the
+// same safety net and options as a restore from a drive. A system migration onto
+// / also gets the package reinstall and the boot config check, recorded in result.
+func restoreReceivedMigration(staging string, header *migrationHeader, stream io.ReadCloser, targetPath string, opts receiveOptions, result *migrationResult, logFile *os.File) error {
+	archive, err := newArchiveReader(stream, header.Codec)
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+
+	// Reinstall the sender's package set before files are copied over it
+	systemOnRoot := header.Kind == "system" && targetPath == "/"
+	if systemOnRoot {
+		scriptPath, err := prepareReinstall(staging, opts.packageAction, logFile)
+		if err != nil {
+			return err
+		}
+		result.reinstallScript = scriptPath
+	}
+
+	activateCompareMode(CompareProfileRestore, logFile)
+	rollback, err := beginRestoreRollback(header.Hostname+":"+header.Source, targetPath, logFile)
+	if err != nil {
+		return fmt.Errorf("cannot prepare rollback area, refusing to restore: %v", err)
+	}
+	defer rollback.finish(logFile)
+
+	// A new machine keeps its own identity
+	if systemOnRoot {
+		defer activateHostIdentity(true, logFile)()
+	}
+
+	// A home directory moving to a differently named account goes to that account
+	receiver := getCurrentUser()
+	if header.Kind == "home" && header.User != "" && header.User != receiver && !hasExplicitUser(header.User) {
+		explicitUserMappings = append(explicitUserMappings, NameMapping{From: header.User, To: receiver})
+		defer func() { explicitUserMappings = explicitUserMappings[:len(explicitUserMappings)-1] }()
+	}
+	defer activateOwnershipMap(staging, ownershipRemapAutomatic(header.Kind, targetPath), logFile)()
+
+	excludePatterns := append(restoreOptionExclusions(opts.restoreConfig, opts.restoreWindowMgrs, logFile),
+		GetSelectiveRestoreExclusions(opts.restoreConfig, opts.restoreWindowMgrs, nil, nil)...)
+	if err := restoreArchiveStream(archive, &ArchiveInfo{Name: "network migration"}, targetPath, excludePatterns, logFile); err != nil {
+		return err
+	}
+	if logFile != nil {
+		logContentRecopies(logFile)
+	}
+
+	// The received fstab/crypttab/loader entries name the sender's disks
+	if systemOnRoot {
+		result.bootFixups = checkRestoredBootConfig(logFile)
+	}
+	return nil
+}
+
+// hasExplicitUser reports whether --map-user names a mapping for an account.
+func hasExplicitUser(name string) bool {
+	for _, mapping := range explicitUserMappings {
+		if mapping.From == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,610 @@
+// Package internal provides backups to S3-compatible object storage.
+//
+// Object storage cannot hold a mirror (no permissions, owners, symlinks or
+// in-place updates), so a backup to s3://bucket/prefix is written in the archive
+// format, with each volume stored as one object:
+//
+//	prefix/BACKUP-INFO.txt, BACKUP-MANIFEST.json, BACKUP-FOLDERS.txt
+//	prefix/migrate-archive/backup-<time>.tar.zst.000, .001, ...
+//	prefix/migrate-archive/backup-<time>.tar.zst.json   the manifest of that run
+//
+// Every run uploads a new archive; the manifest is only replaced once all its
+// volumes are in place, and the newest archives are kept as snapshots. Volumes
+// are sent as multipart uploads that stay open until the archive is complete.
+// The parts sent so far are recorded locally, so an interrupted backup resumes
+// on the next run: the stream is produced again and parts whose content matches
+// what the service already holds are not sent a second time. These archives
+// leave out access times, which reading the files for the first attempt changes.
+package internal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// objectStoreArchivesKept is how many archives a backup leaves in the bucket
+	objectStoreArchivesKept = 7
+
+	// objectStorePartSize is the size of multipart upload parts (S3 allows 10,000 per object)
+	objectStorePartSize = 16 * 1024 * 1024
+
+	// objectStoreUploadsInFlight is how many parts are uploaded at the same time
+	objectStoreUploadsInFlight = 4
+)
+
+// objectUploadState records an unfinished archive upload so the next run can resume it.
+type objectUploadState struct {
+	Destination string              `json:"destination"`
+	Source      string              `json:"source"`
+	Archive     string              `json:"archive"`
+	VolumeSize  int64               `json:"volume_size"`
+	Compression int                 `json:"compression"`
+	Volumes     []objectVolumeState `json:"volumes"`
+}
+
+// objectVolumeState is the multipart upload of one volume.
+type objectVolumeState struct {
+	UploadID string                  `json:"upload_id"`
+	Parts    map[int]objectPartState `json:"parts"`
+}
+
+// objectPartState is an uploaded part and the hash of its content.
+type objectPartState struct {
+	ETag   string `json:"etag"`
+	SHA256 string `json:"sha256"`
+}
+
+// objectUploadStatePath returns where the upload state of source to destination is kept.
+func objectUploadStatePath(source, destination string) string {
+	key := sha256.Sum256([]byte(source + "\x00" + destination))
+	return filepath.Join(stateCacheDir, "s3-"+hex.EncodeToString(key[:6])+".json")
+}
+
+// loadObjectUploadState returns the state of an interrupted upload, or nil.
+func loadObjectUploadState(path string) *objectUploadState {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil
+	}
+	var state objectUploadState
+	if json.Unmarshal(data, &state) != nil {
+		return nil
+	}
+	return &state
+}
+
+// objectVolumeWriter splits the archive stream into volume objects, each sent
+// as a multipart upload. The uploads are left open until complete is called.
+type objectVolumeWriter struct {
+	client     *s3Client
+	base       string // Object key of the archive without the volume number
+	volumeSize int64
+	partSize   int
+	logFile    *os.File
+
+	mu        sync.Mutex // Guards state, parts and err
+	state     *objectUploadState
+	statePath string
+	parts     []map[int]string // ETags of this run's parts, by volume and part number
+	err       error
+	saveMu    sync.Mutex // Serializes saveState, so an older state never overwrites a newer one
+
+	existing map[int]string // Parts the service confirms for the current volume
+	buf      []byte
+	volume   int   // Current volume
+	part     int   // Number of the part being filled
+	written  int64 // Bytes in the current volume, including buf
+	inFlight chan struct{}
+	wg       sync.WaitGroup
+
+	sent, resumed int64 // Bytes uploaded and bytes found already uploaded
+}
+
+func newObjectVolumeWriter(client *s3Client, base string, state *objectUploadState, statePath string, logFile *os.File) *objectVolumeWriter {
+	partSize := int64(objectStorePartSize)
+	if minimum := (state.VolumeSize + 9999) / 10000; partSize < minimum {
+		partSize = minimum
+	}
+	if partSize > state.VolumeSize {
+		partSize = state.VolumeSize
+	}
+	return &objectVolumeWriter{
+		client:     client,
+		base:       base,
+		volumeSize: state.VolumeSize,
+		partSize:   int(partSize),
+		logFile:    logFile,
+		state:      state,
+		statePath:  statePath,
+		volume:     -1,
+		inFlight:   make(chan struct{}, objectStoreUploadsInFlight),
+	}
+}
+
+func (w *objectVolumeWriter) Write(p []byte) (int, error) {
+	total := 0
+	for len(p) > 0 {
+		if err := w.failed(); err != nil {
+			return total, err
+		}
+		if w.volume < 0 || w.written == w.volumeSize {
+			if err := w.startVolume(w.volume + 1); err != nil {
+				return total, err
+			}
+		}
+		n := len(p)
+		if room := w.partSize - len(w.buf); n > room {
+			n = room
+		}
+		if room := w.volumeSize - w.written; int64(n) > room {
+			n = int(room)
+		}
+		w.buf = append(w.buf, p[:n]...)
+		w.written += int64(n)
+		total += n
+		p = p[n:]
+		if len(w.buf) == w.partSize || w.written == w.volumeSize {
+			w.flushPart()
+		}
+	}
+	return total, nil
+}
+
+// failed returns the first error of an upload.
+func (w *objectVolumeWriter) failed() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.err
+}
+
+// startVolume opens the multipart upload of volume v, taking over the one of
+// an interrupted run when the service still has it.
+func (w *objectVolumeWriter) startVolume(v int) error {
+	key := volumePath(w.base, v)
+	w.volume, w.part, w.written = v, 1, 0
+	w.existing = nil
+
+	w.mu.Lock()
+	w.parts = append(w.parts, make(map[int]string))
+	resume := v < len(w.state.Volumes) && w.state.Volumes[v].UploadID != ""
+	uploadID := ""
+	if resume {
+		uploadID = w.state.Volumes[v].UploadID
+		if w.state.Volumes[v].Parts == nil {
+			w.state.Volumes[v].Parts = make(map[int]objectPartState)
+		}
+	}
+	w.mu.Unlock()
+
+	if resume {
+		existing, err := w.client.listParts(key, uploadID)
+		if err == nil {
+			w.existing = existing
+			return nil
+		}
+		if !isS3NotFound(err) {
+			return fmt.Errorf("cannot resume upload of %s: %v", key, err)
+		}
+		if w.logFile != nil {
+			fmt.Fprintf(w.logFile, "Upload of %s expired on the service, starting it again\n", key)
+		}
+	}
+
+	uploadID, err := w.client.createMultipartUpload(key)
+	if err != nil {
+		return fmt.Errorf("cannot start upload of %s: %v", key, err)
+	}
+	w.mu.Lock()
+	volume := objectVolumeState{UploadID: uploadID, Parts: make(map[int]objectPartState)}
+	if v < len(w.state.Volumes) {
+		w.state.Volumes[v] = volume
+	} else {
+		w.state.Volumes = append(w.state.Volumes, volume)
+	}
+	w.mu.Unlock()
+	return w.saveState()
+}
+
+// flushPart sends the filled part, unless the interrupted run already sent the same bytes.
+func (w *objectVolumeWriter) flushPart() {
+	data := w.buf
+	w.buf = make([]byte, 0, w.partSize)
+	v, n := w.volume, w.part
+	w.part++
+
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+
+	w.mu.Lock()
+	volume := w.state.Volumes[v]
+	if previous, ok := volume.Parts[n]; ok && previous.SHA256 == hash && w.existing[n] == previous.ETag {
+		w.parts[v][n] = previous.ETag
+		w.mu.Unlock()
+		w.resumed += int64(len(data))
+		return
+	}
+	w.mu.Unlock()
+
+	bwLimiter.wait(len(data))
+	w.inFlight <- struct{}{}
+	w.wg.Add(1)
+	go func() {
+		defer func() { <-w.inFlight; w.wg.Done() }()
+		etag, err := w.client.uploadPart(volumePath(w.base, v), volume.UploadID, n, data)
+
+		w.mu.Lock()
+		if err != nil {
+			if w.err == nil {
+				w.err = fmt.Errorf("upload of %s part %d failed: %v", volumePath(w.base, v), n, err)
+			}
+			w.mu.Unlock()
+			return
+		}
+		w.parts[v][n] = etag
+		w.state.Volumes[v].Parts[n] = objectPartState{ETag: etag, SHA256: hash}
+		w.mu.Unlock()
+		atomic.AddInt64(&w.sent, int64(len(data)))
+		w.saveState()
+	}()
+}
+
+// flush sends the last part and waits for all uploads.
+func (w *objectVolumeWriter) flush() error {
+	if len(w.buf) > 0 {
+		w.flushPart()
+	}
+	w.wg.Wait()
+	return w.failed()
+}
+
+// saveState records the uploads so far for the next run. Parts finish on
+// several goroutines, and each save replaces the file through the same temporary name.
+func (w *objectVolumeWriter) saveState() error {
+	w.saveMu.Lock()
+	defer w.saveMu.Unlock()
+
+	w.mu.Lock()
+	data, err := json.MarshalIndent(w.state, "", "  ")
+	w.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(w.statePath), 0700); err != nil {
+		return err
+	}
+	return writeFileAtomically(w.statePath, data)
+}
+
+// volumes returns how many volumes the archive has.
+func (w *objectVolumeWriter) volumes() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.parts)
+}
+
+// complete turns the uploads into the volume objects and drops uploads left
+// over from a longer interrupted stream.
+func (w *objectVolumeWriter) complete() error {
+	for v, etags := range w.parts {
+		parts := make([]s3Part, 0, len(etags))
+		for n := 1; n <= len(etags); n++ {
+			parts = append(parts, s3Part{PartNumber: n, ETag: etags[n]})
+		}
+		key := volumePath(w.base, v)
+		if err := w.client.completeMultipartUpload(key, w.state.Volumes[v].UploadID, parts); err != nil {
+			return fmt.Errorf("cannot complete upload of %s: %v", key, err)
+		}
+	}
+	for v := len(w.parts); v < len(w.state.Volumes); v++ {
+		w.client.abortMultipartUpload(volumePath(w.base, v), w.state.Volumes[v].UploadID)
+	}
+	return nil
+}
+
+// abort discards every upload of the archive.
+func (w *objectVolumeWriter) abort() {
+	for v, volume := range w.state.Volumes {
+		w.client.abortMultipartUpload(volumePath(w.base, v), volume.UploadID)
+	}
+}
+
+// performObjectStoreBackupPhases writes the backup as an archive to an s3:// destination.
+func performObjectStoreBackupPhases(destination string, config BackupConfig, logFile *os.File) error {
+	client, target, err := openObjectStore(destination, logFile)
+	if err != nil {
+		return err
+	}
+	return backupToObjectStore(client, target, destination, config, logFile)
+}
+
+// backupToObjectStore uploads a new archive of the source, then the metadata
+// staged in config.DestinationPath, and prunes old archives.
+func backupToObjectStore(client *s3Client, target *objectStoreTarget, destination string, config BackupConfig, logFile *os.File) error {
+	info := &ArchiveInfo{
+		VolumeSize:      archiveVolumeSize,
+		Compression:     archiveCompressionLevel(),
+		OmitAccessTimes: true,
+	}
+
+	// Resume the interrupted upload of the same backup, or start a new archive
+	statePath := objectUploadStatePath(config.SourcePath, destination)
+	state := loadObjectUploadState(statePath)
+	if state != nil && (state.VolumeSize != info.VolumeSize || state.Compression != info.Compression) {
+		abandoned := newObjectVolumeWriter(client, target.key(archiveDir+"/"+state.Archive), state, statePath, logFile)
+		abandoned.abort()
+		state = nil
+	}
+	if state != nil {
+		info.Name = state.Archive
+		if logFile != nil {
+			fmt.Fprintf(logFile, "Resuming interrupted upload of %s\n", info.Name)
+		}
+	} else {
+		extension := ".tar"
+		if info.Compression > 0 {
+			extension += ".zst"
+		}
+		info.Name = "backup-" + time.Now().UTC().Format("20060102-150405") + extension
+		state = &objectUploadState{
+			Destination: destination,
+			Source:      config.SourcePath,
+			Archive:     info.Name,
+			VolumeSize:  info.VolumeSize,
+			Compression: info.Compression,
+		}
+	}
+	base := target.key(archiveDir + "/" + info.Name)
+
+	if logFile != nil {
+		fmt.Fprintf(logFile, "Object storage backup: %s, volumes of %s, compression level %d\n", info.Name, FormatBytes(info.VolumeSize), info.Compression)
+		fmt.Fprintf(logFile, "Throttle: %s\n", throttleStatus())
+	}
+	if err := applyProcessPriority(); err != nil && logFile != nil {
+		fmt.Fprintf(logFile, "Warning: could not set process priority: %v\n", err)
+	}
+
+	// Phase 1: stream the archive into multipart uploads
+	volumes := newObjectVolumeWriter(client, base, state, statePath, logFile)
+	err := writeArchive(config, volumes, info, logFile)
+	if flushErr := volumes.flush(); err == nil {
+		err = flushErr
+	}
+	if err == nil && shouldCancelBackup() {
+		err = fmt.Errorf("operation canceled")
+	}
+	if err != nil {
+		// The uploads stay open: the next run continues them
+		if logFile != nil {
+			fmt.Fprintf(logFile, "ERROR during object storage upload: %v\n", err)
+			fmt.Fprintf(logFile, "%s sent; the upload resumes on the next backup\n", FormatBytes(volumes.sent))
+		}
+		return err
+	}
+	if err := volumes.complete(); err != nil {
+		return err
+	}
+	info.Volumes = volumes.volumes()
+	os.Remove(statePath)
+	syncPhaseComplete = true
+	if logFile != nil {
+		fmt.Fprintf(logFile, "Object storage upload: %s files (%s) in %d volumes, %s sent, %s already uploaded by an earlier run\n",
+			FormatNumber(info.Files), FormatBytes(info.Size), info.Volumes, FormatBytes(volumes.sent), FormatBytes(volumes.resumed))
+	}
+
+	// Phase 2: read the archive back from the service
+	if EnableVerification {
+		if err := verifyObjectStoreArchive(client, target, info, config.SourcePath, logFile); err != nil {
+			return fmt.Errorf("verification phase failed: %v", err)
+		}
+	}
+
+	// Phase 3: the metadata, manifest last, makes the new archive the backup
+	manifest, err := loadBackupManifest(config.DestinationPath)
+	if err != nil {
+		return fmt.Errorf("failed to update backup manifest: %v", err)
+	}
+	manifest.Archive = info
+	if err := writeBackupManifest(config.DestinationPath, manifest); err != nil {
+		return err
+	}
+	manifestData, err := os.ReadFile(filepath.Join(config.DestinationPath, backupManifestFile))
+	if err != nil {
+		return err
+	}
+	if err := client.putObject(base+".json", manifestData); err != nil {
+		return fmt.Errorf("failed to upload archive manifest: %v", err)
+	}
+	for _, name := range remoteMetadataFiles {
+		data, err := os.ReadFile(filepath.Join(config.DestinationPath, name))
+		if os.IsNotExist(err) && name == "BACKUP-FOLDERS.txt" {
+			// A full backup must not keep the folder list of an earlier selective one
+			client.deleteObject(target.key(name))
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if err := client.putObject(target.key(name), data); err != nil {
+			return fmt.Errorf("failed to upload %s: %v", name, err)
+		}
+	}
+
+	// Phase 4: retention
+	deletionPhaseActive = true
+	if err := pruneObjectStoreArchives(client, target, info.Name, logFile); err != nil && logFile != nil {
+		fmt.Fprintf(logFile, "Warning: old archives not pruned: %v\n", err)
+	}
+	deletionPhaseActive = false
+
+	if logFile != nil {
+		fmt.Fprintf(logFile, "Object storage backup to %s completed successfully: %s\n", destination, info.Name)
+	}
+	return nil
+}
+
+// objectStoreArchives groups the objects in migrate-archive/ by archive name.
+func objectStoreArchives(client *s3Client, target *objectStoreTarget) (map[string][]s3Object, error) {
+	prefix := target.key(archiveDir + "/")
+	objects, err := client.listObjects(prefix)
+	if err != nil {
+		return nil, err
+	}
+	archives := make(map[string][]s3Object)
+	for _, object := range objects {
+		name := strings.TrimPrefix(object.Key, prefix)
+		if dot := strings.LastIndex(name, "."); dot > 0 && strings.HasPrefix(name, "backup-") {
+			archives[name[:dot]] = append(archives[name[:dot]], object)
+		}
+	}
+	return archives, nil
+}
+
+// pruneObjectStoreArchives deletes all but the newest archives, never current.
+func pruneObjectStoreArchives(client *s3Client, target *objectStoreTarget, current string, logFile *os.File) error {
+	archives, err := objectStoreArchives(client, target)
+	if err != nil {
+		return err
+	}
+	var names []string
+	for name := range archives {
+		if name != current {
+			names = append(names, name)
+		}
+	}
+	// Names start with their UTC time, so the newest sort last
+	sort.Strings(names)
+	for len(names) > objectStoreArchivesKept-1 {
+		name := names[0]
+		names = names[1:]
+		for _, object := range archives[name] {
+			if err := client.deleteObject(object.Key); err != nil {
+				return err
+			}
+			atomic.AddInt64(&filesDeleted, 1)
+		}
+		if logFile != nil {
+			fmt.Fprintf(logFile, "Removed old archive %s (%d objects)\n", name, len(archives[name]))
+		}
+	}
+	return nil
+}
+
+// objectVolumeReader reads the volume objects of an archive as one stream.
+type objectVolumeReader struct {
+	client  *s3Client
+	base    string
+	volumes int
+	next    int
+	current io.ReadCloser
+}
+
+func (v *objectVolumeReader) Read(p []byte) (int, error) {
+	for {
+		if v.current == nil {
+			if v.next == v.volumes {
+				return 0, io.EOF
+			}
+			body, err := v.client.getObject(volumePath(v.base, v.next))
+			if err != nil {
+				return 0, fmt.Errorf("archive volume missing: %v", err)
+			}
+			v.current = body
+			v.next++
+		}
+		n, err := v.current.Read(p)
+		if err == io.EOF {
+			v.current.Close()
+			v.current = nil
+			if n > 0 {
+				return n, nil
+			}
+			continue
+		}
+		return n, err
+	}
+}
+
+func (v *objectVolumeReader) Close() error {
+	if v.current != nil {
+		return v.current.Close()
+	}
+	return nil
+}
+
+// verifyObjectStoreArchive checks from the bucket listing that every volume is
+// there with the expected size, then reads the archive back and compares it
+// with the source like a local archive.
+func verifyObjectStoreArchive(client *s3Client, target *objectStoreTarget, info *ArchiveInfo, sourcePath string, logFile *os.File) error {
+	base := target.key(archiveDir + "/" + info.Name)
+	objects, err := client.listObjects(base + ".")
+	if err != nil {
+		return fmt.Errorf("cannot list the archive: %v", err)
+	}
+	sizes := make(map[int]int64)
+	for _, object := range objects {
+		if n, err := strconv.Atoi(strings.TrimPrefix(object.Key, base+".")); err == nil {
+			sizes[n] = object.Size
+		}
+	}
+	for v := 0; v < info.Volumes; v++ {
+		size, ok := sizes[v]
+		if !ok {
+			return fmt.Errorf("archive volume %s is missing from the bucket", volumePath(info.Name, v))
+		}
+		if v < info.Volumes-1 && size != info.VolumeSize {
+			return fmt.Errorf("archive volume %s has %s instead of %s", volumePath(info.Name, v), FormatBytes(size), FormatBytes(info.VolumeSize))
+		}
+	}
+
+	archive, err := newArchiveReader(&objectVolumeReader{client: client, base: base, volumes: info.Volumes}, info.codec())
+	if err != nil {
+		return err
+	}
+	defer archive.Close()
+	return verifyArchiveStream(archive, info, sourcePath, logFile)
+}
+
+// fetchObjectStoreMetadata copies a backup's metadata objects into a new local
+// directory, so backup type detection and folder lists work as on a drive.
+func fetchObjectStoreMetadata(destination string, logFile *os.File) (string, error) {
+	client, target, err := openObjectStore(destination, logFile)
+	if err != nil {
+		return "", err
+	}
+	staging, err := os.MkdirTemp("", "migrate-remote-")
+	if err != nil {
+		return "", err
+	}
+	for _, name := range remoteMetadataFiles {
+		if data, err := client.readObject(target.key(name)); err == nil {
+			os.WriteFile(filepath.Join(staging, name), data, 0644)
+		}
+	}
+	return staging, nil
+}
+
+// performObjectStoreVerification verifies the latest archive of an s3:// backup
+// whose metadata has been fetched into metadataPath.
+func performObjectStoreVerification(destination, metadataPath, sourcePath string, logFile *os.File) error {
+	info, err := loadArchiveInfo(metadataPath)
+	if err != nil {
+		return err
+	}
+	client, target, err := openObjectStore(destination, logFile)
+	if err != nil {
+		return err
+	}
+	return verifyObjectStoreArchive(client, target, info, sourcePath, logFile)
+}
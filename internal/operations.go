@@ -22,6 +22,8 @@ import (
 	"sync"
 	"time"
 
+	"migrate/internal/drives"
+
 	tea "github.com/charmbracelet/bubbletea"
 	"golang.org/x/sys/unix"
 )
@@ -37,6 +39,8 @@ type BackupConfig struct {
 	SelectedFolders    map[string]bool  // folder path -> selected state (for selective backups)
 	HomeFolders        []HomeFolderInfo // metadata about home folders (for selective backups)
 	SelectedSubfolders map[string]bool  // explicitly selected subfolders for smart inclusion (hierarchical support)
+	Format             string           // BackupFormatMirror, BackupFormatRepository or BackupFormatArchive
+	DestinationDevice  string           // Block device the destination was mounted from, if it is a drive
 }
 
 // BackupFolderList contains folder selection information from selective home backups.
@@ -148,6 +152,9 @@ func resetBackupState() {
 	filesCopied = 0
 	filesDeleted = 0
 	totalFilesFound = 0
+	filesReflinked = 0
+	filesCopyRange = 0
+	filesBuffered = 0
 	progressCallCounter = 0
 	totalFilesProcessed = 0
 	totalFilesEstimate = 0
@@ -269,6 +276,35 @@ func performPureGoBackup(config BackupConfig, logFile *os.File) error {
 		fmt.Fprintf(logFile, "Source: %s -> Dest: %s\n", config.SourcePath, config.DestinationPath)
 	}
 
+	// Nothing is written unless the destination is still on the drive that was chosen
+	if config.DestinationDevice != "" {
+		if err := drives.VerifyMountedOn(config.DestinationPath, config.DestinationDevice); err != nil {
+			if logFile != nil {
+				fmt.Fprintf(logFile, "Destination check failed: %v\n", err)
+			}
+			return fmt.Errorf("refusing to write the backup: %v", err)
+		}
+	}
+
+	// A remote backup's metadata is written to a local staging directory and uploaded with the tree
+	remoteDestination := ""
+	if isRemoteDestination(config.DestinationPath) || isObjectStoreDestination(config.DestinationPath) {
+		staging, err := os.MkdirTemp("", "migrate-remote-")
+		if err != nil {
+			return fmt.Errorf("failed to create staging directory: %v", err)
+		}
+		defer os.RemoveAll(staging)
+		remoteDestination, config.DestinationPath = config.DestinationPath, staging
+	}
+
+	// Object storage holds archives: a mirror cannot keep permissions or owners there
+	if isObjectStoreDestination(remoteDestination) {
+		if config.Format == BackupFormatRepository {
+			return fmt.Errorf("object storage destinations hold archive backups: --format %s is not supported there", config.Format)
+		}
+		config.Format = BackupFormatArchive
+	}
+
 	// Create backup info file first with CORRECT backup type
 	err := createBackupInfo(config.DestinationPath, config.BackupType) // Use actual backup type, not hardcoded
 	if err != nil {
@@ -278,8 +314,32 @@ func performPureGoBackup(config BackupConfig, logFile *os.File) error {
 		return fmt.Errorf("failed to create backup info: %v", err)
 	}
 
+	// Comparison strategy for this backup's profile
+	if config.BackupType == "Complete System" {
+		activateCompareMode(CompareProfileSystem, logFile)
+	} else {
+		activateCompareMode(CompareProfileHome, logFile)
+	}
+
+	// File states from the last successful run, checked against the manifest before it is rewritten
+	// (a repository compares against its previous snapshot instead, and an archive is always rewritten)
+	var stateCache *stateCache
+	if config.Format != BackupFormatRepository && config.Format != BackupFormatArchive && remoteDestination == "" {
+		stateCache = openStateCache(config.SourcePath, config.DestinationPath, logFile)
+		defer activateStateCache(stateCache)()
+	}
+
+	// Machine-readable manifest (account names for uid/gid remapping on restore)
+	if err := createBackupManifest(config); err != nil {
+		if logFile != nil {
+			fmt.Fprintf(logFile, "Failed to create backup manifest: %v\n", err)
+		}
+		return fmt.Errorf("failed to create backup manifest: %v", err)
+	}
+
 	// For selective backups, create folder selection metadata for verification
-	if config.IsSelectiveBackup {
+	// (not for an encrypted repository, where folder names must not be readable)
+	if config.IsSelectiveBackup && !(config.Format == BackupFormatRepository && backupEncrypted(config.DestinationPath)) {
 		err := createBackupFolderList(config.DestinationPath, config.SelectedFolders, logFile)
 		if err != nil {
 			if logFile != nil {
@@ -340,6 +400,26 @@ func performPureGoBackup(config BackupConfig, logFile *os.File) error {
 		}
 	}
 
+	// OBJECT STORAGE BACKUP: Upload a new archive as volume objects
+	if isObjectStoreDestination(remoteDestination) {
+		return performObjectStoreBackupPhases(remoteDestination, config, logFile)
+	}
+
+	// REMOTE BACKUP: Sync over SFTP into current/ and snapshot it
+	if remoteDestination != "" {
+		return performRemoteBackupPhases(remoteDestination, config, logFile)
+	}
+
+	// REPOSITORY BACKUP: Chunk into migrate-repo/ instead of mirroring the tree
+	if config.Format == BackupFormatRepository {
+		return performRepositoryBackupPhases(config, logFile)
+	}
+
+	// ARCHIVE BACKUP: Stream the tree into tar/zstd volumes in migrate-archive/
+	if config.Format == BackupFormatArchive {
+		return performArchiveBackupPhases(config, logFile)
+	}
+
 	// REGULAR BACKUP: Sync entire source directory with smart hierarchical support
 	if config.IsSelectiveBackup {
 		err = syncDirectoriesWithSelectiveInclusions(config.SourcePath, config.DestinationPath, config.ExcludePatterns, config.SelectedSubfolders, logFile)
@@ -395,12 +475,103 @@ func performPureGoBackup(config BackupConfig, logFile *os.File) error {
 		}
 	}
 
+	// The backup is complete - remember file states so the next run can skip unchanged files
+	if stateCache != nil {
+		if err := stateCache.save(logFile); err != nil && logFile != nil {
+			fmt.Fprintf(logFile, "Warning: could not save state cache: %v\n", err)
+		}
+	}
+
 	if logFile != nil {
+		logCopyMethods(logFile)
+		logContentRecopies(logFile)
 		fmt.Fprintf(logFile, "Pure Go backup completed successfully with verification\n")
 	}
 	return nil
 }
 
+// performRepositoryBackupPhases stores a new snapshot, checks that every chunk it
+// references is present (if verification is enabled) and points the manifest at it.
+// There is no deletion phase: older snapshots keep their own trees.
+func performRepositoryBackupPhases(config BackupConfig, logFile *os.File) error {
+	snapshot, err := performRepositoryBackup(config, logFile)
+	if err != nil {
+		if logFile != nil {
+			fmt.Fprintf(logFile, "ERROR during repository backup: %v\n", err)
+		}
+		return err
+	}
+	syncPhaseComplete = true
+
+	if EnableVerification {
+		if err := checkRepositorySnapshot(config.DestinationPath, snapshot, logFile); err != nil {
+			return fmt.Errorf("verification phase failed: %v", err)
+		}
+	}
+
+	manifest, err := loadBackupManifest(config.DestinationPath)
+	if err != nil {
+		return fmt.Errorf("failed to update backup manifest: %v", err)
+	}
+	manifest.Snapshot = snapshot.ID
+	manifest.Encryption = nil
+	if enc := repositoryEncryption(config.DestinationPath); enc != nil {
+		manifest.Encryption = enc.info()
+	}
+	if err := writeBackupManifest(config.DestinationPath, manifest); err != nil {
+		return err
+	}
+
+	// Retention: older snapshots of this machine's source give back their space
+	if snapshotRetention > 0 {
+		repo, err := openRepository(repositoryPath(config.DestinationPath))
+		if err == nil {
+			err = repo.pruneSnapshots(snapshotKey(snapshot), snapshotRetention, logFile)
+		}
+		if err != nil && logFile != nil {
+			fmt.Fprintf(logFile, "Warning: could not prune old snapshots: %v\n", err)
+		}
+	}
+
+	if logFile != nil {
+		fmt.Fprintf(logFile, "Repository backup completed successfully: snapshot %s\n", snapshot.ID)
+	}
+	return nil
+}
+
+// performArchiveBackupPhases writes a new archive, records it in the manifest
+// and optionally verifies it against the source.
+func performArchiveBackupPhases(config BackupConfig, logFile *os.File) error {
+	archive, err := performArchiveBackup(config, logFile)
+	if err != nil {
+		if logFile != nil {
+			fmt.Fprintf(logFile, "ERROR during archive backup: %v\n", err)
+		}
+		return err
+	}
+	syncPhaseComplete = true
+
+	manifest, err := loadBackupManifest(config.DestinationPath)
+	if err != nil {
+		return fmt.Errorf("failed to update backup manifest: %v", err)
+	}
+	manifest.Archive = archive
+	if err := writeBackupManifest(config.DestinationPath, manifest); err != nil {
+		return err
+	}
+
+	if EnableVerification {
+		if err := performArchiveVerification(config.DestinationPath, config.SourcePath, logFile); err != nil {
+			return fmt.Errorf("verification phase failed: %v", err)
+		}
+	}
+
+	if logFile != nil {
+		fmt.Fprintf(logFile, "Archive backup completed successfully: %s\n", archive.Name)
+	}
+	return nil
+}
+
 // CheckTUIBackupProgress creates a Bubble Tea command that periodically checks operation progress.
 // Handles cancellation detection, completion status, and real-time progress calculation.
 // Returns ProgressUpdate messages with current status for the UI.
@@ -469,6 +640,9 @@ func calculateRealProgress() (float64, string) {
 		filesCopied = 0
 		filesDeleted = 0
 		totalFilesFound = 0
+		filesReflinked = 0
+		filesCopyRange = 0
+		filesBuffered = 0
 		directoryWalkComplete = false
 		syncPhaseComplete = false
 		deletionPhaseActive = false
@@ -588,6 +762,9 @@ func calculateRealProgress() (float64, string) {
 				if filesCopied > 0 {
 					message = fmt.Sprintf("📁 Syncing files • %s copied, %s skipped • %s total",
 						FormatNumber(filesCopied), FormatNumber(filesSkipped), FormatNumber(totalFilesFound))
+					if filesReflinked > 0 {
+						message += fmt.Sprintf(" • %s reflinked", FormatNumber(filesReflinked))
+					}
 				} else if filesSkipped > 1000 {
 					message = fmt.Sprintf("⚡ Comparing files • %s identical • %s total processed",
 						FormatNumber(filesSkipped), FormatNumber(totalFilesFound))
@@ -674,7 +851,10 @@ func calculateRealProgress() (float64, string) {
 // startRestore creates a Bubble Tea command for restore operations.
 // Automatically detects backup type (system/home) and determines the appropriate
 // target path. Handles both full system restores and custom path restores.
-func startRestore(sourcePath, targetPath string, restoreConfig, restoreWindowMgrs bool) tea.Cmd {
+// packageAction selects whether a system backup's package inventory is turned into
+// a reinstall script, run before copying files, or skipped. keepIdentity leaves
+// this machine's identity files (see hostIdentityRules) untouched.
+func startRestore(sourcePath, targetPath string, restoreConfig, restoreWindowMgrs bool, packageAction string, keepIdentity bool) tea.Cmd {
 	return func() tea.Msg {
 		// Add a debug file marker to indicate this function was called
 		debugFile := "/tmp/migrate_restore_debug"
@@ -767,13 +947,45 @@ func startRestore(sourcePath, targetPath string, restoreConfig, restoreWindowMgr
 			fmt.Fprintf(logFile, "Space check passed - internal drive has sufficient capacity\n")
 		}
 
+		// Reinstall the backed-up package set before files are copied over it
+		if backupType == "system" && actualTargetPath == "/" {
+			scriptPath, err := prepareReinstall(sourcePath, packageAction, logFile)
+			if err != nil {
+				if logFile != nil {
+					fmt.Fprintf(logFile, "PACKAGE REINSTALL FAILED: %v\n", err)
+				}
+				return ProgressUpdate{Error: err, Done: true}
+			}
+			if scriptPath != "" && packageAction == PackageActionScript {
+				// Wait for the user to run the script before files are restored
+				if logFile != nil {
+					fmt.Fprintf(logFile, "Restore paused until the package reinstall script has been run\n")
+				}
+				return ReinstallScriptWritten{ScriptPath: scriptPath}
+			}
+		}
+
+		// Identity files only matter when restoring over the running machine
+		if backupType == "system" && actualTargetPath == "/" {
+			defer activateHostIdentity(keepIdentity, logFile)()
+		}
+
 		// Perform the actual restore with options
 		err = performPureGoRestore(sourcePath, actualTargetPath, restoreConfig, restoreWindowMgrs, logFile)
 		if err != nil {
 			return ProgressUpdate{Error: fmt.Errorf("restore failed: %v", err)}
 		}
 
-		return ProgressUpdate{Percentage: 1.0, Message: fmt.Sprintf("%s completed successfully!", operationDesc), Done: true}
+		message := fmt.Sprintf("%s completed successfully!", operationDesc)
+
+		// The restored fstab/crypttab/loader entries may still name the old machine's disks
+		if backupType == "system" && actualTargetPath == "/" {
+			if plan := checkRestoredBootConfig(logFile); plan != nil {
+				return BootFixupsProposed{Plan: plan, Message: message}
+			}
+		}
+
+		return ProgressUpdate{Percentage: 1.0, Message: message, Done: true}
 	}
 }
 
@@ -869,6 +1081,7 @@ func performSelectiveRestore(backupPath, targetPath string, selectedFolders map[
 	if logFile != nil {
 		fmt.Fprintf(logFile, "Starting selective restore: %s -> %s\n", backupPath, targetPath)
 	}
+	activateCompareMode(CompareProfileRestore, logFile)
 
 	// Create a list of folders to restore
 	var foldersToRestore []string
@@ -924,6 +1137,16 @@ func performSelectiveRestore(backupPath, targetPath string, selectedFolders map[
 	totalFilesFound = totalFiles
 	directoryWalkComplete = true // Mark directory scan as complete
 
+	// Safety net: everything overwritten or deleted below can be put back with "Undo Last Restore"
+	rollback, err := beginRestoreRollback(backupPath, targetPath, logFile)
+	if err != nil {
+		return fmt.Errorf("cannot prepare rollback area, refusing to restore: %v", err)
+	}
+	defer rollback.finish(logFile)
+
+	// Home backups are always remapped by name onto the current installation
+	defer activateOwnershipMap(backupPath, true, logFile)()
+
 	if logFile != nil {
 		fmt.Fprintf(logFile, "Total files to restore: %d\n", totalFiles)
 		fmt.Fprintf(logFile, "Phase 2: Starting folder restoration...\n")
@@ -946,6 +1169,7 @@ func performSelectiveRestore(backupPath, targetPath string, selectedFolders map[
 		// Use syncDirectoriesWithExclusions for each folder with proper exclusions
 		// Generate exclusion patterns to prevent overwriting protected directories
 		excludePatterns := GetSelectiveRestoreExclusions(restoreConfig, restoreWindowMgrs, selectedFolders, allFolders)
+		excludePatterns = append(excludePatterns, nestedDestinationExclusions(filepath.Clean(targetPath), filepath.Clean(backupPath))...)
 		err := syncDirectoriesWithExclusions(sourceFolderPath, targetFolderPath, excludePatterns, logFile)
 		if err != nil {
 			if logFile != nil {
@@ -972,6 +1196,8 @@ func performSelectiveRestore(backupPath, targetPath string, selectedFolders map[
 	}
 
 	if logFile != nil {
+		logCopyMethods(logFile)
+		logContentRecopies(logFile)
 		fmt.Fprintf(logFile, "\nSelective restore completed successfully\n")
 	}
 
@@ -1029,9 +1255,60 @@ func performPureGoRestore(backupPath, targetPath string, restoreConfig, restoreW
 		fmt.Fprintf(logFile, "Starting restore: %s -> %s\n", backupPath, targetPath)
 		fmt.Fprintf(logFile, "Restore config: %v, Restore window managers: %v\n", restoreConfig, restoreWindowMgrs)
 	}
+	activateCompareMode(CompareProfileRestore, logFile)
+
+	// Safety net: everything overwritten or deleted below can be put back with "Undo Last Restore"
+	rollback, err := beginRestoreRollback(backupPath, targetPath, logFile)
+	if err != nil {
+		return fmt.Errorf("cannot prepare rollback area, refusing to restore: %v", err)
+	}
+	defer rollback.finish(logFile)
+
+	// Translate owners by name when restoring onto a different installation
+	backupType, _ := detectBackupType(backupPath)
+	defer activateOwnershipMap(backupPath, ownershipRemapAutomatic(backupType, targetPath), logFile)()
+
+	// A backup kept in a directory under the target is not in itself and must survive the delete phase
+	backupGuard := nestedDestinationExclusions(filepath.Clean(targetPath), filepath.Clean(backupPath))
+
+	// Repository backups restore their latest snapshot with the same options
+	if isRepositoryBackup(backupPath) {
+		excludePatterns := append(restoreOptionExclusions(restoreConfig, restoreWindowMgrs, logFile),
+			GetSelectiveRestoreExclusions(restoreConfig, restoreWindowMgrs, nil, nil)...)
+		excludePatterns = append(excludePatterns, backupGuard...)
+		if err := performRepositoryRestore(backupPath, targetPath, excludePatterns, logFile); err != nil {
+			if logFile != nil {
+				fmt.Fprintf(logFile, "Error during repository restore: %v\n", err)
+			}
+			return err
+		}
+		if logFile != nil {
+			logContentRecopies(logFile)
+			fmt.Fprintf(logFile, "Repository restore completed successfully\n")
+		}
+		return nil
+	}
+
+	// Archive backups are extracted straight from their volumes
+	if isArchiveBackup(backupPath) {
+		excludePatterns := append(restoreOptionExclusions(restoreConfig, restoreWindowMgrs, logFile),
+			GetSelectiveRestoreExclusions(restoreConfig, restoreWindowMgrs, nil, nil)...)
+		excludePatterns = append(excludePatterns, backupGuard...)
+		if err := performArchiveRestore(backupPath, targetPath, excludePatterns, logFile); err != nil {
+			if logFile != nil {
+				fmt.Fprintf(logFile, "Error during archive restore: %v\n", err)
+			}
+			return err
+		}
+		if logFile != nil {
+			logContentRecopies(logFile)
+			fmt.Fprintf(logFile, "Archive restore completed successfully\n")
+		}
+		return nil
+	}
 
 	// Phase 1: Copy files from backup to target with selective restore
-	err := syncDirectoriesWithOptions(backupPath, targetPath, restoreConfig, restoreWindowMgrs, logFile)
+	err = syncDirectoriesWithOptions(backupPath, targetPath, restoreConfig, restoreWindowMgrs, logFile)
 	if err != nil {
 		if logFile != nil {
 			fmt.Fprintf(logFile, "Error during restore copy: %v\n", err)
@@ -1042,7 +1319,7 @@ func performPureGoRestore(backupPath, targetPath string, restoreConfig, restoreW
 	// Phase 2: Delete files that exist in target but not in backup (--delete behavior)
 	// Generate exclusion patterns based on user's restore preferences
 	// Note: For pure restore, we don't have selectedFolders/allFolders data, so pass nil
-	excludePatterns := GetSelectiveRestoreExclusions(restoreConfig, restoreWindowMgrs, nil, nil)
+	excludePatterns := append(GetSelectiveRestoreExclusions(restoreConfig, restoreWindowMgrs, nil, nil), backupGuard...)
 	err = deleteExtraFiles(backupPath, targetPath, excludePatterns, logFile)
 	if err != nil {
 		if logFile != nil {
@@ -1052,6 +1329,8 @@ func performPureGoRestore(backupPath, targetPath string, restoreConfig, restoreW
 	}
 
 	if logFile != nil {
+		logCopyMethods(logFile)
+		logContentRecopies(logFile)
 		fmt.Fprintf(logFile, "Pure Go restore completed successfully\n")
 	}
 	return nil
@@ -1182,6 +1461,13 @@ func syncDirectoriesWithOptions(sourcePath, destPath string, restoreConfig, rest
 		fmt.Fprintf(logFile, "Starting selective restore: config=%v, windowMgrs=%v\n", restoreConfig, restoreWindowMgrs)
 	}
 
+	// Use the filesystem package sync function with our exclusion patterns
+	return syncDirectoriesWithExclusions(sourcePath, destPath, restoreOptionExclusions(restoreConfig, restoreWindowMgrs, logFile), logFile)
+}
+
+// restoreOptionExclusions builds the exclusion patterns for the configuration and
+// window manager restore options.
+func restoreOptionExclusions(restoreConfig, restoreWindowMgrs bool, logFile *os.File) []string {
 	// Build exclusion patterns based on user choices
 	var excludePatterns []string
 
@@ -1219,8 +1505,7 @@ func syncDirectoriesWithOptions(sourcePath, destPath string, restoreConfig, rest
 		}
 	}
 
-	// Use the filesystem package sync function with our exclusion patterns
-	return syncDirectoriesWithExclusions(sourcePath, destPath, excludePatterns, logFile)
+	return excludePatterns
 }
 
 // createBackupInfo generates the BACKUP-INFO.txt file for a backup.
@@ -1237,14 +1522,22 @@ func createBackupInfo(mountPoint, backupType string) error {
 	kernel := unix.ByteSliceToString(utsname.Release[:])
 	arch := unix.ByteSliceToString(utsname.Machine[:])
 
+	// Only the cipher and key derivation are recorded, never the key; the
+	// hostname of an encrypted backup is sealed in the repository
+	encryptionLine := ""
+	hostnameLine := fmt.Sprintf("Hostname: %s\n", hostname)
+	if backupFormatFor(mountPoint) == BackupFormatRepository && backupEncrypted(mountPoint) {
+		encryptionLine = fmt.Sprintf("Encryption: %s, key derived with %s\n", encryptionCipher, encryptionKDF)
+		hostnameLine = ""
+	}
+
 	info := fmt.Sprintf(`%s BACKUP
 =========================
 Created: %s
-Hostname: %s
-Kernel: %s
+%sKernel: %s
 Architecture: %s
 Backup Type: %s
-
+%s
 %s
 
 To restore:
@@ -1252,9 +1545,11 @@ To restore:
 2. Reboot into the new installation
 3. Connect and mount this backup drive
 4. Run: migrate restore
+5. For system backups, choose to reinstall packages first so /usr and the
+   package database match the restored files (see BACKUP-MANIFEST.json)
 
 The restored system will overwrite the fresh install and boot exactly as it was when backed up.
-`, strings.ToUpper(backupType), time.Now().Format(time.RFC3339), hostname, kernel, arch, backupType, GetBackupInfoHeader(backupType))
+`, strings.ToUpper(backupType), time.Now().Format(time.RFC3339), hostnameLine, kernel, arch, backupType, encryptionLine, GetBackupInfoHeader(backupType))
 
 	infoPath := filepath.Join(mountPoint, "BACKUP-INFO.txt")
 	return os.WriteFile(infoPath, []byte(info), 0644)
@@ -1380,6 +1675,7 @@ func createBackupConfig(operationType, mountPoint string, selectedFolders map[st
 			IsSelectiveBackup: false,
 			SelectedFolders:   nil,
 			HomeFolders:       nil,
+			Format:            backupFormatFor(mountPoint),
 		}
 
 	case "home_backup":
@@ -1399,6 +1695,7 @@ func createBackupConfig(operationType, mountPoint string, selectedFolders map[st
 			IsSelectiveBackup: false,
 			SelectedFolders:   nil,
 			HomeFolders:       nil,
+			Format:            backupFormatFor(mountPoint),
 		}
 
 	case "selective_home_backup":
@@ -1419,12 +1716,19 @@ func createBackupConfig(operationType, mountPoint string, selectedFolders map[st
 			SelectedFolders:    selectedFolders,
 			HomeFolders:        homeFolders,
 			SelectedSubfolders: selectedFolders,
+			Format:             backupFormatFor(mountPoint),
 		}
 
 	default:
 		return BackupConfig{}, fmt.Errorf("unknown backup operation type: %s", operationType)
 	}
 
+	// A drive's mount point is checked again before the backup writes to it
+	config.DestinationDevice = driveMountDevice(mountPoint)
+
+	// A destination directory inside the source must not back itself up
+	config.ExcludePatterns = append(config.ExcludePatterns, nestedDestinationExclusions(config.SourcePath, filepath.Clean(mountPoint))...)
+
 	return config, nil
 }
 
@@ -1489,6 +1793,23 @@ func runVerificationSilently(operationType, mountPoint string) {
 	// Initialize progress tracking like backup operations
 	backupStartTime = time.Now()
 
+	// A remote backup's metadata is read from a local copy
+	remoteDestination := ""
+	if isRemoteDestination(mountPoint) || isObjectStoreDestination(mountPoint) {
+		fetch := fetchRemoteMetadata
+		if isObjectStoreDestination(mountPoint) {
+			fetch = fetchObjectStoreMetadata
+		}
+		staging, err := fetch(mountPoint, logFile)
+		if err != nil {
+			tuiBackupCompleted = true
+			tuiBackupError = fmt.Errorf("cannot read remote backup: %v", err)
+			return
+		}
+		defer os.RemoveAll(staging)
+		remoteDestination, mountPoint = mountPoint, staging
+	}
+
 	// Check if valid backup exists
 	backupInfo := filepath.Join(mountPoint, "BACKUP-INFO.txt")
 	if _, err := os.Stat(backupInfo); os.IsNotExist(err) {
@@ -1580,6 +1901,7 @@ func runVerificationSilently(operationType, mountPoint string) {
 	// Use shared verification exclusions function with runtime directory exclusions for system
 	// Use shared verification exclusions function (no need for additional patterns)
 	excludePatterns = GetVerificationExclusions(backupType, selectiveExclusions)
+	excludePatterns = append(excludePatterns, nestedDestinationExclusions(sourcePath, filepath.Clean(mountPoint))...)
 
 	if logFile != nil {
 		fmt.Fprintf(logFile, "Backup type detected: %s\n", backupType)
@@ -1589,8 +1911,18 @@ func runVerificationSilently(operationType, mountPoint string) {
 		fmt.Fprintf(logFile, "Starting verification...\n")
 	}
 
-	// Perform the actual verification
-	err = performStandaloneVerification(sourcePath, mountPoint, excludePatterns, logFile)
+	// Perform the actual verification (a repository checks its chunks, an archive reads its volumes)
+	if isObjectStoreDestination(remoteDestination) {
+		err = performObjectStoreVerification(remoteDestination, mountPoint, sourcePath, logFile)
+	} else if remoteDestination != "" {
+		err = performRemoteVerification(remoteDestination, sourcePath, excludePatterns, logFile)
+	} else if isRepositoryBackup(mountPoint) {
+		err = performRepositoryVerification(mountPoint, sourcePath, logFile)
+	} else if isArchiveBackup(mountPoint) {
+		err = performArchiveVerification(mountPoint, sourcePath, logFile)
+	} else {
+		err = performStandaloneVerification(sourcePath, mountPoint, excludePatterns, logFile)
+	}
 	if err != nil {
 		if logFile != nil {
 			fmt.Fprintf(logFile, "VERIFICATION ERROR: %v\n", err)
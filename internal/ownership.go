@@ -0,0 +1,281 @@
+// Package internal provides uid/gid remapping for restores onto a different installation.
+//
+// A mirrored backup stores raw numeric owners. On a fresh install the same user
+// may have a different uid, and system groups such as docker or libvirt often get
+// different gids. Restore therefore translates ids by name, using the names
+// recorded in the backup manifest and the account database of the target system,
+// plus any explicit --map-user / --map-group mappings.
+package internal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// NameMapping maps an account name in the backup to an account name on the target.
+type NameMapping struct {
+	From string
+	To   string
+}
+
+var (
+	// explicitUserMappings holds --map-user olduser:newuser options.
+	explicitUserMappings []NameMapping
+
+	// explicitGroupMappings holds --map-group oldgroup:newgroup options.
+	explicitGroupMappings []NameMapping
+
+	// activeOwnership is the id translation of the restore in progress, or nil.
+	activeOwnership *OwnershipMap
+)
+
+// parseNameMapping parses an "old:new" mapping option.
+func parseNameMapping(spec string) (NameMapping, error) {
+	parts := strings.SplitN(spec, ":", 2)
+	if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+		return NameMapping{}, fmt.Errorf("invalid mapping %q (expected old:new)", spec)
+	}
+	return NameMapping{From: parts[0], To: parts[1]}, nil
+}
+
+// AddUserMapping registers an explicit --map-user old:new mapping for restores.
+func AddUserMapping(spec string) error {
+	mapping, err := parseNameMapping(spec)
+	if err != nil {
+		return err
+	}
+	explicitUserMappings = append(explicitUserMappings, mapping)
+	return nil
+}
+
+// AddGroupMapping registers an explicit --map-group old:new mapping for restores.
+func AddGroupMapping(spec string) error {
+	mapping, err := parseNameMapping(spec)
+	if err != nil {
+		return err
+	}
+	explicitGroupMappings = append(explicitGroupMappings, mapping)
+	return nil
+}
+
+// OwnershipMap translates backup uids/gids into target uids/gids.
+type OwnershipMap struct {
+	UIDs map[uint32]uint32
+	GIDs map[uint32]uint32
+
+	preview  []string // Human-readable list of remappings
+	warnings []string // Mappings that could not be resolved
+}
+
+// remapOwner returns the owner to apply to a restored file.
+// Without an active restore mapping the ids are returned unchanged.
+func remapOwner(uid, gid uint32) (int, int) {
+	o := activeOwnership
+	if o == nil {
+		return int(uid), int(gid)
+	}
+	if mapped, ok := o.UIDs[uid]; ok {
+		uid = mapped
+	}
+	if mapped, ok := o.GIDs[gid]; ok {
+		gid = mapped
+	}
+	return int(uid), int(gid)
+}
+
+// ownershipRemapAutomatic reports whether ids should be remapped by name for a
+// restore into targetPath. A complete system restore onto / brings its own
+// /etc/passwd and /etc/group along, so its numeric ids stay consistent and only
+// explicit mappings apply.
+func ownershipRemapAutomatic(backupType, targetPath string) bool {
+	return !(backupType == "system" && targetPath == "/")
+}
+
+// buildOwnershipMap computes the id translation for restoring backupPath onto the
+// running system.
+func buildOwnershipMap(backupPath string, automatic bool) *OwnershipMap {
+	o := &OwnershipMap{
+		UIDs: make(map[uint32]uint32),
+		GIDs: make(map[uint32]uint32),
+	}
+
+	var backupUsers, backupGroups map[uint32]string
+	if manifest, err := loadBackupFacts(backupPath); err == nil {
+		backupUsers, backupGroups = manifest.Users, manifest.Groups
+	} else {
+		// Older system backups still carry their own account database
+		backupUsers, _ = readAccountNames(filepath.Join(backupPath, "etc", "passwd"))
+		backupGroups, _ = readAccountNames(filepath.Join(backupPath, "etc", "group"))
+	}
+	if backupUsers == nil && backupGroups == nil && len(explicitUserMappings)+len(explicitGroupMappings) > 0 {
+		o.warnings = append(o.warnings, "backup has no account names - explicit mappings cannot be resolved")
+	}
+
+	targetUsers, _ := readAccountNames("/etc/passwd")
+	targetGroups, _ := readAccountNames("/etc/group")
+
+	var unmatchedUsers, unmatchedGroups map[uint32]string
+	if automatic {
+		unmatchedUsers = o.matchByName("👤", backupUsers, targetUsers, o.UIDs)
+		unmatchedGroups = o.matchByName("👥", backupGroups, targetGroups, o.GIDs)
+	}
+
+	o.applyExplicit("👤", "--map-user", explicitUserMappings, backupUsers, targetUsers, o.UIDs)
+
+	// With user private groups, olduser:newuser also maps the group of the same name
+	groupMappings := append([]NameMapping(nil), explicitGroupMappings...)
+	for _, mapping := range explicitUserMappings {
+		if hasExplicitGroup(mapping.From) {
+			continue
+		}
+		if idForName(backupGroups, mapping.From) >= 0 && idForName(targetGroups, mapping.To) >= 0 {
+			groupMappings = append(groupMappings, mapping)
+		}
+	}
+	o.applyExplicit("👥", "--map-group", groupMappings, backupGroups, targetGroups, o.GIDs)
+
+	o.warnUnmatched("users", "--map-user", unmatchedUsers, o.UIDs)
+	o.warnUnmatched("groups", "--map-group", unmatchedGroups, o.GIDs)
+
+	sort.Strings(o.preview)
+	return o
+}
+
+// hasExplicitGroup reports whether a --map-group option was given for name.
+func hasExplicitGroup(name string) bool {
+	for _, mapping := range explicitGroupMappings {
+		if mapping.From == name {
+			return true
+		}
+	}
+	return false
+}
+
+// matchByName maps every backup id whose name exists on the target with a
+// different id. It returns the ids whose name does not exist on the target.
+func (o *OwnershipMap) matchByName(icon string, backup, target map[uint32]string, ids map[uint32]uint32) map[uint32]string {
+	unmatched := make(map[uint32]string)
+	for oldID, name := range backup {
+		newID := idForName(target, name)
+		if newID < 0 {
+			unmatched[oldID] = name
+			continue
+		}
+		if uint32(newID) == oldID {
+			continue
+		}
+		ids[oldID] = uint32(newID)
+		o.preview = append(o.preview, fmt.Sprintf("%s %s: %d → %d", icon, name, oldID, newID))
+	}
+	return unmatched
+}
+
+// warnUnmatched warns about backup accounts that neither exist on the target nor
+// have an explicit mapping: files they own keep the raw id, which may belong to
+// someone else here or to nobody.
+func (o *OwnershipMap) warnUnmatched(kind, option string, unmatched map[uint32]string, ids map[uint32]uint32) {
+	var names []string
+	for id, name := range unmatched {
+		if _, mapped := ids[id]; !mapped {
+			names = append(names, fmt.Sprintf("%s (%d)", name, id))
+		}
+	}
+	if len(names) == 0 {
+		return
+	}
+	sort.Strings(names)
+
+	const maxNames = 5
+	list := strings.Join(names, ", ")
+	if len(names) > maxNames {
+		list = fmt.Sprintf("%s and %d more", strings.Join(names[:maxNames], ", "), len(names)-maxNames)
+	}
+	o.warnings = append(o.warnings, fmt.Sprintf("%d %s not on this system keep their raw id: %s (map them with %s)", len(names), kind, list, option))
+}
+
+// applyExplicit resolves explicit name mappings, overriding any automatic match.
+func (o *OwnershipMap) applyExplicit(icon, option string, mappings []NameMapping, backup, target map[uint32]string, ids map[uint32]uint32) {
+	for _, mapping := range mappings {
+		oldID := idForName(backup, mapping.From)
+		if oldID < 0 {
+			o.warnings = append(o.warnings, fmt.Sprintf("%s %s:%s - %s not found in backup", option, mapping.From, mapping.To, mapping.From))
+			continue
+		}
+		newID := idForName(target, mapping.To)
+		if newID < 0 {
+			o.warnings = append(o.warnings, fmt.Sprintf("%s %s:%s - %s does not exist on this system", option, mapping.From, mapping.To, mapping.To))
+			continue
+		}
+
+		// Drop any automatic preview line for the same id
+		prefix := fmt.Sprintf("%s %s: ", icon, mapping.From)
+		kept := o.preview[:0]
+		for _, line := range o.preview {
+			if !strings.HasPrefix(line, prefix) {
+				kept = append(kept, line)
+			}
+		}
+		o.preview = kept
+
+		ids[uint32(oldID)] = uint32(newID)
+		o.preview = append(o.preview, fmt.Sprintf("%s %s (%d) → %s (%d)", icon, mapping.From, oldID, mapping.To, newID))
+	}
+}
+
+// idForName returns the id of name in an id -> name table, or -1.
+func idForName(names map[uint32]string, name string) int64 {
+	for id, n := range names {
+		if n == name {
+			return int64(id)
+		}
+	}
+	return -1
+}
+
+// describe renders the remapping for confirmation screens and the restore log.
+func (o *OwnershipMap) describe() string {
+	if len(o.preview) == 0 && len(o.warnings) == 0 {
+		return ""
+	}
+
+	var s strings.Builder
+	if len(o.preview) > 0 {
+		s.WriteString("Ownership remapping (backup → this system):\n")
+		const maxLines = 8
+		for i, line := range o.preview {
+			if i == maxLines {
+				s.WriteString(fmt.Sprintf("  … and %d more\n", len(o.preview)-maxLines))
+				break
+			}
+			s.WriteString("  " + line + "\n")
+		}
+	}
+	for _, warning := range o.warnings {
+		s.WriteString("⚠️ " + warning + "\n")
+	}
+	return s.String()
+}
+
+// describeOwnershipRemap returns the remapping preview for restoring backupPath,
+// or an empty string when every owner is kept as is.
+func describeOwnershipRemap(backupPath string, automatic bool) string {
+	return buildOwnershipMap(backupPath, automatic).describe()
+}
+
+// activateOwnershipMap installs the id translation for a restore and logs it.
+// The returned function deactivates it again.
+func activateOwnershipMap(backupPath string, automatic bool, logFile *os.File) func() {
+	o := buildOwnershipMap(backupPath, automatic)
+	if logFile != nil {
+		if text := o.describe(); text != "" {
+			fmt.Fprintf(logFile, "%s", text)
+		} else {
+			fmt.Fprintf(logFile, "Ownership: keeping numeric uid/gid from backup\n")
+		}
+	}
+	activeOwnership = o
+	return func() { activeOwnership = nil }
+}
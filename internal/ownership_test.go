@@ -0,0 +1,39 @@
+package internal
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestOwnershipWarnsAboutUnmatchedIDs(t *testing.T) {
+	o := &OwnershipMap{UIDs: make(map[uint32]uint32), GIDs: make(map[uint32]uint32)}
+	backup := map[uint32]string{0: "root", 1000: "alice", 1001: "bob"}
+	target := map[uint32]string{0: "root", 1005: "alice"}
+
+	unmatched := o.matchByName("👤", backup, target, o.UIDs)
+	o.warnUnmatched("users", "--map-user", unmatched, o.UIDs)
+
+	if o.UIDs[1000] != 1005 {
+		t.Fatalf("alice not remapped: %v", o.UIDs)
+	}
+	if len(o.warnings) != 1 || !strings.Contains(o.warnings[0], "bob (1001)") {
+		t.Fatalf("bob's raw uid not reported: %q", o.warnings)
+	}
+	if !strings.Contains(o.describe(), "bob (1001)") {
+		t.Fatal("preview does not show the unmatched uid")
+	}
+}
+
+func TestOwnershipExplicitMappingClearsUnmatchedWarning(t *testing.T) {
+	o := &OwnershipMap{UIDs: make(map[uint32]uint32), GIDs: make(map[uint32]uint32)}
+	backup := map[uint32]string{1001: "bob"}
+	target := map[uint32]string{1002: "robert"}
+
+	unmatched := o.matchByName("👤", backup, target, o.UIDs)
+	o.applyExplicit("👤", "--map-user", []NameMapping{{From: "bob", To: "robert"}}, backup, target, o.UIDs)
+	o.warnUnmatched("users", "--map-user", unmatched, o.UIDs)
+
+	if len(o.warnings) != 0 {
+		t.Fatalf("explicitly mapped account still reported: %q", o.warnings)
+	}
+}
@@ -0,0 +1,304 @@
+// Package internal provides pairing and the encrypted channel for network migrations.
+//
+// The receiving machine shows a short numeric code, which is typed on the
+// sending machine. Both sides run SPAKE2 over edwards25519 with the code as the
+// password: a passive listener learns nothing, and an attacker in the middle
+// gets a single guess per connection attempt instead of an offline search. Each
+// side then proves it derived the same key before anything else is sent, and
+// the connection continues as AES-256-GCM frames, keyed separately per direction
+// with a counter nonce, so frames cannot be altered, replayed or reordered.
+package internal
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"strings"
+	"sync/atomic"
+
+	"filippo.io/edwards25519"
+)
+
+const (
+	// pairingMagic opens every connection, so a stray client is turned away early.
+	pairingMagic = "MIGRATE-PAIR-1\n"
+
+	// pairingCodeDigits is the length of a pairing code.
+	pairingCodeDigits = 8
+
+	// maxFramePayload is the largest payload of one encrypted frame.
+	maxFramePayload = 1024 * 1024
+)
+
+// errPairingFailed means the other side derived a different key: the codes differ.
+var errPairingFailed = errors.New("pairing failed: the code does not match the one shown on the receiving machine")
+
+// spakeM and spakeN are the SPAKE2 blinding points. They are hashed to the
+// curve from fixed strings, so nobody knows their discrete logarithms.
+var spakeM, spakeN = hashToPoint("migrate SPAKE2 M"), hashToPoint("migrate SPAKE2 N")
+
+// hashToPoint maps a label to a point of the prime-order subgroup.
+func hashToPoint(label string) *edwards25519.Point {
+	for counter := 0; ; counter++ {
+		h := sha512.Sum512([]byte(fmt.Sprintf("%s %d", label, counter)))
+		p, err := new(edwards25519.Point).SetBytes(h[:32])
+		if err != nil {
+			continue
+		}
+		p.MultByCofactor(p)
+		if p.Equal(edwards25519.NewIdentityPoint()) == 0 {
+			return p
+		}
+	}
+}
+
+// newPairingCode returns a random code such as "4821-0937".
+func newPairingCode() (string, error) {
+	limit := new(big.Int).Exp(big.NewInt(10), big.NewInt(pairingCodeDigits), nil)
+	n, err := rand.Int(rand.Reader, limit)
+	if err != nil {
+		return "", err
+	}
+	digits := fmt.Sprintf("%0*d", pairingCodeDigits, n)
+	return digits[:4] + "-" + digits[4:], nil
+}
+
+// normalizePairingCode keeps the digits of a typed code.
+func normalizePairingCode(code string) (string, error) {
+	var digits strings.Builder
+	for _, r := range code {
+		switch {
+		case r >= '0' && r <= '9':
+			digits.WriteRune(r)
+		case r == '-' || r == ' ':
+		default:
+			return "", fmt.Errorf("pairing codes only contain digits")
+		}
+	}
+	if digits.Len() != pairingCodeDigits {
+		return "", fmt.Errorf("pairing codes have %d digits", pairingCodeDigits)
+	}
+	return digits.String(), nil
+}
+
+// secureChannel sends and receives encrypted frames over a paired connection.
+type secureChannel struct {
+	rw       io.ReadWriter
+	send     cipher.AEAD
+	recv     cipher.AEAD
+	sendSeq  uint64
+	recvSeq  uint64
+	sent     int64 // Payload bytes sent
+	received int64 // Payload bytes received
+}
+
+// pairConnection runs the pairing handshake. The sender initiates; the
+// receiver answers and checks the sender's proof first, so a wrong code costs
+// the attacker the connection without learning whether the receiver's key matched.
+func pairConnection(rw io.ReadWriter, code string, initiator bool) (*secureChannel, error) {
+	digits, err := normalizePairingCode(code)
+	if err != nil {
+		return nil, err
+	}
+	wHash := sha512.Sum512([]byte("migrate pairing code " + digits))
+	w, err := edwards25519.NewScalar().SetUniformBytes(wHash[:])
+	if err != nil {
+		return nil, err
+	}
+
+	var seed [64]byte
+	if _, err := rand.Read(seed[:]); err != nil {
+		return nil, err
+	}
+	x, err := edwards25519.NewScalar().SetUniformBytes(seed[:])
+	if err != nil {
+		return nil, err
+	}
+
+	// Own share: x*G + w*M (sender) or x*G + w*N (receiver)
+	own, other := spakeM, spakeN
+	if !initiator {
+		own, other = spakeN, spakeM
+	}
+	share := new(edwards25519.Point).ScalarBaseMult(x)
+	share.Add(share, new(edwards25519.Point).ScalarMult(w, own))
+
+	var peerBytes [32]byte
+	if initiator {
+		if _, err := io.WriteString(rw, pairingMagic); err != nil {
+			return nil, err
+		}
+		if _, err := rw.Write(share.Bytes()); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(rw, peerBytes[:]); err != nil {
+			return nil, fmt.Errorf("no answer from the receiving machine: %v", err)
+		}
+	} else {
+		magic := make([]byte, len(pairingMagic))
+		if _, err := io.ReadFull(rw, magic); err != nil || string(magic) != pairingMagic {
+			return nil, fmt.Errorf("not a Migrate sender")
+		}
+		if _, err := io.ReadFull(rw, peerBytes[:]); err != nil {
+			return nil, err
+		}
+		if _, err := rw.Write(share.Bytes()); err != nil {
+			return nil, err
+		}
+	}
+
+	peer, err := new(edwards25519.Point).SetBytes(peerBytes[:])
+	if err != nil {
+		return nil, fmt.Errorf("invalid pairing message")
+	}
+	// K = 8*x*(peer - w*other)
+	k := new(edwards25519.Point).Subtract(peer, new(edwards25519.Point).ScalarMult(w, other))
+	k.ScalarMult(x, k)
+	k.MultByCofactor(k)
+	if k.Equal(edwards25519.NewIdentityPoint()) == 1 {
+		return nil, fmt.Errorf("invalid pairing message")
+	}
+
+	// The transcript binds both shares in sender, receiver order
+	senderShare, receiverShare := share.Bytes(), peerBytes[:]
+	if !initiator {
+		senderShare, receiverShare = peerBytes[:], share.Bytes()
+	}
+	transcript := sha256.New()
+	transcript.Write([]byte(pairingMagic))
+	transcript.Write(senderShare)
+	transcript.Write(receiverShare)
+	transcript.Write(k.Bytes())
+	transcript.Write(w.Bytes())
+	secret := transcript.Sum(nil)
+
+	derive := func(purpose string) []byte {
+		key, _ := hkdf.Key(sha256.New, secret, nil, "migrate "+purpose, 32)
+		return key
+	}
+	confirm := func(purpose string) []byte {
+		mac := hmac.New(sha256.New, derive(purpose))
+		mac.Write(senderShare)
+		mac.Write(receiverShare)
+		return mac.Sum(nil)
+	}
+
+	// Key confirmation: the sender proves itself first
+	senderProof, receiverProof := confirm("sender confirmation"), confirm("receiver confirmation")
+	proof := make([]byte, sha256.Size)
+	if initiator {
+		if _, err := rw.Write(senderProof); err != nil {
+			return nil, err
+		}
+		if _, err := io.ReadFull(rw, proof); err != nil || !hmac.Equal(proof, receiverProof) {
+			return nil, errPairingFailed
+		}
+	} else {
+		if _, err := io.ReadFull(rw, proof); err != nil {
+			return nil, err
+		}
+		if !hmac.Equal(proof, senderProof) {
+			return nil, errPairingFailed
+		}
+		if _, err := rw.Write(receiverProof); err != nil {
+			return nil, err
+		}
+	}
+
+	toReceiver, err := newFrameCipher(derive("sender to receiver"))
+	if err != nil {
+		return nil, err
+	}
+	toSender, err := newFrameCipher(derive("receiver to sender"))
+	if err != nil {
+		return nil, err
+	}
+	if initiator {
+		return &secureChannel{rw: rw, send: toReceiver, recv: toSender}, nil
+	}
+	return &secureChannel{rw: rw, send: toSender, recv: toReceiver}, nil
+}
+
+func newFrameCipher(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// frameNonce is the nonce of frame number seq.
+func frameNonce(seq uint64) []byte {
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], seq)
+	return nonce
+}
+
+// writeFrame sends a typed payload as one encrypted frame.
+func (c *secureChannel) writeFrame(kind byte, payload []byte) error {
+	if len(payload) > maxFramePayload {
+		return fmt.Errorf("frame too large")
+	}
+	plain := append([]byte{kind}, payload...)
+	sealed := c.send.Seal(nil, frameNonce(c.sendSeq), plain, nil)
+	c.sendSeq++
+
+	header := make([]byte, 4)
+	binary.BigEndian.PutUint32(header, uint32(len(sealed)))
+	if _, err := c.rw.Write(append(header, sealed...)); err != nil {
+		return err
+	}
+	atomic.AddInt64(&c.sent, int64(len(payload)))
+	return nil
+}
+
+// readFrame receives the next frame.
+func (c *secureChannel) readFrame() (byte, []byte, error) {
+	header := make([]byte, 4)
+	if _, err := io.ReadFull(c.rw, header); err != nil {
+		return 0, nil, err
+	}
+	size := binary.BigEndian.Uint32(header)
+	if size > maxFramePayload+1+uint32(c.recv.Overhead()) || size < 1+uint32(c.recv.Overhead()) {
+		return 0, nil, fmt.Errorf("invalid frame size %d", size)
+	}
+	sealed := make([]byte, size)
+	if _, err := io.ReadFull(c.rw, sealed); err != nil {
+		return 0, nil, err
+	}
+	plain, err := c.recv.Open(sealed[:0], frameNonce(c.recvSeq), sealed, nil)
+	if err != nil {
+		return 0, nil, fmt.Errorf("frame failed authentication")
+	}
+	c.recvSeq++
+	atomic.AddInt64(&c.received, int64(len(plain)-1))
+	return plain[0], plain[1:], nil
+}
+
+// frameWriter sends everything written to it as frames of one kind.
+type frameWriter struct {
+	channel *secureChannel
+	kind    byte
+}
+
+func (w frameWriter) Write(p []byte) (int, error) {
+	total := 0
+	for len(p) > 0 {
+		n := min(len(p), maxFramePayload)
+		if err := w.channel.writeFrame(w.kind, p[:n]); err != nil {
+			return total, err
+		}
+		total += n
+		p = p[n:]
+	}
+	return total, nil
+}
@@ -0,0 +1,166 @@
+package internal
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+)
+
+// pairOverLoopback pairs a sender and a receiver over a TCP connection on the
+// loopback interface and returns both ends' results.
+func pairOverLoopback(t *testing.T, senderCode, receiverCode string) (sender, receiver *secureChannel, senderErr, receiverErr error) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	type result struct {
+		channel *secureChannel
+		err     error
+	}
+	accepted := make(chan result, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			accepted <- result{err: err}
+			return
+		}
+		t.Cleanup(func() { conn.Close() })
+		channel, err := pairConnection(conn, receiverCode, false)
+		if err != nil {
+			// The sender waits for a proof that will never come
+			conn.Close()
+		}
+		accepted <- result{channel, err}
+	}()
+
+	conn, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	sender, senderErr = pairConnection(conn, senderCode, true)
+	r := <-accepted
+	return sender, r.channel, senderErr, r.err
+}
+
+func TestPairingLoopbackExchangesFrames(t *testing.T) {
+	code, err := newPairingCode()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The sender types the code without the dash
+	sender, receiver, senderErr, receiverErr := pairOverLoopback(t, code[:4]+code[5:], code)
+	if senderErr != nil || receiverErr != nil {
+		t.Fatalf("pairing with the same code failed: sender %v, receiver %v", senderErr, receiverErr)
+	}
+
+	big := bytes.Repeat([]byte("payload "), maxFramePayload/4) // Two frames
+	done := make(chan error, 1)
+	go func() {
+		if err := sender.writeFrame(1, []byte("header")); err != nil {
+			done <- err
+			return
+		}
+		_, err := frameWriter{channel: sender, kind: 2}.Write(big)
+		done <- err
+	}()
+
+	kind, payload, err := receiver.readFrame()
+	if err != nil || kind != 1 || string(payload) != "header" {
+		t.Fatalf("first frame: kind %d, %q, %v", kind, payload, err)
+	}
+	var received []byte
+	for len(received) < len(big) {
+		kind, payload, err := receiver.readFrame()
+		if err != nil || kind != 2 {
+			t.Fatalf("data frame: kind %d, %v", kind, err)
+		}
+		received = append(received, payload...)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(received, big) {
+		t.Fatal("data frames do not add up to what was sent")
+	}
+
+	// And back, with the other direction's key
+	go func() { done <- receiver.writeFrame(3, []byte("done")) }()
+	if kind, payload, err := sender.readFrame(); err != nil || kind != 3 || string(payload) != "done" {
+		t.Fatalf("reply frame: kind %d, %q, %v", kind, payload, err)
+	}
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestPairingWithWrongCodeFails(t *testing.T) {
+	sender, receiver, senderErr, receiverErr := pairOverLoopback(t, "1234-5678", "1234-5679")
+	if sender != nil || receiver != nil {
+		t.Fatal("pairing with different codes produced a channel")
+	}
+	if !errors.Is(receiverErr, errPairingFailed) {
+		t.Fatalf("receiver: %v, want a pairing failure", receiverErr)
+	}
+	if !errors.Is(senderErr, errPairingFailed) {
+		t.Fatalf("sender: %v, want a pairing failure", senderErr)
+	}
+}
+
+func TestPairingRejectsStrayClient(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	go client.Write([]byte("GET / HTTP/1.1\r\n\r\n"))
+
+	if _, err := pairConnection(server, "1234-5678", false); err == nil {
+		t.Fatal("a connection without the pairing greeting was accepted")
+	}
+	server.Close()
+}
+
+func TestSecureChannelRejectsTamperedAndReplayedFrames(t *testing.T) {
+	sender, receiver, senderErr, receiverErr := pairOverLoopback(t, "2468-1357", "2468-1357")
+	if senderErr != nil || receiverErr != nil {
+		t.Fatalf("pairing failed: %v, %v", senderErr, receiverErr)
+	}
+
+	// Frames go through a buffer here, so they can be altered on the way
+	var wire bytes.Buffer
+	sender.rw, receiver.rw = &wire, &wire
+
+	sender.writeFrame(1, []byte("first"))
+	frame := append([]byte(nil), wire.Bytes()...)
+	if _, payload, err := receiver.readFrame(); err != nil || string(payload) != "first" {
+		t.Fatalf("untouched frame: %q, %v", payload, err)
+	}
+
+	wire.Write(frame)
+	if _, _, err := receiver.readFrame(); err == nil {
+		t.Fatal("a replayed frame was accepted")
+	}
+
+	receiver.recvSeq = sender.sendSeq
+	sender.writeFrame(1, []byte("second"))
+	tampered := wire.Bytes()
+	tampered[len(tampered)-1] ^= 1
+	if _, _, err := receiver.readFrame(); err == nil {
+		t.Fatal("an altered frame was accepted")
+	}
+}
+
+func TestNormalizePairingCode(t *testing.T) {
+	for code, want := range map[string]string{"4821-0937": "48210937", "4821 0937": "48210937", "48210937": "48210937"} {
+		if got, err := normalizePairingCode(code); err != nil || got != want {
+			t.Errorf("normalizePairingCode(%q) = %q, %v", code, got, err)
+		}
+	}
+	for _, code := range []string{"4821-093", "4821-09371", "4821-O937", ""} {
+		if _, err := normalizePairingCode(code); err == nil {
+			t.Errorf("normalizePairingCode(%q) accepted", code)
+		}
+	}
+}
@@ -0,0 +1,152 @@
+// Package internal provides the passphrase prompt for encrypted repository backups.
+package internal
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"migrate/internal/screens"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+// PassphraseChecked reports whether an entered passphrase unlocked the backup.
+type PassphraseChecked struct {
+	err error
+}
+
+// checkPassphraseCmd derives the key in the background, since argon2id takes a moment.
+func checkPassphraseCmd(mountPoint, passphrase string) tea.Cmd {
+	return func() tea.Msg {
+		return PassphraseChecked{err: checkBackupPassphrase(mountPoint, passphrase)}
+	}
+}
+
+// startPassphraseEntry switches to the passphrase screen; the confirmed operation
+// resumes once the passphrase is accepted.
+func (m Model) startPassphraseEntry(create bool) Model {
+	m.passphrase = ""
+	m.passphraseFirst = ""
+	m.passphraseCreate = create
+	m.passphraseChecking = false
+	m.passphraseError = ""
+	m.screen = screens.ScreenPassphrase
+	return m
+}
+
+// handlePassphraseKey edits the masked passphrase field.
+func (m Model) handlePassphraseKey(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	if m.passphraseChecking {
+		return m, nil
+	}
+
+	switch msg.Type {
+	case tea.KeyEsc, tea.KeyCtrlC:
+		// Back to the confirmation, where the operation can be canceled
+		m.passphrase = ""
+		m.passphraseFirst = ""
+		m.passphraseError = ""
+		m.screen = screens.ScreenConfirm
+		m.cursor = 1
+		return m, nil
+
+	case tea.KeyEnter:
+		if m.passphrase == "" {
+			m.passphraseError = "Please enter a passphrase"
+			return m, nil
+		}
+		if m.passphraseCreate {
+			if m.passphraseFirst == "" {
+				if utf8.RuneCountInString(m.passphrase) < minPassphraseLength {
+					m.passphraseError = fmt.Sprintf("Use at least %d characters", minPassphraseLength)
+					m.passphrase = ""
+					return m, nil
+				}
+				m.passphraseFirst = m.passphrase
+				m.passphrase = ""
+				m.passphraseError = ""
+				return m, nil
+			}
+			if m.passphrase != m.passphraseFirst {
+				m.passphraseError = "The passphrases did not match, please start again"
+				m.passphrase = ""
+				m.passphraseFirst = ""
+				return m, nil
+			}
+		}
+		m.passphraseChecking = true
+		m.passphraseError = ""
+		return m, checkPassphraseCmd(m.selectedDrive, m.passphrase)
+	}
+
+	m.typePassphrase(msg)
+	return m, nil
+}
+
+// typePassphrase applies a typed key to the masked passphrase field.
+func (m *Model) typePassphrase(msg tea.KeyMsg) {
+	switch msg.Type {
+	case tea.KeyBackspace:
+		if m.passphrase != "" {
+			_, size := utf8.DecodeLastRuneInString(m.passphrase)
+			m.passphrase = m.passphrase[:len(m.passphrase)-size]
+		}
+
+	case tea.KeySpace:
+		m.passphrase += " "
+
+	case tea.KeyRunes:
+		m.passphrase += string(msg.Runes)
+	}
+}
+
+// handlePassphraseChecked resumes the confirmed operation, or asks again.
+func (m Model) handlePassphraseChecked(msg PassphraseChecked) (tea.Model, tea.Cmd) {
+	m.passphraseChecking = false
+	m.passphrase = ""
+	m.passphraseFirst = ""
+	if msg.err != nil {
+		m.passphraseError = "❌ " + msg.err.Error()
+		return m, nil
+	}
+	m.passphraseError = ""
+	m.screen = screens.ScreenConfirm
+	m.cursor = 0
+	return m.handleSelection()
+}
+
+// renderPassphrase renders the masked passphrase prompt.
+func (m Model) renderPassphrase() string {
+	var s strings.Builder
+
+	ascii := asciiStyle.Render(MigrateASCII)
+	s.WriteString(ascii + "\n")
+	s.WriteString(titleStyle.Render("🔐 Backup Passphrase") + "\n\n")
+
+	var prompt string
+	switch {
+	case m.passphraseCreate && m.passphraseFirst == "":
+		prompt = fmt.Sprintf("Choose a passphrase for the encrypted backup on %s.\nWithout it the backup cannot be restored - there is no recovery.", m.selectedDrive)
+	case m.passphraseCreate:
+		prompt = "Enter the passphrase again to confirm."
+	default:
+		prompt = fmt.Sprintf("The backup on %s is encrypted.\nEnter its passphrase.", m.selectedDrive)
+	}
+	s.WriteString(infoStyle.Render(prompt) + "\n\n")
+
+	masked := strings.Repeat("•", utf8.RuneCountInString(m.passphrase))
+	s.WriteString(selectedMenuItemStyle.Render("🔑 "+masked+"▏") + "\n")
+
+	if m.passphraseChecking {
+		s.WriteString("\n" + infoStyle.Render("Deriving key...") + "\n")
+	} else if m.passphraseError != "" {
+		s.WriteString("\n" + warningStyle.Render(m.passphraseError) + "\n")
+	}
+
+	help := helpStyle.Render("enter: confirm • esc: cancel")
+	s.WriteString("\n" + help)
+
+	content := borderStyle.Width(safeRenderWidth(m.width)).Render(s.String())
+	return safeCenterContent(m.width, m.height, content)
+}
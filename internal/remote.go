@@ -0,0 +1,604 @@
+// Package internal provides backups to remote destinations through a Store.
+//
+// A remote backup keeps the same layout as a drive, with the mirror in a
+// subdirectory so snapshots can sit next to it:
+//
+//	BACKUP-INFO.txt, BACKUP-MANIFEST.json, BACKUP-FOLDERS.txt
+//	current/              the tree, synced with the same exclusions and --delete rules
+//	snapshots/<time>/     hard-linked copies of current/ after each successful backup
+//
+// Changed files are uploaded under a temporary name and renamed into place, so
+// a file in a snapshot is never modified by a later backup.
+package internal
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	remoteCurrentDir   = "current"
+	remoteSnapshotsDir = "snapshots"
+
+	// remoteSnapshotsKept is how many snapshots a backup leaves on the server
+	remoteSnapshotsKept = 7
+)
+
+// remoteMetadataFiles are the backup's metadata files at the root of a remote destination.
+var remoteMetadataFiles = []string{"BACKUP-INFO.txt", backupManifestFile, "BACKUP-FOLDERS.txt"}
+
+// remoteUpload is a file uploaded by this run and the hash of what was sent.
+type remoteUpload struct {
+	rel  string
+	path string
+	hash []byte
+}
+
+// performRemoteBackupPhases connects to a remote destination and backs up to it.
+func performRemoteBackupPhases(destination string, config BackupConfig, logFile *os.File) error {
+	if config.Format != "" && config.Format != BackupFormatMirror {
+		return fmt.Errorf("remote destinations hold mirror backups: --format %s is not supported there", config.Format)
+	}
+
+	store, err := openRemoteStore(destination, logFile)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	return backupToStore(store, config, logFile)
+}
+
+// backupToStore uploads the metadata staged in config.DestinationPath, syncs the
+// source into current/, deletes what the source no longer has, optionally reads
+// the uploads back, and takes a snapshot.
+func backupToStore(store Store, config BackupConfig, logFile *os.File) error {
+	if err := store.MkdirAll(remoteCurrentDir, 0755); err != nil {
+		return fmt.Errorf("cannot create %s on the server: %v", remoteCurrentDir, err)
+	}
+	for _, name := range remoteMetadataFiles {
+		data, err := os.ReadFile(filepath.Join(config.DestinationPath, name))
+		if err != nil {
+			continue
+		}
+		if err := writeStoreFile(store, name, data, 0644); err != nil {
+			return fmt.Errorf("failed to upload %s: %v", name, err)
+		}
+	}
+
+	// Phase 1: sync
+	uploads, err := syncToStore(config, store, remoteCurrentDir, logFile)
+	if err != nil {
+		if logFile != nil {
+			fmt.Fprintf(logFile, "ERROR during remote sync: %v\n", err)
+		}
+		return err
+	}
+	syncPhaseComplete = true
+
+	// Phase 2: delete files the source no longer has
+	deletionPhaseActive = true
+	if err := deleteExtraFromStore(config, store, remoteCurrentDir, logFile); err != nil {
+		return fmt.Errorf("deletion phase failed: %v", err)
+	}
+	deletionPhaseActive = false
+
+	// Phase 3: read back what was sent
+	if EnableVerification {
+		if err := verifyRemoteUploads(store, remoteCurrentDir, uploads, logFile); err != nil {
+			return fmt.Errorf("verification phase failed: %v", err)
+		}
+	}
+
+	// Phase 4: snapshot (a server without hard links keeps only current/)
+	if err := createRemoteSnapshot(store, logFile); err != nil {
+		if logFile != nil {
+			fmt.Fprintf(logFile, "Warning: no snapshot taken: %v\n", err)
+		}
+	}
+
+	if logFile != nil {
+		logContentRecopies(logFile)
+		fmt.Fprintf(logFile, "Remote backup to %s completed successfully\n", store)
+	}
+	return nil
+}
+
+// syncToStore makes dir in store a copy of the backup source. A file is
+// uploaded again when its size, mtime (to the second, as SFTP keeps it), mode
+// or owner differ; anything else is skipped.
+func syncToStore(config BackupConfig, store Store, dir string, logFile *os.File) ([]remoteUpload, error) {
+	// The remote tree first, in one pass
+	remote := make(map[string]os.FileInfo)
+	err := walkStore(store, dir, func(name string, info os.FileInfo) error {
+		rel := strings.TrimPrefix(strings.TrimPrefix(name, dir), "/")
+		if rel != "" {
+			remote[rel] = info
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("cannot list %s on the server: %v", dir, err)
+	}
+
+	var dirs, others []repositoryJob
+	var rootEntry *TreeEntry
+	err = walkBackupSource(config, logFile, func(path, rel string, d os.DirEntry, info os.FileInfo) error {
+		if rel == "." {
+			rootEntry = treeEntryFor(".", info)
+			return nil
+		}
+		entry := treeEntryFor(filepath.ToSlash(rel), info)
+		entry.Size = info.Size()
+		if d.IsDir() {
+			dirs = append(dirs, repositoryJob{path: path, entry: entry})
+		} else {
+			others = append(others, repositoryJob{path: path, entry: entry})
+			atomic.AddInt64(&totalFilesFound, 1)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	directoryWalkComplete = true
+
+	// Directories first, so files have somewhere to go
+	for _, job := range dirs {
+		if shouldCancelBackup() {
+			return nil, fmt.Errorf("operation canceled")
+		}
+		name := path.Join(dir, job.entry.Path)
+		if info, ok := remote[job.entry.Path]; ok && !info.IsDir() {
+			if err := store.RemoveAll(name); err != nil {
+				return nil, fmt.Errorf("cannot replace %s: %v", name, err)
+			}
+		}
+		if err := store.MkdirAll(name, 0700); err != nil {
+			return nil, fmt.Errorf("cannot create %s: %v", name, err)
+		}
+	}
+
+	// Owners are kept only when the server lets this login change them (usually as root);
+	// otherwise they are not compared either, or every file would look changed
+	keepOwners := rootEntry != nil && store.Lchown(dir, int(rootEntry.UID), int(rootEntry.GID)) == nil
+	if !keepOwners && logFile != nil {
+		fmt.Fprintf(logFile, "Remote login cannot change file owners: owners are not kept on %s\n", store)
+	}
+
+	var mu sync.Mutex
+	var uploads []remoteUpload
+	workers := newRepositoryWorkers(func(job repositoryJob) error {
+		entry := job.entry
+		name := path.Join(dir, entry.Path)
+		existing, exists := remote[entry.Path]
+		if exists && remoteEntryCurrent(store, name, job.path, existing, entry, keepOwners) {
+			atomic.AddInt64(&filesSkipped, 1)
+			return nil
+		}
+		if exists && existing.IsDir() {
+			if err := store.RemoveAll(name); err != nil {
+				return fmt.Errorf("cannot replace %s: %v", name, err)
+			}
+		}
+
+		if entry.Mode&os.ModeSymlink != 0 {
+			target, err := os.Readlink(job.path)
+			if err != nil {
+				return nil // Vanished since the walk
+			}
+			if exists {
+				store.Remove(name)
+			}
+			if err := store.Symlink(target, name); err != nil {
+				return fmt.Errorf("cannot create symlink %s: %v", name, err)
+			}
+			if keepOwners {
+				store.Lchown(name, int(entry.UID), int(entry.GID))
+			}
+			atomic.AddInt64(&filesCopied, 1)
+			return nil
+		}
+
+		f, err := os.Open(job.path)
+		if err != nil {
+			if logFile != nil {
+				fmt.Fprintf(logFile, "Skipping unreadable file %s: %v\n", job.path, err)
+			}
+			atomic.AddInt64(&filesSkipped, 1)
+			return nil
+		}
+		hash, err := uploadToStore(store, f, name, entry, keepOwners)
+		f.Close()
+		if err != nil {
+			if isSpaceError(err) {
+				return fmt.Errorf("🚨 OUT OF SPACE on the server while uploading %s", job.path)
+			}
+			return fmt.Errorf("failed to upload %s: %v", job.path, err)
+		}
+		mu.Lock()
+		uploads = append(uploads, remoteUpload{rel: entry.Path, path: job.path, hash: hash})
+		mu.Unlock()
+		copiedFilesListMutex.Lock()
+		copiedFilesList = append(copiedFilesList, job.path)
+		copiedFilesListMutex.Unlock()
+		atomic.AddInt64(&filesCopied, 1)
+		return nil
+	})
+	for _, job := range others {
+		workers.jobs <- job
+	}
+	if err := workers.finish(); err != nil {
+		return nil, err
+	}
+	if shouldCancelBackup() {
+		return nil, fmt.Errorf("operation canceled")
+	}
+
+	// Directory metadata last, deepest first, so adding files does not change it again
+	for i := len(dirs) - 1; i >= 0; i-- {
+		entry := dirs[i].entry
+		name := path.Join(dir, entry.Path)
+		store.Chmod(name, entry.Mode.Perm())
+		if keepOwners {
+			store.Lchown(name, int(entry.UID), int(entry.GID))
+		}
+		store.Chtimes(name, time.Unix(0, entry.MtimeNs))
+	}
+	return uploads, nil
+}
+
+// remoteEntryCurrent reports whether the remote copy of a source file or symlink is up to date.
+func remoteEntryCurrent(store Store, name, localPath string, remote os.FileInfo, entry *TreeEntry, keepOwners bool) bool {
+	if remote.Mode().Type() != entry.Mode.Type() {
+		return false
+	}
+	if uid, gid, ok := fileOwner(remote); ok && keepOwners && (uid != entry.UID || gid != entry.GID) {
+		return false
+	}
+	if entry.Mode&os.ModeSymlink != 0 {
+		target, err := store.Readlink(name)
+		local, lerr := os.Readlink(localPath)
+		return err == nil && lerr == nil && target == local
+	}
+	return remote.Size() == entry.Size &&
+		remote.Mode().Perm() == entry.Mode.Perm() &&
+		remote.ModTime().Unix() == time.Unix(0, entry.MtimeNs).Unix()
+}
+
+// uploadToStore copies an open local file to name and returns the sha256 of what was sent.
+func uploadToStore(store Store, f *os.File, name string, entry *TreeEntry, keepOwners bool) ([]byte, error) {
+	w, err := store.Create(name, entry.Mode.Perm())
+	if err != nil {
+		return nil, err
+	}
+	hasher := sha256.New()
+	if _, err := io.Copy(w, io.TeeReader(throttledReader{f}, hasher)); err != nil {
+		w.Abort()
+		return nil, err
+	}
+	if err := w.Commit(); err != nil {
+		return nil, err
+	}
+	if keepOwners {
+		store.Lchown(name, int(entry.UID), int(entry.GID))
+	}
+	store.Chtimes(name, time.Unix(0, entry.MtimeNs))
+	return hasher.Sum(nil), nil
+}
+
+// deleteExtraFromStore removes everything under dir that the source no longer
+// has. Excluded paths are kept, as in deleteExtraFilesFromBackupWithExclusions.
+func deleteExtraFromStore(config BackupConfig, store Store, dir string, logFile *os.File) error {
+	return walkStore(store, dir, func(name string, info os.FileInfo) error {
+		if shouldCancelBackup() {
+			return fmt.Errorf("operation canceled")
+		}
+		rel := strings.TrimPrefix(strings.TrimPrefix(name, dir), "/")
+		if rel == "" {
+			return nil
+		}
+		sourcePath := filepath.Join(config.SourcePath, filepath.FromSlash(rel))
+		if isExcludedFromBackup(config, sourcePath) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		local, err := os.Lstat(sourcePath)
+		if err == nil && local.IsDir() == info.IsDir() {
+			return nil
+		}
+		if err := store.RemoveAll(name); err != nil {
+			return fmt.Errorf("cannot delete %s: %v", name, err)
+		}
+		atomic.AddInt64(&filesDeleted, 1)
+		if logFile != nil {
+			fmt.Fprintf(logFile, "Deleted from remote backup: %s\n", rel)
+		}
+		if info.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+}
+
+// hashStoreFile returns the sha256 of a file in a store.
+func hashStoreFile(store Store, name string) ([]byte, error) {
+	r, err := store.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return hashContent(r)
+}
+
+// verifyRemoteUploads reads every file uploaded by this run back from the server.
+func verifyRemoteUploads(store Store, dir string, uploads []remoteUpload, logFile *os.File) error {
+	verificationPhaseActive = true
+	defer func() { verificationPhaseActive = false }()
+
+	failed := 0
+	for _, upload := range uploads {
+		if shouldCancelBackup() {
+			return fmt.Errorf("operation canceled")
+		}
+		hash, err := hashStoreFile(store, path.Join(dir, upload.rel))
+		atomic.AddInt64(&totalFilesVerified, 1)
+		if err != nil || !bytes.Equal(hash, upload.hash) {
+			failed++
+			verificationErrors = append(verificationErrors, fmt.Sprintf("Upload differs on the server: %s", upload.path))
+			if logFile != nil {
+				fmt.Fprintf(logFile, "Remote verification error: %s (%v)\n", upload.path, err)
+			}
+		}
+	}
+	if logFile != nil {
+		fmt.Fprintf(logFile, "Remote verification: %d uploads read back, %d errors\n", len(uploads), failed)
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d uploaded files differ on the server", failed)
+	}
+	return nil
+}
+
+// createRemoteSnapshot hard-links current/ into snapshots/<time>/ and removes
+// the oldest snapshots beyond remoteSnapshotsKept.
+func createRemoteSnapshot(store Store, logFile *os.File) error {
+	// A second backup within the same second gets its own snapshot rather
+	// than failing into, and then removing, the first one
+	base := path.Join(remoteSnapshotsDir, time.Now().Format("2006-01-02T150405"))
+	name := base
+	for i := 2; ; i++ {
+		if _, err := store.Lstat(name); err != nil {
+			break
+		}
+		name = fmt.Sprintf("%s-%d", base, i)
+	}
+	if err := store.MkdirAll(name, 0755); err != nil {
+		return err
+	}
+
+	type dirMeta struct {
+		name string
+		info os.FileInfo
+	}
+	var dirs []dirMeta
+	err := walkStore(store, remoteCurrentDir, func(current string, info os.FileInfo) error {
+		if shouldCancelBackup() {
+			return fmt.Errorf("operation canceled")
+		}
+		snapshot := path.Join(name, strings.TrimPrefix(current, remoteCurrentDir))
+		switch {
+		case info.IsDir():
+			dirs = append(dirs, dirMeta{snapshot, info})
+			return store.MkdirAll(snapshot, 0700)
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := store.Readlink(current)
+			if err != nil {
+				return err
+			}
+			return store.Symlink(target, snapshot)
+		default:
+			return store.Link(current, snapshot)
+		}
+	})
+	if err != nil {
+		store.RemoveAll(name)
+		return err
+	}
+	for i := len(dirs) - 1; i >= 0; i-- {
+		store.Chmod(dirs[i].name, dirs[i].info.Mode().Perm())
+		if uid, gid, ok := fileOwner(dirs[i].info); ok {
+			store.Lchown(dirs[i].name, int(uid), int(gid))
+		}
+		store.Chtimes(dirs[i].name, dirs[i].info.ModTime())
+	}
+	if logFile != nil {
+		fmt.Fprintf(logFile, "Remote snapshot created: %s\n", name)
+	}
+
+	snapshots, err := store.ReadDir(remoteSnapshotsDir)
+	if err != nil {
+		return nil
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].Name() < snapshots[j].Name() })
+	for i := 0; i < len(snapshots)-remoteSnapshotsKept; i++ {
+		old := path.Join(remoteSnapshotsDir, snapshots[i].Name())
+		if err := store.RemoveAll(old); err != nil && logFile != nil {
+			fmt.Fprintf(logFile, "Warning: could not remove old snapshot %s: %v\n", old, err)
+		} else if logFile != nil {
+			fmt.Fprintf(logFile, "Removed old remote snapshot: %s\n", old)
+		}
+	}
+	return nil
+}
+
+// fetchRemoteMetadata copies a remote backup's metadata files into a new local
+// directory, so backup type detection and folder lists work as on a drive.
+func fetchRemoteMetadata(destination string, logFile *os.File) (string, error) {
+	store, err := openRemoteStore(destination, logFile)
+	if err != nil {
+		return "", err
+	}
+	defer store.Close()
+
+	staging, err := os.MkdirTemp("", "migrate-remote-")
+	if err != nil {
+		return "", err
+	}
+	for _, name := range remoteMetadataFiles {
+		if data, err := readStoreFile(store, name); err == nil {
+			os.WriteFile(filepath.Join(staging, name), data, 0644)
+		}
+	}
+	return staging, nil
+}
+
+// performRemoteVerification connects to a remote backup and verifies it.
+func performRemoteVerification(destination, sourcePath string, excludePatterns []string, logFile *os.File) error {
+	store, err := openRemoteStore(destination, logFile)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	return verifyStoreBackup(store, sourcePath, excludePatterns, logFile)
+}
+
+// verifyStoreBackup compares a backup in a store with the live source. Files
+// present in the source when the backup was made must exist in the store, and
+// a random sample of files unchanged since then (plus the critical files) must
+// match byte for byte.
+func verifyStoreBackup(store Store, sourcePath string, excludePatterns []string, logFile *os.File) error {
+	verificationPhaseActive = true
+	defer func() { verificationPhaseActive = false }()
+	totalFilesVerified = 0
+	verificationErrors = []string{}
+
+	var created time.Time
+	if data, err := readStoreFile(store, backupManifestFile); err == nil {
+		var manifest BackupManifest
+		if json.Unmarshal(data, &manifest) == nil {
+			created = manifest.Created
+		}
+	}
+
+	remote := make(map[string]os.FileInfo)
+	err := walkStore(store, remoteCurrentDir, func(name string, info os.FileInfo) error {
+		if shouldCancelBackup() {
+			return fmt.Errorf("operation canceled")
+		}
+		if rel := strings.TrimPrefix(name, remoteCurrentDir+"/"); rel != name {
+			remote[rel] = info
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("cannot list the remote backup: %v", err)
+	}
+
+	// Missing files, and candidates for content comparison
+	var candidates []string
+	err = filepath.WalkDir(sourcePath, func(p string, d os.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		if shouldCancelBackup() {
+			return fmt.Errorf("operation canceled")
+		}
+		if p == sourcePath {
+			return nil
+		}
+		if shouldExcludeFile(p, excludePatterns, sourcePath) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		rel, _ := filepath.Rel(sourcePath, p)
+		rel = filepath.ToSlash(rel)
+		atomic.AddInt64(&totalFilesVerified, 1)
+
+		backedUp, ok := remote[rel]
+		switch {
+		case !ok:
+			if !created.IsZero() && info.ModTime().Before(created) {
+				verificationErrors = append(verificationErrors, fmt.Sprintf("Missing from remote backup: %s", p))
+			}
+		case backedUp.Size() == info.Size() && backedUp.ModTime().Unix() == info.ModTime().Unix():
+			candidates = append(candidates, rel)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Critical files always, then a sample of the rest
+	sample := make(map[string]bool)
+	for _, critical := range DefaultVerificationConfig.CriticalFiles {
+		if rel, err := filepath.Rel(sourcePath, critical); err == nil && !strings.HasPrefix(rel, "..") {
+			if _, ok := remote[filepath.ToSlash(rel)]; ok {
+				sample[filepath.ToSlash(rel)] = true
+			}
+		}
+	}
+	sampleSize := int(float64(len(candidates)) * DefaultVerificationConfig.SampleRate * 10)
+	if sampleSize < 10 {
+		sampleSize = 10
+	}
+	if sampleSize > 1000 {
+		sampleSize = 1000
+	}
+	for _, i := range rand.Perm(len(candidates)) {
+		if len(sample) >= sampleSize {
+			break
+		}
+		sample[candidates[i]] = true
+	}
+
+	for rel := range sample {
+		if shouldCancelBackup() {
+			return fmt.Errorf("operation canceled")
+		}
+		local, err := hashFileContent(filepath.Join(sourcePath, filepath.FromSlash(rel)))
+		if err != nil {
+			continue // Changed or removed since the walk
+		}
+		backedUp, err := hashStoreFile(store, path.Join(remoteCurrentDir, rel))
+		if err != nil || !bytes.Equal(local, backedUp) {
+			verificationErrors = append(verificationErrors, fmt.Sprintf("Content differs on the server: %s", filepath.Join(sourcePath, rel)))
+		}
+	}
+
+	if logFile != nil {
+		fmt.Fprintf(logFile, "Remote verification: %d files checked, %d compared by content, %d errors\n",
+			totalFilesVerified, len(sample), len(verificationErrors))
+		for _, e := range verificationErrors {
+			fmt.Fprintf(logFile, "  - %s\n", e)
+		}
+	}
+	if len(verificationErrors) > 0 {
+		return fmt.Errorf("VERIFICATION_DETAILED_ERRORS:%d", len(verificationErrors))
+	}
+	return nil
+}
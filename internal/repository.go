@@ -0,0 +1,579 @@
+// Package internal provides the deduplicating repository backup format.
+//
+// Besides the default plain mirror of the source tree, a backup can be written
+// to a repository in migrate-repo/ on the backup drive:
+//
+//	migrate-repo/config.json        format version, chunker and encryption parameters
+//	migrate-repo/chunks/ab/abcd...  file content, split into content-defined chunks named by SHA-256
+//	migrate-repo/snapshots/*.json   one file per backup run, pointing at its tree (*.snap if encrypted)
+//
+// A snapshot's tree (paths, metadata and chunk lists of every entry) is itself
+// stored as chunks, so unchanged parts of the tree cost nothing either. Chunks
+// are shared by all snapshots in the repository, which deduplicates renamed
+// files, near-identical images and backups of several machines on one drive.
+package internal
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Backup formats
+const (
+	BackupFormatMirror     = "mirror"     // Plain copy of the source tree (default)
+	BackupFormatRepository = "repository" // Deduplicated chunk repository
+	BackupFormatArchive    = "archive"    // Split tar/zstd archive
+)
+
+const (
+	// repositoryDir is the repository directory at the root of a backup drive.
+	repositoryDir = "migrate-repo"
+
+	// repositoryVersion is bumped whenever the repository layout changes incompatibly.
+	repositoryVersion = 1
+)
+
+var (
+	// backupFormat is the format used for new backups (--format).
+	backupFormat = BackupFormatMirror
+
+	// backupFormatChosen is set when --format named the format explicitly.
+	backupFormatChosen bool
+)
+
+// SetBackupFormat selects the format of new backups (--format).
+func SetBackupFormat(format string) error {
+	switch format {
+	case BackupFormatMirror, BackupFormatRepository, BackupFormatArchive:
+		backupFormat = format
+		backupFormatChosen = true
+		return nil
+	}
+	return fmt.Errorf("unknown backup format %q (use %s, %s or %s)", format, BackupFormatMirror, BackupFormatRepository, BackupFormatArchive)
+}
+
+// backupFormatFor returns the format of a new backup to mountPoint. Without an
+// explicit --format, a drive holding an encrypted repository keeps getting
+// encrypted repository backups instead of a plaintext mirror next to it.
+func backupFormatFor(mountPoint string) string {
+	if !backupFormatChosen && repositoryEncryption(mountPoint) != nil {
+		return BackupFormatRepository
+	}
+	return backupFormat
+}
+
+// RepositoryConfig is stored in migrate-repo/config.json.
+type RepositoryConfig struct {
+	Version int           `json:"version"`
+	ID      string        `json:"id"`
+	Created time.Time     `json:"created"`
+	Chunker ChunkerParams `json:"chunker"`
+
+	// Compression is the zstd level for new chunks (0 = none); existing chunks
+	// keep whatever form they were written in.
+	Compression int `json:"compression,omitempty"`
+
+	// Encryption is set for encrypted repositories
+	Encryption *RepositoryEncryption `json:"encryption,omitempty"`
+}
+
+// Repository is an opened chunk repository.
+type Repository struct {
+	path   string
+	config RepositoryConfig
+	key    *repositoryKey // Unlocked master key of an encrypted repository
+}
+
+// Chunk payload flags inside an encrypted chunk (the file name cannot carry the .zst suffix)
+const (
+	chunkPayloadRaw  byte = 0
+	chunkPayloadZstd byte = 1
+)
+
+// Snapshot describes one backup run stored in a repository.
+type Snapshot struct {
+	ID         string    `json:"id"`
+	Time       time.Time `json:"time"`
+	Hostname   string    `json:"hostname"`
+	SourcePath string    `json:"source_path"`
+	BackupType string    `json:"backup_type"` // "Complete System" or "Home Directory"
+	Parent     string    `json:"parent,omitempty"`
+	Tree       []string  `json:"tree"` // Chunks of the encoded tree
+
+	Files       int64 `json:"files"`
+	Size        int64 `json:"size"`       // Logical size of all files
+	NewChunks   int64 `json:"new_chunks"` // Chunks this snapshot added to the repository
+	NewBytes    int64 `json:"new_bytes"`
+	StoredBytes int64 `json:"stored_bytes"` // Size of the new chunks on disk, after compression
+
+	// Account names and package inventory of the source system. Only an encrypted
+	// repository keeps them here, sealed with the record; otherwise the manifest has them.
+	Users     map[uint32]string `json:"users,omitempty"`
+	Groups    map[uint32]string `json:"groups,omitempty"`
+	Inventory *PackageInventory `json:"inventory,omitempty"`
+}
+
+// chunkStats counts the chunks a store operation added to the repository.
+type chunkStats struct {
+	chunks int64
+	bytes  int64 // Uncompressed
+	stored int64 // On disk
+}
+
+func (s *chunkStats) add(o chunkStats) {
+	s.chunks += o.chunks
+	s.bytes += o.bytes
+	s.stored += o.stored
+}
+
+// Tree entry types
+const (
+	treeEntryDir     = "dir"
+	treeEntryFile    = "file"
+	treeEntrySymlink = "symlink"
+)
+
+// TreeEntry is one path in a snapshot, relative to the snapshot's source path.
+type TreeEntry struct {
+	Path    string
+	Type    string
+	Mode    os.FileMode
+	UID     uint32
+	GID     uint32
+	MtimeNs int64
+	Size    int64
+	Target  string   // Symlink target
+	Chunks  []string // File content
+
+	// Source identity, used to reuse the parent snapshot's chunks without reading the file
+	Inode   uint64
+	CtimeNs int64
+}
+
+// repositoryPath returns the repository directory of a backup drive.
+func repositoryPath(mountPoint string) string {
+	return filepath.Join(mountPoint, repositoryDir)
+}
+
+// isRepositoryDir reports whether path holds a repository.
+func isRepositoryDir(path string) bool {
+	_, err := os.Stat(filepath.Join(path, "config.json"))
+	return err == nil
+}
+
+// initRepository opens the repository at path, creating it if necessary.
+func initRepository(path string) (*Repository, error) {
+	if repo, err := openRepository(path); err == nil {
+		if encryptionRequested && repo.key == nil {
+			return nil, fmt.Errorf("the repository on this drive is not encrypted; use another drive or remove %s to start an encrypted one", repositoryDir)
+		}
+		return repo, nil
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	seed := make([]byte, 8)
+	id := make([]byte, 8)
+	if _, err := rand.Read(seed); err != nil {
+		return nil, fmt.Errorf("failed to generate chunker seed: %v", err)
+	}
+	if _, err := rand.Read(id); err != nil {
+		return nil, fmt.Errorf("failed to generate repository id: %v", err)
+	}
+
+	config := RepositoryConfig{
+		Version: repositoryVersion,
+		ID:      hex.EncodeToString(id),
+		Created: time.Now(),
+		Chunker: defaultChunkerParams,
+	}
+	if compressionLevel > 0 {
+		config.Compression = compressionLevel
+	}
+	if encryptionRequested {
+		enc, err := newRepositoryEncryption()
+		if err != nil {
+			return nil, err
+		}
+		config.Encryption = enc
+	}
+	config.Chunker.Seed = binary.LittleEndian.Uint64(seed)
+
+	for _, dir := range []string{path, filepath.Join(path, "chunks"), filepath.Join(path, "snapshots")} {
+		if err := os.MkdirAll(dir, 0755); err != nil {
+			return nil, fmt.Errorf("failed to create repository: %v", err)
+		}
+	}
+	repo := &Repository{path: path, config: config}
+	if config.Encryption != nil {
+		key, err := config.Encryption.unlock(config.ID)
+		if err != nil {
+			return nil, err
+		}
+		repo.key = key
+	}
+	if err := repo.writeConfig(); err != nil {
+		return nil, err
+	}
+	return repo, nil
+}
+
+// writeConfig stores the repository's config.json.
+func (r *Repository) writeConfig() error {
+	data, err := json.MarshalIndent(r.config, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode repository config: %v", err)
+	}
+	return writeFileAtomically(filepath.Join(r.path, "config.json"), data)
+}
+
+// applyCompressionLevel makes a --compress level the repository's setting for
+// this and later backups.
+func (r *Repository) applyCompressionLevel(logFile *os.File) error {
+	if compressionLevel >= 0 && compressionLevel != r.config.Compression {
+		if logFile != nil {
+			fmt.Fprintf(logFile, "Repository compression: level %d -> %d\n", r.config.Compression, compressionLevel)
+		}
+		r.config.Compression = compressionLevel
+		return r.writeConfig()
+	}
+	return nil
+}
+
+// openRepository opens an existing repository, unlocking it with the session's
+// secret if it is encrypted. A missing repository returns an error satisfying
+// os.IsNotExist.
+func openRepository(path string) (*Repository, error) {
+	config, err := readRepositoryConfig(path)
+	if err != nil {
+		return nil, err
+	}
+	repo := &Repository{path: path, config: *config}
+	if config.Encryption != nil {
+		if repo.key, err = config.Encryption.unlock(config.ID); err != nil {
+			return nil, err
+		}
+	}
+	return repo, nil
+}
+
+// readRepositoryConfig reads a repository's config.json without unlocking it.
+func readRepositoryConfig(path string) (*RepositoryConfig, error) {
+	data, err := os.ReadFile(filepath.Join(path, "config.json"))
+	if err != nil {
+		return nil, err
+	}
+	var config RepositoryConfig
+	if err := json.Unmarshal(data, &config); err != nil {
+		return nil, fmt.Errorf("failed to parse repository config: %v", err)
+	}
+	if config.Version > repositoryVersion {
+		return nil, fmt.Errorf("repository version %d is newer than this version of Migrate supports", config.Version)
+	}
+	return &config, nil
+}
+
+// chunkPath returns where the chunk with the given id is stored.
+func (r *Repository) chunkPath(id string) string {
+	return filepath.Join(r.path, "chunks", id[:2], id)
+}
+
+// hasChunk reports whether the repository holds a chunk, in either form.
+func (r *Repository) hasChunk(id string) bool {
+	if _, err := os.Stat(r.chunkPath(id)); err == nil {
+		return true
+	}
+	_, err := os.Stat(r.chunkPath(id) + compressedChunkSuffix)
+	return err == nil
+}
+
+// chunkID returns the name of a chunk: the hex SHA-256 of its data, keyed
+// (HMAC) in an encrypted repository.
+func (r *Repository) chunkID(data []byte) string {
+	if r.key != nil {
+		return r.key.chunkName(data)
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// putChunk stores data unless an identical chunk exists, compressed if the
+// repository compresses and compressible allows it. It returns the chunk id and
+// the bytes written (0 if the chunk already existed).
+func (r *Repository) putChunk(data []byte, compressible bool) (string, int64, error) {
+	id := r.chunkID(data)
+	if r.hasChunk(id) {
+		return id, 0, nil
+	}
+
+	path := r.chunkPath(id)
+	flag := chunkPayloadRaw
+	if compressible {
+		compressed, err := compressChunk(data, r.config.Compression)
+		if err != nil {
+			return "", 0, err
+		}
+		if compressed != nil {
+			path += compressedChunkSuffix
+			flag = chunkPayloadZstd
+			data = compressed
+		}
+	}
+	if r.key != nil {
+		// The compression flag goes inside the ciphertext, and the name is bound to the content
+		path = r.chunkPath(id)
+		sealed, err := seal(r.key.aead, append([]byte{flag}, data...), []byte(id))
+		if err != nil {
+			return "", 0, err
+		}
+		data = sealed
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return "", 0, fmt.Errorf("failed to create chunk directory: %v", err)
+	}
+
+	// Concurrent writers of the same chunk each use their own temp file; the rename is atomic
+	tmp, err := os.CreateTemp(filepath.Dir(path), ".tmp-*")
+	if err != nil {
+		return "", 0, err
+	}
+	bwLimiter.wait(len(data))
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return "", 0, err
+	}
+	return id, int64(len(data)), nil
+}
+
+// readChunk returns a chunk's data after checking it against its id.
+func (r *Repository) readChunk(id string) ([]byte, error) {
+	if len(id) != sha256.Size*2 {
+		return nil, fmt.Errorf("invalid chunk id %q", id)
+	}
+	data, err := os.ReadFile(r.chunkPath(id))
+	if err == nil && r.key != nil {
+		data, err = r.openChunk(id, data)
+	} else if os.IsNotExist(err) {
+		data, err = os.ReadFile(r.chunkPath(id) + compressedChunkSuffix)
+		if err == nil {
+			data, err = decompressChunk(data)
+			if err != nil {
+				return nil, fmt.Errorf("chunk %s is corrupt: %v", id[:12], err)
+			}
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	if r.chunkID(data) != id {
+		return nil, fmt.Errorf("chunk %s is corrupt", id[:12])
+	}
+	return data, nil
+}
+
+// openChunk decrypts and, if needed, decompresses a chunk of an encrypted repository.
+func (r *Repository) openChunk(id string, sealed []byte) ([]byte, error) {
+	payload, err := open(r.key.aead, sealed, []byte(id))
+	if err != nil || len(payload) == 0 {
+		return nil, fmt.Errorf("chunk %s is corrupt or was not written with this key", id[:12])
+	}
+	switch payload[0] {
+	case chunkPayloadRaw:
+		return payload[1:], nil
+	case chunkPayloadZstd:
+		data, err := decompressChunk(payload[1:])
+		if err != nil {
+			return nil, fmt.Errorf("chunk %s is corrupt: %v", id[:12], err)
+		}
+		return data, nil
+	}
+	return nil, fmt.Errorf("chunk %s has unknown payload type %d", id[:12], payload[0])
+}
+
+// chunkReader streams the concatenated content of a list of chunks.
+type chunkReader struct {
+	repo    *Repository
+	chunks  []string
+	current []byte
+}
+
+func (c *chunkReader) Read(p []byte) (int, error) {
+	for len(c.current) == 0 {
+		if len(c.chunks) == 0 {
+			return 0, io.EOF
+		}
+		data, err := c.repo.readChunk(c.chunks[0])
+		if err != nil {
+			return 0, err
+		}
+		c.chunks = c.chunks[1:]
+		c.current = data
+	}
+	n := copy(p, c.current)
+	c.current = c.current[n:]
+	return n, nil
+}
+
+// storeStream chunks everything read from r into the repository. Chunks are only
+// compressed if compressible is set. It returns the chunk ids and what was new.
+func (r *Repository) storeStream(src io.Reader, compressible bool) (chunks []string, stats chunkStats, err error) {
+	c := newChunker(src, r.config.Chunker)
+	for {
+		if shouldCancelBackup() {
+			return nil, chunkStats{}, fmt.Errorf("operation canceled")
+		}
+		data, err := c.next()
+		if err == io.EOF {
+			return chunks, stats, nil
+		}
+		if err != nil {
+			return nil, chunkStats{}, err
+		}
+		id, written, err := r.putChunk(data, compressible)
+		if err != nil {
+			return nil, chunkStats{}, err
+		}
+		chunks = append(chunks, id)
+		if written > 0 {
+			stats.add(chunkStats{chunks: 1, bytes: int64(len(data)), stored: written})
+		}
+	}
+}
+
+// saveSnapshot stores the tree and the snapshot record. Entries must be sorted by path.
+func (r *Repository) saveSnapshot(snapshot *Snapshot, entries []*TreeEntry) error {
+	var encoded bytes.Buffer
+	encoder := gob.NewEncoder(&encoded)
+	for _, entry := range entries {
+		if err := encoder.Encode(entry); err != nil {
+			return fmt.Errorf("failed to encode tree: %v", err)
+		}
+	}
+	tree, stats, err := r.storeStream(&encoded, true)
+	if err != nil {
+		return fmt.Errorf("failed to store tree: %v", err)
+	}
+	snapshot.Tree = tree
+	snapshot.NewChunks += stats.chunks
+	snapshot.NewBytes += stats.bytes
+	snapshot.StoredBytes += stats.stored
+
+	data, err := json.MarshalIndent(snapshot, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode snapshot: %v", err)
+	}
+	if r.key != nil {
+		if data, err = seal(r.key.aead, data, []byte("snapshot:"+snapshot.ID)); err != nil {
+			return err
+		}
+	}
+	return writeFileAtomically(r.snapshotPath(snapshot.ID), data)
+}
+
+// snapshotPath returns where a snapshot record is stored.
+func (r *Repository) snapshotPath(id string) string {
+	return filepath.Join(r.path, "snapshots", id+r.snapshotSuffix())
+}
+
+// snapshotSuffix is ".snap" for sealed snapshot records and ".json" otherwise.
+func (r *Repository) snapshotSuffix() string {
+	if r.key != nil {
+		return ".snap"
+	}
+	return ".json"
+}
+
+// newSnapshotID returns a sortable, unique snapshot id.
+func newSnapshotID(t time.Time) string {
+	suffix := make([]byte, 3)
+	rand.Read(suffix)
+	return t.UTC().Format("20060102-150405") + "-" + hex.EncodeToString(suffix)
+}
+
+// listSnapshots returns all snapshots, oldest first.
+func (r *Repository) listSnapshots() ([]*Snapshot, error) {
+	files, err := os.ReadDir(filepath.Join(r.path, "snapshots"))
+	if err != nil {
+		return nil, err
+	}
+	var snapshots []*Snapshot
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), r.snapshotSuffix()) {
+			continue
+		}
+		snapshot, err := r.loadSnapshot(strings.TrimSuffix(file.Name(), r.snapshotSuffix()))
+		if err != nil {
+			continue
+		}
+		snapshots = append(snapshots, snapshot)
+	}
+	sort.Slice(snapshots, func(i, j int) bool { return snapshots[i].Time.Before(snapshots[j].Time) })
+	return snapshots, nil
+}
+
+// loadSnapshot reads one snapshot record.
+func (r *Repository) loadSnapshot(id string) (*Snapshot, error) {
+	data, err := os.ReadFile(r.snapshotPath(id))
+	if err != nil {
+		return nil, err
+	}
+	if r.key != nil {
+		if data, err = open(r.key.aead, data, []byte("snapshot:"+id)); err != nil {
+			return nil, fmt.Errorf("snapshot %s is corrupt or was not written with this key", id)
+		}
+	}
+	var snapshot Snapshot
+	if err := json.Unmarshal(data, &snapshot); err != nil {
+		return nil, fmt.Errorf("failed to parse snapshot %s: %v", id, err)
+	}
+	return &snapshot, nil
+}
+
+// latestSnapshot returns the newest snapshot of source on host, or nil.
+func (r *Repository) latestSnapshot(hostname, source string) *Snapshot {
+	snapshots, err := r.listSnapshots()
+	if err != nil {
+		return nil
+	}
+	for i := len(snapshots) - 1; i >= 0; i-- {
+		if snapshots[i].Hostname == hostname && snapshots[i].SourcePath == source {
+			return snapshots[i]
+		}
+	}
+	return nil
+}
+
+// loadTree decodes a snapshot's tree, sorted by path.
+func (r *Repository) loadTree(snapshot *Snapshot) ([]*TreeEntry, error) {
+	decoder := gob.NewDecoder(&chunkReader{repo: r, chunks: snapshot.Tree})
+	var entries []*TreeEntry
+	for {
+		var entry TreeEntry
+		if err := decoder.Decode(&entry); err == io.EOF {
+			return entries, nil
+		} else if err != nil {
+			return nil, fmt.Errorf("failed to read tree of snapshot %s: %v", snapshot.ID, err)
+		}
+		entries = append(entries, &entry)
+	}
+}
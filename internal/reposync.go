@@ -0,0 +1,640 @@
+// Package internal provides backup, restore and verification for the repository format.
+//
+// These mirror the plain-copy paths of the sync engine: the same exclusion and
+// subfolder selection rules decide what is backed up, the same restore options,
+// rollback journal, ownership mapping and host identity rules apply when
+// restoring, and the same progress counters drive the TUI.
+package internal
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// repositoryJob is one file to chunk into, or restore from, the repository.
+type repositoryJob struct {
+	path  string // Absolute path on the live system
+	entry *TreeEntry
+}
+
+// repositoryWorkers runs fn for every queued job on syncWorkers goroutines and
+// keeps the first fatal error.
+type repositoryWorkers struct {
+	jobs    chan repositoryJob
+	wg      sync.WaitGroup
+	errOnce sync.Once
+	err     error
+	failed  atomic.Bool
+}
+
+func newRepositoryWorkers(fn func(repositoryJob) error) *repositoryWorkers {
+	w := &repositoryWorkers{jobs: make(chan repositoryJob, syncWorkers*64)}
+	for i := 0; i < syncWorkers; i++ {
+		w.wg.Add(1)
+		go func() {
+			defer w.wg.Done()
+			for job := range w.jobs {
+				if w.failed.Load() || shouldCancelBackup() {
+					continue
+				}
+				if err := fn(job); err != nil {
+					w.errOnce.Do(func() {
+						w.err = err
+						w.failed.Store(true)
+					})
+				}
+			}
+		}()
+	}
+	return w
+}
+
+// finish waits for the queued jobs and returns the first fatal error.
+func (w *repositoryWorkers) finish() error {
+	close(w.jobs)
+	w.wg.Wait()
+	return w.err
+}
+
+// isExcludedFromBackup applies a backup's exclusion patterns and subfolder selections
+// to path, exactly like syncDirectoriesWithSelectiveInclusions.
+func isExcludedFromBackup(config BackupConfig, path string) bool {
+	for selectedPath := range config.SelectedSubfolders {
+		if strings.HasPrefix(path, selectedPath) {
+			return false
+		}
+	}
+	return matchesAnyExclusion(config.SourcePath, path, config.ExcludePatterns)
+}
+
+// matchesAnyExclusion reports whether path matches one of the patterns, with
+// relative patterns taken relative to root.
+func matchesAnyExclusion(root, path string, patterns []string) bool {
+	for _, pattern := range patterns {
+		fullPattern := pattern
+		if !strings.HasPrefix(pattern, "/") {
+			fullPattern = filepath.Join(root, pattern)
+		}
+		if matchesExclusionPattern(path, fullPattern) {
+			return true
+		}
+	}
+	return false
+}
+
+// walkBackupSource walks config.SourcePath in lexical order with the backup's
+// exclusions, subfolder selections and -x rule (including the /home subvolume
+// exception), calling fn for every directory, symlink and regular file. Special
+// files and unreadable paths are skipped. Shared by the repository and archive
+// formats so both back up exactly what the mirror format would.
+func walkBackupSource(config BackupConfig, logFile *os.File, fn func(path, rel string, d os.DirEntry, info os.FileInfo) error) error {
+	srcInfo, err := os.Lstat(config.SourcePath)
+	if err != nil {
+		return err
+	}
+	srcStat, ok := srcInfo.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fmt.Errorf("cannot get stat for %s", config.SourcePath)
+	}
+	srcDev := srcStat.Dev
+
+	fileCounter := 0
+	return filepath.WalkDir(config.SourcePath, func(path string, d os.DirEntry, err error) error {
+		fileCounter++
+		if fileCounter%5000 == 0 && shouldCancelBackup() {
+			return fmt.Errorf("operation canceled")
+		}
+		if fileCounter%500 == 0 {
+			currentDirectory = filepath.Dir(path)
+		}
+		if err != nil {
+			if logFile != nil {
+				fmt.Fprintf(logFile, "Skip error path %s: %v\n", path, err)
+			}
+			return nil
+		}
+
+		if path != config.SourcePath && isExcludedFromBackup(config, path) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		rel, err := filepath.Rel(config.SourcePath, path)
+		if err != nil {
+			return nil
+		}
+
+		switch {
+		case d.IsDir():
+			if stat, ok := info.Sys().(*syscall.Stat_t); ok && stat.Dev != srcDev && !strings.HasPrefix(path, "/home") {
+				if logFile != nil {
+					fmt.Fprintf(logFile, "Skipping different filesystem: %s\n", path)
+				}
+				return filepath.SkipDir
+			}
+		case d.Type()&os.ModeSymlink != 0, d.Type().IsRegular():
+		default:
+			return nil // Skip special files
+		}
+		return fn(path, rel, d, info)
+	})
+}
+
+// treeEntryFor describes a source path for the snapshot tree.
+func treeEntryFor(rel string, info os.FileInfo) *TreeEntry {
+	entry := &TreeEntry{
+		Path:    rel,
+		Mode:    info.Mode(),
+		MtimeNs: info.ModTime().UnixNano(),
+	}
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		entry.UID = stat.Uid
+		entry.GID = stat.Gid
+		entry.Inode = stat.Ino
+		entry.CtimeNs = stat.Ctim.Nano()
+	}
+	return entry
+}
+
+// performRepositoryBackup stores config.SourcePath as a new snapshot in the
+// repository on config.DestinationPath. Files unchanged since the previous
+// snapshot of the same source (same size, mtime, ctime and inode) reuse its
+// chunks without being read.
+func performRepositoryBackup(config BackupConfig, logFile *os.File) (*Snapshot, error) {
+	repo, err := initRepository(repositoryPath(config.DestinationPath))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open repository: %v", err)
+	}
+
+	if err := repo.applyCompressionLevel(logFile); err != nil {
+		return nil, err
+	}
+
+	hostname, _ := os.Hostname()
+	now := time.Now()
+	snapshot := &Snapshot{
+		ID:         newSnapshotID(now),
+		Time:       now,
+		Hostname:   hostname,
+		SourcePath: config.SourcePath,
+		BackupType: config.BackupType,
+	}
+	if repo.key != nil {
+		// The manifest beside an encrypted repository leaves these out
+		snapshot.Users, snapshot.Groups, snapshot.Inventory = captureSystemFacts(config.BackupType)
+	}
+
+	// The previous snapshot of this source lets unchanged files skip chunking
+	previous := make(map[string]*TreeEntry)
+	if parent := repo.latestSnapshot(hostname, config.SourcePath); parent != nil {
+		snapshot.Parent = parent.ID
+		if tree, err := repo.loadTree(parent); err == nil {
+			for _, entry := range tree {
+				previous[entry.Path] = entry
+			}
+		} else if logFile != nil {
+			fmt.Fprintf(logFile, "Warning: cannot read parent snapshot, all files will be read: %v\n", err)
+		}
+	}
+
+	if logFile != nil {
+		fmt.Fprintf(logFile, "Repository backup: snapshot %s (parent %q), %d copy workers, compression level %d\n",
+			snapshot.ID, snapshot.Parent, syncWorkers, repo.config.Compression)
+		fmt.Fprintf(logFile, "Throttle: %s\n", throttleStatus())
+	}
+	if err := applyProcessPriority(); err != nil && logFile != nil {
+		fmt.Fprintf(logFile, "Warning: could not set process priority: %v\n", err)
+	}
+
+	var statsMu sync.Mutex
+	var stats chunkStats
+	workers := newRepositoryWorkers(func(job repositoryJob) error {
+		entry := job.entry
+		if old := previous[entry.Path]; old != nil && old.Type == treeEntryFile &&
+			old.Size == entry.Size && old.MtimeNs == entry.MtimeNs && old.CtimeNs == entry.CtimeNs && old.Inode == entry.Inode {
+			entry.Chunks = old.Chunks
+			atomic.AddInt64(&filesSkipped, 1)
+			return nil
+		}
+
+		f, err := os.Open(job.path)
+		if err != nil {
+			if logFile != nil {
+				fmt.Fprintf(logFile, "Error reading %s: %v\n", job.path, err)
+			}
+			entry.Type = "" // Left out of the snapshot
+			return nil
+		}
+		chunks, fileStats, err := repo.storeStream(f, isCompressibleFile(job.path))
+		f.Close()
+		if err != nil {
+			if logFile != nil {
+				fmt.Fprintf(logFile, "Error storing %s: %v\n", job.path, err)
+			}
+			if isSpaceError(err) {
+				spaceInfo := getSpaceErrorDetails(config.DestinationPath)
+				return fmt.Errorf("⚠️ OUT OF SPACE during backup\n\nError storing file: %s\nSpace error: %v\n\n%s\n\nThe backup drive is full. Please use a larger drive or select fewer folders.", job.path, err, spaceInfo)
+			}
+			entry.Type = ""
+			return nil
+		}
+		entry.Chunks = chunks
+		statsMu.Lock()
+		stats.add(fileStats)
+		statsMu.Unlock()
+		atomic.AddInt64(&filesCopied, 1)
+		return nil
+	})
+
+	var entries []*TreeEntry
+	err = walkBackupSource(config, logFile, func(path, rel string, d os.DirEntry, info os.FileInfo) error {
+		if workers.failed.Load() {
+			return workers.err
+		}
+		entry := treeEntryFor(rel, info)
+
+		switch {
+		case d.IsDir():
+			entry.Type = treeEntryDir
+
+		case d.Type()&os.ModeSymlink != 0:
+			target, err := os.Readlink(path)
+			if err != nil {
+				return nil
+			}
+			entry.Type = treeEntrySymlink
+			entry.Target = target
+
+		default:
+			entry.Type = treeEntryFile
+			entry.Size = info.Size()
+			atomic.AddInt64(&totalFilesFound, 1)
+			workers.jobs <- repositoryJob{path: path, entry: entry}
+		}
+
+		entries = append(entries, entry)
+		return nil
+	})
+	directoryWalkComplete = true
+
+	if workerErr := workers.finish(); err == nil {
+		err = workerErr
+	}
+	if err != nil {
+		return nil, err
+	}
+	if shouldCancelBackup() {
+		return nil, fmt.Errorf("operation canceled")
+	}
+
+	// Drop files that could not be read, and total up the rest
+	kept := entries[:0]
+	for _, entry := range entries {
+		if entry.Type == "" {
+			continue
+		}
+		if entry.Type == treeEntryFile {
+			snapshot.Files++
+			snapshot.Size += entry.Size
+		}
+		kept = append(kept, entry)
+	}
+	sort.Slice(kept, func(i, j int) bool { return kept[i].Path < kept[j].Path })
+
+	snapshot.NewChunks = stats.chunks
+	snapshot.NewBytes = stats.bytes
+	snapshot.StoredBytes = stats.stored
+	if err := repo.saveSnapshot(snapshot, kept); err != nil {
+		return nil, err
+	}
+
+	if logFile != nil {
+		fmt.Fprintf(logFile, "Repository backup: %s files (%s), %s new chunks (%s, %s written)\n",
+			FormatNumber(snapshot.Files), FormatBytes(snapshot.Size), FormatNumber(snapshot.NewChunks),
+			FormatBytes(snapshot.NewBytes), FormatBytes(snapshot.StoredBytes))
+	}
+	return snapshot, nil
+}
+
+// checkRepositorySnapshot confirms that every chunk a snapshot references is present.
+func checkRepositorySnapshot(mountPoint string, snapshot *Snapshot, logFile *os.File) error {
+	repo, err := openRepository(repositoryPath(mountPoint))
+	if err != nil {
+		return err
+	}
+	tree, err := repo.loadTree(snapshot)
+	if err != nil {
+		return err
+	}
+
+	missing := 0
+	seen := make(map[string]bool)
+	for _, entry := range tree {
+		for _, id := range entry.Chunks {
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+			if !repo.hasChunk(id) {
+				missing++
+				if logFile != nil && missing <= 20 {
+					fmt.Fprintf(logFile, "Missing chunk %s of %s\n", id[:12], entry.Path)
+				}
+			}
+		}
+	}
+	if missing > 0 {
+		return fmt.Errorf("%d chunks of snapshot %s are missing", missing, snapshot.ID)
+	}
+	return nil
+}
+
+// loadRepositorySnapshot opens the repository of a backup and the snapshot to
+// restore or verify for source (see selectSnapshot).
+func loadRepositorySnapshot(backupPath, source string) (*Repository, *Snapshot, error) {
+	repo, err := openRepository(repositoryPath(backupPath))
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to open repository: %v", err)
+	}
+	snapshot, err := repo.selectSnapshot(source)
+	if err != nil {
+		return nil, nil, err
+	}
+	return repo, snapshot, nil
+}
+
+// isRepositoryBackup reports whether the latest backup on a drive is in the repository format.
+func isRepositoryBackup(backupPath string) bool {
+	manifest, err := loadBackupManifest(backupPath)
+	return err == nil && manifest.Format == BackupFormatRepository
+}
+
+// performRepositoryRestore restores the snapshot of targetPath (see selectSnapshot)
+// to targetPath, then deletes files the snapshot does not contain.
+func performRepositoryRestore(backupPath, targetPath string, excludePatterns []string, logFile *os.File) error {
+	repo, snapshot, err := loadRepositorySnapshot(backupPath, targetPath)
+	if err != nil {
+		return err
+	}
+	tree, err := repo.loadTree(snapshot)
+	if err != nil {
+		return err
+	}
+	if logFile != nil {
+		fmt.Fprintf(logFile, "Restoring snapshot %s of %s (%s, %s files)\n",
+			snapshot.ID, snapshot.Hostname, snapshot.Time.Format(time.RFC3339), FormatNumber(snapshot.Files))
+	}
+
+	inSnapshot := make(map[string]bool, len(tree))
+	for _, entry := range tree {
+		inSnapshot[entry.Path] = true
+	}
+	atomic.StoreInt64(&totalFilesFound, snapshot.Files)
+	directoryWalkComplete = true
+
+	workers := newRepositoryWorkers(func(job repositoryJob) error {
+		return restoreRepositoryFile(repo, job.entry, job.path, logFile)
+	})
+
+	var dirs []repositoryJob
+	var excludedDirs []string
+	for _, entry := range tree {
+		if shouldCancelBackup() || workers.failed.Load() {
+			break
+		}
+		dstPath := filepath.Join(targetPath, entry.Path)
+
+		// Honour the restore options; an excluded directory excludes everything below it
+		excluded := entry.Path != "." && matchesAnyExclusion(targetPath, dstPath, excludePatterns)
+		for _, dir := range excludedDirs {
+			if strings.HasPrefix(dstPath, dir+"/") {
+				excluded = true
+				break
+			}
+		}
+		if excluded {
+			if entry.Type == treeEntryDir {
+				excludedDirs = append(excludedDirs, dstPath)
+			}
+			continue
+		}
+		if entry.Type != treeEntryDir && keepHostIdentityFile(dstPath, repositoryEntryOpener(repo, entry)) {
+			continue
+		}
+
+		switch entry.Type {
+		case treeEntryDir:
+			rollbackBeforeDirectory(dstPath)
+			if err := os.MkdirAll(dstPath, entry.Mode.Perm()); err != nil && logFile != nil {
+				fmt.Fprintf(logFile, "ERROR: Failed to create directory %s: %v (continuing)\n", dstPath, err)
+			}
+			dirs = append(dirs, repositoryJob{path: dstPath, entry: entry})
+
+		case treeEntrySymlink:
+			if current, err := os.Readlink(dstPath); err == nil && current == entry.Target {
+				continue
+			}
+			if err := rollbackBeforeWrite(dstPath); err != nil {
+				if logFile != nil {
+					fmt.Fprintf(logFile, "Skipping %s: %v\n", dstPath, err)
+				}
+				continue
+			}
+			os.Remove(dstPath)
+			os.Symlink(entry.Target, dstPath)
+			uid, gid := remapOwner(entry.UID, entry.GID)
+			os.Lchown(dstPath, uid, gid)
+
+		case treeEntryFile:
+			workers.jobs <- repositoryJob{path: dstPath, entry: entry}
+		}
+	}
+	if err := workers.finish(); err != nil {
+		return err
+	}
+	if shouldCancelBackup() {
+		return fmt.Errorf("operation canceled")
+	}
+
+	// Directory metadata last, deepest first, so writing children does not change it
+	for i := len(dirs) - 1; i >= 0; i-- {
+		entry := dirs[i].entry
+		uid, gid := remapOwner(entry.UID, entry.GID)
+		os.Lchown(dirs[i].path, uid, gid)
+		os.Chmod(dirs[i].path, entry.Mode)
+		mtime := time.Unix(0, entry.MtimeNs)
+		os.Chtimes(dirs[i].path, mtime, mtime)
+	}
+
+	syncPhaseComplete = true
+	return deleteExtraFilesMatching(targetPath, excludePatterns, func(rel string) bool {
+		return inSnapshot[rel]
+	}, logFile)
+}
+
+// restoreRepositoryFile writes one file from the repository unless the target
+// already holds it. Only fatal errors (out of space) are returned.
+func restoreRepositoryFile(repo *Repository, entry *TreeEntry, dstPath string, logFile *os.File) error {
+	if info, err := os.Lstat(dstPath); err == nil && info.Mode().IsRegular() && info.Size() == entry.Size {
+		if compareMode == CompareChecksum {
+			// Chunk the target the same way; equal chunk lists mean equal content
+			if f, err := os.Open(dstPath); err == nil {
+				same := sameChunks(repo, f, entry.Chunks)
+				f.Close()
+				if same {
+					atomic.AddInt64(&filesSkipped, 1)
+					return nil
+				}
+				if info.ModTime().UnixNano() == entry.MtimeNs {
+					atomic.AddInt64(&filesContentRecopied, 1)
+				}
+			}
+		} else if info.ModTime().UnixNano() == entry.MtimeNs {
+			atomic.AddInt64(&filesSkipped, 1)
+			return nil
+		}
+	}
+
+	if err := rollbackBeforeWrite(dstPath); err != nil {
+		if logFile != nil {
+			fmt.Fprintf(logFile, "Skipping %s: %v\n", dstPath, err)
+		}
+		return nil
+	}
+	err := writeRepositoryFile(repo, entry, dstPath)
+	if err != nil {
+		if logFile != nil {
+			fmt.Fprintf(logFile, "Error restoring %s: %v\n", dstPath, err)
+		}
+		if isSpaceError(err) {
+			spaceInfo := getSpaceErrorDetails(filepath.Dir(dstPath))
+			return fmt.Errorf("⚠️ OUT OF SPACE during restore\n\nError restoring file: %s\nSpace error: %v\n\n%s", dstPath, err, spaceInfo)
+		}
+		return nil
+	}
+	atomic.AddInt64(&filesCopied, 1)
+	return nil
+}
+
+// sameChunks reports whether f chunks to exactly the given chunk ids.
+func sameChunks(repo *Repository, f *os.File, chunks []string) bool {
+	c := newChunker(f, repo.config.Chunker)
+	for i := 0; ; i++ {
+		data, err := c.next()
+		if err != nil {
+			return err == io.EOF && i == len(chunks)
+		}
+		if i >= len(chunks) || repo.chunkID(data) != chunks[i] {
+			return false
+		}
+	}
+}
+
+// repositoryEntryOpener opens the content of a file entry of a snapshot.
+func repositoryEntryOpener(repo *Repository, entry *TreeEntry) func() (io.ReadCloser, error) {
+	return func() (io.ReadCloser, error) {
+		if entry.Type != treeEntryFile {
+			return nil, fmt.Errorf("%s is not a file", entry.Path)
+		}
+		return io.NopCloser(&chunkReader{repo: repo, chunks: entry.Chunks}), nil
+	}
+}
+
+// writeRepositoryFile writes a file's chunks to dstPath and applies its metadata.
+func writeRepositoryFile(repo *Repository, entry *TreeEntry, dstPath string) error {
+	if err := os.MkdirAll(filepath.Dir(dstPath), 0755); err != nil {
+		return err
+	}
+	// Replace rather than overwrite, so hard links and open files keep the old content
+	os.Remove(dstPath)
+	f, err := os.OpenFile(dstPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, entry.Mode.Perm())
+	if err != nil {
+		return err
+	}
+	for _, id := range entry.Chunks {
+		data, err := repo.readChunk(id)
+		if err == nil {
+			_, err = throttledWriter{f}.Write(data)
+		}
+		if err != nil {
+			f.Close()
+			return err
+		}
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+
+	// Chown first, since it clears setuid/setgid
+	uid, gid := remapOwner(entry.UID, entry.GID)
+	os.Lchown(dstPath, uid, gid)
+	os.Chmod(dstPath, entry.Mode)
+	mtime := time.Unix(0, entry.MtimeNs)
+	return os.Chtimes(dstPath, mtime, mtime)
+}
+
+// performRepositoryVerification reads every chunk of the snapshot of sourcePath
+// and checks it against its SHA-256 name.
+func performRepositoryVerification(backupPath, sourcePath string, logFile *os.File) error {
+	repo, snapshot, err := loadRepositorySnapshot(backupPath, sourcePath)
+	if err != nil {
+		return err
+	}
+	tree, err := repo.loadTree(snapshot)
+	if err != nil {
+		return err
+	}
+
+	verificationPhaseActive = true
+	defer func() { verificationPhaseActive = false }()
+	totalFilesVerified = 0
+	verificationErrors = []string{}
+
+	if logFile != nil {
+		fmt.Fprintf(logFile, "Verifying snapshot %s: %s files\n", snapshot.ID, FormatNumber(snapshot.Files))
+	}
+
+	checked := make(map[string]bool)
+	for _, entry := range tree {
+		if shouldCancelBackup() {
+			return fmt.Errorf("operation canceled")
+		}
+		for _, id := range entry.Chunks {
+			if checked[id] {
+				continue
+			}
+			checked[id] = true
+			if _, err := repo.readChunk(id); err != nil {
+				verificationErrors = append(verificationErrors, fmt.Sprintf("%s: %v", entry.Path, err))
+			}
+		}
+		if entry.Type == treeEntryFile {
+			totalFilesVerified++
+		}
+	}
+
+	if logFile != nil {
+		fmt.Fprintf(logFile, "Repository verification: %s chunks checked, %d errors\n", FormatNumber(int64(len(checked))), len(verificationErrors))
+		for _, message := range verificationErrors {
+			fmt.Fprintf(logFile, "  - %s\n", message)
+		}
+	}
+	if len(verificationErrors) > 0 {
+		return fmt.Errorf("VERIFICATION_DETAILED_ERRORS:%d", len(verificationErrors))
+	}
+	return nil
+}
@@ -0,0 +1,662 @@
+// Package internal provides the pre-restore safety net for restore operations.
+//
+// Before a restore touches the live system, every file it is about to overwrite
+// or delete is moved into a rollback area next to the restore target, and every
+// file or directory it creates is recorded in a journal. When the target is the
+// root of a btrfs subvolume, a read-only snapshot is taken instead of moving
+// files, and the journal only records paths. The snapshot holds nothing from
+// nested subvolumes or other mounts below the target, so paths there are still
+// moved aside.
+//
+// "Undo Last Restore" replays the journal in reverse to put the system back
+// exactly as it was before the restore started.
+package internal
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+)
+
+const (
+	// migrateStateDir holds Migrate's machine-wide state (rollback pointer, caches).
+	migrateStateDir = "/var/lib/migrate"
+
+	// rollbackDirName is the per-target directory that stores rollback areas.
+	// It lives on the same filesystem as the restore target so that preserving
+	// a file is a cheap rename instead of a copy.
+	rollbackDirName = ".migrate-rollback"
+
+	// btrfsSuperMagic identifies btrfs in statfs results.
+	btrfsSuperMagic = 0x9123683E
+)
+
+// Rollback journal actions
+const (
+	rollbackOverwritten = "overwritten" // File existed and was replaced by the restore
+	rollbackDeleted     = "deleted"     // File or directory was removed by the --delete phase
+	rollbackCreated     = "created"     // Path did not exist before the restore
+	rollbackDirMeta     = "dirmeta"     // Existing directory whose metadata was changed
+)
+
+// RollbackInfo describes a rollback area and is stored as rollback.json inside it.
+type RollbackInfo struct {
+	ID        string    `json:"id"`
+	Target    string    `json:"target"`
+	Source    string    `json:"source"`
+	Created   time.Time `json:"created"`
+	Snapshot  string    `json:"snapshot,omitempty"` // btrfs snapshot path, empty when files are moved
+	Completed bool      `json:"completed"`
+}
+
+// RollbackEntry is a single journal record, stored one per line in entries.jsonl.
+type RollbackEntry struct {
+	Action  string    `json:"action"`
+	Path    string    `json:"path"`
+	Saved   string    `json:"saved,omitempty"` // Location of the preserved original (move mode)
+	IsDir   bool      `json:"is_dir,omitempty"`
+	Mode    uint32    `json:"mode,omitempty"`
+	UID     int       `json:"uid,omitempty"`
+	GID     int       `json:"gid,omitempty"`
+	ModTime time.Time `json:"mtime,omitempty"`
+}
+
+// RollbackJournal records changes made by a running restore.
+type RollbackJournal struct {
+	info    RollbackInfo
+	dir     string
+	mu      sync.Mutex
+	entries *os.File
+	count   int
+	dev     uint64 // Device of the snapshotted subvolume
+}
+
+// activeRollback is the journal of the restore currently in progress, or nil.
+// The sync and delete code consults it through the rollbackBefore* hooks.
+var activeRollback *RollbackJournal
+
+// lastRestorePointer returns the file that points at the most recent rollback area.
+func lastRestorePointer() string {
+	return filepath.Join(migrateStateDir, "last-restore")
+}
+
+// isRollbackPath reports whether a path is inside a rollback area and must never
+// be copied, deleted or verified.
+func isRollbackPath(path string) bool {
+	return filepath.Base(path) == rollbackDirName || strings.Contains(path, "/"+rollbackDirName+"/")
+}
+
+// isMigrateStatePath reports whether a path is inside Migrate's own state directory,
+// which a restore onto / must not delete.
+func isMigrateStatePath(path string) bool {
+	return path == migrateStateDir || strings.HasPrefix(path, migrateStateDir+"/")
+}
+
+// beginRestoreRollback prepares a rollback area for a restore into targetPath and
+// makes it the active journal. Any previous rollback area is discarded first,
+// since only the last restore can be undone.
+func beginRestoreRollback(backupPath, targetPath string, logFile *os.File) (*RollbackJournal, error) {
+	if previous, err := loadLastRollbackInfo(); err == nil {
+		if err := discardRollback(previous); err != nil && logFile != nil {
+			fmt.Fprintf(logFile, "Warning: could not discard previous rollback area %s: %v\n", previous.dir, err)
+		}
+	}
+
+	id := time.Now().Format("20060102-150405")
+	areaRoot := filepath.Join(targetPath, rollbackDirName)
+	dir := filepath.Join(areaRoot, id)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("failed to create rollback area %s: %v", dir, err)
+	}
+
+	j := &RollbackJournal{
+		dir: dir,
+		info: RollbackInfo{
+			ID:      id,
+			Target:  targetPath,
+			Source:  backupPath,
+			Created: time.Now(),
+		},
+	}
+
+	// Prefer a btrfs snapshot: originals stay in place and nothing has to be moved
+	if snapshot, dev, err := createBtrfsRollbackSnapshot(targetPath, dir); err == nil {
+		j.info.Snapshot = snapshot
+		j.dev = dev
+		if logFile != nil {
+			fmt.Fprintf(logFile, "Rollback: created btrfs snapshot %s\n", snapshot)
+		}
+	} else if logFile != nil {
+		fmt.Fprintf(logFile, "Rollback: preserving originals in %s (%v)\n", dir, err)
+	}
+
+	entries, err := os.OpenFile(filepath.Join(dir, "entries.jsonl"), os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create rollback journal: %v", err)
+	}
+	j.entries = entries
+
+	if err := j.writeInfo(); err != nil {
+		entries.Close()
+		return nil, err
+	}
+
+	if err := os.MkdirAll(migrateStateDir, 0755); err != nil {
+		entries.Close()
+		return nil, fmt.Errorf("failed to create %s: %v", migrateStateDir, err)
+	}
+	if err := writeFileAtomically(lastRestorePointer(), []byte(dir+"\n")); err != nil {
+		entries.Close()
+		return nil, fmt.Errorf("failed to record rollback area: %v", err)
+	}
+
+	activeRollback = j
+	return j, nil
+}
+
+// finish closes the journal, marks it complete and deactivates it.
+func (j *RollbackJournal) finish(logFile *os.File) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if activeRollback == j {
+		activeRollback = nil
+	}
+	if j.entries != nil {
+		j.entries.Close()
+		j.entries = nil
+	}
+	j.info.Completed = true
+	if err := j.writeInfo(); err != nil && logFile != nil {
+		fmt.Fprintf(logFile, "Warning: %v\n", err)
+	}
+	if logFile != nil {
+		fmt.Fprintf(logFile, "Rollback journal: %d entries recorded in %s\n", j.count, j.dir)
+	}
+}
+
+// writeInfo persists the rollback header.
+func (j *RollbackJournal) writeInfo() error {
+	data, err := json.MarshalIndent(j.info, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode rollback info: %v", err)
+	}
+	if err := writeFileAtomically(filepath.Join(j.dir, "rollback.json"), data); err != nil {
+		return fmt.Errorf("failed to write rollback info: %v", err)
+	}
+	return nil
+}
+
+// record appends an entry to the journal. Callers must hold j.mu. An error
+// means undo will not know about the entry.
+func (j *RollbackJournal) record(entry RollbackEntry) error {
+	if j.entries == nil {
+		return nil
+	}
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to encode rollback entry for %s: %v", entry.Path, err)
+	}
+	if _, err := j.entries.Write(append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write rollback journal: %v", err)
+	}
+	j.count++
+	return nil
+}
+
+// preserve moves an existing path into the rollback area, or only records it
+// when the snapshot holds the original. Returns whether the path was moved; an
+// error means the original could not be kept and must not be touched.
+func (j *RollbackJournal) preserve(action, path string) (bool, error) {
+	fi, err := os.Lstat(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, fmt.Errorf("cannot preserve %s for undo: %v", path, err)
+	}
+
+	entry := RollbackEntry{Action: action, Path: path, IsDir: fi.IsDir()}
+	if !j.snapshotCovers(path, fi) {
+		saved := filepath.Join(j.dir, "files", path)
+		if err := os.MkdirAll(filepath.Dir(saved), 0700); err != nil {
+			return false, fmt.Errorf("cannot preserve %s for undo: %v", path, err)
+		}
+		if err := moveRollbackPath(path, saved); err != nil {
+			return false, fmt.Errorf("cannot preserve %s for undo: %v", path, err)
+		}
+		entry.Saved = saved
+	}
+	if err := j.record(entry); err != nil {
+		// Undo would not find the moved original: put it back and leave the path alone
+		if entry.Saved != "" {
+			if moveErr := moveRollbackPath(entry.Saved, path); moveErr != nil {
+				return false, fmt.Errorf("cannot preserve %s for undo: %v (the original is in %s)", path, err, entry.Saved)
+			}
+		}
+		return false, fmt.Errorf("cannot preserve %s for undo: %v", path, err)
+	}
+	return entry.Saved != "", nil
+}
+
+// snapshotCovers reports whether the snapshot holds path and, for a directory,
+// everything below it: all of it must be on the snapshotted subvolume. Nested
+// subvolumes and mounts have a device of their own.
+func (j *RollbackJournal) snapshotCovers(path string, fi os.FileInfo) bool {
+	if j.info.Snapshot == "" || deviceOf(fi) != j.dev {
+		return false
+	}
+	if !fi.IsDir() {
+		return true
+	}
+	covered := true
+	filepath.WalkDir(path, func(_ string, d os.DirEntry, err error) error {
+		if err != nil {
+			covered = false
+			return filepath.SkipAll
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil || deviceOf(info) != j.dev {
+			covered = false
+			return filepath.SkipAll
+		}
+		return nil
+	})
+	return covered
+}
+
+// deviceOf returns the device a file is on, or 0 when it is unknown.
+func deviceOf(fi os.FileInfo) uint64 {
+	if stat, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return uint64(stat.Dev)
+	}
+	return 0
+}
+
+// rollbackBeforeDirectory records an existing directory's metadata, or the fact
+// that it is about to be created, before the sync walk touches it. A failed record
+// loses no data (undo then leaves the directory as the restore made it), so the
+// walk goes on.
+func rollbackBeforeDirectory(dstPath string) {
+	j := activeRollback
+	if j == nil {
+		return
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	fi, err := os.Lstat(dstPath)
+	if os.IsNotExist(err) {
+		j.record(RollbackEntry{Action: rollbackCreated, Path: dstPath, IsDir: true})
+		return
+	}
+	if err != nil || !fi.IsDir() {
+		return
+	}
+	entry := RollbackEntry{Action: rollbackDirMeta, Path: dstPath, IsDir: true, Mode: uint32(fi.Mode()), ModTime: fi.ModTime()}
+	if stat, ok := fi.Sys().(*syscall.Stat_t); ok {
+		entry.UID = int(stat.Uid)
+		entry.GID = int(stat.Gid)
+	}
+	j.record(entry)
+}
+
+// rollbackBeforeWrite preserves a file that is about to be overwritten, or records
+// that a new file is about to be created. On error the file must not be written,
+// since undo could not bring the original back.
+func rollbackBeforeWrite(dstPath string) error {
+	j := activeRollback
+	if j == nil {
+		return nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	if _, err := os.Lstat(dstPath); os.IsNotExist(err) {
+		return j.record(RollbackEntry{Action: rollbackCreated, Path: dstPath})
+	}
+	_, err := j.preserve(rollbackOverwritten, dstPath)
+	return err
+}
+
+// rollbackBeforeDelete preserves a path that the --delete phase is about to remove.
+// Returns true when the path was moved into the rollback area, in which case the
+// caller has nothing left to delete. On error the path must be left in place.
+func rollbackBeforeDelete(path string) (bool, error) {
+	j := activeRollback
+	if j == nil {
+		return false, nil
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+
+	return j.preserve(rollbackDeleted, path)
+}
+
+// moveRollbackPath renames src to dst, falling back to copy and remove when the
+// two paths are on different filesystems.
+func moveRollbackPath(src, dst string) error {
+	err := os.Rename(src, dst)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, syscall.EXDEV) {
+		return err
+	}
+	if err := copyRollbackTree(src, dst); err != nil {
+		return err
+	}
+	return os.RemoveAll(src)
+}
+
+// copyRollbackTree copies a file, symlink or directory tree with ownership,
+// permissions and timestamps preserved.
+func copyRollbackTree(src, dst string) error {
+	type dirTimes struct {
+		path string
+		mod  time.Time
+	}
+	var dirs []dirTimes
+
+	err := filepath.WalkDir(src, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+
+		fi, err := os.Lstat(path)
+		if err != nil {
+			return err
+		}
+		stat, _ := fi.Sys().(*syscall.Stat_t)
+
+		switch {
+		case d.IsDir():
+			if err := os.MkdirAll(target, fi.Mode().Perm()); err != nil {
+				return err
+			}
+			os.Chmod(target, fi.Mode())
+			if stat != nil {
+				os.Lchown(target, int(stat.Uid), int(stat.Gid))
+			}
+			dirs = append(dirs, dirTimes{target, fi.ModTime()})
+		case d.Type()&os.ModeSymlink != 0:
+			link, err := os.Readlink(path)
+			if err != nil {
+				return err
+			}
+			if err := os.Symlink(link, target); err != nil {
+				return err
+			}
+			if stat != nil {
+				os.Lchown(target, int(stat.Uid), int(stat.Gid))
+			}
+		case d.Type().IsRegular():
+			if err := copyFileEfficient(path, target); err != nil {
+				return err
+			}
+			// Originals keep their exact numeric owner even while a restore remaps ids
+			if stat != nil {
+				os.Lchown(target, int(stat.Uid), int(stat.Gid))
+				os.Chmod(target, fi.Mode())
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Directory times last, deepest first, so copying children doesn't disturb them
+	for i := len(dirs) - 1; i >= 0; i-- {
+		os.Chtimes(dirs[i].path, dirs[i].mod, dirs[i].mod)
+	}
+	return nil
+}
+
+// createBtrfsRollbackSnapshot takes a read-only snapshot of targetPath inside the
+// rollback area when the target is the root of a btrfs subvolume. Returns the
+// snapshot and the device of the subvolume it copies.
+func createBtrfsRollbackSnapshot(targetPath, areaDir string) (string, uint64, error) {
+	var fs syscall.Statfs_t
+	if err := syscall.Statfs(targetPath, &fs); err != nil {
+		return "", 0, err
+	}
+	if int64(fs.Type) != btrfsSuperMagic {
+		return "", 0, fmt.Errorf("target is not on btrfs")
+	}
+
+	fi, err := os.Stat(targetPath)
+	if err != nil {
+		return "", 0, err
+	}
+	// Subvolume roots always have inode 256 on btrfs
+	stat, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok || stat.Ino != 256 {
+		return "", 0, fmt.Errorf("target is not a btrfs subvolume root")
+	}
+
+	btrfs, err := exec.LookPath("btrfs")
+	if err != nil {
+		return "", 0, fmt.Errorf("btrfs command not available")
+	}
+
+	snapshot := filepath.Join(areaDir, "snapshot")
+	out, err := exec.Command(btrfs, "subvolume", "snapshot", "-r", targetPath, snapshot).CombinedOutput()
+	if err != nil {
+		return "", 0, fmt.Errorf("btrfs snapshot failed: %v (%s)", err, strings.TrimSpace(string(out)))
+	}
+	return snapshot, uint64(stat.Dev), nil
+}
+
+// loadedRollback is a rollback area read back from disk.
+type loadedRollback struct {
+	info RollbackInfo
+	dir  string
+}
+
+// loadLastRollbackInfo reads the rollback area of the most recent restore.
+func loadLastRollbackInfo() (*loadedRollback, error) {
+	data, err := os.ReadFile(lastRestorePointer())
+	if err != nil {
+		return nil, fmt.Errorf("no restore to undo")
+	}
+	dir := strings.TrimSpace(string(data))
+
+	infoData, err := os.ReadFile(filepath.Join(dir, "rollback.json"))
+	if err != nil {
+		return nil, fmt.Errorf("rollback area %s is missing: %v", dir, err)
+	}
+	var info RollbackInfo
+	if err := json.Unmarshal(infoData, &info); err != nil {
+		return nil, fmt.Errorf("rollback area %s is corrupt: %v", dir, err)
+	}
+	return &loadedRollback{info: info, dir: dir}, nil
+}
+
+// loadRollbackEntries reads all journal entries of a rollback area.
+func loadRollbackEntries(dir string) ([]RollbackEntry, error) {
+	f, err := os.Open(filepath.Join(dir, "entries.jsonl"))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var entries []RollbackEntry
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var entry RollbackEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			// A torn final line from an interrupted restore - everything before it is valid
+			break
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
+
+// discardRollback deletes a rollback area, including its btrfs snapshot.
+func discardRollback(r *loadedRollback) error {
+	if r.info.Snapshot != "" {
+		if btrfs, err := exec.LookPath("btrfs"); err == nil {
+			exec.Command(btrfs, "subvolume", "delete", r.info.Snapshot).Run()
+		}
+	}
+	os.Remove(lastRestorePointer())
+	if err := os.RemoveAll(r.dir); err != nil {
+		return err
+	}
+	// Drop the per-target rollback directory once it holds no other areas
+	os.Remove(filepath.Dir(r.dir))
+	return nil
+}
+
+// LastRestoreSummary describes the restore that "Undo Last Restore" would revert.
+func LastRestoreSummary() (string, error) {
+	r, err := loadLastRollbackInfo()
+	if err != nil {
+		return "", err
+	}
+	entries, err := loadRollbackEntries(r.dir)
+	if err != nil {
+		return "", fmt.Errorf("failed to read rollback journal: %v", err)
+	}
+
+	counts := make(map[string]int)
+	for _, entry := range entries {
+		counts[entry.Action]++
+	}
+
+	method := "preserved originals"
+	if r.info.Snapshot != "" {
+		method = "btrfs snapshot"
+	}
+	status := ""
+	if !r.info.Completed {
+		status = "\n⚠️ The restore did not finish - undo will revert what it changed."
+	}
+
+	return fmt.Sprintf("Undo restore from %s\n\nRestored: %s\nTarget: %s\nRollback: %s\n\nFiles to put back: %s\nFiles to remove: %s%s",
+		r.info.Source,
+		r.info.Created.Format("2006-01-02 15:04:05"),
+		r.info.Target,
+		method,
+		FormatNumber(int64(counts[rollbackOverwritten]+counts[rollbackDeleted])),
+		FormatNumber(int64(counts[rollbackCreated])),
+		status), nil
+}
+
+// startUndoRestore creates a Bubble Tea command that reverts the last restore.
+func startUndoRestore() tea.Cmd {
+	return func() tea.Msg {
+		logPath := getLogFilePath()
+		logFile, err := os.OpenFile(logPath, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+		if err == nil {
+			fmt.Fprintf(logFile, "\n=== UNDO RESTORE STARTED: %s ===\n", time.Now().Format(time.RFC3339))
+			defer logFile.Close()
+		}
+
+		if err := undoLastRestore(logFile); err != nil {
+			if logFile != nil {
+				fmt.Fprintf(logFile, "UNDO RESTORE ERROR: %v\n", err)
+			}
+			return ProgressUpdate{Error: fmt.Errorf("undo restore failed: %v", err), Done: true}
+		}
+		return ProgressUpdate{Percentage: 1.0, Message: "Last restore has been undone - files are back as they were", Done: true}
+	}
+}
+
+// undoLastRestore replays the journal of the last restore in reverse order.
+func undoLastRestore(logFile *os.File) error {
+	r, err := loadLastRollbackInfo()
+	if err != nil {
+		return err
+	}
+	entries, err := loadRollbackEntries(r.dir)
+	if err != nil {
+		return fmt.Errorf("failed to read rollback journal: %v", err)
+	}
+
+	failures := 0
+	for i := len(entries) - 1; i >= 0; i-- {
+		if err := undoRollbackEntry(r, entries[i]); err != nil {
+			failures++
+			if logFile != nil {
+				fmt.Fprintf(logFile, "Undo: %s %s: %v\n", entries[i].Action, entries[i].Path, err)
+			}
+		}
+	}
+
+	if logFile != nil {
+		fmt.Fprintf(logFile, "Undo complete: %d entries replayed, %d failures\n", len(entries), failures)
+	}
+	if failures > 0 {
+		return fmt.Errorf("%d of %d changes could not be reverted (rollback area kept at %s, see log)", failures, len(entries), r.dir)
+	}
+	return discardRollback(r)
+}
+
+// undoRollbackEntry reverts a single journal entry.
+func undoRollbackEntry(r *loadedRollback, entry RollbackEntry) error {
+	switch entry.Action {
+	case rollbackCreated:
+		if entry.IsDir {
+			// Only remove directories the restore created that are empty again;
+			// anything added afterwards by the user stays
+			err := os.Remove(entry.Path)
+			if err != nil && !os.IsNotExist(err) && !errors.Is(err, syscall.ENOTEMPTY) {
+				return err
+			}
+			return nil
+		}
+		if err := os.Remove(entry.Path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return nil
+
+	case rollbackOverwritten, rollbackDeleted:
+		original := entry.Saved
+		if original == "" {
+			rel, err := filepath.Rel(r.info.Target, entry.Path)
+			if err != nil {
+				return err
+			}
+			original = filepath.Join(r.info.Snapshot, rel)
+		}
+		// Nothing is removed unless the original is there to take its place
+		if _, err := os.Lstat(original); err != nil {
+			return fmt.Errorf("original is missing from the rollback area: %v", err)
+		}
+		if err := os.RemoveAll(entry.Path); err != nil {
+			return err
+		}
+		if entry.Saved != "" {
+			return moveRollbackPath(entry.Saved, entry.Path)
+		}
+		return copyRollbackTree(original, entry.Path)
+
+	case rollbackDirMeta:
+		os.Chmod(entry.Path, os.FileMode(entry.Mode))
+		os.Lchown(entry.Path, entry.UID, entry.GID)
+		return os.Chtimes(entry.Path, entry.ModTime, entry.ModTime)
+	}
+	return nil
+}
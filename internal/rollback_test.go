@@ -0,0 +1,110 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// testJournal returns a journal for target with its area in a temporary directory.
+func testJournal(t *testing.T, target string) *RollbackJournal {
+	t.Helper()
+	dir := t.TempDir()
+	entries, err := os.Create(filepath.Join(dir, "entries.jsonl"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { entries.Close() })
+	return &RollbackJournal{dir: dir, entries: entries, info: RollbackInfo{Target: target}}
+}
+
+func TestPreserveMovesPathsTheSnapshotDoesNotHold(t *testing.T) {
+	target := t.TempDir()
+	file := filepath.Join(target, "data")
+	os.WriteFile(file, []byte("original"), 0644)
+	fi, _ := os.Lstat(file)
+
+	j := testJournal(t, target)
+	j.info.Snapshot = filepath.Join(j.dir, "snapshot")
+
+	// On the snapshotted device the snapshot has it; nothing is moved
+	j.dev = deviceOf(fi)
+	if moved, err := j.preserve(rollbackOverwritten, file); err != nil || moved {
+		t.Fatalf("preserve on the snapshot device: moved=%v err=%v", moved, err)
+	}
+
+	// Anywhere else (nested subvolume, other mount) the original is moved aside
+	j.dev = deviceOf(fi) + 1
+	moved, err := j.preserve(rollbackOverwritten, file)
+	if err != nil || !moved {
+		t.Fatalf("preserve off the snapshot device: moved=%v err=%v", moved, err)
+	}
+	data, err := os.ReadFile(filepath.Join(j.dir, "files", file))
+	if err != nil || string(data) != "original" {
+		t.Fatalf("saved original = %q, %v", data, err)
+	}
+}
+
+func TestRollbackBeforeWriteFailsWhenOriginalCannotBeKept(t *testing.T) {
+	target := t.TempDir()
+	file := filepath.Join(target, "data")
+	os.WriteFile(file, []byte("original"), 0644)
+
+	j := testJournal(t, target)
+	// The rollback area cannot hold anything below a regular file
+	blocker := filepath.Join(j.dir, "files")
+	os.WriteFile(blocker, nil, 0644)
+
+	activeRollback = j
+	defer func() { activeRollback = nil }()
+
+	if err := rollbackBeforeWrite(file); err == nil {
+		t.Fatal("rollbackBeforeWrite succeeded without preserving the original")
+	}
+	if moved, err := rollbackBeforeDelete(file); err == nil || moved {
+		t.Fatalf("rollbackBeforeDelete: moved=%v err=%v", moved, err)
+	}
+	if data, _ := os.ReadFile(file); string(data) != "original" {
+		t.Fatalf("original was changed: %q", data)
+	}
+}
+
+func TestPreservePutsOriginalBackWhenJournalWriteFails(t *testing.T) {
+	target := t.TempDir()
+	file := filepath.Join(target, "data")
+	os.WriteFile(file, []byte("original"), 0644)
+
+	// A journal that can no longer be written, as on a full disk
+	j := testJournal(t, target)
+	j.entries.Close()
+
+	if moved, err := j.preserve(rollbackOverwritten, file); err == nil || moved {
+		t.Fatalf("preserve without a journal entry: moved=%v err=%v", moved, err)
+	}
+	if data, err := os.ReadFile(file); err != nil || string(data) != "original" {
+		t.Fatalf("original not put back: %q, %v", data, err)
+	}
+	if _, err := os.Lstat(filepath.Join(j.dir, "files", file)); !os.IsNotExist(err) {
+		t.Fatalf("original left in the rollback area: %v", err)
+	}
+
+	activeRollback = j
+	defer func() { activeRollback = nil }()
+	if err := rollbackBeforeWrite(filepath.Join(target, "new")); err == nil {
+		t.Fatal("rollbackBeforeWrite of a new file succeeded without a journal entry")
+	}
+}
+
+func TestUndoKeepsPathMissingFromSnapshot(t *testing.T) {
+	target := t.TempDir()
+	file := filepath.Join(target, "data")
+	os.WriteFile(file, []byte("restored"), 0644)
+
+	r := &loadedRollback{info: RollbackInfo{Target: target, Snapshot: filepath.Join(t.TempDir(), "snapshot")}}
+	if err := undoRollbackEntry(r, RollbackEntry{Action: rollbackOverwritten, Path: file}); err == nil {
+		t.Fatal("undo succeeded without an original")
+	}
+	if _, err := os.Stat(file); err != nil {
+		t.Fatalf("undo removed a path it could not put back: %v", err)
+	}
+}
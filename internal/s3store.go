@@ -0,0 +1,631 @@
+// Package internal provides the S3 client for object storage destinations.
+//
+// Object storage destinations are given as s3://bucket/prefix. Any service that
+// speaks the S3 API works: AWS itself, or MinIO, Ceph, Garage and the like with
+// --s3-endpoint, which switches to path-style requests (endpoint/bucket/key).
+// Requests are signed with AWS Signature Version 4. Credentials come from the
+// usual AWS environment variables or from the invoking user's ~/.aws/credentials.
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// s3Endpoint is the service URL given with --s3-endpoint ("" = AWS).
+var s3Endpoint string
+
+// s3Region is the region given with --s3-region.
+var s3Region string
+
+// s3EnvironmentVariables are the variables the S3 client reads; they are kept
+// when Migrate re-runs itself with sudo.
+var s3EnvironmentVariables = []string{
+	"AWS_ACCESS_KEY_ID", "AWS_SECRET_ACCESS_KEY", "AWS_SESSION_TOKEN",
+	"AWS_REGION", "AWS_DEFAULT_REGION", "AWS_PROFILE",
+	"AWS_ENDPOINT_URL", "AWS_ENDPOINT_URL_S3",
+}
+
+// S3EnvironmentVariables returns the names of the S3 settings present in the environment.
+func S3EnvironmentVariables() []string {
+	var set []string
+	for _, name := range s3EnvironmentVariables {
+		if os.Getenv(name) != "" {
+			set = append(set, name)
+		}
+	}
+	return set
+}
+
+// SetS3Endpoint makes s3:// destinations use an S3-compatible service such as MinIO (--s3-endpoint).
+func SetS3Endpoint(endpoint string) error {
+	u, err := url.Parse(endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("invalid endpoint %q (expected http[s]://host[:port])", endpoint)
+	}
+	s3Endpoint = strings.TrimSuffix(endpoint, "/")
+	return nil
+}
+
+// SetS3Region sets the region s3:// requests are signed for (--s3-region).
+func SetS3Region(region string) {
+	s3Region = region
+}
+
+// isObjectStoreDestination reports whether a destination is an s3:// URL.
+func isObjectStoreDestination(destination string) bool {
+	return strings.HasPrefix(destination, "s3://")
+}
+
+// objectStoreTarget is a parsed s3:// destination.
+type objectStoreTarget struct {
+	bucket string
+	prefix string // Key prefix without slashes at either end, may be ""
+}
+
+// parseObjectStoreTarget parses s3://bucket[/prefix].
+func parseObjectStoreTarget(destination string) (*objectStoreTarget, error) {
+	u, err := url.Parse(destination)
+	if err != nil || u.Scheme != "s3" || u.Host == "" || u.User != nil || u.Port() != "" {
+		return nil, fmt.Errorf("invalid object storage destination %q (expected s3://bucket/prefix)", destination)
+	}
+	return &objectStoreTarget{bucket: u.Host, prefix: strings.Trim(u.Path, "/")}, nil
+}
+
+// key returns the object key of name below the destination's prefix.
+func (t *objectStoreTarget) key(name string) string {
+	if t.prefix == "" {
+		return name
+	}
+	return t.prefix + "/" + name
+}
+
+// s3Credentials are the keys requests are signed with.
+type s3Credentials struct {
+	accessKey    string
+	secretKey    string
+	sessionToken string
+}
+
+// awsHomeDir is the ~/.aws directory of the user who started Migrate (not root under sudo).
+func awsHomeDir() string {
+	if u, err := user.Lookup(getCurrentUser()); err == nil {
+		return filepath.Join(u.HomeDir, ".aws")
+	}
+	return filepath.Join("/home", getCurrentUser(), ".aws")
+}
+
+// readAWSConfigSection returns the keys of one section of an AWS INI file.
+func readAWSConfigSection(path, section string) map[string]string {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	values := make(map[string]string)
+	inSection := false
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' || line[0] == ';' {
+			continue
+		}
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			inSection = strings.TrimSpace(line[1:len(line)-1]) == section
+			continue
+		}
+		if key, value, ok := strings.Cut(line, "="); ok && inSection {
+			values[strings.TrimSpace(key)] = strings.TrimSpace(value)
+		}
+	}
+	return values
+}
+
+// awsProfile is the profile to read from the AWS files.
+func awsProfile() string {
+	if profile := os.Getenv("AWS_PROFILE"); profile != "" {
+		return profile
+	}
+	return "default"
+}
+
+// loadS3Credentials reads the credentials from the environment, then from ~/.aws/credentials.
+func loadS3Credentials() (*s3Credentials, error) {
+	if access := os.Getenv("AWS_ACCESS_KEY_ID"); access != "" {
+		return &s3Credentials{
+			accessKey:    access,
+			secretKey:    os.Getenv("AWS_SECRET_ACCESS_KEY"),
+			sessionToken: os.Getenv("AWS_SESSION_TOKEN"),
+		}, nil
+	}
+	file := filepath.Join(awsHomeDir(), "credentials")
+	values := readAWSConfigSection(file, awsProfile())
+	if values["aws_access_key_id"] == "" {
+		return nil, fmt.Errorf("no S3 credentials: set AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY or add profile [%s] to %s", awsProfile(), file)
+	}
+	return &s3Credentials{
+		accessKey:    values["aws_access_key_id"],
+		secretKey:    values["aws_secret_access_key"],
+		sessionToken: values["aws_session_token"],
+	}, nil
+}
+
+// s3RegionSetting returns the region from --s3-region, the environment or ~/.aws/config.
+func s3RegionSetting() string {
+	for _, region := range []string{s3Region, os.Getenv("AWS_REGION"), os.Getenv("AWS_DEFAULT_REGION")} {
+		if region != "" {
+			return region
+		}
+	}
+	section := "profile " + awsProfile()
+	if awsProfile() == "default" {
+		section = "default"
+	}
+	if region := readAWSConfigSection(filepath.Join(awsHomeDir(), "config"), section)["region"]; region != "" {
+		return region
+	}
+	return "us-east-1"
+}
+
+// s3EndpointSetting returns the endpoint from --s3-endpoint or the environment ("" = AWS).
+func s3EndpointSetting() string {
+	for _, endpoint := range []string{s3Endpoint, os.Getenv("AWS_ENDPOINT_URL_S3"), os.Getenv("AWS_ENDPOINT_URL")} {
+		if endpoint != "" {
+			return strings.TrimSuffix(endpoint, "/")
+		}
+	}
+	return ""
+}
+
+// s3Client talks to one bucket.
+type s3Client struct {
+	http        *http.Client
+	endpoint    *url.URL // Scheme and host requests go to
+	bucket      string
+	pathStyle   bool // Bucket in the path instead of the host name
+	region      string
+	credentials *s3Credentials
+}
+
+// newS3Client returns a client for bucket at endpoint ("" = AWS in region).
+func newS3Client(endpoint, region, bucket string, credentials *s3Credentials) (*s3Client, error) {
+	c := &s3Client{
+		http:        &http.Client{Timeout: 10 * time.Minute},
+		bucket:      bucket,
+		region:      region,
+		credentials: credentials,
+	}
+	if endpoint == "" {
+		// Virtual-hosted style, except for bucket names TLS cannot cover
+		c.pathStyle = strings.Contains(bucket, ".")
+		host := "s3." + region + ".amazonaws.com"
+		if !c.pathStyle {
+			host = bucket + "." + host
+		}
+		c.endpoint = &url.URL{Scheme: "https", Host: host}
+		return c, nil
+	}
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("invalid S3 endpoint %q", endpoint)
+	}
+	c.endpoint = &url.URL{Scheme: u.Scheme, Host: u.Host}
+	c.pathStyle = true
+	return c, nil
+}
+
+// s3Error is an error response from the service.
+type s3Error struct {
+	Status  int    `xml:"-"`
+	Code    string `xml:"Code"`
+	Message string `xml:"Message"`
+}
+
+func (e *s3Error) Error() string {
+	if e.Message != "" {
+		return fmt.Sprintf("%s: %s (HTTP %d)", e.Code, e.Message, e.Status)
+	}
+	if e.Code != "" {
+		return fmt.Sprintf("%s (HTTP %d)", e.Code, e.Status)
+	}
+	return fmt.Sprintf("HTTP %d", e.Status)
+}
+
+// isS3NotFound reports whether err says a key, bucket or upload does not exist.
+func isS3NotFound(err error) bool {
+	e, ok := err.(*s3Error)
+	return ok && (e.Status == http.StatusNotFound || e.Code == "NoSuchKey" || e.Code == "NoSuchUpload")
+}
+
+// s3Escape percent-encodes s as SigV4 requires: everything except unreserved
+// characters, and '/' too unless keepSlash is set.
+func s3Escape(s string, keepSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (c == '/' && keepSlash) {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// s3CanonicalQuery encodes a query string in the sorted form SigV4 signs.
+func s3CanonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for key := range query {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	var parts []string
+	for _, key := range keys {
+		values := append([]string(nil), query[key]...)
+		sort.Strings(values)
+		for _, value := range values {
+			parts = append(parts, s3Escape(key, false)+"="+s3Escape(value, false))
+		}
+	}
+	return strings.Join(parts, "&")
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// sign adds the SigV4 Authorization header to req, whose body hashes to payloadHash.
+func (c *s3Client) sign(req *http.Request, payloadHash string, now time.Time) {
+	amzDate := now.UTC().Format("20060102T150405Z")
+	date := amzDate[:8]
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if c.credentials.sessionToken != "" {
+		req.Header.Set("X-Amz-Security-Token", c.credentials.sessionToken)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name := range req.Header {
+		lower := strings.ToLower(name)
+		if strings.HasPrefix(lower, "x-amz-") || lower == "content-type" || lower == "content-md5" {
+			headers[lower] = strings.TrimSpace(req.Header.Get(name))
+		}
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		canonicalHeaders.String(),
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := date + "/" + c.region + "/s3/aws4_request"
+	requestHash := sha256.Sum256([]byte(canonicalRequest))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(requestHash[:])
+
+	key := hmacSHA256([]byte("AWS4"+c.credentials.secretKey), date)
+	key = hmacSHA256(key, c.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.credentials.accessKey, scope, signedHeaders, signature))
+}
+
+// s3Attempts is how often a request is sent before a network or server error is returned.
+const s3Attempts = 4
+
+// do sends a signed request for key (""= the bucket) and returns the response
+// of a successful one. body is sent as is, so requests can be retried; network
+// errors and 5xx responses are retried with a growing delay.
+func (c *s3Client) do(method, key string, query url.Values, header http.Header, body []byte) (*http.Response, error) {
+	escapedPath := "/"
+	if c.pathStyle {
+		escapedPath += s3Escape(c.bucket, false)
+		if key != "" {
+			escapedPath += "/"
+		}
+	}
+	escapedPath += s3Escape(key, true)
+	unescapedPath, _ := url.PathUnescape(escapedPath)
+
+	payload := sha256.Sum256(body)
+	payloadHash := hex.EncodeToString(payload[:])
+
+	var lastErr error
+	for attempt := 0; attempt < s3Attempts; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(attempt*attempt) * time.Second)
+		}
+		u := *c.endpoint
+		u.Path = unescapedPath
+		u.RawPath = escapedPath
+		u.RawQuery = s3CanonicalQuery(query)
+		req, err := http.NewRequest(method, u.String(), bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.ContentLength = int64(len(body))
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		c.sign(req, payloadHash, time.Now())
+
+		resp, err := c.http.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if resp.StatusCode < 300 {
+			return resp, nil
+		}
+
+		e := &s3Error{Status: resp.StatusCode}
+		data, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+		resp.Body.Close()
+		xml.Unmarshal(data, e)
+		if resp.StatusCode < 500 {
+			return nil, e
+		}
+		lastErr = e
+	}
+	return nil, lastErr
+}
+
+// discard reads and closes a response whose body is not needed.
+func discard(resp *http.Response) {
+	io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+}
+
+// putObject stores data under key.
+func (c *s3Client) putObject(key string, data []byte) error {
+	resp, err := c.do(http.MethodPut, key, nil, nil, data)
+	if err != nil {
+		return err
+	}
+	discard(resp)
+	return nil
+}
+
+// getObject returns the content of key.
+func (c *s3Client) getObject(key string) (io.ReadCloser, error) {
+	resp, err := c.do(http.MethodGet, key, nil, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// readObject returns the content of a small object.
+func (c *s3Client) readObject(key string) ([]byte, error) {
+	body, err := c.getObject(key)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+	return io.ReadAll(body)
+}
+
+// headObject returns the size of key.
+func (c *s3Client) headObject(key string) (int64, error) {
+	resp, err := c.do(http.MethodHead, key, nil, nil, nil)
+	if err != nil {
+		return 0, err
+	}
+	discard(resp)
+	return resp.ContentLength, nil
+}
+
+// deleteObject removes key; a missing key is not an error.
+func (c *s3Client) deleteObject(key string) error {
+	resp, err := c.do(http.MethodDelete, key, nil, nil, nil)
+	if err != nil {
+		if isS3NotFound(err) {
+			return nil
+		}
+		return err
+	}
+	discard(resp)
+	return nil
+}
+
+// s3Object is an entry of a bucket listing.
+type s3Object struct {
+	Key          string    `xml:"Key"`
+	Size         int64     `xml:"Size"`
+	LastModified time.Time `xml:"LastModified"`
+}
+
+// listObjects returns every object whose key starts with prefix, in key order.
+func (c *s3Client) listObjects(prefix string) ([]s3Object, error) {
+	var objects []s3Object
+	token := ""
+	for {
+		query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := c.do(http.MethodGet, "", query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Contents              []s3Object `xml:"Contents"`
+			IsTruncated           bool       `xml:"IsTruncated"`
+			NextContinuationToken string     `xml:"NextContinuationToken"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&page)
+		discard(resp)
+		if err != nil {
+			return nil, fmt.Errorf("invalid listing: %v", err)
+		}
+		objects = append(objects, page.Contents...)
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			return objects, nil
+		}
+		token = page.NextContinuationToken
+	}
+}
+
+// createMultipartUpload starts a multipart upload of key and returns its ID.
+func (c *s3Client) createMultipartUpload(key string) (string, error) {
+	resp, err := c.do(http.MethodPost, key, url.Values{"uploads": {""}}, nil, nil)
+	if err != nil {
+		return "", err
+	}
+	var result struct {
+		UploadID string `xml:"UploadId"`
+	}
+	err = xml.NewDecoder(resp.Body).Decode(&result)
+	discard(resp)
+	if err != nil || result.UploadID == "" {
+		return "", fmt.Errorf("no upload ID in response: %v", err)
+	}
+	return result.UploadID, nil
+}
+
+// uploadPart stores part number n of an upload and returns its ETag.
+func (c *s3Client) uploadPart(key, uploadID string, n int, data []byte) (string, error) {
+	query := url.Values{"partNumber": {strconv.Itoa(n)}, "uploadId": {uploadID}}
+	resp, err := c.do(http.MethodPut, key, query, nil, data)
+	if err != nil {
+		return "", err
+	}
+	discard(resp)
+	etag := resp.Header.Get("ETag")
+	if etag == "" {
+		return "", fmt.Errorf("no ETag for part %d", n)
+	}
+	return etag, nil
+}
+
+// s3Part is an uploaded part of a multipart upload.
+type s3Part struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+// listParts returns the ETags of the parts an upload holds, by part number.
+func (c *s3Client) listParts(key, uploadID string) (map[int]string, error) {
+	parts := make(map[int]string)
+	marker := ""
+	for {
+		query := url.Values{"uploadId": {uploadID}}
+		if marker != "" {
+			query.Set("part-number-marker", marker)
+		}
+		resp, err := c.do(http.MethodGet, key, query, nil, nil)
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Parts                []s3Part `xml:"Part"`
+			IsTruncated          bool     `xml:"IsTruncated"`
+			NextPartNumberMarker string   `xml:"NextPartNumberMarker"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&page)
+		discard(resp)
+		if err != nil {
+			return nil, fmt.Errorf("invalid part listing: %v", err)
+		}
+		for _, part := range page.Parts {
+			parts[part.PartNumber] = part.ETag
+		}
+		if !page.IsTruncated || page.NextPartNumberMarker == "" {
+			return parts, nil
+		}
+		marker = page.NextPartNumberMarker
+	}
+}
+
+// completeMultipartUpload joins the parts into the object.
+func (c *s3Client) completeMultipartUpload(key, uploadID string, parts []s3Part) error {
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name `xml:"CompleteMultipartUpload"`
+		Parts   []s3Part `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(http.MethodPost, key, url.Values{"uploadId": {uploadID}}, nil, body)
+	if err != nil {
+		return err
+	}
+	// The service can report a failure in the body of a 200 response
+	data, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if bytes.Contains(data, []byte("<Error>")) {
+		e := &s3Error{Status: resp.StatusCode}
+		xml.Unmarshal(data, e)
+		return e
+	}
+	return nil
+}
+
+// abortMultipartUpload discards an upload and its parts.
+func (c *s3Client) abortMultipartUpload(key, uploadID string) error {
+	resp, err := c.do(http.MethodDelete, key, url.Values{"uploadId": {uploadID}}, nil, nil)
+	if err != nil {
+		if isS3NotFound(err) {
+			return nil
+		}
+		return err
+	}
+	discard(resp)
+	return nil
+}
+
+// openObjectStore connects to an s3:// destination and checks the bucket can be listed.
+func openObjectStore(destination string, logFile *os.File) (*s3Client, *objectStoreTarget, error) {
+	target, err := parseObjectStoreTarget(destination)
+	if err != nil {
+		return nil, nil, err
+	}
+	credentials, err := loadS3Credentials()
+	if err != nil {
+		return nil, nil, err
+	}
+	client, err := newS3Client(s3EndpointSetting(), s3RegionSetting(), target.bucket, credentials)
+	if err != nil {
+		return nil, nil, err
+	}
+	if logFile != nil {
+		fmt.Fprintf(logFile, "Object storage: bucket %s at %s (region %s, path-style %v)\n", target.bucket, client.endpoint, client.region, client.pathStyle)
+	}
+	if _, err := client.listObjects(target.key("BACKUP-INFO.txt")); err != nil {
+		return nil, nil, fmt.Errorf("cannot access bucket %s: %v", target.bucket, err)
+	}
+	return client, target, nil
+}
@@ -0,0 +1,450 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3 is a MinIO-style stand-in for one bucket: it checks every request's
+// SigV4 signature on its own, and serves objects, listings and multipart uploads.
+type fakeS3 struct {
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+
+	mu          sync.Mutex
+	objects     map[string][]byte
+	uploads     map[string]*fakeUpload
+	nextUpload  int
+	partUploads int // UploadPart requests received
+	failNext    int // Requests still to answer with 500
+}
+
+type fakeUpload struct {
+	key   string
+	parts map[int][]byte
+}
+
+// newFakeS3 starts the stand-in and returns a client signed with the right keys.
+func newFakeS3(t *testing.T) (*fakeS3, *s3Client) {
+	t.Helper()
+	s := &fakeS3{
+		bucket:    "backups",
+		region:    "eu-test-1",
+		accessKey: "AKIDMIGRATETEST",
+		secretKey: "wJalrXUtnFEMI/K7MDENG/bPxRfiCYEXAMPLEKEY",
+		objects:   make(map[string][]byte),
+		uploads:   make(map[string]*fakeUpload),
+	}
+	server := httptest.NewServer(s)
+	t.Cleanup(server.Close)
+
+	client, err := newS3Client(server.URL, s.region, s.bucket, &s3Credentials{accessKey: s.accessKey, secretKey: s.secretKey})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, client
+}
+
+func etagOf(data []byte) string {
+	sum := md5.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+// awsEscape percent-encodes one URI component the way the SigV4 documentation describes.
+func awsEscape(s string) string {
+	return strings.ReplaceAll(url.QueryEscape(s), "+", "%20")
+}
+
+// checkSignature recomputes the SigV4 signature of r from scratch and returns
+// the S3 error code for a mismatch, or "".
+func (s *fakeS3) checkSignature(r *http.Request, body []byte) string {
+	auth, ok := strings.CutPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ")
+	if !ok {
+		return "AccessDenied"
+	}
+	fields := make(map[string]string)
+	for _, part := range strings.Split(auth, ", ") {
+		key, value, _ := strings.Cut(part, "=")
+		fields[key] = value
+	}
+	amzDate := r.Header.Get("X-Amz-Date")
+	credential := strings.Split(fields["Credential"], "/")
+	if len(credential) != 5 || len(amzDate) != 16 {
+		return "AuthorizationHeaderMalformed"
+	}
+	if credential[0] != s.accessKey {
+		return "InvalidAccessKeyId"
+	}
+	if credential[1] != amzDate[:8] || credential[2] != s.region || credential[3] != "s3" || credential[4] != "aws4_request" {
+		return "AuthorizationHeaderMalformed"
+	}
+	payload := sha256.Sum256(body)
+	if r.Header.Get("X-Amz-Content-Sha256") != hex.EncodeToString(payload[:]) {
+		return "XAmzContentSHA256Mismatch"
+	}
+
+	segments := strings.Split(r.URL.Path, "/")
+	for i := range segments {
+		segments[i] = awsEscape(segments[i])
+	}
+	query, _ := url.ParseQuery(r.URL.RawQuery)
+	var queryParts []string
+	for key, values := range query {
+		for _, value := range values {
+			queryParts = append(queryParts, awsEscape(key)+"="+awsEscape(value))
+		}
+	}
+	sort.Strings(queryParts)
+	var headers strings.Builder
+	signed := strings.Split(fields["SignedHeaders"], ";")
+	for _, name := range signed {
+		value := r.Header.Get(name)
+		if name == "host" {
+			value = r.Host
+		}
+		headers.WriteString(name + ":" + strings.TrimSpace(value) + "\n")
+	}
+	if !strings.Contains(fields["SignedHeaders"], "host") || !strings.Contains(fields["SignedHeaders"], "x-amz-date") {
+		return "AccessDenied"
+	}
+
+	canonical := r.Method + "\n" + strings.Join(segments, "/") + "\n" + strings.Join(queryParts, "&") + "\n" +
+		headers.String() + "\n" + fields["SignedHeaders"] + "\n" + hex.EncodeToString(payload[:])
+	canonicalHash := sha256.Sum256([]byte(canonical))
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + strings.Join(credential[1:], "/") + "\n" + hex.EncodeToString(canonicalHash[:])
+
+	key := []byte("AWS4" + s.secretKey)
+	for _, part := range []string{credential[1], s.region, "s3", "aws4_request", stringToSign} {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(part))
+		key = mac.Sum(nil)
+	}
+	if !hmac.Equal([]byte(hex.EncodeToString(key)), []byte(fields["Signature"])) {
+		return "SignatureDoesNotMatch"
+	}
+	return ""
+}
+
+func (s *fakeS3) fail(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	fmt.Fprintf(w, "<Error><Code>%s</Code><Message>fake S3</Message></Error>", code)
+}
+
+func (s *fakeS3) reply(w http.ResponseWriter, v any) {
+	data, _ := xml.Marshal(v)
+	w.Write(data)
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.failNext > 0 {
+		s.failNext--
+		s.fail(w, http.StatusServiceUnavailable, "SlowDown")
+		return
+	}
+	if code := s.checkSignature(r, body); code != "" {
+		s.fail(w, http.StatusForbidden, code)
+		return
+	}
+	rest, ok := strings.CutPrefix(r.URL.Path, "/"+s.bucket)
+	if !ok {
+		s.fail(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+	key := strings.TrimPrefix(rest, "/")
+	query := r.URL.Query()
+
+	switch {
+	case key == "" && r.Method == http.MethodGet && query.Get("list-type") == "2":
+		s.listObjects(w, query)
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		s.nextUpload++
+		id := fmt.Sprintf("upload-%d", s.nextUpload)
+		s.uploads[id] = &fakeUpload{key: key, parts: make(map[int][]byte)}
+		s.reply(w, struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			UploadID string   `xml:"UploadId"`
+		}{UploadID: id})
+	case query.Has("uploadId"):
+		s.multipart(w, r.Method, key, query, body)
+	case r.Method == http.MethodPut:
+		s.objects[key] = body
+		w.Header().Set("ETag", etagOf(body))
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		data, ok := s.objects[key]
+		if !ok {
+			s.fail(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+		if r.Method == http.MethodGet {
+			w.Write(data)
+		}
+	case r.Method == http.MethodDelete:
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		s.fail(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+// listObjects answers ListObjectsV2 two keys per page, so paging is exercised.
+func (s *fakeS3) listObjects(w http.ResponseWriter, query url.Values) {
+	var keys []string
+	for key := range s.objects {
+		if strings.HasPrefix(key, query.Get("prefix")) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	start, _ := strconv.Atoi(query.Get("continuation-token"))
+
+	type content struct {
+		Key          string `xml:"Key"`
+		Size         int    `xml:"Size"`
+		LastModified string `xml:"LastModified"`
+	}
+	result := struct {
+		XMLName               xml.Name  `xml:"ListBucketResult"`
+		Contents              []content `xml:"Contents"`
+		IsTruncated           bool      `xml:"IsTruncated"`
+		NextContinuationToken string    `xml:"NextContinuationToken,omitempty"`
+	}{}
+	for i := start; i < len(keys) && i < start+2; i++ {
+		result.Contents = append(result.Contents, content{Key: keys[i], Size: len(s.objects[keys[i]]), LastModified: time.Now().UTC().Format(time.RFC3339)})
+	}
+	if start+2 < len(keys) {
+		result.IsTruncated = true
+		result.NextContinuationToken = strconv.Itoa(start + 2)
+	}
+	s.reply(w, result)
+}
+
+func (s *fakeS3) multipart(w http.ResponseWriter, method, key string, query url.Values, body []byte) {
+	upload, ok := s.uploads[query.Get("uploadId")]
+	if !ok || upload.key != key {
+		s.fail(w, http.StatusNotFound, "NoSuchUpload")
+		return
+	}
+	switch method {
+	case http.MethodPut:
+		n, _ := strconv.Atoi(query.Get("partNumber"))
+		upload.parts[n] = body
+		s.partUploads++
+		w.Header().Set("ETag", etagOf(body))
+	case http.MethodGet:
+		result := struct {
+			XMLName xml.Name `xml:"ListPartsResult"`
+			Parts   []s3Part `xml:"Part"`
+		}{}
+		for n, data := range upload.parts {
+			result.Parts = append(result.Parts, s3Part{PartNumber: n, ETag: etagOf(data)})
+		}
+		sort.Slice(result.Parts, func(i, j int) bool { return result.Parts[i].PartNumber < result.Parts[j].PartNumber })
+		s.reply(w, result)
+	case http.MethodPost:
+		var request struct {
+			Parts []s3Part `xml:"Part"`
+		}
+		if xml.Unmarshal(body, &request) != nil || len(request.Parts) == 0 {
+			s.fail(w, http.StatusBadRequest, "MalformedXML")
+			return
+		}
+		var object []byte
+		for i, part := range request.Parts {
+			data, ok := upload.parts[part.PartNumber]
+			if part.PartNumber != i+1 || !ok || etagOf(data) != part.ETag {
+				// Like S3, report the failure in the body of a 200 response
+				fmt.Fprintf(w, "<Error><Code>InvalidPart</Code><Message>part %d</Message></Error>", part.PartNumber)
+				return
+			}
+			object = append(object, data...)
+		}
+		s.objects[key] = object
+		delete(s.uploads, query.Get("uploadId"))
+		s.reply(w, struct {
+			XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+			Key     string   `xml:"Key"`
+		}{Key: key})
+	case http.MethodDelete:
+		delete(s.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func TestS3ClientObjects(t *testing.T) {
+	s, client := newFakeS3(t)
+
+	// Keys with spaces, reserved and non-ASCII characters must sign the same on both sides
+	keys := []string{"host/BACKUP-INFO.txt", "host/a b+c=d&e.json", "host/Café/ünï~code", "other/x"}
+	for _, key := range keys {
+		if err := client.putObject(key, []byte("content of "+key)); err != nil {
+			t.Fatalf("put %s: %v", key, err)
+		}
+	}
+	for _, key := range keys {
+		data, err := client.readObject(key)
+		if err != nil || string(data) != "content of "+key {
+			t.Fatalf("get %s: %q, %v", key, data, err)
+		}
+	}
+	if size, err := client.headObject(keys[1]); err != nil || size != int64(len("content of "+keys[1])) {
+		t.Fatalf("head: %d, %v", size, err)
+	}
+
+	objects, err := client.listObjects("host/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(objects) != 3 {
+		t.Fatalf("listing over several pages returned %d objects, want 3: %+v", len(objects), objects)
+	}
+
+	if err := client.deleteObject(keys[0]); err != nil {
+		t.Fatal(err)
+	}
+	if err := client.deleteObject(keys[0]); err != nil {
+		t.Fatalf("deleting a missing key: %v", err)
+	}
+	if _, err := client.readObject(keys[0]); !isS3NotFound(err) {
+		t.Fatalf("deleted object still readable: %v", err)
+	}
+	if len(s.objects) != 3 {
+		t.Fatalf("%d objects left, want 3", len(s.objects))
+	}
+}
+
+func TestS3ClientRejectedSignature(t *testing.T) {
+	s, client := newFakeS3(t)
+	client.credentials = &s3Credentials{accessKey: s.accessKey, secretKey: "not-the-secret"}
+
+	err := client.putObject("key", []byte("data"))
+	if e, ok := err.(*s3Error); !ok || e.Code != "SignatureDoesNotMatch" || e.Status != http.StatusForbidden {
+		t.Fatalf("wrong secret not refused: %v", err)
+	}
+	if len(s.objects) != 0 {
+		t.Fatal("object stored despite a bad signature")
+	}
+}
+
+func TestS3ClientRetriesServerErrors(t *testing.T) {
+	s, client := newFakeS3(t)
+	s.failNext = 1
+
+	if err := client.putObject("key", []byte("data")); err != nil {
+		t.Fatalf("a single 503 was not retried: %v", err)
+	}
+	if string(s.objects["key"]) != "data" {
+		t.Fatal("object not stored after the retry")
+	}
+}
+
+// writeVolumes streams data through a volume writer with small volumes and parts.
+func writeVolumes(t *testing.T, client *s3Client, state *objectUploadState, statePath string, data []byte) *objectVolumeWriter {
+	t.Helper()
+	w := newObjectVolumeWriter(client, "host/migrate-archive/backup.tar.zst", state, statePath, nil)
+	w.partSize = 16
+	// Odd-sized writes, so parts and volumes are cut across them
+	for chunk := data; len(chunk) > 0; {
+		n := min(7, len(chunk))
+		if _, err := w.Write(chunk[:n]); err != nil {
+			t.Fatal(err)
+		}
+		chunk = chunk[n:]
+	}
+	if err := w.flush(); err != nil {
+		t.Fatal(err)
+	}
+	return w
+}
+
+func TestObjectVolumeWriterResumesUploads(t *testing.T) {
+	s, client := newFakeS3(t)
+	statePath := filepath.Join(t.TempDir(), "upload.json")
+	data := bytes.Repeat([]byte("0123456789abcdef-migrate-"), 6) // 150 bytes: volumes of 64, 64 and 22
+
+	// The first run is interrupted after every part was sent, before completion
+	w := writeVolumes(t, client, &objectUploadState{VolumeSize: 64}, statePath, data)
+	if w.volumes() != 3 {
+		t.Fatalf("%d volumes, want 3", w.volumes())
+	}
+	sentFirst := s.partUploads
+	if sentFirst != 10 || len(s.objects) != 0 {
+		t.Fatalf("first run sent %d parts and made %d objects, want 10 and none", sentFirst, len(s.objects))
+	}
+
+	// The next run produces the same stream and sends nothing again
+	state := loadObjectUploadState(statePath)
+	if state == nil || len(state.Volumes) != 3 {
+		t.Fatalf("upload state not recorded: %+v", state)
+	}
+	w = writeVolumes(t, client, state, statePath, data)
+	if s.partUploads != sentFirst {
+		t.Fatalf("resumed run uploaded %d parts again", s.partUploads-sentFirst)
+	}
+	if w.resumed != int64(len(data)) {
+		t.Fatalf("resumed %d bytes, want %d", w.resumed, len(data))
+	}
+	if err := w.complete(); err != nil {
+		t.Fatal(err)
+	}
+
+	var joined []byte
+	for v := 0; v < 3; v++ {
+		volume, ok := s.objects[volumePath("host/migrate-archive/backup.tar.zst", v)]
+		if !ok {
+			t.Fatalf("volume %d missing", v)
+		}
+		joined = append(joined, volume...)
+	}
+	if !bytes.Equal(joined, data) {
+		t.Fatal("volumes do not add up to the stream")
+	}
+	if len(s.uploads) != 0 {
+		t.Fatalf("%d multipart uploads left open", len(s.uploads))
+	}
+}
+
+func TestObjectVolumeWriterResendsChangedParts(t *testing.T) {
+	s, client := newFakeS3(t)
+	statePath := filepath.Join(t.TempDir(), "upload.json")
+	data := bytes.Repeat([]byte("x"), 64)
+
+	writeVolumes(t, client, &objectUploadState{VolumeSize: 64}, statePath, data)
+	sentFirst := s.partUploads
+
+	// A file changed between the runs: only the parts that differ are sent
+	changed := append([]byte(nil), data...)
+	changed[40] = 'y'
+	w := writeVolumes(t, client, loadObjectUploadState(statePath), statePath, changed)
+	if got := s.partUploads - sentFirst; got != 1 {
+		t.Fatalf("resumed run sent %d parts, want only the changed one", got)
+	}
+	if err := w.complete(); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(s.objects[volumePath("host/migrate-archive/backup.tar.zst", 0)], changed) {
+		t.Fatal("completed volume does not hold the new content")
+	}
+}
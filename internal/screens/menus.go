@@ -22,6 +22,8 @@ var (
 	RestoreMenuChoices = []string{
 		"🔄 Restore to Current System",
 		"📂 Restore to Custom Path",
+		"↩️ Undo Last Restore",
+		"📥 Adopt Existing Backup",
 		"⬅️ Back",
 	}
 
@@ -130,7 +132,12 @@ func GetRestoreMenuAction(index int) MenuAction {
 			Screen:    ScreenRestoreOptions,
 			Operation: "custom_restore",
 		}
-	case 2: // Back
+	case 2: // Undo Last Restore
+		return MenuAction{
+			Screen:    ScreenConfirm,
+			Operation: "undo_restore",
+		}
+	case 3: // Back
 		return MenuAction{Screen: ScreenMain}
 	default:
 		return MenuAction{}
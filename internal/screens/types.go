@@ -20,6 +20,11 @@ const (
 	ScreenHomeSubfolderSelect
 	ScreenVerificationErrors
 	ScreenRestoreFolderSelect
+	ScreenSystemRestoreOptions
+	ScreenPassphrase
+	ScreenAdoptPath
+	ScreenDestPath
+	ScreenUnlockDrive
 )
 
 // String returns the string representation of a screen
@@ -55,6 +60,16 @@ func (s Screen) String() string {
 		return "Verification Errors"
 	case ScreenRestoreFolderSelect:
 		return "Restore Folder Selection"
+	case ScreenSystemRestoreOptions:
+		return "System Restore Options"
+	case ScreenPassphrase:
+		return "Backup Passphrase"
+	case ScreenAdoptPath:
+		return "Adopt Existing Backup"
+	case ScreenDestPath:
+		return "Destination Path"
+	case ScreenUnlockDrive:
+		return "Unlock Drive"
 	default:
 		return "Unknown"
 	}
@@ -0,0 +1,412 @@
+// Package internal provides the SFTP backend for remote backup destinations.
+//
+// Remote destinations are given as sftp://[user@]host[:port]/path. Only key-based
+// authentication is used (ssh-agent, --ssh-key or the invoking user's default
+// keys), and the server must already be listed in the user's known_hosts: an
+// unknown or changed host key refuses the connection instead of prompting.
+package internal
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"os"
+	"os/user"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// sshKeyFile is the private key given with --ssh-key.
+var sshKeyFile string
+
+// SetSSHKeyFile makes remote destinations authenticate with a specific private key (--ssh-key).
+func SetSSHKeyFile(path string) error {
+	if _, err := os.Stat(path); err != nil {
+		return fmt.Errorf("cannot read key file: %v", err)
+	}
+	sshKeyFile = path
+	return nil
+}
+
+// isRemoteDestination reports whether a destination is an sftp:// URL.
+func isRemoteDestination(destination string) bool {
+	return strings.HasPrefix(destination, "sftp://")
+}
+
+// remoteTarget is a parsed sftp:// destination.
+type remoteTarget struct {
+	user string
+	host string // host:port
+	path string // Absolute path on the server
+}
+
+// parseRemoteTarget parses sftp://[user@]host[:port]/path.
+func parseRemoteTarget(destination string) (*remoteTarget, error) {
+	u, err := url.Parse(destination)
+	if err != nil || u.Scheme != "sftp" || u.Host == "" {
+		return nil, fmt.Errorf("invalid remote destination %q (expected sftp://[user@]host[:port]/path)", destination)
+	}
+	target := &remoteTarget{host: u.Host, path: path.Clean("/" + u.Path)}
+	if u.Port() == "" {
+		target.host = net.JoinHostPort(u.Hostname(), "22")
+	}
+	if u.User != nil {
+		target.user = u.User.Username()
+	}
+	if target.user == "" {
+		target.user = getCurrentUser()
+	}
+	if target.path == "/" {
+		return nil, fmt.Errorf("remote destination %s needs a directory, not the server's root", destination)
+	}
+	return target, nil
+}
+
+// sshHomeDir is the ~/.ssh directory of the user who started Migrate (not root under sudo).
+func sshHomeDir() string {
+	if u, err := user.Lookup(getCurrentUser()); err == nil {
+		return filepath.Join(u.HomeDir, ".ssh")
+	}
+	return filepath.Join("/home", getCurrentUser(), ".ssh")
+}
+
+// sshAuthMethods offers the agent's keys and then the key files, in that order.
+// Passphrase-protected key files are skipped: they can be used through ssh-agent.
+func sshAuthMethods(logFile *os.File) []ssh.AuthMethod {
+	var methods []ssh.AuthMethod
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		if conn, err := net.Dial("unix", sock); err == nil {
+			methods = append(methods, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+		}
+	}
+
+	keyFiles := []string{sshKeyFile}
+	if sshKeyFile == "" {
+		dir := sshHomeDir()
+		keyFiles = []string{filepath.Join(dir, "id_ed25519"), filepath.Join(dir, "id_ecdsa"), filepath.Join(dir, "id_rsa")}
+	}
+	var signers []ssh.Signer
+	for _, keyFile := range keyFiles {
+		data, err := os.ReadFile(keyFile)
+		if err != nil {
+			continue
+		}
+		signer, err := ssh.ParsePrivateKey(data)
+		if err != nil {
+			if logFile != nil {
+				fmt.Fprintf(logFile, "Skipping SSH key %s: %v\n", keyFile, err)
+			}
+			continue
+		}
+		signers = append(signers, signer)
+	}
+	if len(signers) > 0 {
+		methods = append(methods, ssh.PublicKeys(signers...))
+	}
+	return methods
+}
+
+// sshHostKeyCheck checks host keys against the user's and the system's known_hosts.
+// It also returns the key algorithms known for the host, so the server is asked
+// for a key that can actually be checked.
+func sshHostKeyCheck(host string) (ssh.HostKeyCallback, []string, error) {
+	var files []string
+	for _, file := range []string{filepath.Join(sshHomeDir(), "known_hosts"), "/etc/ssh/ssh_known_hosts"} {
+		if _, err := os.Stat(file); err == nil {
+			files = append(files, file)
+		}
+	}
+	if len(files) == 0 {
+		return nil, nil, fmt.Errorf("no known_hosts file found: connect once with ssh to check and accept the server's host key")
+	}
+	callback, err := knownhosts.New(files...)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot read known_hosts: %v", err)
+	}
+
+	// A key no server has makes the callback list the known keys for host
+	var algorithms []string
+	addr, _ := net.ResolveTCPAddr("tcp", host)
+	if addr == nil {
+		addr = &net.TCPAddr{}
+	}
+	var keyErr *knownhosts.KeyError
+	if errors.As(callback(host, addr, unknownHostKey{}), &keyErr) {
+		for _, known := range keyErr.Want {
+			algorithms = append(algorithms, hostKeyAlgorithms(known.Key.Type())...)
+		}
+	}
+	return callback, algorithms, nil
+}
+
+// unknownHostKey is a public key that matches no known_hosts entry.
+type unknownHostKey struct{}
+
+func (unknownHostKey) Type() string                        { return "migrate-probe" }
+func (unknownHostKey) Marshal() []byte                     { return []byte("migrate-probe") }
+func (unknownHostKey) Verify([]byte, *ssh.Signature) error { return errors.New("probe key") }
+
+// hostKeyAlgorithms lists the signature algorithms a host key type can be offered with.
+func hostKeyAlgorithms(keyType string) []string {
+	if keyType == ssh.KeyAlgoRSA {
+		return []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256, ssh.KeyAlgoRSA}
+	}
+	return []string{keyType}
+}
+
+// explainHostKeyError turns a known_hosts refusal into instructions.
+func explainHostKeyError(host string, err error) error {
+	var keyErr *knownhosts.KeyError
+	if errors.As(err, &keyErr) {
+		if len(keyErr.Want) == 0 {
+			return fmt.Errorf("the host key of %s is not in known_hosts: connect once with ssh to check and accept it", host)
+		}
+		return fmt.Errorf("⚠️ HOST KEY MISMATCH for %s: the server's key differs from known_hosts (line %d of %s). Refusing to connect",
+			host, keyErr.Want[0].Line, keyErr.Want[0].Filename)
+	}
+	var revoked *knownhosts.RevokedError
+	if errors.As(err, &revoked) {
+		return fmt.Errorf("the host key of %s is revoked in known_hosts", host)
+	}
+	return err
+}
+
+// SFTPStore is a Store on an SFTP server.
+type SFTPStore struct {
+	client *sftp.Client
+	root   string
+	conn   *ssh.Client // The SSH connection, when the store opened it
+	name   string
+}
+
+// NewSFTPStore uses an established SFTP session, with root as an absolute path on the server.
+func NewSFTPStore(client *sftp.Client, root string) *SFTPStore {
+	return &SFTPStore{client: client, root: path.Clean(root), name: "sftp:" + root}
+}
+
+// openRemoteStore connects to an sftp:// destination.
+func openRemoteStore(destination string, logFile *os.File) (*SFTPStore, error) {
+	target, err := parseRemoteTarget(destination)
+	if err != nil {
+		return nil, err
+	}
+
+	methods := sshAuthMethods(logFile)
+	if len(methods) == 0 {
+		return nil, fmt.Errorf("no SSH key found: start ssh-agent, use --ssh-key or create %s", filepath.Join(sshHomeDir(), "id_ed25519"))
+	}
+	hostKeyCallback, algorithms, err := sshHostKeyCheck(target.host)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &ssh.ClientConfig{
+		User:              target.user,
+		Auth:              methods,
+		HostKeyCallback:   hostKeyCallback,
+		HostKeyAlgorithms: algorithms,
+		Timeout:           15 * time.Second,
+	}
+	conn, err := ssh.Dial("tcp", target.host, config)
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to %s: %v", target.host, explainHostKeyError(target.host, err))
+	}
+	client, err := sftp.NewClient(conn, sftp.UseConcurrentWrites(true))
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("cannot start SFTP on %s: %v", target.host, err)
+	}
+
+	if logFile != nil {
+		fmt.Fprintf(logFile, "Connected to %s@%s (SFTP), backup directory %s\n", target.user, target.host, target.path)
+	}
+	store := NewSFTPStore(client, target.path)
+	store.conn = conn
+	store.name = destination
+	return store, nil
+}
+
+func (s *SFTPStore) Path(name string) string {
+	return path.Join(s.root, name)
+}
+
+func (s *SFTPStore) Lstat(name string) (os.FileInfo, error) {
+	return s.client.Lstat(s.Path(name))
+}
+
+func (s *SFTPStore) Stat(name string) (os.FileInfo, error) {
+	return s.client.Stat(s.Path(name))
+}
+
+func (s *SFTPStore) ReadDir(name string) ([]os.FileInfo, error) {
+	return s.client.ReadDir(s.Path(name))
+}
+
+func (s *SFTPStore) Open(name string) (io.ReadCloser, error) {
+	return s.client.Open(s.Path(name))
+}
+
+// Create writes to a temporary file next to name and renames it into place on Commit.
+func (s *SFTPStore) Create(name string, perm os.FileMode) (StoreWriter, error) {
+	random := make([]byte, 6)
+	rand.Read(random)
+	target := s.Path(name)
+	tmp := path.Join(path.Dir(target), ".migrate-tmp-"+hex.EncodeToString(random))
+
+	f, err := s.client.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_EXCL)
+	if err != nil {
+		return nil, err
+	}
+	return &sftpWriter{store: s, file: f, tmp: tmp, target: target, perm: perm}, nil
+}
+
+// sftpWriter is a file being uploaded under a temporary name.
+type sftpWriter struct {
+	store  *SFTPStore
+	file   *sftp.File
+	tmp    string
+	target string
+	perm   os.FileMode
+}
+
+func (w *sftpWriter) Write(p []byte) (int, error) {
+	return w.file.Write(p)
+}
+
+// ReadFrom lets io.Copy use the client's pipelined writes.
+func (w *sftpWriter) ReadFrom(r io.Reader) (int64, error) {
+	return w.file.ReadFrom(r)
+}
+
+func (w *sftpWriter) Commit() error {
+	if err := w.file.Close(); err != nil {
+		w.store.client.Remove(w.tmp)
+		return err
+	}
+	if err := w.store.client.Chmod(w.tmp, w.perm); err != nil {
+		w.store.client.Remove(w.tmp)
+		return err
+	}
+	if err := w.store.rename(w.tmp, w.target); err != nil {
+		w.store.client.Remove(w.tmp)
+		return err
+	}
+	return nil
+}
+
+func (w *sftpWriter) Abort() {
+	w.file.Close()
+	w.store.client.Remove(w.tmp)
+}
+
+// rename replaces newname atomically where the server supports it.
+func (s *SFTPStore) rename(oldname, newname string) error {
+	if _, ok := s.client.HasExtension("posix-rename@openssh.com"); ok {
+		return s.client.PosixRename(oldname, newname)
+	}
+	// Plain SFTP rename refuses to replace an existing file
+	if err := s.client.Remove(newname); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return s.client.Rename(oldname, newname)
+}
+
+func (s *SFTPStore) MkdirAll(name string, perm os.FileMode) error {
+	if err := s.client.MkdirAll(s.Path(name)); err != nil {
+		return err
+	}
+	return s.client.Chmod(s.Path(name), perm)
+}
+
+func (s *SFTPStore) Remove(name string) error {
+	return s.client.Remove(s.Path(name))
+}
+
+func (s *SFTPStore) RemoveAll(name string) error {
+	return s.client.RemoveAll(s.Path(name))
+}
+
+func (s *SFTPStore) Rename(oldname, newname string) error {
+	return s.rename(s.Path(oldname), s.Path(newname))
+}
+
+func (s *SFTPStore) Symlink(target, name string) error {
+	return s.client.Symlink(target, s.Path(name))
+}
+
+func (s *SFTPStore) Readlink(name string) (string, error) {
+	return s.client.ReadLink(s.Path(name))
+}
+
+func (s *SFTPStore) Link(oldname, newname string) error {
+	if _, ok := s.client.HasExtension("hardlink@openssh.com"); !ok {
+		return fmt.Errorf("the SFTP server does not support hard links")
+	}
+	return s.client.Link(s.Path(oldname), s.Path(newname))
+}
+
+func (s *SFTPStore) Chmod(name string, mode os.FileMode) error {
+	return s.client.Chmod(s.Path(name), mode)
+}
+
+// Lchown changes the owner of name. SFTP follows symlinks here, so links keep
+// the owner the server gave them.
+func (s *SFTPStore) Lchown(name string, uid, gid int) error {
+	if info, err := s.client.Lstat(s.Path(name)); err == nil && info.Mode()&os.ModeSymlink != 0 {
+		return nil
+	}
+	return s.client.Chown(s.Path(name), uid, gid)
+}
+
+func (s *SFTPStore) Chtimes(name string, mtime time.Time) error {
+	return s.client.Chtimes(s.Path(name), mtime, mtime)
+}
+
+// Xattrs reports none: SFTP has no extended attributes.
+func (s *SFTPStore) Xattrs(name string) (map[string][]byte, error) {
+	if _, err := s.Lstat(name); err != nil {
+		return nil, err
+	}
+	return nil, nil
+}
+
+func (s *SFTPStore) SetXattrs(name string, xattrs map[string][]byte) error {
+	if len(xattrs) == 0 {
+		return nil
+	}
+	return fmt.Errorf("SFTP does not support extended attributes")
+}
+
+func (s *SFTPStore) Space() (int64, int64, error) {
+	if _, ok := s.client.HasExtension("statvfs@openssh.com"); !ok {
+		return 0, 0, fmt.Errorf("the SFTP server does not report free space")
+	}
+	stat, err := s.client.StatVFS(s.root)
+	if err != nil {
+		return 0, 0, err
+	}
+	return int64(stat.Blocks * stat.Frsize), int64(stat.Bavail * stat.Frsize), nil
+}
+
+func (s *SFTPStore) String() string {
+	return s.name
+}
+
+func (s *SFTPStore) Close() error {
+	err := s.client.Close()
+	if s.conn != nil {
+		s.conn.Close()
+	}
+	return err
+}
@@ -0,0 +1,189 @@
+package internal
+
+import (
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"testing"
+
+	"github.com/pkg/sftp"
+)
+
+// newTestSFTPStore serves a temporary directory over an in-process SFTP server
+// and returns a store on it, with the directory's local path.
+func newTestSFTPStore(t *testing.T) (*SFTPStore, string) {
+	t.Helper()
+	root := t.TempDir()
+
+	clientReader, serverWriter := io.Pipe()
+	serverReader, clientWriter := io.Pipe()
+	server, err := sftp.NewServer(struct {
+		io.Reader
+		io.WriteCloser
+	}{serverReader, serverWriter})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go server.Serve()
+
+	client, err := sftp.NewClientPipe(clientReader, clientWriter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := NewSFTPStore(client, root)
+	t.Cleanup(func() {
+		// The server closes its end first, or the client waits for it forever
+		server.Close()
+		store.Close()
+	})
+	return store, root
+}
+
+// writeTestFile creates a file with content under root, with its parent directories.
+func writeTestFile(t *testing.T, root, name, content string) {
+	t.Helper()
+	path := filepath.Join(root, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSFTPStoreCommitAndAbort(t *testing.T) {
+	store, root := newTestSFTPStore(t)
+
+	if err := writeStoreFile(store, "kept", []byte("first"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeStoreFile(store, "kept", []byte("second"), 0600); err != nil {
+		t.Fatalf("replacing a file: %v", err)
+	}
+	if data, err := readStoreFile(store, "kept"); err != nil || string(data) != "second" {
+		t.Fatalf("read back %q, %v", data, err)
+	}
+	if info, err := os.Stat(filepath.Join(root, "kept")); err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("committed file has mode %v, %v", info.Mode(), err)
+	}
+
+	w, err := store.Create("aborted", 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Write([]byte("partial"))
+	w.Abort()
+
+	entries, err := os.ReadDir(root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "kept" {
+		var names []string
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		t.Fatalf("aborted upload left files behind: %v", names)
+	}
+}
+
+func TestSFTPStoreLinksAndSymlinks(t *testing.T) {
+	store, root := newTestSFTPStore(t)
+
+	if err := store.MkdirAll("a/b", 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := writeStoreFile(store, "a/b/file", []byte("data"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.Link("a/b/file", "a/hardlink"); err != nil {
+		t.Fatalf("hard link: %v", err)
+	}
+	if err := store.Symlink("b/file", "a/symlink"); err != nil {
+		t.Fatal(err)
+	}
+	if target, err := store.Readlink("a/symlink"); err != nil || target != "b/file" {
+		t.Fatalf("symlink reads %q, %v", target, err)
+	}
+
+	original, _ := os.Stat(filepath.Join(root, "a/b/file"))
+	linked, err := os.Stat(filepath.Join(root, "a/hardlink"))
+	if err != nil || !os.SameFile(original, linked) {
+		t.Fatalf("hard link is not the same file: %v", err)
+	}
+
+	var walked []string
+	walkStore(store, "a", func(name string, info os.FileInfo) error {
+		walked = append(walked, name)
+		return nil
+	})
+	want := []string{"a", "a/b", "a/b/file", "a/hardlink", "a/symlink"}
+	if len(walked) != len(want) {
+		t.Fatalf("walked %v, want %v", walked, want)
+	}
+	for i := range want {
+		if walked[i] != want[i] {
+			t.Fatalf("walked %v, want %v", walked, want)
+		}
+	}
+}
+
+func TestBackupToSFTPStore(t *testing.T) {
+	resetBackupState()
+	store, root := newTestSFTPStore(t)
+	source := t.TempDir()
+	staging := t.TempDir()
+	writeTestFile(t, source, "docs/report.txt", "quarterly numbers")
+	writeTestFile(t, source, "notes.txt", "remember the milk")
+	os.Symlink("docs/report.txt", filepath.Join(source, "latest"))
+	writeTestFile(t, staging, "BACKUP-INFO.txt", "Backup Type: Home Directory\n")
+
+	config := BackupConfig{SourcePath: source, DestinationPath: staging, BackupType: "Home Directory"}
+	if err := backupToStore(store, config, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	current := filepath.Join(root, remoteCurrentDir)
+	if data, err := os.ReadFile(filepath.Join(current, "docs/report.txt")); err != nil || string(data) != "quarterly numbers" {
+		t.Fatalf("uploaded file reads %q, %v", data, err)
+	}
+	if target, err := os.Readlink(filepath.Join(current, "latest")); err != nil || target != "docs/report.txt" {
+		t.Fatalf("uploaded symlink reads %q, %v", target, err)
+	}
+	if _, err := os.Stat(filepath.Join(root, "BACKUP-INFO.txt")); err != nil {
+		t.Fatalf("metadata not uploaded: %v", err)
+	}
+	snapshots, err := os.ReadDir(filepath.Join(root, remoteSnapshotsDir))
+	if err != nil || len(snapshots) != 1 {
+		t.Fatalf("expected one snapshot, got %d (%v)", len(snapshots), err)
+	}
+	snapshotFile := filepath.Join(root, remoteSnapshotsDir, snapshots[0].Name(), "notes.txt")
+	if data, err := os.ReadFile(snapshotFile); err != nil || string(data) != "remember the milk" {
+		t.Fatalf("snapshot file reads %q, %v", data, err)
+	}
+
+	if err := verifyStoreBackup(store, source, nil, nil); err != nil {
+		t.Fatalf("verification of a fresh backup failed: %v", err)
+	}
+
+	// A second run deletes what the source lost and leaves the snapshot alone
+	resetBackupState()
+	os.Remove(filepath.Join(source, "notes.txt"))
+	if err := backupToStore(store, config, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Lstat(filepath.Join(current, "notes.txt")); !os.IsNotExist(err) {
+		t.Fatalf("deleted source file still in current/: %v", err)
+	}
+	if _, err := os.Stat(snapshotFile); err != nil {
+		t.Fatalf("deleting from current/ touched the snapshot: %v", err)
+	}
+}
+
+func TestSFTPStorePaths(t *testing.T) {
+	store := NewSFTPStore(nil, "/srv/backup/")
+	if got := store.Path("current/a"); got != path.Join("/srv/backup", "current/a") {
+		t.Fatalf("Path = %q", got)
+	}
+}
@@ -0,0 +1,192 @@
+// Package internal provides snapshot selection and retention for repository backups.
+//
+// One repository can hold the backups of several machines and sources, such as
+// a laptop's system and a desktop's home directory on the same drive. Restore and
+// verify therefore pick a snapshot by host and source rather than whichever was
+// written last: the newest snapshot of the source from this machine, or from the
+// only machine that backed it up, unless --snapshot names one. With
+// --keep-snapshots, a repository backup deletes the older snapshots of its own
+// host and source and then the chunks no snapshot uses any more.
+package internal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+var (
+	// selectedSnapshot is the snapshot restore and verify use (--snapshot); empty
+	// selects one by host and source.
+	selectedSnapshot string
+
+	// snapshotRetention is how many snapshots of a host and source a repository
+	// backup keeps (--keep-snapshots); 0 keeps all.
+	snapshotRetention int
+)
+
+// SetSnapshot makes restore and verify use the repository snapshot with this id (--snapshot).
+func SetSnapshot(id string) {
+	id = strings.TrimSuffix(strings.TrimSpace(id), ".json")
+	selectedSnapshot = strings.TrimSuffix(id, ".snap")
+}
+
+// SetSnapshotRetention keeps the newest keep snapshots of each host and source (--keep-snapshots).
+func SetSnapshotRetention(keep int) error {
+	if keep < 0 {
+		return fmt.Errorf("cannot keep %d snapshots", keep)
+	}
+	snapshotRetention = keep
+	return nil
+}
+
+// snapshotKey identifies the backups of one source on one machine.
+func snapshotKey(snapshot *Snapshot) string {
+	return snapshot.Hostname + ":" + snapshot.SourcePath
+}
+
+// selectSnapshot returns the snapshot to restore or verify for source; source
+// is the restore target or verified path, or "" when it is not known yet.
+// Without --snapshot this is the newest snapshot of source from this machine, or
+// from the only machine that has one. A source nothing was backed up from falls
+// back to every snapshot, so a home directory can move to another account.
+func (r *Repository) selectSnapshot(source string) (*Snapshot, error) {
+	if selectedSnapshot != "" {
+		snapshot, err := r.loadSnapshot(selectedSnapshot)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load snapshot %s: %v", selectedSnapshot, err)
+		}
+		return snapshot, nil
+	}
+
+	snapshots, err := r.listSnapshots()
+	if err != nil {
+		return nil, fmt.Errorf("failed to list snapshots: %v", err)
+	}
+	var candidates []*Snapshot
+	for _, snapshot := range snapshots {
+		if snapshot.SourcePath == source {
+			candidates = append(candidates, snapshot)
+		}
+	}
+	if len(candidates) == 0 {
+		candidates = snapshots
+	}
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("the repository holds no snapshots")
+	}
+
+	// Oldest first, so the last of a key is its newest snapshot
+	latest := make(map[string]*Snapshot)
+	hostname, _ := os.Hostname()
+	var local *Snapshot
+	for _, snapshot := range candidates {
+		latest[snapshotKey(snapshot)] = snapshot
+		if source != "" && snapshot.Hostname == hostname && snapshot.SourcePath == source {
+			local = snapshot
+		}
+	}
+	if len(latest) == 1 {
+		return candidates[len(candidates)-1], nil
+	}
+	if local != nil {
+		return local, nil
+	}
+
+	var choices []string
+	for key, snapshot := range latest {
+		choices = append(choices, fmt.Sprintf("%s (latest %s)", key, snapshot.ID))
+	}
+	sort.Strings(choices)
+	return nil, fmt.Errorf("the repository holds backups of several machines or folders: %s; choose one with --snapshot", strings.Join(choices, ", "))
+}
+
+// pruneSnapshots deletes all but the newest keep snapshots of key, then every
+// chunk that no remaining snapshot references.
+func (r *Repository) pruneSnapshots(key string, keep int, logFile *os.File) error {
+	snapshots, err := r.listSnapshots()
+	if err != nil {
+		return fmt.Errorf("failed to list snapshots: %v", err)
+	}
+	var own []*Snapshot
+	for _, snapshot := range snapshots {
+		if snapshotKey(snapshot) == key {
+			own = append(own, snapshot)
+		}
+	}
+	if len(own) <= keep {
+		return nil
+	}
+
+	for _, snapshot := range own[:len(own)-keep] {
+		if err := os.Remove(r.snapshotPath(snapshot.ID)); err != nil {
+			return fmt.Errorf("failed to delete snapshot %s: %v", snapshot.ID, err)
+		}
+		if logFile != nil {
+			fmt.Fprintf(logFile, "Pruned snapshot %s of %s\n", snapshot.ID, key)
+		}
+	}
+	return r.removeUnusedChunks(logFile)
+}
+
+// removeUnusedChunks deletes the chunks no snapshot references. Nothing is
+// deleted unless every snapshot record and tree could be read, since a chunk of
+// an unreadable snapshot would otherwise look unused.
+func (r *Repository) removeUnusedChunks(logFile *os.File) error {
+	files, err := os.ReadDir(filepath.Join(r.path, "snapshots"))
+	if err != nil {
+		return fmt.Errorf("failed to list snapshots: %v", err)
+	}
+	used := make(map[string]bool)
+	for _, file := range files {
+		if !strings.HasSuffix(file.Name(), r.snapshotSuffix()) {
+			continue
+		}
+		snapshot, err := r.loadSnapshot(strings.TrimSuffix(file.Name(), r.snapshotSuffix()))
+		if err != nil {
+			return fmt.Errorf("keeping all chunks: %v", err)
+		}
+		tree, err := r.loadTree(snapshot)
+		if err != nil {
+			return fmt.Errorf("keeping all chunks: %v", err)
+		}
+		for _, id := range snapshot.Tree {
+			used[id] = true
+		}
+		for _, entry := range tree {
+			for _, id := range entry.Chunks {
+				used[id] = true
+			}
+		}
+	}
+
+	var removed, freed int64
+	err = filepath.WalkDir(filepath.Join(r.path, "chunks"), func(path string, d os.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		id := strings.TrimSuffix(d.Name(), compressedChunkSuffix)
+		if used[id] {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		removed++
+		freed += info.Size()
+		return nil
+	})
+	if logFile != nil {
+		fmt.Fprintf(logFile, "Pruned %s unused chunks (%s)\n", FormatNumber(removed), FormatBytes(freed))
+	}
+	if err != nil {
+		return fmt.Errorf("failed to remove unused chunks: %v", err)
+	}
+	return nil
+}
@@ -0,0 +1,117 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// addTestSnapshot stores a snapshot of source on host holding one file with content.
+func addTestSnapshot(t *testing.T, repo *Repository, host, source, content string, at time.Time) *Snapshot {
+	t.Helper()
+	chunks, _, err := repo.storeStream(strings.NewReader(content), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshot := &Snapshot{ID: newSnapshotID(at), Time: at, Hostname: host, SourcePath: source}
+	entries := []*TreeEntry{{Path: "file", Type: treeEntryFile, Size: int64(len(content)), Chunks: chunks}}
+	if err := repo.saveSnapshot(snapshot, entries); err != nil {
+		t.Fatal(err)
+	}
+	return snapshot
+}
+
+func TestSelectSnapshotByHostAndSource(t *testing.T) {
+	repo, err := initRepository(filepath.Join(t.TempDir(), repositoryDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostname, _ := os.Hostname()
+	start := time.Now().Add(-time.Hour)
+
+	ownSystem := addTestSnapshot(t, repo, hostname, "/", "system", start)
+	addTestSnapshot(t, repo, "other-machine", "/", "other system", start.Add(time.Minute))
+	home := addTestSnapshot(t, repo, "other-machine", "/home/alice", "home", start.Add(2*time.Minute))
+
+	// The newest snapshot overall belongs to another source and machine
+	if got, err := repo.selectSnapshot("/"); err != nil || got.ID != ownSystem.ID {
+		t.Fatalf("system restore selected %v, %v; want this machine's %s", got, err, ownSystem.ID)
+	}
+	if got, err := repo.selectSnapshot("/home/alice"); err != nil || got.ID != home.ID {
+		t.Fatalf("home restore selected %v, %v; want %s", got, err, home.ID)
+	}
+	// Nothing was backed up from /home/bob, and three sources qualify
+	if _, err := repo.selectSnapshot("/home/bob"); err == nil || !strings.Contains(err.Error(), "--snapshot") {
+		t.Fatalf("ambiguous selection did not ask for --snapshot: %v", err)
+	}
+
+	SetSnapshot(home.ID + ".json")
+	defer SetSnapshot("")
+	if got, err := repo.selectSnapshot("/"); err != nil || got.ID != home.ID {
+		t.Fatalf("--snapshot selected %v, %v; want %s", got, err, home.ID)
+	}
+}
+
+func TestPruneSnapshotsRemovesUnusedChunks(t *testing.T) {
+	repo, err := initRepository(filepath.Join(t.TempDir(), repositoryDir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now().Add(-time.Hour)
+
+	old := addTestSnapshot(t, repo, "laptop", "/", "first version", start)
+	addTestSnapshot(t, repo, "laptop", "/", "second version", start.Add(time.Minute))
+	kept := addTestSnapshot(t, repo, "laptop", "/", "third version", start.Add(2*time.Minute))
+	other := addTestSnapshot(t, repo, "desktop", "/", "first version", start.Add(3*time.Minute))
+
+	oldTree, err := repo.loadTree(old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	secondTree, err := repo.loadTree(mustSnapshot(t, repo, "laptop", 1))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := repo.pruneSnapshots(snapshotKey(kept), 1, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	snapshots, err := repo.listSnapshots()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(snapshots) != 2 || snapshots[0].ID != kept.ID || snapshots[1].ID != other.ID {
+		t.Fatalf("snapshots after pruning: %d, want %s and %s", len(snapshots), kept.ID, other.ID)
+	}
+	// The desktop still uses the content of the first laptop snapshot
+	if !repo.hasChunk(oldTree[0].Chunks[0]) {
+		t.Fatal("a chunk another machine's snapshot uses was removed")
+	}
+	if repo.hasChunk(secondTree[0].Chunks[0]) {
+		t.Fatal("a chunk no snapshot uses was kept")
+	}
+	for _, snapshot := range snapshots {
+		if _, err := repo.loadTree(snapshot); err != nil {
+			t.Fatalf("remaining snapshot %s is damaged: %v", snapshot.ID, err)
+		}
+	}
+}
+
+// mustSnapshot returns the index-th snapshot of host, oldest first.
+func mustSnapshot(t *testing.T, repo *Repository, host string, index int) *Snapshot {
+	t.Helper()
+	snapshots, err := repo.listSnapshots()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var own []*Snapshot
+	for _, snapshot := range snapshots {
+		if snapshot.Hostname == host {
+			own = append(own, snapshot)
+		}
+	}
+	return own[index]
+}
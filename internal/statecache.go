@@ -0,0 +1,283 @@
+// Package internal provides the persistent file-state cache for incremental backups.
+//
+// An incremental run normally stats every file on both sides. On a slow USB
+// disk the destination stats dominate, so after each successful backup the
+// size, mtime, ctime and inode of every source file is saved locally. On the
+// next run a source file whose metadata is unchanged is skipped without
+// touching the backup drive at all.
+//
+// The cache is only trusted while the backup on the drive is exactly the one
+// it describes: it is keyed by the drive's filesystem UUID, and each successful
+// run writes a fresh random token into both the cache and the backup manifest.
+// A different drive, a failed or interrupted run, or a backup written by
+// another machine all leave the tokens mismatched and the cache is discarded.
+package internal
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+)
+
+const (
+	// stateCacheDir holds one cache file per backup destination.
+	stateCacheDir = "/var/lib/migrate/state"
+
+	// stateCacheVersion is bumped whenever the cache layout changes.
+	stateCacheVersion = 1
+)
+
+// fileState is the source metadata recorded for one file.
+type fileState struct {
+	Size    int64
+	MtimeNs int64
+	CtimeNs int64
+	Ino     uint64
+}
+
+// stateCacheFile is the on-disk form of a cache.
+type stateCacheFile struct {
+	Version     int
+	DriveUUID   string
+	Token       string
+	Source      string
+	Destination string
+	Files       map[string]fileState
+}
+
+// stateCache tracks file states during one backup run.
+type stateCache struct {
+	path        string
+	driveUUID   string
+	source      string
+	destination string
+
+	previous map[string]fileState // From the last successful run, read-only
+
+	mu   sync.Mutex
+	next map[string]fileState // Everything known to be on the drive after this run
+
+	hits atomic.Int64
+}
+
+// activeStateCache is the cache of the backup currently in progress, or nil.
+var activeStateCache *stateCache
+
+// openStateCache loads the cache for a backup of source to destination. It must be
+// called before the manifest on the drive is rewritten, since the manifest's token
+// is what proves the cache still describes the backup. Returns nil (no caching)
+// when the destination's drive cannot be identified.
+func openStateCache(source, destination string, logFile *os.File) *stateCache {
+	uuid := filesystemUUID(destination)
+	if uuid == "" {
+		if logFile != nil {
+			fmt.Fprintf(logFile, "State cache: disabled (no filesystem UUID for %s)\n", destination)
+		}
+		return nil
+	}
+
+	key := sha256.Sum256([]byte(source + "\x00" + destination))
+	c := &stateCache{
+		path:        filepath.Join(stateCacheDir, fmt.Sprintf("%s-%s.gob", uuid, hex.EncodeToString(key[:6]))),
+		driveUUID:   uuid,
+		source:      source,
+		destination: destination,
+		next:        make(map[string]fileState),
+	}
+	c.load(logFile)
+	return c
+}
+
+// load reads the saved states into c.previous if they still describe the backup.
+func (c *stateCache) load(logFile *os.File) {
+	saved, err := readStateCacheFile(c.path)
+	if err != nil {
+		if logFile != nil && !os.IsNotExist(err) {
+			fmt.Fprintf(logFile, "State cache: ignoring unreadable cache: %v\n", err)
+		}
+		return
+	}
+
+	// Only trust the cache if the backup is still the one it was written for
+	token := ""
+	if manifest, err := loadBackupManifest(c.destination); err == nil {
+		token = manifest.StateToken
+	}
+	switch {
+	case saved.Version != stateCacheVersion:
+		reason := fmt.Sprintf("cache version %d", saved.Version)
+		logStateCacheInvalid(logFile, reason)
+	case saved.DriveUUID != c.driveUUID:
+		logStateCacheInvalid(logFile, "drive UUID changed")
+	case saved.Source != c.source || saved.Destination != c.destination:
+		logStateCacheInvalid(logFile, "backup paths changed")
+	case token == "" || saved.Token != token:
+		logStateCacheInvalid(logFile, "backup on drive changed since the cache was written")
+	default:
+		c.previous = saved.Files
+		if logFile != nil {
+			fmt.Fprintf(logFile, "State cache: loaded %s file states for drive %s\n", FormatNumber(int64(len(saved.Files))), c.driveUUID)
+		}
+	}
+}
+
+// logStateCacheInvalid notes why a saved cache was discarded.
+func logStateCacheInvalid(logFile *os.File, reason string) {
+	if logFile != nil {
+		fmt.Fprintf(logFile, "State cache: discarded (%s), all files will be compared\n", reason)
+	}
+}
+
+// readStateCacheFile decodes a cache file.
+func readStateCacheFile(path string) (*stateCacheFile, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var saved stateCacheFile
+	if err := gob.NewDecoder(f).Decode(&saved); err != nil {
+		return nil, fmt.Errorf("failed to decode %s: %v", path, err)
+	}
+	return &saved, nil
+}
+
+// filesystemUUID returns the UUID of the filesystem containing path, or "".
+func filesystemUUID(path string) string {
+	output, err := exec.Command("findmnt", "-n", "-o", "UUID", "--target", path).Output()
+	if err != nil {
+		return ""
+	}
+	return strings.TrimSpace(string(output))
+}
+
+// stateOf extracts the cached metadata from a source file's info.
+func stateOf(info os.FileInfo) (fileState, bool) {
+	stat, ok := info.Sys().(*syscall.Stat_t)
+	if !ok {
+		return fileState{}, false
+	}
+	return fileState{
+		Size:    info.Size(),
+		MtimeNs: info.ModTime().UnixNano(),
+		CtimeNs: stat.Ctim.Nano(),
+		Ino:     stat.Ino,
+	}, true
+}
+
+// stateCacheUnchanged reports whether the source file at path is exactly as it was
+// after the last successful backup, in which case the drive need not be touched.
+// A hit is carried over into the next cache.
+func stateCacheUnchanged(path string, info os.FileInfo) bool {
+	c := activeStateCache
+	if c == nil || c.previous == nil {
+		return false
+	}
+	current, ok := stateOf(info)
+	if !ok {
+		return false
+	}
+	if saved, found := c.previous[path]; !found || saved != current {
+		return false
+	}
+	c.hits.Add(1)
+	c.remember(path, current)
+	return true
+}
+
+// stateCacheRecord notes that the backup now holds the given version of path.
+func stateCacheRecord(path string, info os.FileInfo) {
+	c := activeStateCache
+	if c == nil {
+		return
+	}
+	if current, ok := stateOf(info); ok {
+		c.remember(path, current)
+	}
+}
+
+func (c *stateCache) remember(path string, state fileState) {
+	c.mu.Lock()
+	c.next[path] = state
+	c.mu.Unlock()
+}
+
+// activateStateCache makes c the cache consulted by the sync engine. The
+// returned function deactivates it again.
+func activateStateCache(c *stateCache) func() {
+	activeStateCache = c
+	return func() {
+		if activeStateCache == c {
+			activeStateCache = nil
+		}
+	}
+}
+
+// save stores the states gathered during a successful run and stamps the backup
+// manifest with the matching token. Must only be called once the backup has
+// completed; an unsaved cache simply forces a full comparison next time.
+func (c *stateCache) save(logFile *os.File) error {
+	tokenBytes := make([]byte, 16)
+	if _, err := rand.Read(tokenBytes); err != nil {
+		return fmt.Errorf("failed to generate state token: %v", err)
+	}
+	token := hex.EncodeToString(tokenBytes)
+
+	if err := os.MkdirAll(filepath.Dir(c.path), 0700); err != nil {
+		return fmt.Errorf("failed to create %s: %v", filepath.Dir(c.path), err)
+	}
+
+	// Write the cache first: a cache without a matching manifest token is ignored
+	tmpPath := c.path + ".tmp"
+	f, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to create state cache: %v", err)
+	}
+	c.mu.Lock()
+	saved := stateCacheFile{
+		Version:     stateCacheVersion,
+		DriveUUID:   c.driveUUID,
+		Token:       token,
+		Source:      c.source,
+		Destination: c.destination,
+		Files:       c.next,
+	}
+	err = gob.NewEncoder(f).Encode(&saved)
+	c.mu.Unlock()
+	if closeErr := f.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to write state cache: %v", err)
+	}
+	if err := os.Rename(tmpPath, c.path); err != nil {
+		os.Remove(tmpPath)
+		return fmt.Errorf("failed to save state cache: %v", err)
+	}
+
+	manifest, err := loadBackupManifest(c.destination)
+	if err != nil {
+		return fmt.Errorf("failed to stamp backup manifest: %v", err)
+	}
+	manifest.StateToken = token
+	if err := writeBackupManifest(c.destination, manifest); err != nil {
+		return err
+	}
+
+	if logFile != nil {
+		fmt.Fprintf(logFile, "State cache: %s files unchanged since the last run, %s file states saved\n",
+			FormatNumber(c.hits.Load()), FormatNumber(int64(len(saved.Files))))
+	}
+	return nil
+}
@@ -0,0 +1,89 @@
+package internal
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testStateCache returns a cache for a backup of source to destination kept at path.
+func testStateCache(path, source, destination string) *stateCache {
+	c := &stateCache{path: path, driveUUID: "test-uuid", source: source, destination: destination, next: make(map[string]fileState)}
+	c.load(nil)
+	return c
+}
+
+// syncWithStateCache runs one backup of src to dst with the cache at path and saves it.
+func syncWithStateCache(t *testing.T, path, src, dst string) *stateCache {
+	t.Helper()
+	c := testStateCache(path, src, dst)
+	defer activateStateCache(c)()
+	resetBackupState()
+	if err := syncDirectoriesWithExclusions(src, dst, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.save(nil); err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+func TestStateCacheSkipsUnchangedAndRecopiesChangedFiles(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	cachePath := filepath.Join(t.TempDir(), "state", "cache.gob")
+	writeTestFile(t, src, "docs/a.txt", "unchanged")
+	writeTestFile(t, src, "docs/b.txt", "version 1")
+	if err := writeBackupManifest(dst, &BackupManifest{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if c := syncWithStateCache(t, cachePath, src, dst); c.previous != nil || filesCopied != 2 {
+		t.Fatalf("first run: cache loaded %v, copied %d", c.previous != nil, filesCopied)
+	}
+
+	// A file changes inside an otherwise unchanged directory
+	later := time.Now().Add(time.Minute)
+	writeTestFile(t, src, "docs/b.txt", "version 2")
+	os.Chtimes(filepath.Join(src, "docs/b.txt"), later, later)
+
+	c := syncWithStateCache(t, cachePath, src, dst)
+	if c.previous == nil {
+		t.Fatal("second run did not trust the cache")
+	}
+	if c.hits.Load() != 1 || filesCopied != 1 {
+		t.Fatalf("second run: %d cache hits, %d copied; want 1 and 1", c.hits.Load(), filesCopied)
+	}
+	if data, _ := os.ReadFile(filepath.Join(dst, "docs/b.txt")); string(data) != "version 2" {
+		t.Fatalf("changed file not recopied: %q", data)
+	}
+	if saved, _ := readStateCacheFile(cachePath); saved == nil || len(saved.Files) != 2 {
+		t.Fatal("saved cache does not hold both files")
+	}
+}
+
+func TestStateCacheDiscardedWhenBackupTokenChanges(t *testing.T) {
+	src, dst := t.TempDir(), t.TempDir()
+	cachePath := filepath.Join(t.TempDir(), "cache.gob")
+	writeTestFile(t, src, "a.txt", "content")
+	writeBackupManifest(dst, &BackupManifest{})
+	syncWithStateCache(t, cachePath, src, dst)
+
+	if c := testStateCache(cachePath, src, dst); c.previous == nil {
+		t.Fatal("cache not trusted right after a successful run")
+	}
+
+	// Another run rewrote the backup without saving a cache (failed or interrupted)
+	manifest, _ := loadBackupManifest(dst)
+	manifest.StateToken = ""
+	writeBackupManifest(dst, manifest)
+	if c := testStateCache(cachePath, src, dst); c.previous != nil {
+		t.Fatal("cache trusted although the backup's token changed")
+	}
+
+	// The same cache for another destination is not trusted either
+	syncWithStateCache(t, cachePath, src, dst)
+	if c := testStateCache(cachePath, src, t.TempDir()); c.previous != nil {
+		t.Fatal("cache trusted for a different destination")
+	}
+}
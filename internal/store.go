@@ -0,0 +1,207 @@
+// Package internal provides the storage interface behind sync, delete and verify.
+//
+// A Store addresses files by slash-separated names relative to its root, so the
+// same sync, delete, snapshot and verify logic can run against any backend that
+// implements it: the local filesystem (LocalStore), an SFTP server (SFTPStore)
+// or memory (MemStore).
+package internal
+
+import (
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"syscall"
+	"time"
+
+	"github.com/pkg/sftp"
+)
+
+// Store is a tree of files a backup can be written to and read back from.
+// Names are slash-separated and relative to the root of the store; "" or "."
+// is the root itself.
+type Store interface {
+	Lstat(name string) (os.FileInfo, error)
+	Stat(name string) (os.FileInfo, error) // Follows symlinks
+	ReadDir(name string) ([]os.FileInfo, error)
+	Open(name string) (io.ReadCloser, error)
+
+	// Create starts writing a regular file. Nothing appears at name until
+	// Commit, which replaces any previous file atomically.
+	Create(name string, perm os.FileMode) (StoreWriter, error)
+
+	MkdirAll(name string, perm os.FileMode) error
+	Remove(name string) error // A file, symlink or empty directory
+	RemoveAll(name string) error
+	Rename(oldname, newname string) error
+	Symlink(target, name string) error
+	Readlink(name string) (string, error)
+	Link(oldname, newname string) error // A hard link, for snapshots
+	Chmod(name string, mode os.FileMode) error
+	Lchown(name string, uid, gid int) error
+	Chtimes(name string, mtime time.Time) error
+
+	// Xattrs returns the extended attributes of name (not following symlinks);
+	// SetXattrs applies them. A store without extended attributes has none and
+	// refuses to set any.
+	Xattrs(name string) (map[string][]byte, error)
+	SetXattrs(name string, xattrs map[string][]byte) error
+
+	// Space returns the total and available bytes of the filesystem holding the store.
+	Space() (total, available int64, err error)
+
+	// Path returns where name lives as the backend sees it, such as an absolute
+	// local or server path. Exclusion patterns, logs and the rollback journal use it.
+	Path(name string) string
+
+	String() string
+	Close() error
+}
+
+// StoreWriter is a file being written to a Store.
+type StoreWriter interface {
+	io.Writer
+	Commit() error // Make the file visible under its name
+	Abort()        // Discard it
+}
+
+// fileOwner returns the owner of a file from a local or remote stat.
+func fileOwner(info os.FileInfo) (uid, gid uint32, ok bool) {
+	switch stat := info.Sys().(type) {
+	case *syscall.Stat_t:
+		return stat.Uid, stat.Gid, true
+	case *sftp.FileStat:
+		return stat.UID, stat.GID, true
+	}
+	return 0, 0, false
+}
+
+// walkStore calls fn for name and everything below it, parents before children
+// and in lexical order. Returning filepath.SkipDir from fn for a directory skips
+// its contents; any other error, including one reading the tree, stops the walk.
+func walkStore(store Store, name string, fn func(name string, info os.FileInfo) error) error {
+	return walkStoreTree(store, name, func(name string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		return fn(name, info)
+	})
+}
+
+// walkStoreTree walks a store like filepath.WalkDir walks a directory: fn sees
+// name and everything below it in lexical order. When name cannot be read fn
+// gets a nil info and the error; when a directory cannot be listed fn is called
+// for it a second time with the error. Returning filepath.SkipDir skips a
+// directory's contents, or the rest of the directory when returned for a file.
+func walkStoreTree(store Store, name string, fn func(name string, info os.FileInfo, err error) error) error {
+	info, err := store.Lstat(name)
+	if err != nil {
+		err = fn(name, nil, err)
+	} else {
+		err = walkStoreTreeEntry(store, name, info, fn)
+	}
+	if err == filepath.SkipDir || err == filepath.SkipAll {
+		return nil
+	}
+	return err
+}
+
+func walkStoreTreeEntry(store Store, name string, info os.FileInfo, fn func(name string, info os.FileInfo, err error) error) error {
+	if err := fn(name, info, nil); err != nil || !info.IsDir() {
+		if err == filepath.SkipDir && info.IsDir() {
+			return nil
+		}
+		return err
+	}
+
+	entries, err := store.ReadDir(name)
+	if err != nil {
+		if err := fn(name, info, err); err != nil {
+			if err == filepath.SkipDir {
+				return nil
+			}
+			return err
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+	for _, entry := range entries {
+		if err := walkStoreTreeEntry(store, path.Join(name, entry.Name()), entry, fn); err != nil {
+			if err == filepath.SkipDir {
+				break
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// copyStoreFile copies the regular file name from src to dst with its owner,
+// mode and modification time. Between two local stores the data goes through
+// copyFileData (reflink, copy_file_range); otherwise it is streamed, throttled
+// by --bwlimit.
+func copyStoreFile(src, dst Store, name string, info os.FileInfo) error {
+	r, err := src.Open(name)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	w, err := dst.Create(name, info.Mode().Perm())
+	if os.IsNotExist(err) {
+		if err := dst.MkdirAll(path.Dir(name), 0755); err != nil {
+			return err
+		}
+		w, err = dst.Create(name, info.Mode().Perm())
+	}
+	if err != nil {
+		return err
+	}
+
+	srcFile, srcLocal := r.(*os.File)
+	dstFile, dstLocal := w.(*localWriter)
+	if srcLocal && dstLocal {
+		err = copyFileData(dstFile.file, srcFile, info.Size())
+	} else {
+		_, err = io.Copy(throttledWriter{w}, r)
+	}
+	if err != nil {
+		w.Abort()
+		return err
+	}
+	if err := w.Commit(); err != nil {
+		return err
+	}
+
+	// Chown first, since it clears setuid/setgid bits
+	if uid, gid, ok := fileOwner(info); ok {
+		newUID, newGID := remapOwner(uid, gid)
+		dst.Lchown(name, newUID, newGID)
+	}
+	dst.Chmod(name, info.Mode())
+	dst.Chtimes(name, info.ModTime())
+	return nil
+}
+
+// writeStoreFile stores data under name, replacing any previous file.
+func writeStoreFile(store Store, name string, data []byte, perm os.FileMode) error {
+	w, err := store.Create(name, perm)
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(data); err != nil {
+		w.Abort()
+		return err
+	}
+	return w.Commit()
+}
+
+// readStoreFile returns the content of a small file in a store.
+func readStoreFile(store Store, name string) ([]byte, error) {
+	r, err := store.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(r)
+}
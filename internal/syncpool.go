@@ -0,0 +1,249 @@
+// Package internal provides the copy worker pool behind syncDirectoriesWithExclusions.
+//
+// The directory walk itself is cheap; opening, copying and chowning small files
+// is latency bound. The walker therefore only creates directories and hands
+// regular files to a bounded pool of workers. Each directory's ownership, mode
+// and timestamps are applied once everything inside it has been written, so
+// copying children never disturbs a parent's restored mtime.
+package internal
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// maxSyncWorkers caps --jobs; more workers than this only add seek contention.
+const maxSyncWorkers = 64
+
+// syncWorkers is the number of concurrent copy workers used by the sync engine.
+var syncWorkers = defaultSyncWorkers()
+
+// defaultSyncWorkers sizes the pool for I/O latency rather than CPU count.
+func defaultSyncWorkers() int {
+	n := runtime.NumCPU()
+	if n < 4 {
+		n = 4
+	}
+	if n > 16 {
+		n = 16
+	}
+	return n
+}
+
+// SetSyncWorkers sets the number of concurrent copy workers (--jobs).
+func SetSyncWorkers(n int) error {
+	if n < 1 || n > maxSyncWorkers {
+		return fmt.Errorf("jobs must be between 1 and %d, got %d", maxSyncWorkers, n)
+	}
+	syncWorkers = n
+	return nil
+}
+
+// syncDir is a destination directory whose metadata is applied once all of its
+// children - files queued to workers and subdirectories - are finished.
+type syncDir struct {
+	name    string // Store name, the same on both sides
+	info    os.FileInfo
+	parent  *syncDir
+	pending atomic.Int32 // Outstanding children, plus one while the walker is inside
+}
+
+// syncFileJob is one regular file handed from the walker to a worker.
+type syncFileJob struct {
+	name string
+	info os.FileInfo
+	dir  *syncDir
+}
+
+// syncPool runs copy workers for one syncDirectoriesWithExclusions call.
+type syncPool struct {
+	src     Store
+	dst     Store
+	jobs    chan syncFileJob
+	wg      sync.WaitGroup
+	logFile *os.File
+
+	errOnce sync.Once
+	err     error
+	failed  atomic.Bool
+
+	open []*syncDir // Directories the walker is currently inside, outermost first
+}
+
+// newSyncPool starts workers copy workers from src to dst.
+func newSyncPool(src, dst Store, workers int, logFile *os.File) *syncPool {
+	p := &syncPool{
+		src:     src,
+		dst:     dst,
+		jobs:    make(chan syncFileJob, workers*64),
+		logFile: logFile,
+	}
+	for i := 0; i < workers; i++ {
+		p.wg.Add(1)
+		go p.work()
+	}
+	return p
+}
+
+// work copies queued files until the queue is closed. After the first fatal
+// error or a cancellation the remaining jobs are only drained.
+func (p *syncPool) work() {
+	defer p.wg.Done()
+	for job := range p.jobs {
+		if !p.failed.Load() && !shouldCancelBackup() {
+			if err := syncRegularFile(p.src, p.dst, job.name, job.info, p.logFile); err != nil {
+				p.fail(err)
+			}
+		}
+		p.release(job.dir)
+	}
+}
+
+// fail records the first fatal error and stops the pipeline.
+func (p *syncPool) fail(err error) {
+	p.errOnce.Do(func() {
+		p.err = err
+		p.failed.Store(true)
+	})
+}
+
+// submit queues a regular file for copying.
+func (p *syncPool) submit(name string, info os.FileInfo) {
+	dir := p.dirFor(name)
+	if dir != nil {
+		dir.pending.Add(1)
+	}
+	p.jobs <- syncFileJob{name: name, info: info, dir: dir}
+}
+
+// enter starts tracking a directory the walker is about to descend into.
+func (p *syncPool) enter(name string, info os.FileInfo) {
+	name = path.Clean(name)
+	dir := &syncDir{name: name, info: info, parent: p.dirFor(name)}
+	dir.pending.Store(1)
+	if dir.parent != nil {
+		dir.parent.pending.Add(1)
+	}
+	p.open = append(p.open, dir)
+}
+
+// advance closes every open directory that the walk at name has left.
+// The walk visits in lexical order, so a directory is finished as soon as a
+// name outside it is visited.
+func (p *syncPool) advance(name string) {
+	name = path.Clean(name)
+	for len(p.open) > 0 {
+		top := p.open[len(p.open)-1]
+		if top.name == "." || name == top.name || strings.HasPrefix(name, top.name+"/") {
+			return
+		}
+		p.open = p.open[:len(p.open)-1]
+		p.release(top)
+	}
+}
+
+// dirFor returns the open directory that directly contains name, or nil.
+func (p *syncPool) dirFor(name string) *syncDir {
+	if len(p.open) == 0 {
+		return nil
+	}
+	top := p.open[len(p.open)-1]
+	if path.Dir(path.Clean(name)) != top.name {
+		return nil
+	}
+	return top
+}
+
+// release drops one hold on dir, applying its metadata when the last one goes.
+func (p *syncPool) release(dir *syncDir) {
+	for dir != nil && dir.pending.Add(-1) == 0 {
+		applyDirectoryMetadata(p.dst, dir.name, dir.info)
+		dir = dir.parent
+	}
+}
+
+// finish closes the remaining directories, waits for the workers and returns the
+// first fatal error.
+func (p *syncPool) finish() error {
+	for len(p.open) > 0 {
+		top := p.open[len(p.open)-1]
+		p.open = p.open[:len(p.open)-1]
+		p.release(top)
+	}
+	close(p.jobs)
+	p.wg.Wait()
+	return p.err
+}
+
+// applyDirectoryMetadata sets ownership, mode and timestamps on a synced directory.
+func applyDirectoryMetadata(dst Store, name string, fi os.FileInfo) {
+	uid, gid, ok := fileOwner(fi)
+	if !ok {
+		return
+	}
+	// Chown first, since it clears setgid on some filesystems
+	newUID, newGID := remapOwner(uid, gid)
+	dst.Lchown(name, newUID, newGID)
+	dst.Chmod(name, fi.Mode())
+	dst.Chtimes(name, fi.ModTime())
+}
+
+// syncRegularFile copies one regular file unless the destination already matches
+// according to the comparison mode.
+// Only fatal errors (out of space) are returned; other failures are logged.
+func syncRegularFile(src, dst Store, name string, srcInfo os.FileInfo, logFile *os.File) error {
+	path, dstPath := src.Path(name), dst.Path(name)
+
+	// Unchanged since the last successful backup - no need to touch the drive
+	// (a checksum comparison always reads the backup copy)
+	if compareMode != CompareChecksum && stateCacheUnchanged(path, srcInfo) {
+		atomic.AddInt64(&filesSkipped, 1)
+		return nil
+	}
+
+	// Quick paths for known scenarios
+	// PERFORMANCE OPTIMIZATION: Use faster file existence check
+	dstStat, err := dst.Stat(name)
+	if err == nil {
+		// Compare with the configured strategy (see compare.go)
+		if destinationMatches(src, name, srcInfo, dst, name, dstStat) {
+			atomic.AddInt64(&filesSkipped, 1)
+			stateCacheRecord(path, srcInfo)
+			return nil
+		}
+	}
+
+	// Destination is missing or different - copy
+	if err := rollbackBeforeWrite(dstPath); err != nil {
+		if logFile != nil {
+			fmt.Fprintf(logFile, "Skipping %s: %v\n", dstPath, err)
+		}
+		return nil
+	}
+	err = copyStoreFile(src, dst, name, srcInfo)
+	if err != nil {
+		if logFile != nil {
+			fmt.Fprintf(logFile, "Error copying %s: %v\n", path, err)
+		}
+		// Check for fatal disk space errors
+		if isSpaceError(err) {
+			spaceInfo := getSpaceErrorDetails(filepath.Dir(dstPath))
+			return fmt.Errorf("⚠️ OUT OF SPACE during backup\n\nError copying file: %s\nSpace error: %v\n\n%s\n\nThe backup drive is full. Please use a larger drive or select fewer folders.", path, err, spaceInfo)
+		}
+		return nil
+	}
+
+	atomic.AddInt64(&filesCopied, 1)
+	stateCacheRecord(path, srcInfo)
+	// Track copied files for verification (thread-safe)
+	copiedFilesListMutex.Lock()
+	copiedFilesList = append(copiedFilesList, path)
+	copiedFilesListMutex.Unlock()
+	return nil
+}
@@ -0,0 +1,45 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSyncPoolAppliesDirectoryTimesAfterChildren(t *testing.T) {
+	resetBackupState()
+	defer func(n int) { syncWorkers = n }(syncWorkers)
+	syncWorkers = 8
+
+	src, dst := t.TempDir(), t.TempDir()
+	dirs := []string{"a", "a/b", "a/b/c", "a/d", "e"}
+	for _, dir := range dirs {
+		for i := 0; i < 40; i++ {
+			writeTestFile(t, src, fmt.Sprintf("%s/file%02d", dir, i), fmt.Sprintf("%s %d", dir, i))
+		}
+	}
+	// Older than anything written during the sync, set once the children exist
+	for i, dir := range dirs {
+		old := time.Date(2020, 1, 1+i, 0, 0, 0, 0, time.UTC)
+		os.Chtimes(filepath.Join(src, dir), old, old)
+	}
+
+	if err := syncDirectoriesWithExclusions(src, dst, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if filesCopied != int64(len(dirs)*40) {
+		t.Fatalf("copied %d files, want %d", filesCopied, len(dirs)*40)
+	}
+	for _, dir := range dirs {
+		want, _ := os.Stat(filepath.Join(src, dir))
+		got, err := os.Stat(filepath.Join(dst, dir))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !got.ModTime().Equal(want.ModTime()) {
+			t.Errorf("%s: mtime %v, want %v (a child was written after it was set)", dir, got.ModTime(), want.ModTime())
+		}
+	}
+}
@@ -0,0 +1,331 @@
+// Package internal provides I/O priority, CPU priority and bandwidth throttling.
+//
+// Backing up a running system at full speed makes the desktop sluggish. The
+// backup can instead run in the idle or best-effort I/O scheduling class, at a
+// higher nice level, and under a bytes-per-second cap enforced in the copy
+// loop. All three can be changed while an operation is running.
+package internal
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+// I/O scheduling classes understood by ioprio_set(2)
+const (
+	IOClassDefault    = ""            // Leave the kernel default alone
+	IOClassBestEffort = "best-effort" // IOPRIO_CLASS_BE, normal priority
+	IOClassIdle       = "idle"        // IOPRIO_CLASS_IDLE, only when the disk is otherwise idle
+
+	ioprioClassBE    = 2
+	ioprioClassIdle  = 3
+	ioprioClassShift = 13
+	ioprioWhoProcess = 1 // Per thread on Linux
+)
+
+// bandwidthPresets are the steps used by the +/- keys on the progress screen,
+// slowest first. 0 means unlimited.
+var bandwidthPresets = []int64{
+	5 * 1024 * 1024,
+	10 * 1024 * 1024,
+	25 * 1024 * 1024,
+	50 * 1024 * 1024,
+	100 * 1024 * 1024,
+	250 * 1024 * 1024,
+	0,
+}
+
+// nicePresets are the levels cycled by the n key on the progress screen.
+var nicePresets = []int{0, 10, 19}
+
+// throttleSettings holds the current priority settings.
+type throttleSettings struct {
+	mu      sync.Mutex
+	ioClass string
+	nice    int
+	niceSet bool
+}
+
+var (
+	throttle throttleSettings
+
+	// bwLimiter caps the bytes per second written by copy workers.
+	bwLimiter bandwidthLimiter
+)
+
+// SetIOPriorityClass selects the I/O scheduling class (--ionice).
+func SetIOPriorityClass(class string) error {
+	switch class {
+	case IOClassDefault, IOClassBestEffort, IOClassIdle:
+	default:
+		return fmt.Errorf("unknown I/O class %q (use idle or best-effort)", class)
+	}
+	throttle.mu.Lock()
+	throttle.ioClass = class
+	throttle.mu.Unlock()
+	return applyProcessPriority()
+}
+
+// SetNiceLevel sets the CPU nice level (--nice).
+func SetNiceLevel(nice int) error {
+	if nice < -20 || nice > 19 {
+		return fmt.Errorf("nice level must be between -20 and 19, got %d", nice)
+	}
+	throttle.mu.Lock()
+	throttle.nice = nice
+	throttle.niceSet = true
+	throttle.mu.Unlock()
+	return applyProcessPriority()
+}
+
+// SetBandwidthLimit sets the copy bandwidth cap (--bwlimit), e.g. "50M" for
+// 50 MiB/s. "0" removes the limit.
+func SetBandwidthLimit(spec string) error {
+	rate, err := parseByteRate(spec)
+	if err != nil {
+		return err
+	}
+	bwLimiter.setRate(rate)
+	return nil
+}
+
+// parseByteRate parses "1048576", "500K", "50M", "1G" or "50MB/s" into bytes per second.
+func parseByteRate(spec string) (int64, error) {
+	s := strings.ToUpper(strings.TrimSpace(spec))
+	s = strings.TrimSuffix(s, "/S")
+	if len(s) > 1 && strings.HasSuffix(s, "B") {
+		s = s[:len(s)-1]
+	}
+	if s == "" {
+		return 0, fmt.Errorf("invalid bandwidth %q", spec)
+	}
+
+	multiplier := int64(1)
+	switch s[len(s)-1] {
+	case 'K':
+		multiplier = 1024
+	case 'M':
+		multiplier = 1024 * 1024
+	case 'G':
+		multiplier = 1024 * 1024 * 1024
+	}
+	if multiplier > 1 {
+		s = s[:len(s)-1]
+	}
+
+	value, err := strconv.ParseFloat(s, 64)
+	if err != nil || value < 0 {
+		return 0, fmt.Errorf("invalid bandwidth %q (examples: 500K, 50M, 1G)", spec)
+	}
+	return int64(value * float64(multiplier)), nil
+}
+
+// applyProcessPriority applies the I/O class and nice level to every thread of
+// the process. Linux keeps both per thread, and Go schedules copy work on
+// whichever thread is free, so all of them are updated. Threads created later
+// inherit the setting from the thread that spawned them.
+func applyProcessPriority() error {
+	throttle.mu.Lock()
+	ioClass, nice, niceSet := throttle.ioClass, throttle.nice, throttle.niceSet
+	throttle.mu.Unlock()
+
+	if ioClass == IOClassDefault && !niceSet {
+		return nil
+	}
+
+	tasks, err := os.ReadDir("/proc/self/task")
+	if err != nil {
+		return fmt.Errorf("failed to list threads: %v", err)
+	}
+
+	var firstErr error
+	for _, task := range tasks {
+		tid, err := strconv.Atoi(task.Name())
+		if err != nil {
+			continue
+		}
+		if ioClass != IOClassDefault {
+			class := ioprioClassBE
+			data := 4 // Default best-effort level
+			if ioClass == IOClassIdle {
+				class, data = ioprioClassIdle, 0
+			}
+			prio := class<<ioprioClassShift | data
+			if _, _, errno := unix.Syscall(unix.SYS_IOPRIO_SET, ioprioWhoProcess, uintptr(tid), uintptr(prio)); errno != 0 && firstErr == nil {
+				firstErr = fmt.Errorf("ioprio_set failed: %v", errno)
+			}
+		}
+		if niceSet {
+			if err := unix.Setpriority(unix.PRIO_PROCESS, tid, nice); err != nil && firstErr == nil {
+				firstErr = fmt.Errorf("setpriority failed: %v", err)
+			}
+		}
+	}
+	return firstErr
+}
+
+// throttleStatus describes the current settings for the progress screen and log.
+func throttleStatus() string {
+	throttle.mu.Lock()
+	ioClass, nice, niceSet := throttle.ioClass, throttle.nice, throttle.niceSet
+	throttle.mu.Unlock()
+
+	var parts []string
+	if ioClass != IOClassDefault {
+		parts = append(parts, "I/O "+ioClass)
+	}
+	if niceSet && nice != 0 {
+		parts = append(parts, fmt.Sprintf("nice %d", nice))
+	}
+	if rate := bwLimiter.currentRate(); rate > 0 {
+		parts = append(parts, fmt.Sprintf("max %s/s", FormatBytes(rate)))
+	}
+	if len(parts) == 0 {
+		return "🚀 Full speed"
+	}
+	return "🐢 " + strings.Join(parts, " • ")
+}
+
+// adjustBandwidth moves the bandwidth cap one preset faster (+1) or slower (-1).
+func adjustBandwidth(direction int) {
+	rate := bwLimiter.currentRate()
+
+	// Find the current position (unlimited is the last preset)
+	index := len(bandwidthPresets) - 1
+	if rate > 0 {
+		index = 0
+		for i, preset := range bandwidthPresets {
+			if preset > 0 && preset <= rate {
+				index = i
+			}
+		}
+	}
+
+	index += direction
+	if index < 0 {
+		index = 0
+	}
+	if index >= len(bandwidthPresets) {
+		index = len(bandwidthPresets) - 1
+	}
+	bwLimiter.setRate(bandwidthPresets[index])
+}
+
+// cycleIOClass switches between the idle and best-effort I/O classes.
+func cycleIOClass() {
+	throttle.mu.Lock()
+	next := IOClassIdle
+	if throttle.ioClass == IOClassIdle {
+		next = IOClassBestEffort
+	}
+	throttle.mu.Unlock()
+	SetIOPriorityClass(next)
+}
+
+// cycleNiceLevel steps through nicePresets.
+func cycleNiceLevel() {
+	throttle.mu.Lock()
+	next := nicePresets[0]
+	for i, level := range nicePresets {
+		if level == throttle.nice {
+			next = nicePresets[(i+1)%len(nicePresets)]
+			break
+		}
+	}
+	throttle.mu.Unlock()
+	SetNiceLevel(next)
+}
+
+// bandwidthLimiter is a token bucket shared by all copy workers.
+type bandwidthLimiter struct {
+	rate atomic.Int64 // Bytes per second, 0 = unlimited
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// setRate changes the cap; the bucket starts empty so the new rate applies at once.
+func (l *bandwidthLimiter) setRate(rate int64) {
+	l.mu.Lock()
+	l.tokens = 0
+	l.last = time.Now()
+	l.mu.Unlock()
+	l.rate.Store(rate)
+}
+
+// currentRate returns the cap in bytes per second, 0 when unlimited.
+func (l *bandwidthLimiter) currentRate() int64 {
+	return l.rate.Load()
+}
+
+// wait blocks until n more bytes may be written.
+func (l *bandwidthLimiter) wait(n int) {
+	rate := l.rate.Load()
+	if rate <= 0 || n <= 0 {
+		return
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * float64(rate)
+	if l.tokens > float64(rate) { // At most one second of burst
+		l.tokens = float64(rate)
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	deficit := -l.tokens
+	l.mu.Unlock()
+
+	if deficit > 0 {
+		time.Sleep(time.Duration(deficit / float64(rate) * float64(time.Second)))
+	}
+}
+
+// throttleChunk is the largest write made between bandwidth checks.
+const throttleChunk = 256 * 1024
+
+// throttledWriter applies the bandwidth cap to writes.
+type throttledWriter struct {
+	w io.Writer
+}
+
+func (t throttledWriter) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := len(p)
+		if n > throttleChunk {
+			n = throttleChunk
+		}
+		bwLimiter.wait(n)
+		m, err := t.w.Write(p[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// throttledReader applies the bandwidth cap to reads, for uploads whose writer
+// batches requests itself.
+type throttledReader struct {
+	r io.Reader
+}
+
+func (t throttledReader) Read(p []byte) (int, error) {
+	if len(p) > throttleChunk {
+		p = p[:throttleChunk]
+	}
+	bwLimiter.wait(len(p))
+	return t.r.Read(p)
+}
@@ -551,6 +551,44 @@ func (m Model) renderRestoreOptions() string {
 	return safeCenterContent(m.width, m.height, content)
 }
 
+// Render system restore options (package reinstall and host identity)
+func (m Model) renderSystemRestoreOptions() string {
+	var s strings.Builder
+
+	// Header with ASCII art (consistent with other screens)
+	ascii := asciiStyle.Render(MigrateASCII)
+	s.WriteString(ascii + "\n")
+	s.WriteString(titleStyle.Render("🔄 System Restore Options") + "\n\n")
+
+	for i, choice := range m.choices {
+		if m.cursor == i {
+			s.WriteString(selectedMenuItemStyle.Render("❯ "+choice) + "\n")
+		} else {
+			s.WriteString(menuItemStyle.Render("  "+choice) + "\n")
+		}
+	}
+
+	// What the backup recorded about the original system
+	if m.restoreInventory != nil {
+		info := infoBoxStyle.Render("Installed on the backed-up system:\n" + strings.TrimRight(m.restoreInventory.summary(), "\n"))
+		s.WriteString(info)
+
+		restoreInfo := infoBoxStyle.Render("⚠️  Reinstalling first keeps /usr and the package database in step with the restored files.")
+		s.WriteString("\n" + restoreInfo)
+	}
+
+	identityInfo := infoBoxStyle.Render("🪪 Keep identity when cloning to a second machine - these stay as they are here:\n" + strings.TrimRight(describeHostIdentityRules(), "\n"))
+	s.WriteString("\n" + identityInfo)
+
+	// Help text
+	help := m.renderHelp()
+	s.WriteString("\n" + help)
+
+	// Center the content with beautiful border
+	content := borderStyle.Width(safeRenderWidth(m.width)).Render(s.String())
+	return safeCenterContent(m.width, m.height, content)
+}
+
 // Render about screen
 func (m Model) renderAbout() string {
 	var s strings.Builder
@@ -567,7 +605,7 @@ func (m Model) renderAbout() string {
 		renderDataMetric("UI Framework", "Bubble Tea + Lipgloss", "🎨"),
 		renderDataMetric("Progress Tracking", "Real-time file-based", "📊"),
 		renderDataMetric("Deduplication", "SHA256 checksums", "🔍"),
-		renderDataMetric("Encryption", "LUKS drive support", "🔐"),
+		renderDataMetric("Encryption", "LUKS drives or AES-256-GCM repositories", "🔐"),
 		renderDataMetric("Sync Method", "rsync --delete equivalent", "🔄"),
 		renderDataMetric("Portability", "Static binary", "📦"),
 	}
@@ -713,6 +751,12 @@ func (m Model) renderProgress() string {
 		s.WriteString(backupTypeStyle.Render("⚡ Operation:      Custom Restore") + "\n")
 		s.WriteString("📂 Source:         " + m.selectedDrive + "\n")
 		s.WriteString(logStyle.Render("📋 Log:            "+logPath) + "\n\n")
+	case "undo_restore":
+		s.WriteString(backupTypeStyle.Render("↩️ Operation:      Undo Last Restore") + "\n")
+		s.WriteString(logStyle.Render("📋 Log:            "+logPath) + "\n\n")
+	case "boot_fixups":
+		s.WriteString(backupTypeStyle.Render("🥾 Operation:      Boot Configuration Fix-ups") + "\n")
+		s.WriteString(logStyle.Render("📋 Log:            "+logPath) + "\n\n")
 	default:
 		// Format unknown operations nicely
 		opName := formatOperationName(m.operation)
@@ -762,7 +806,10 @@ func (m Model) renderProgress() string {
 	if m.canceling {
 		help = helpStyle.Render("Please wait for cleanup to complete...")
 	} else {
-		help = helpStyle.Render("Please wait... • Ctrl+C: cancel")
+		// Current throttle settings, adjustable while the operation runs
+		throttleLine := lipgloss.NewStyle().Foreground(dimColor).Render(throttleStatus())
+		s.WriteString("\n" + throttleLine + "\n")
+		help = helpStyle.Render("Please wait... • +/-: speed limit • i: I/O priority • n: nice • Ctrl+C: cancel")
 	}
 	s.WriteString("\n" + help)
 
@@ -931,17 +978,20 @@ func (m Model) renderDriveSelect() string {
 		if len(m.choices) == 0 {
 			s.WriteString(infoBoxStyle.Render("🔍 Scanning for external drives...") + "\n")
 		} else {
-			s.WriteString(warningStyle.Render("⚠️  No external drives found") + "\n")
+			s.WriteString(warningStyle.Render("⚠️  No external drives found") + "\n\n")
+			for i, choice := range m.choices {
+				if m.cursor == i {
+					s.WriteString(selectedMenuItemStyle.Render("❯ "+choice) + "\n")
+				} else {
+					s.WriteString(menuItemStyle.Render("  "+choice) + "\n")
+				}
+			}
 		}
 	} else {
 		// Show available drives
 		info := infoBoxStyle.Render("Select a drive to mount.")
 		s.WriteString(info + "\n\n")
 
-		// Add LUKS warning
-		luksWarning := warningStyle.Render("⚠️  LUKS encrypted drives must be unlocked manually first")
-		s.WriteString(luksWarning + "\n\n")
-
 		for i, choice := range m.choices {
 			if m.cursor == i {
 				s.WriteString(selectedMenuItemStyle.Render("❯ "+choice) + "\n")
@@ -1875,6 +1925,10 @@ func formatOperationName(operation string) string {
 		return "Home Directory Restore"
 	case "custom_restore":
 		return "Custom Restore"
+	case "undo_restore":
+		return "Undo Last Restore"
+	case "boot_fixups":
+		return "Boot Configuration Fix-ups"
 	default:
 		// Capitalize first letter and replace underscores with spaces
 		formatted := strings.ReplaceAll(operation, "_", " ")
@@ -97,6 +97,11 @@ func GetSystemBackupExclusions() []string {
 		"/home/*/.local/share/Steam/*",
 		"/home/*/.local/share/flatpak/*",
 		"/home/*/.local/share/containers/*",
+
+		// Restore rollback areas (machine-local undo data)
+		"/.migrate-rollback/*",
+		"/home/*/.migrate-rollback/*",
+		"/var/lib/migrate/*",
 	}
 }
 
@@ -125,6 +130,8 @@ func GetHomeBackupExclusions() []string {
 		".cache/go-build/*",
 		".cache/gopls/*",
 		".cache/golangci-lint/*",
+		// Restore rollback area (machine-local undo data)
+		".migrate-rollback/*",
 	}
 }
 
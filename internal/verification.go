@@ -236,6 +236,8 @@ func performBackupVerification(sourcePath, destPath string, excludePatterns []st
 	totalFilesVerified = 0
 	verificationErrors = []string{}
 
+	source, dest := NewLocalStore(sourcePath), NewLocalStore(destPath)
+
 	if logFile != nil {
 		fmt.Fprintf(logFile, "\n=== VERIFICATION PHASES ===\n")
 		fmt.Fprintf(logFile, "Phase 1: Verifying newly copied files (%d files)\n", len(copiedFilesList))
@@ -264,7 +266,7 @@ func performBackupVerification(sourcePath, destPath string, excludePatterns []st
 			fmt.Fprintf(logFile, "Verifying %d newly copied files\n", copiedFilesCount)
 		}
 
-		err := verifyNewFiles(copiedFilesCopy, sourcePath, destPath, excludePatterns, logFile)
+		err := verifyNewFiles(copiedFilesCopy, source, dest, excludePatterns, logFile)
 		if err != nil {
 			return fmt.Errorf("verification of new files failed: %v", err)
 		}
@@ -278,7 +280,7 @@ func performBackupVerification(sourcePath, destPath string, excludePatterns []st
 	if logFile != nil {
 		fmt.Fprintf(logFile, "Verifying critical system files\n")
 	}
-	err := verifyCriticalFiles(sourcePath, destPath, logFile)
+	err := verifyCriticalFiles(source, dest, logFile)
 	if err != nil {
 		return fmt.Errorf("critical files verification failed: %v", err)
 	}
@@ -288,7 +290,7 @@ func performBackupVerification(sourcePath, destPath string, excludePatterns []st
 		if logFile != nil {
 			fmt.Fprintf(logFile, "Sampling verification of %d unchanged files\n", filesSkipped)
 		}
-		err = verifySampledFiles(sourcePath, destPath, DefaultVerificationConfig.SampleRate, excludePatterns, logFile)
+		err = verifySampledFiles(source, dest, DefaultVerificationConfig.SampleRate, excludePatterns, logFile)
 		if err != nil {
 			// Non-critical error - log but don't fail backup
 			verificationErrors = append(verificationErrors, fmt.Sprintf("Sample verification: %v", err))
@@ -302,7 +304,7 @@ func performBackupVerification(sourcePath, destPath string, excludePatterns []st
 	if logFile != nil {
 		fmt.Fprintf(logFile, "Verifying directory structure\n")
 	}
-	err = verifyDirectoryStructure(sourcePath, destPath, logFile)
+	err = verifyDirectoryStructure(source, dest, logFile)
 	if err != nil {
 		verificationErrors = append(verificationErrors, fmt.Sprintf("Directory structure: %v", err))
 		if logFile != nil {
@@ -355,17 +357,18 @@ func performBackupVerification(sourcePath, destPath string, excludePatterns []st
 //
 // Parameters:
 //   - copiedFiles: Slice of file paths that were copied during backup
-//   - sourcePath: Original source directory for path resolution
-//   - destPath: Destination backup directory for verification
+//   - source: Original source store for path resolution
+//   - dest: Destination backup store for verification
 //   - logFile: Optional log file for detailed verification reporting
 //
 // Returns an error if verification fails beyond the acceptable threshold.
 // Individual file errors are logged but don't immediately fail the verification.
 // Only when error rates exceed 10% (or 10 files minimum) does this function fail.
-func verifyNewFiles(copiedFiles []string, sourcePath, destPath string, excludePatterns []string, logFile *os.File) error {
+func verifyNewFiles(copiedFiles []string, source, dest Store, excludePatterns []string, logFile *os.File) error {
 	if len(copiedFiles) == 0 {
 		return nil
 	}
+	sourcePath := source.Path(".")
 
 	// Use worker pool for parallel verification
 	const maxWorkers = 4
@@ -390,7 +393,7 @@ func verifyNewFiles(copiedFiles []string, sourcePath, destPath string, excludePa
 					continue
 				}
 
-				err := verifySingleFile(filePath, sourcePath, destPath)
+				err := verifySingleFile(filePath, source, dest)
 				if err != nil {
 					errorCh <- fmt.Errorf("file %s: %v", filePath, err)
 				} else {
@@ -458,16 +461,17 @@ func verifyNewFiles(copiedFiles []string, sourcePath, destPath string, excludePa
 //   - Non-blocking verification (errors logged but don't fail backup)
 //
 // Parameters:
-//   - sourcePath: Original source directory (system root "/" or home directory)
-//   - destPath: Destination backup directory for verification
+//   - source: Original source store (system root "/" or home directory)
+//   - dest: Destination backup store for verification
 //   - logFile: Optional log file for detailed verification reporting
 //
 // The function automatically adapts to backup type:
-//   - For system backups (sourcePath="/"), verifies all critical system files
+//   - For system backups (source at "/"), verifies all critical system files
 //   - For home backups, skips system-level files that aren't relevant
 //
 // Returns nil (never fails backup) but logs all errors to verificationErrors slice.
-func verifyCriticalFiles(sourcePath, destPath string, logFile *os.File) error {
+func verifyCriticalFiles(source, dest Store, logFile *os.File) error {
+	sourcePath := source.Path(".")
 	criticalFiles := DefaultVerificationConfig.CriticalFiles
 	verified := 0
 	errors := 0
@@ -491,17 +495,12 @@ func verifyCriticalFiles(sourcePath, destPath string, logFile *os.File) error {
 			continue
 		}
 
-		var srcFile string
-		if strings.HasPrefix(criticalPath, "/") {
-			// Absolute path - adjust for source root
-			srcFile = filepath.Join(sourcePath, strings.TrimPrefix(criticalPath, "/"))
-		} else {
-			// Relative path
-			srcFile = filepath.Join(sourcePath, criticalPath)
-		}
+		// Absolute paths are relative to the source root
+		srcName := strings.TrimPrefix(criticalPath, "/")
+		srcFile := source.Path(srcName)
 
 		// Skip if file doesn't exist in source (not an error for critical files)
-		if info, err := os.Stat(srcFile); err != nil {
+		if info, err := source.Stat(srcName); err != nil {
 			if logFile != nil {
 				if os.IsNotExist(err) {
 					fmt.Fprintf(logFile, "  - File not found in source, skipping: %s\n", srcFile)
@@ -531,7 +530,7 @@ func verifyCriticalFiles(sourcePath, destPath string, logFile *os.File) error {
 			fmt.Fprintf(logFile, "  - Starting verification of %s\n", criticalPath)
 		}
 
-		err := verifySingleFile(criticalPath, sourcePath, destPath)
+		err := verifySingleFile(criticalPath, source, dest)
 		if err != nil {
 			// Check if it's a timeout error
 			if strings.Contains(err.Error(), "timed out") {
@@ -576,8 +575,8 @@ func verifyCriticalFiles(sourcePath, destPath string, logFile *os.File) error {
 //   - Error tolerance of 1% sample failure rate
 //
 // Parameters:
-//   - sourcePath: Original source directory for file discovery
-//   - destPath: Destination backup directory for verification
+//   - source: Original source store for file discovery
+//   - dest: Destination backup store for verification
 //   - sampleRate: Fraction of files to verify (0.01 = 1%, 0.05 = 5%)
 //   - excludePatterns: Patterns that were excluded during backup (should also be excluded from verification)
 //   - logFile: Optional log file for detailed verification reporting
@@ -589,7 +588,7 @@ func verifyCriticalFiles(sourcePath, destPath string, logFile *os.File) error {
 //   - Uses cryptographically secure random selection
 //
 // Returns an error only if sample error rate exceeds 1%, indicating systematic issues.
-func verifySampledFiles(sourcePath, destPath string, sampleRate float64, excludePatterns []string, logFile *os.File) error {
+func verifySampledFiles(source, dest Store, sampleRate float64, excludePatterns []string, logFile *os.File) error {
 	if sampleRate <= 0 || filesSkipped == 0 {
 		return nil
 	}
@@ -611,25 +610,21 @@ func verifySampledFiles(sourcePath, destPath string, sampleRate float64, exclude
 	// We don't have a list of skipped files, so we'll do a directory walk
 	// and randomly sample files that exist in both locations
 	var candidateFiles []string
+	sourcePath := source.Path(".")
 
-	err := filepath.WalkDir(sourcePath, func(path string, d os.DirEntry, err error) error {
-		if err != nil || !d.Type().IsRegular() {
+	err := walkStoreTree(source, ".", func(name string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
 			return nil
 		}
 
 		// Skip excluded patterns - comprehensive browser cache exclusion
+		path := source.Path(name)
 		if shouldExcludeFile(path, excludePatterns, sourcePath) {
 			return nil
 		}
 
 		// Check if file exists in destination
-		relPath, err := filepath.Rel(sourcePath, path)
-		if err != nil {
-			return nil
-		}
-		destFile := filepath.Join(destPath, relPath)
-
-		if _, err := os.Stat(destFile); err == nil {
+		if _, err := dest.Stat(name); err == nil {
 			candidateFiles = append(candidateFiles, path)
 		}
 
@@ -665,7 +660,7 @@ func verifySampledFiles(sourcePath, destPath string, sampleRate float64, exclude
 		filePath := candidateFiles[idx]
 		candidateFiles = append(candidateFiles[:idx], candidateFiles[idx+1:]...)
 
-		err := verifySingleFile(filePath, sourcePath, destPath)
+		err := verifySingleFile(filePath, source, dest)
 		if err != nil {
 			errors++
 			if logFile != nil {
@@ -696,13 +691,13 @@ func verifySampledFiles(sourcePath, destPath string, sampleRate float64, exclude
 // Directory structure validation features:
 //   - Comprehensive directory counting in both source and destination
 //   - Tolerance for minor differences (backup metadata, temporary files)
-//   - Performance-optimized tree traversal using filepath.WalkDir
+//   - Performance-optimized tree traversal using walkStoreTree
 //   - Statistical validation approach (allows ±10 directory variance)
 //   - Non-blocking verification (errors logged but backup continues)
 //
 // Parameters:
-//   - sourcePath: Original source directory to analyze
-//   - destPath: Destination backup directory for comparison
+//   - source: Original source store to analyze
+//   - dest: Destination backup store for comparison
 //   - logFile: Optional log file for detailed verification reporting
 //
 // Validation Logic:
@@ -713,14 +708,14 @@ func verifySampledFiles(sourcePath, destPath string, sampleRate float64, exclude
 //
 // Returns an error if directory count variance exceeds acceptable thresholds,
 // which may indicate incomplete backup or structural corruption.
-func verifyDirectoryStructure(sourcePath, destPath string, logFile *os.File) error {
+func verifyDirectoryStructure(source, dest Store, logFile *os.File) error {
 	// Count directories in source and destination
 	sourceDirs := 0
 	destDirs := 0
 
 	// Count source directories
-	err := filepath.WalkDir(sourcePath, func(path string, d os.DirEntry, err error) error {
-		if err != nil || !d.IsDir() {
+	err := walkStoreTree(source, ".", func(name string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
 			return nil
 		}
 		sourceDirs++
@@ -731,8 +726,8 @@ func verifyDirectoryStructure(sourcePath, destPath string, logFile *os.File) err
 	}
 
 	// Count destination directories
-	err = filepath.WalkDir(destPath, func(path string, d os.DirEntry, err error) error {
-		if err != nil || !d.IsDir() {
+	err = walkStoreTree(dest, ".", func(name string, info os.FileInfo, err error) error {
+		if err != nil || !info.IsDir() {
 			return nil
 		}
 		destDirs++
@@ -772,8 +767,8 @@ func verifyDirectoryStructure(sourcePath, destPath string, logFile *os.File) err
 //
 // Parameters:
 //   - filePath: Path to the file being verified (can be absolute or relative)
-//   - sourcePath: Root source directory for path resolution
-//   - destPath: Root destination directory for path resolution
+//   - source: Source store for path resolution
+//   - dest: Destination store for path resolution
 //
 // Path Resolution Logic:
 //   - Handles absolute paths within source directory
@@ -786,11 +781,11 @@ func verifyDirectoryStructure(sourcePath, destPath string, logFile *os.File) err
 //   - Size mismatches between source and destination
 //   - Checksum failures for small or critical files
 //   - Content sampling failures for large files
-func verifySingleFile(filePath, sourcePath, destPath string) error {
+func verifySingleFile(filePath string, source, dest Store) error {
 	// Convert absolute source path to relative path for destination
 	var relPath string
 	var err error
-	var actualSourcePath string
+	sourcePath := source.Path(".")
 
 	if filepath.IsAbs(filePath) && strings.HasPrefix(filePath, sourcePath) {
 		// File path is absolute and within source path
@@ -798,26 +793,25 @@ func verifySingleFile(filePath, sourcePath, destPath string) error {
 		if err != nil {
 			return fmt.Errorf("failed to get relative path: %v", err)
 		}
-		actualSourcePath = filePath
 	} else if strings.HasPrefix(filePath, "/") {
 		// Critical file path - absolute path like "/etc/fstab"
 		relPath = strings.TrimPrefix(filePath, "/")
-		actualSourcePath = filepath.Join(sourcePath, relPath)
 	} else {
 		// Already relative path
 		relPath = filePath
-		actualSourcePath = filepath.Join(sourcePath, relPath)
 	}
 
-	destFile := filepath.Join(destPath, relPath)
+	name := filepath.ToSlash(relPath)
+	actualSourcePath := source.Path(name)
+	destFile := dest.Path(name)
 
 	// Check if both files exist
-	srcInfo, err := os.Stat(actualSourcePath)
+	srcInfo, err := source.Stat(name)
 	if err != nil {
 		return fmt.Errorf("source file missing: %v", err)
 	}
 
-	destInfo, err := os.Stat(destFile)
+	destInfo, err := dest.Stat(name)
 	if err != nil {
 		return fmt.Errorf("destination file missing: %v", err)
 	}
@@ -835,12 +829,12 @@ func verifySingleFile(filePath, sourcePath, destPath string) error {
 				relPath, srcInfo.Size()/(1024*1024))
 		}
 
-		srcHash, err := getFileSHA256(actualSourcePath)
+		srcHash, err := getStoreFileSHA256(source, name)
 		if err != nil {
 			return fmt.Errorf("failed to hash source %s: %v", actualSourcePath, err)
 		}
 
-		destHash, err := getFileSHA256(destFile)
+		destHash, err := getStoreFileSHA256(dest, name)
 		if err != nil {
 			return fmt.Errorf("failed to hash destination %s: %v", destFile, err)
 		}
@@ -850,7 +844,7 @@ func verifySingleFile(filePath, sourcePath, destPath string) error {
 		}
 	} else {
 		// For large files, use the same sampling strategy as during backup
-		if !largFilesIdentical(actualSourcePath, destFile, srcInfo.Size()) {
+		if !largFilesIdentical(source, name, dest, name, srcInfo.Size()) {
 			return fmt.Errorf("content mismatch (sampling)")
 		}
 	}
@@ -903,6 +897,8 @@ func performStandaloneVerification(sourcePath, destPath string, excludePatterns
 	totalFilesVerified = 0
 	verificationErrors = []string{}
 
+	source, dest := NewLocalStore(sourcePath), NewLocalStore(destPath)
+
 	// For standalone verification, we don't have a list of copied files,
 	// so we'll verify a representative sample of all files
 
@@ -910,7 +906,7 @@ func performStandaloneVerification(sourcePath, destPath string, excludePatterns
 	if logFile != nil {
 		fmt.Fprintf(logFile, "Verifying critical system files\n")
 	}
-	err := verifyCriticalFiles(sourcePath, destPath, logFile)
+	err := verifyCriticalFiles(source, dest, logFile)
 	if err != nil {
 		return fmt.Errorf("critical files verification failed: %v", err)
 	}
@@ -919,7 +915,7 @@ func performStandaloneVerification(sourcePath, destPath string, excludePatterns
 	if logFile != nil {
 		fmt.Fprintf(logFile, "Sampling verification of backup files\n")
 	}
-	err = verifyRandomSampleOfBackup(sourcePath, destPath, DefaultVerificationConfig.SampleRate*10, excludePatterns, logFile) // Use 10x sample rate for standalone
+	err = verifyRandomSampleOfBackup(source, dest, DefaultVerificationConfig.SampleRate*10, excludePatterns, logFile) // Use 10x sample rate for standalone
 	if err != nil {
 		// Non-critical error - log but don't fail verification
 		verificationErrors = append(verificationErrors, fmt.Sprintf("Sample verification: %v", err))
@@ -932,7 +928,7 @@ func performStandaloneVerification(sourcePath, destPath string, excludePatterns
 	if logFile != nil {
 		fmt.Fprintf(logFile, "Verifying directory structure\n")
 	}
-	err = verifyDirectoryStructure(sourcePath, destPath, logFile)
+	err = verifyDirectoryStructure(source, dest, logFile)
 	if err != nil {
 		verificationErrors = append(verificationErrors, fmt.Sprintf("Directory structure: %v", err))
 		if logFile != nil {
@@ -992,8 +988,8 @@ func performStandaloneVerification(sourcePath, destPath string, excludePatterns
 //   - Reports files missing from backup or content mismatches
 //
 // Parameters:
-//   - sourcePath: Original source directory to validate (this is the "truth")
-//   - destPath: Backup directory to verify against source
+//   - source: Original source store to validate (this is the "truth")
+//   - dest: Backup store to verify against source
 //   - sampleRate: Fraction of discovered files to verify (0.1 = 10%)
 //   - excludePatterns: Patterns that were excluded during backup (should also be excluded from verification)
 //   - logFile: Optional log file for detailed verification reporting
@@ -1006,10 +1002,11 @@ func performStandaloneVerification(sourcePath, destPath string, excludePatterns
 //
 // Returns an error if sample error rate exceeds 5%, indicating systematic backup issues.
 // This correctly detects missing files, content mismatches, and backup corruption.
-func verifyRandomSampleOfBackup(sourcePath, destPath string, sampleRate float64, excludePatterns []string, logFile *os.File) error {
+func verifyRandomSampleOfBackup(source, dest Store, sampleRate float64, excludePatterns []string, logFile *os.File) error {
 	if sampleRate <= 0 {
 		return nil
 	}
+	sourcePath, destPath := source.Path("."), dest.Path(".")
 
 	if logFile != nil {
 		fmt.Fprintf(logFile, "Starting smart two-phase verification\n")
@@ -1025,10 +1022,11 @@ func verifyRandomSampleOfBackup(sourcePath, destPath string, sampleRate float64,
 	startTime := time.Now()
 	const MAX_DIR_ENTRIES = 50000 // Skip processing directories with more than 50k entries
 
-	err := filepath.WalkDir(sourcePath, func(sourceFilePath string, d os.DirEntry, err error) error {
+	err := walkStoreTree(source, ".", func(name string, info os.FileInfo, err error) error {
+		sourceFilePath := source.Path(name)
 		if err != nil {
 			// Skip directories we can't access
-			if d != nil && d.IsDir() {
+			if info != nil && info.IsDir() {
 				if logFile != nil {
 					fmt.Fprintf(logFile, "Skipping inaccessible directory: %s (error: %v)\n", sourceFilePath, err)
 				}
@@ -1038,13 +1036,13 @@ func verifyRandomSampleOfBackup(sourcePath, destPath string, sampleRate float64,
 		}
 
 		// Only check directories, not files
-		if !d.IsDir() {
+		if !info.IsDir() {
 			return nil
 		}
 
 		// CRITICAL: Check exclusions BEFORE processing to avoid hanging on virtual filesystems
 		// Skip system virtual filesystems immediately
-		skipPath, _ := filepath.Rel(sourcePath, sourceFilePath)
+		skipPath := filepath.FromSlash(name)
 		if strings.HasPrefix(skipPath, "proc") || strings.HasPrefix(skipPath, "sys") ||
 			strings.HasPrefix(skipPath, "dev") || strings.HasPrefix(skipPath, "run") {
 			if logFile != nil && dirCount < 10 {
@@ -1059,7 +1057,7 @@ func verifyRandomSampleOfBackup(sourcePath, destPath string, sampleRate float64,
 		}
 
 		// Check directory size before processing to avoid hanging on massive directories
-		entries, err := os.ReadDir(sourceFilePath)
+		entries, err := source.ReadDir(name)
 		if err == nil && len(entries) > MAX_DIR_ENTRIES {
 			if logFile != nil {
 				fmt.Fprintf(logFile, "SKIPPING MASSIVE DIRECTORY: %s (%d entries, limit: %d)\n", skipPath, len(entries), MAX_DIR_ENTRIES)
@@ -1087,16 +1085,11 @@ func verifyRandomSampleOfBackup(sourcePath, destPath string, sampleRate float64,
 			return fmt.Errorf("directory walk timeout")
 		}
 
-		// Convert source dir path to backup dir path
-		relPath, err := filepath.Rel(sourcePath, sourceFilePath)
-		if err != nil {
-			return nil
-		}
-
-		backupDirPath := filepath.Join(destPath, relPath)
+		// The backup directory has the same name
+		relPath := skipPath
 
 		// Check if corresponding backup directory exists
-		if _, err := os.Stat(backupDirPath); os.IsNotExist(err) {
+		if _, err := dest.Stat(name); os.IsNotExist(err) {
 			// Check if this directory should be empty due to exclusions
 			if isDirectoryEmptyDueToExclusions(sourceFilePath, excludePatterns, sourcePath, logFile) {
 				// This directory is missing but should be empty due to exclusions - not an error
@@ -1166,19 +1159,20 @@ func verifyRandomSampleOfBackup(sourcePath, destPath string, sampleRate float64,
 	}
 
 	startTime = time.Now()
-	err = filepath.WalkDir(sourcePath, func(sourceFilePath string, d os.DirEntry, err error) error {
+	err = walkStoreTree(source, ".", func(name string, info os.FileInfo, err error) error {
 		// Handle errors and skip inaccessible items
 		if err != nil {
-			if d != nil && d.IsDir() {
+			if info != nil && info.IsDir() {
 				return filepath.SkipDir
 			}
 			return nil
 		}
+		sourceFilePath := source.Path(name)
 
 		// Skip directories
-		if d.IsDir() {
+		if info.IsDir() {
 			// CRITICAL: Skip virtual filesystems early
-			skipPath, _ := filepath.Rel(sourcePath, sourceFilePath)
+			skipPath := filepath.FromSlash(name)
 			if strings.HasPrefix(skipPath, "proc") || strings.HasPrefix(skipPath, "sys") ||
 				strings.HasPrefix(skipPath, "dev") || strings.HasPrefix(skipPath, "run") {
 				return filepath.SkipDir
@@ -1191,7 +1185,7 @@ func verifyRandomSampleOfBackup(sourcePath, destPath string, sampleRate float64,
 		}
 
 		// Only process regular files
-		if !d.Type().IsRegular() {
+		if !info.Mode().IsRegular() {
 			return nil
 		}
 
@@ -1217,16 +1211,11 @@ func verifyRandomSampleOfBackup(sourcePath, destPath string, sampleRate float64,
 			return nil
 		}
 
-		// Convert source path to relative path, then to backup path
-		relPath, err := filepath.Rel(sourcePath, sourceFilePath)
-		if err != nil {
-			return nil
-		}
-
-		backupFilePath := filepath.Join(destPath, relPath)
+		// The backup file has the same name
+		relPath := filepath.FromSlash(name)
 
 		// Check if corresponding backup file exists
-		if _, err := os.Stat(backupFilePath); err == nil {
+		if _, err := dest.Stat(name); err == nil {
 			// Backup file exists - add to candidates for verification
 			if len(candidateFiles) < 10000 {
 				candidateFiles = append(candidateFiles, sourceFilePath)
@@ -1298,7 +1287,7 @@ func verifyRandomSampleOfBackup(sourcePath, destPath string, sampleRate float64,
 		filePath := candidateFiles[idx]
 		candidateFiles = append(candidateFiles[:idx], candidateFiles[idx+1:]...)
 
-		err := verifySingleFile(filePath, sourcePath, destPath)
+		err := verifySingleFile(filePath, source, dest)
 		if err != nil {
 			errors++
 			verificationErrors = append(verificationErrors, fmt.Sprintf("Content mismatch: %s", filePath))
@@ -1359,35 +1348,31 @@ func verifyRandomSampleOfBackup(sourcePath, destPath string, sampleRate float64,
 	extraFilesFound := 0
 	startTime = time.Now()
 
-	err = filepath.WalkDir(destPath, func(backupFilePath string, d os.DirEntry, err error) error {
+	err = walkStoreTree(dest, ".", func(name string, info os.FileInfo, err error) error {
 		if err != nil {
 			return nil // Skip errors
 		}
 
 		// Skip directories
-		if d.IsDir() {
+		if info.IsDir() {
 			return nil
 		}
 
 		// Only check regular files
-		if !d.Type().IsRegular() {
+		if !info.Mode().IsRegular() {
 			return nil
 		}
 
 		// Skip special backup metadata files
-		if strings.Contains(backupFilePath, "BACKUP-INFO.txt") || strings.Contains(backupFilePath, "BACKUP-FOLDERS.txt") {
+		if isBackupMetadataFile(dest.Path(name)) {
 			return nil
 		}
 
-		// Calculate corresponding source file path
-		relPath, err := filepath.Rel(destPath, backupFilePath)
-		if err != nil {
-			return nil
-		}
-		sourceFilePath := filepath.Join(sourcePath, relPath)
+		// The source file has the same name
+		relPath := filepath.FromSlash(name)
 
 		// Check if file exists in source
-		if _, err := os.Stat(sourceFilePath); os.IsNotExist(err) {
+		if _, err := source.Stat(name); os.IsNotExist(err) {
 			extraFilesFound++
 			verificationErrors = append(verificationErrors, fmt.Sprintf("Extra file in backup: %s", relPath))
 			// Only log every 100 extra files to reduce verbosity
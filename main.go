@@ -3,7 +3,7 @@
 // This package handles:
 //   - Privilege elevation and root access verification
 //   - Single instance checking to prevent concurrent operations
-//   - System dependency validation (lsblk, udisksctl, cryptsetup, etc.)
+//   - System dependency validation (udisksctl, cryptsetup, etc.)
 //   - Signal handling for clean shutdown
 //   - TUI initialization and execution
 //
@@ -13,8 +13,10 @@
 package main
 
 import (
+	"flag"
 	"fmt"
 	"log"
+	"net"
 	"os"
 	"os/exec"
 	"os/signal"
@@ -72,7 +74,390 @@ func removeInstanceLock() {
 	os.Remove(lockFilePath)
 }
 
+// stringListFlag collects repeatable string options such as --map-user.
+type stringListFlag []string
+
+func (s *stringListFlag) String() string {
+	return strings.Join(*s, ",")
+}
+
+func (s *stringListFlag) Set(value string) error {
+	*s = append(*s, value)
+	return nil
+}
+
+// options holds the command-line options until they are handed to the internal package.
+type options struct {
+	mapUsers, mapGroups stringListFlag
+	set                 map[string]bool // Flags given on the command line
+
+	// Copying
+	jobs      int
+	ioClass   string
+	nice      int
+	bwLimit   string
+	compare   string
+	snapshot  string
+	keepSnaps int
+
+	// Destination
+	dest        string
+	sshKey      string
+	s3Endpoint  string
+	s3Region    string
+	luksKeyFile string
+
+	// Repository and encryption
+	format     string
+	compress   int
+	volumeSize string
+	encrypt    bool
+	keyFile    string
+
+	// Network migration
+	send              string
+	to                string
+	code              string
+	receive           bool
+	port              int
+	restoreConfig     bool
+	restoreWindowMgrs bool
+	packages          string
+	sendAddress       string // --to with --port unless it names one
+
+	// Agent
+	agent       bool
+	agentAdd    string
+	agentRemove string
+	agentList   bool
+
+	// One-off commands
+	setCompare string
+	adopt      string
+}
+
+// defineFlags registers every command-line option.
+func defineFlags() *options {
+	o := &options{}
+	flag.Var(&o.mapUsers, "map-user", "on restore, give files owned by `olduser:newuser` in the backup to newuser (repeatable)")
+	flag.Var(&o.mapGroups, "map-group", "on restore, give files with group `oldgroup:newgroup` in the backup to newgroup (repeatable)")
+	flag.IntVar(&o.jobs, "jobs", 0, "number of parallel copy workers (default: based on CPU count)")
+	flag.StringVar(&o.ioClass, "ionice", "", "I/O scheduling `class` for copying: idle or best-effort")
+	flag.IntVar(&o.nice, "nice", 0, "CPU nice `level` for copying (-20 to 19)")
+	flag.StringVar(&o.bwLimit, "bwlimit", "", "limit copy bandwidth to `rate` per second, e.g. 50M (0 = unlimited)")
+	flag.StringVar(&o.compare, "compare", "", "file comparison `mode` for this run: size-mtime, size-mtime-ctime or checksum")
+	flag.StringVar(&o.format, "format", "", "`format` of new backups: mirror (plain file tree), repository (deduplicated chunks) or archive (split tar.zst volumes)")
+	flag.IntVar(&o.compress, "compress", 0, "zstd `level` (1-19) for repository and archive backups, 0 = off (default: the repository's current level, 3 for archives)")
+	flag.StringVar(&o.dest, "dest", "", "back up to a directory, disk image, sftp://user@host/path or s3://bucket/prefix `destination` instead of choosing a drive")
+	flag.StringVar(&o.sshKey, "ssh-key", "", "private key `file` for sftp:// destinations (default: ssh-agent, then ~/.ssh/id_ed25519, id_ecdsa, id_rsa)")
+	flag.StringVar(&o.s3Endpoint, "s3-endpoint", "", "`URL` of an S3-compatible service for s3:// destinations, e.g. http://localhost:9000 for MinIO (default: AWS)")
+	flag.StringVar(&o.s3Region, "s3-region", "", "`region` for s3:// destinations (default: AWS_REGION, ~/.aws/config, then us-east-1)")
+	flag.StringVar(&o.volumeSize, "volume-size", "", "split archive backups into volumes of `size`, e.g. 700M (default: just under 4G for FAT32)")
+	flag.BoolVar(&o.encrypt, "encrypt", false, "encrypt new backups, which are written as a repository (asks for a passphrase unless --key-file is given)")
+	flag.StringVar(&o.keyFile, "key-file", "", "use the content of `file` instead of a passphrase for encrypted backups")
+	flag.StringVar(&o.luksKeyFile, "luks-key-file", "", "unlock encrypted drives with the content of `file` instead of asking for their passphrase")
+	flag.StringVar(&o.setCompare, "set-compare", "", "save the comparison mode of a `profile=mode` (profiles: system, home, restore) and exit")
+	flag.StringVar(&o.send, "send", "", "migrate this machine's `home` or `system` directly to another machine running --receive, then exit")
+	flag.StringVar(&o.to, "to", "", "`address` (host or host:port) of the receiving machine for --send")
+	flag.StringVar(&o.code, "code", "", "pairing `code` shown by the receiving machine for --send (asked for if omitted)")
+	flag.BoolVar(&o.receive, "receive", false, "wait for a migration from another machine running --send, apply it and exit")
+	flag.IntVar(&o.port, "port", internal.DefaultMigrationPort, "TCP `port` for --send and --receive")
+	flag.BoolVar(&o.restoreConfig, "restore-config", true, "with --receive, apply ~/.config from the other machine")
+	flag.BoolVar(&o.restoreWindowMgrs, "restore-window-managers", true, "with --receive, apply window manager and desktop settings from the other machine")
+	flag.StringVar(&o.packages, "packages", internal.PackageActionScript, "with --receive of a system, `action` for the other machine's packages: script (write a reinstall script), run (reinstall before copying files) or skip")
+	flag.BoolVar(&o.agent, "agent", false, "keep running and back up each drive designated with --agent-add when it is plugged in")
+	flag.StringVar(&o.agentAdd, "agent-add", "", "designate a backup drive for --agent as `uuid=system` or uuid=home and exit")
+	flag.StringVar(&o.agentRemove, "agent-remove", "", "stop --agent from backing up the drive with this `uuid` and exit")
+	flag.BoolVar(&o.agentList, "agent-list", false, "list the backup drives designated for --agent and the attached drives with their UUIDs, then exit")
+	flag.StringVar(&o.snapshot, "snapshot", "", "restore or verify this repository `snapshot` instead of the newest one of the restored or verified path")
+	flag.IntVar(&o.keepSnaps, "keep-snapshots", 0, "after a repository backup, keep only the newest `N` snapshots of this machine's source and delete chunks nothing uses (0 = keep all)")
+	flag.StringVar(&o.adopt, "adopt", "", "adopt an rsync tree or tarball at `path` as a Migrate backup (writes BACKUP-INFO.txt and a manifest) and exit")
+	return o
+}
+
+// parseFlags handles command-line options and hands them to the internal package.
+// Invalid options exit before privilege elevation so the user sees the error immediately.
+func parseFlags() {
+	o := defineFlags()
+	flag.Parse()
+	o.set = make(map[string]bool)
+	flag.Visit(func(f *flag.Flag) { o.set[f.Name] = true })
+
+	// Saved settings live in root's config, so they are changed after privilege elevation
+	if os.Geteuid() == 0 {
+		runSettingsCommands(o)
+	}
+
+	for _, apply := range []func(*options) error{
+		applyCopyFlags,
+		applyRepositoryFlags,
+		applyDestinationFlags,
+		applyOwnershipFlags,
+		applyNetworkFlags,
+		applyAgentFlags,
+	} {
+		if err := apply(o); err != nil {
+			fmt.Printf("❌ %v\n", err)
+			os.Exit(2)
+		}
+	}
+
+	// Migrations and the agent read and write everywhere, so they run after privilege elevation
+	if os.Geteuid() == 0 {
+		runNetworkCommands(o)
+		runAgentCommand(o)
+	}
+}
+
+// runSettingsCommands runs the options that adopt a backup or change saved
+// settings, and exits if one was given.
+func runSettingsCommands(o *options) {
+	// Adopting writes next to the old backup, which is usually root-owned
+	if o.adopt != "" {
+		backup, err := internal.AdoptBackup(o.adopt)
+		if err != nil {
+			fmt.Printf("❌ --adopt: %v\n", err)
+			os.Exit(1)
+		}
+		fmt.Printf("✅ Adopted existing backup\n%s", backup.Describe())
+		os.Exit(0)
+	}
+
+	if o.setCompare != "" {
+		if err := internal.SaveProfileCompareMode(o.setCompare); err != nil {
+			fmt.Printf("❌ --set-compare: %v\n", err)
+			os.Exit(2)
+		}
+		fmt.Printf("✅ Comparison modes:\n%s", internal.DescribeCompareProfiles())
+		os.Exit(0)
+	}
+
+	if o.agentAdd != "" || o.agentRemove != "" || o.agentList {
+		if o.agentAdd != "" {
+			if err := internal.SaveAgentDrive(o.agentAdd); err != nil {
+				fmt.Printf("❌ --agent-add: %v\n", err)
+				os.Exit(2)
+			}
+		}
+		if o.agentRemove != "" {
+			if err := internal.RemoveAgentDrive(o.agentRemove); err != nil {
+				fmt.Printf("❌ --agent-remove: %v\n", err)
+				os.Exit(2)
+			}
+		}
+		fmt.Printf("✅ Backup drives:\n%s", internal.DescribeAgentDrives())
+		os.Exit(0)
+	}
+}
+
+// applyCopyFlags sets how files are compared and how hard copying may load the system.
+func applyCopyFlags(o *options) error {
+	if o.compare != "" {
+		if err := internal.SetCompareMode(o.compare); err != nil {
+			return fmt.Errorf("--compare: %v", err)
+		}
+	}
+	if o.ioClass != "" {
+		if err := internal.SetIOPriorityClass(o.ioClass); err != nil {
+			return fmt.Errorf("--ionice: %v", err)
+		}
+	}
+	if o.set["nice"] {
+		if err := internal.SetNiceLevel(o.nice); err != nil {
+			return fmt.Errorf("--nice: %v", err)
+		}
+	}
+	if o.bwLimit != "" {
+		if err := internal.SetBandwidthLimit(o.bwLimit); err != nil {
+			return fmt.Errorf("--bwlimit: %v", err)
+		}
+	}
+	if o.jobs != 0 {
+		if err := internal.SetSyncWorkers(o.jobs); err != nil {
+			return fmt.Errorf("--jobs: %v", err)
+		}
+	}
+	return nil
+}
+
+// applyRepositoryFlags sets the format, compression, encryption and snapshots of backups.
+func applyRepositoryFlags(o *options) error {
+	toObjectStore := strings.HasPrefix(o.dest, "s3://")
+
+	if o.format != "" {
+		if err := internal.SetBackupFormat(o.format); err != nil {
+			return fmt.Errorf("--format: %v", err)
+		}
+	}
+
+	if o.set["compress"] {
+		if err := internal.SetCompressionLevel(o.compress); err != nil {
+			return fmt.Errorf("--compress: %v", err)
+		}
+		if internal.CompressionRequested() && o.format != internal.BackupFormatRepository && o.format != internal.BackupFormatArchive && !toObjectStore && o.send == "" {
+			return fmt.Errorf("--compress: compression needs --format repository or archive")
+		}
+	}
+
+	if o.volumeSize != "" {
+		if o.format != internal.BackupFormatArchive && !toObjectStore {
+			return fmt.Errorf("--volume-size: volumes need --format archive")
+		}
+		if err := internal.SetArchiveVolumeSize(o.volumeSize); err != nil {
+			return fmt.Errorf("--volume-size: %v", err)
+		}
+	}
+
+	if o.encrypt {
+		if toObjectStore {
+			return fmt.Errorf("--encrypt: object storage holds archive backups, which cannot be encrypted")
+		}
+		if err := internal.SetEncryption(true); err != nil {
+			return fmt.Errorf("--encrypt: %v", err)
+		}
+	}
+	if o.keyFile != "" {
+		if err := internal.SetKeyFile(o.keyFile); err != nil {
+			return fmt.Errorf("--key-file: %v", err)
+		}
+	}
+
+	if o.snapshot != "" {
+		internal.SetSnapshot(o.snapshot)
+	}
+	if o.keepSnaps != 0 {
+		if err := internal.SetSnapshotRetention(o.keepSnaps); err != nil {
+			return fmt.Errorf("--keep-snapshots: %v", err)
+		}
+	}
+	return nil
+}
+
+// applyDestinationFlags sets where backups go and how drives and remote stores are opened.
+func applyDestinationFlags(o *options) error {
+	if o.dest != "" {
+		if err := internal.SetBackupDestination(o.dest); err != nil {
+			return fmt.Errorf("--dest: %v", err)
+		}
+	}
+	if o.sshKey != "" {
+		if err := internal.SetSSHKeyFile(o.sshKey); err != nil {
+			return fmt.Errorf("--ssh-key: %v", err)
+		}
+	}
+	if o.s3Endpoint != "" {
+		if err := internal.SetS3Endpoint(o.s3Endpoint); err != nil {
+			return fmt.Errorf("--s3-endpoint: %v", err)
+		}
+	}
+	if o.s3Region != "" {
+		internal.SetS3Region(o.s3Region)
+	}
+	if o.luksKeyFile != "" {
+		if err := internal.SetLUKSKeyFile(o.luksKeyFile); err != nil {
+			return fmt.Errorf("--luks-key-file: %v", err)
+		}
+	}
+	return nil
+}
+
+// applyOwnershipFlags sets the user and group mappings of restores.
+func applyOwnershipFlags(o *options) error {
+	for _, spec := range o.mapUsers {
+		if err := internal.AddUserMapping(spec); err != nil {
+			return fmt.Errorf("--map-user: %v", err)
+		}
+	}
+	for _, spec := range o.mapGroups {
+		if err := internal.AddGroupMapping(spec); err != nil {
+			return fmt.Errorf("--map-group: %v", err)
+		}
+	}
+	return nil
+}
+
+// applyNetworkFlags checks the options of --send and --receive and works out the
+// receiving machine's address.
+func applyNetworkFlags(o *options) error {
+	if o.send == "" && !o.receive {
+		return nil
+	}
+	if o.send != "" && o.receive {
+		return fmt.Errorf("--send and --receive run on different machines")
+	}
+	if o.send != "" && o.send != "home" && o.send != "system" {
+		return fmt.Errorf("--send: expected home or system")
+	}
+	if o.send != "" && o.to == "" {
+		return fmt.Errorf("--send: --to names the receiving machine")
+	}
+	if o.packages != internal.PackageActionScript && o.packages != internal.PackageActionRun && o.packages != internal.PackageActionSkip {
+		return fmt.Errorf("--packages: expected script, run or skip")
+	}
+	if o.port < 1 || o.port > 65535 {
+		return fmt.Errorf("--port: %d is not a TCP port", o.port)
+	}
+
+	if o.send != "" {
+		o.sendAddress = o.to
+		if _, _, err := net.SplitHostPort(o.to); err != nil {
+			o.sendAddress = net.JoinHostPort(o.to, strconv.Itoa(o.port))
+		}
+	}
+	return nil
+}
+
+// applyAgentFlags checks that --agent is not combined with a one-off migration.
+func applyAgentFlags(o *options) error {
+	if o.agent && (o.send != "" || o.receive) {
+		return fmt.Errorf("--agent cannot be combined with --send or --receive")
+	}
+	return nil
+}
+
+// runNetworkCommands sends or receives a migration and exits if --send or --receive was given.
+func runNetworkCommands(o *options) {
+	if o.send != "" {
+		if err := internal.SendMigration(o.send, o.sendAddress, o.code); err != nil {
+			fmt.Printf("\n❌ --send: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+	if o.receive {
+		if err := internal.ReceiveMigration(o.port, o.restoreConfig, o.restoreWindowMgrs, o.packages); err != nil {
+			fmt.Printf("\n❌ --receive: %v\n", err)
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+}
+
+// runAgentCommand runs the backup agent until it is stopped and exits if --agent was given.
+func runAgentCommand(o *options) {
+	if !o.agent {
+		return
+	}
+	if err := checkSystemDependencies(); err != nil {
+		fmt.Printf("❌ Dependency check failed: %v\n", err)
+		os.Exit(1)
+	}
+	lock := func() error {
+		if err := checkSingleInstance(); err != nil {
+			return err
+		}
+		return createInstanceLock()
+	}
+	if err := internal.RunAgent(lock, removeInstanceLock); err != nil {
+		fmt.Printf("❌ --agent: %v\n", err)
+		os.Exit(1)
+	}
+	os.Exit(0)
+}
+
 func main() {
+	parseFlags()
+
 	// Check if we need to elevate to root
 	if os.Geteuid() != 0 {
 		if err := elevateToRoot(); err != nil {
@@ -106,6 +491,10 @@ func elevateToRoot() error {
 	// Silent privilege escalation - only show messages on failure
 	// Re-run this program with sudo, preserving all arguments
 	args := append([]string{execPath}, os.Args[1:]...)
+	// sudo resets the environment: keep the S3 credentials and settings that are set
+	if names := internal.S3EnvironmentVariables(); len(names) > 0 {
+		args = append([]string{"--preserve-env=" + strings.Join(names, ",")}, args...)
+	}
 	cmd := exec.Command("sudo", args...)
 
 	// Connect stdio so user can enter password if needed
@@ -212,7 +601,7 @@ func hasSudoAccess() bool {
 }
 
 // checkSystemDependencies validates that all required system programs are available.
-// It checks for critical programs (lsblk, udisksctl, cryptsetup) and optional ones,
+// It checks for critical programs (udisksctl, cryptsetup) and optional ones,
 // providing installation instructions for missing dependencies.
 func checkSystemDependencies() error {
 	// Required programs for core functionality
@@ -221,9 +610,6 @@ func checkSystemDependencies() error {
 		purpose  string
 		critical bool
 	}{
-		// Drive detection and information
-		{"lsblk", "drive detection and information", true},
-
 		// Drive mounting/unmounting
 		{"udisksctl", "drive mounting and unmounting", true},
 		{"umount", "drive unmounting", true},
@@ -293,15 +679,11 @@ func formatMissingList(missing []string) string {
 func getInstallCommands(missing []string) string {
 	commands := []string{}
 
-	needsLsblk := false
 	needsUdisks := false
 	needsCryptsetup := false
 	needsUtil := false
 
 	for _, prog := range missing {
-		if contains(prog, "lsblk") {
-			needsLsblk = true
-		}
 		if contains(prog, "udisksctl") {
 			needsUdisks = true
 		}
@@ -315,7 +697,7 @@ func getInstallCommands(missing []string) string {
 
 	// Debian/Ubuntu
 	debianPkgs := []string{}
-	if needsLsblk || needsUtil {
+	if needsUtil {
 		debianPkgs = append(debianPkgs, "util-linux")
 	}
 	if needsUdisks {
@@ -327,7 +709,7 @@ func getInstallCommands(missing []string) string {
 
 	// Arch Linux
 	archPkgs := []string{}
-	if needsLsblk || needsUtil {
+	if needsUtil {
 		archPkgs = append(archPkgs, "util-linux")
 	}
 	if needsUdisks {